@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ip2country-api/internal/config"
+	"ip2country-api/internal/ip2country"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const usage = `Usage: ip2country-api <command> [arguments]
+
+Commands:
+  serve                          Start the HTTP server (default when no command is given)
+  lookup [-json] <ip>...         Look up IP addresses against the configured backend
+  validate [flags] <dataset>     Report problems in a dataset file
+  convert [flags] <dataset>      Convert a dataset file to another format
+  compile [flags] <dataset>      Merge and normalize a dataset into its smallest form
+  diff [flags] <old> <new>       Compare two dataset files
+  sign -key <key> <dataset>      Write a detached signature for a dataset file
+  version                        Print version information
+
+Run 'ip2country-api <command> -h' for the flags of a command.
+`
+
+// run dispatches the command line to a subcommand and returns the exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return serve()
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve()
+	case "lookup":
+		return runLookup(args, stdout, stderr)
+	case "validate":
+		return runValidate(args, stdout, stderr)
+	case "convert":
+		return runConvert(args, stdout, stderr)
+	case "compile":
+		return runCompile(args, stdout, stderr)
+	case "diff":
+		return runDiff(args, stdout, stderr)
+	case "sign":
+		return runSign(args, stdout, stderr)
+	case "version":
+		return runVersion(stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+}
+
+// newFlagSet creates a flag set for a subcommand that reports errors instead of exiting
+func newFlagSet(name, arguments string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: ip2country-api %s [flags] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses args and returns the exit code to use when parsing did not succeed
+func parseFlags(flags *flag.FlagSet, args []string) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	return 0, true
+}
+
+// csvFormatFlags registers the flags describing the layout of CSV input files
+// and returns a function that parses them once the flags are parsed
+func csvFormatFlags(flags *flag.FlagSet) func() (ip2country.CSVFormat, error) {
+	delimiter := flags.String("delimiter", ",", `field delimiter of CSV input files, a single character or "tab"`)
+	columns := flags.String("columns", "", "header names of the CSV columns, like ip=network,city=city_name,country=country_name")
+	attributes := flags.String("attributes", "", `extra CSV columns to keep as attributes, like region,isp, or "*" for all`)
+	return func() (ip2country.CSVFormat, error) {
+		comma, err := ip2country.ParseCSVDelimiter(*delimiter)
+		if err != nil {
+			return ip2country.CSVFormat{}, fmt.Errorf("invalid -delimiter value: %v", err)
+		}
+		mapping, err := ip2country.ParseCSVColumns(*columns)
+		if err != nil {
+			return ip2country.CSVFormat{}, fmt.Errorf("invalid -columns value: %v", err)
+		}
+		selected, err := ip2country.ParseCSVAttributes(*attributes)
+		if err != nil {
+			return ip2country.CSVFormat{}, fmt.Errorf("invalid -attributes value: %v", err)
+		}
+		return ip2country.CSVFormat{Delimiter: comma, Columns: mapping, Attributes: selected}, nil
+	}
+}
+
+// runLookup looks up IP addresses against the backend configured through the
+// environment, without starting the server
+func runLookup(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("lookup", "<ip>...", stderr)
+	asJSON := flags.Bool("json", false, "print results as JSON lines")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load configuration: %v\n", err)
+		return 1
+	}
+	// Offline lookups have no use for hot reloading
+	cfg.IP2Country.OverridesReloadInterval = 0
+
+	service, err := ip2country.NewService(cfg.IP2Country)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to initialize IP2Country service: %v\n", err)
+		return 1
+	}
+	if closer, ok := service.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	code := 0
+	encoder := json.NewEncoder(stdout)
+	for _, ip := range flags.Args() {
+		result, err := service.LookupIP(ip)
+		if err == nil && result == nil {
+			err = ip2country.ErrIPNotFound
+		}
+		if err != nil {
+			code = 1
+		}
+
+		if *asJSON {
+			line := map[string]any{"ip": ip}
+			if err != nil {
+				line["error"] = err.Error()
+			} else {
+				line["country"] = result.Country
+				line["city"] = result.City
+				line["dataset_version"] = result.DatasetVersion
+				if !result.Attributes.IsZero() {
+					line["attributes"] = result.Attributes
+				}
+			}
+			encoder.Encode(line)
+			continue
+		}
+
+		if err != nil {
+			fmt.Fprintf(stdout, "%s\terror: %v\n", ip, err)
+		} else {
+			fmt.Fprintf(stdout, "%s\t%s\t%s", ip, result.Country, result.City)
+			if !result.Attributes.IsZero() {
+				fmt.Fprintf(stdout, "\t%s", result.Attributes)
+			}
+			fmt.Fprintln(stdout)
+		}
+	}
+	return code
+}
+
+// runValidate lints a dataset file with the parser used by the server and
+// reports every problem with its line number
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("validate", "<dataset>", stderr)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	strict := flags.Bool("strict", false, "treat warnings as errors")
+	from := flags.String("from", "", "input format ("+strings.Join(ip2country.InputFormats, ", ")+", default: from the file extension)")
+	parseCSVFormat := csvFormatFlags(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *from != "" && !slices.Contains(ip2country.InputFormats, *from) {
+		fmt.Fprintf(stderr, "unsupported input format: %s\n", *from)
+		return 2
+	}
+	csvFormat, err := parseCSVFormat()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	report, err := ip2country.ValidateDataset(flags.Arg(0), *from, csvFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		fmt.Fprint(stdout, report)
+	}
+
+	if report.Errors > 0 || (*strict && report.Warnings > 0) {
+		return 1
+	}
+	return 0
+}
+
+// runConvert reads a dataset file and writes it in another format
+func runConvert(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("convert", "<dataset>", stderr)
+	from := flags.String("from", "", "input format ("+strings.Join(ip2country.InputFormats, ", ")+", default: from the file extension)")
+	to := flags.String("to", "csv", "output format ("+strings.Join(ip2country.OutputFormats, ", ")+")")
+	out := flags.String("out", "", "output file (default: standard output)")
+	parseCSVFormat := csvFormatFlags(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *from != "" && !slices.Contains(ip2country.InputFormats, *from) {
+		fmt.Fprintf(stderr, "unsupported input format: %s\n", *from)
+		return 2
+	}
+	if !slices.Contains(ip2country.OutputFormats, *to) {
+		fmt.Fprintf(stderr, "unsupported output format: %s\n", *to)
+		return 2
+	}
+	csvFormat, err := parseCSVFormat()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	records, err := ip2country.ReadDatasetFile(flags.Arg(0), *from, csvFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	return writeOutput(*out, *to, records, stdout, stderr)
+}
+
+// runCompile normalizes a dataset, with an optional overrides file applied on
+// top of it, into the smallest sorted set of blocks that answers the same
+func runCompile(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("compile", "<dataset>", stderr)
+	from := flags.String("from", "", "input format ("+strings.Join(ip2country.InputFormats, ", ")+", default: from the file extension)")
+	to := flags.String("to", "csv", "output format ("+strings.Join(ip2country.OutputFormats, ", ")+")")
+	out := flags.String("out", "", "output file (default: standard output)")
+	overrides := flags.String("overrides", "", "overrides file whose unexpired entries take precedence over the dataset")
+	parseCSVFormat := csvFormatFlags(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *from != "" && !slices.Contains(ip2country.InputFormats, *from) {
+		fmt.Fprintf(stderr, "unsupported input format: %s\n", *from)
+		return 2
+	}
+	if !slices.Contains(ip2country.OutputFormats, *to) {
+		fmt.Fprintf(stderr, "unsupported output format: %s\n", *to)
+		return 2
+	}
+	csvFormat, err := parseCSVFormat()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	records, err := ip2country.ReadDatasetFile(flags.Arg(0), *from, csvFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	layers := [][]ip2country.Record{records}
+	inputRecords := len(records)
+
+	if *overrides != "" {
+		service, err := ip2country.NewOverrideService(nil, *overrides, 0)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *overrides, err)
+			return 1
+		}
+		layers = append(layers, service.Records())
+		inputRecords += len(layers[1])
+	}
+
+	compacted := ip2country.CompactRecords(layers...)
+	fmt.Fprintf(stderr, "compiled %d records into %d\n", inputRecords, len(compacted))
+	return writeOutput(*out, *to, compacted, stdout, stderr)
+}
+
+// writeOutput writes records to the output file, or stdout when path is empty.
+// The file is written next to path and renamed over it once complete, like
+// fileutil.WriteFileAtomic, so a failed write never leaves a truncated dataset
+func writeOutput(path, format string, records []ip2country.Record, stdout, stderr io.Writer) int {
+	if path == "" {
+		if err := ip2country.WriteDataset(stdout, format, records); err != nil {
+			fmt.Fprintf(stderr, "failed to write dataset: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create output file: %v\n", err)
+		return 1
+	}
+	defer os.Remove(file.Name())
+
+	// Keep the permissions of the file being replaced, and give new files the
+	// usual 0644 rather than the 0600 of temporary files
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		fmt.Fprintf(stderr, "failed to set output file permissions: %v\n", err)
+		return 1
+	}
+
+	if err := ip2country.WriteDataset(file, format, records); err != nil {
+		file.Close()
+		fmt.Fprintf(stderr, "failed to write dataset: %v\n", err)
+		return 1
+	}
+	if err := file.Close(); err != nil {
+		fmt.Fprintf(stderr, "failed to write dataset: %v\n", err)
+		return 1
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		fmt.Fprintf(stderr, "failed to replace output file: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runDiff compares two dataset files and fails when more addresses than
+// allowed moved between countries
+func runDiff(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("diff", "<old> <new>", stderr)
+	asJSON := flags.Bool("json", false, "print the diff as JSON")
+	maxMoved := flags.String("max-moved", "", "fail if more IPv4 addresses moved between countries, as a count or a prefix length like /16")
+	maxMovedIPv6 := flags.String("max-moved-ipv6", "", "fail if more IPv6 addresses moved between countries, as a count or a prefix length like /48")
+	parseCSVFormat := csvFormatFlags(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	limitIPv4, err := parseAddressCount(*maxMoved, 32)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -max-moved value: %v\n", err)
+		return 2
+	}
+	limitIPv6, err := parseAddressCount(*maxMovedIPv6, 128)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -max-moved-ipv6 value: %v\n", err)
+		return 2
+	}
+	csvFormat, err := parseCSVFormat()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var datasets [2][]ip2country.Record
+	for i, path := range flags.Args() {
+		if datasets[i], err = ip2country.ReadDatasetFile(path, "", csvFormat); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			return 1
+		}
+	}
+
+	diff := ip2country.DiffDatasets(datasets[0], datasets[1])
+	diff.Old, diff.New = flags.Arg(0), flags.Arg(1)
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(diff)
+	} else {
+		fmt.Fprint(stdout, diff)
+	}
+
+	code := 0
+	if limitIPv4 != nil && diff.IPv4.Moved.Cmp(limitIPv4) > 0 {
+		fmt.Fprintf(stderr, "%s IPv4 addresses moved between countries, more than the allowed %s\n", diff.IPv4.Moved, limitIPv4)
+		code = 1
+	}
+	if limitIPv6 != nil && diff.IPv6.Moved.Cmp(limitIPv6) > 0 {
+		fmt.Fprintf(stderr, "%s IPv6 addresses moved between countries, more than the allowed %s\n", diff.IPv6.Moved, limitIPv6)
+		code = 1
+	}
+	return code
+}
+
+// parseAddressCount parses a number of addresses given either as a count or
+// as the size of a prefix such as /16. An empty value means no limit.
+func parseAddressCount(value string, bitLen int) (*big.Int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if length, ok := strings.CutPrefix(value, "/"); ok {
+		bits, err := strconv.Atoi(length)
+		if err != nil || bits < 0 || bits > bitLen {
+			return nil, fmt.Errorf("prefix length must be between /0 and /%d", bitLen)
+		}
+		return new(big.Int).Lsh(big.NewInt(1), uint(bitLen-bits)), nil
+	}
+	count, ok := new(big.Int).SetString(value, 10)
+	if !ok || count.Sign() < 0 {
+		return nil, fmt.Errorf("%q is not a positive number", value)
+	}
+	return count, nil
+}
+
+// runSign writes the detached signature that the server checks when trusted
+// keys are configured
+func runSign(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("sign", "<dataset>", stderr)
+	keyPath := flags.String("key", "", "PEM encoded ed25519 private key (openssl genpkey -algorithm ed25519)")
+	out := flags.String("out", "", "signature file (default: the dataset path with "+ip2country.SignatureSuffix+")")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() != 1 || *keyPath == "" {
+		flags.Usage()
+		return 2
+	}
+
+	pemData, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read key: %v\n", err)
+		return 1
+	}
+	key, err := ip2country.ParsePrivateKey(pemData)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *keyPath, err)
+		return 1
+	}
+
+	signature, err := ip2country.SignDataset(flags.Arg(0), key)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	path := *out
+	if path == "" {
+		path = flags.Arg(0) + ip2country.SignatureSuffix
+	}
+	if err := os.WriteFile(path, []byte(signature+"\n"), 0644); err != nil {
+		fmt.Fprintf(stderr, "failed to write signature: %v\n", err)
+		return 1
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	fmt.Fprintf(stderr, "signed %s with key %s\n", flags.Arg(0), ip2country.KeyFingerprint(public))
+	fmt.Fprintf(stdout, "public key: %s\n", base64.StdEncoding.EncodeToString(public))
+	return 0
+}
+
+// runVersion prints the binary version and build information
+func runVersion(stdout io.Writer) int {
+	revision := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	fmt.Fprintf(stdout, "ip2country-api %s (revision %s, %s)\n", version, revision, runtime.Version())
+	return 0
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ip2country-api/internal/ip2country"
+)
+
+// writeDataset writes a test dataset file and returns its path
+func writeDataset(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "ip2country.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test data file: %v", err)
+	}
+	return path
+}
+
+func TestRunCommands(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	dataset := writeDataset(t, "8.8.8.8,Mountain View,United States\n1.1.1.1,Sydney,Australia\n")
+	invalid := writeDataset(t, "1.1.1.1,Sydney\n")
+	suspicious := writeDataset(t, "1.1.1.1,Sydney,Narnia\n")
+	semicolons := writeDataset(t, "network;locality;nation\n1.1.1.1;Sydney;Australia\n")
+	updated := writeDataset(t, "8.8.8.0/24,Mountain View,United States\n1.1.1.1,Auckland,New Zealand\n")
+	jsonLines := writeDataset(t, `{"cidr":"1.1.1.1/32","country":"Narnia","city":"Sydney"}`+"\n")
+
+	// Save original environment and restore after test
+	origDataPath := os.Getenv("CSV_DATA_PATH")
+	origDBType := os.Getenv("IP2COUNTRY_DB_TYPE")
+	os.Setenv("CSV_DATA_PATH", dataset)
+	os.Setenv("IP2COUNTRY_DB_TYPE", "csv")
+	defer func() {
+		os.Setenv("CSV_DATA_PATH", origDataPath)
+		os.Setenv("IP2COUNTRY_DB_TYPE", origDBType)
+	}()
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedOut  string
+	}{
+		{name: "version", args: []string{"version"}, expectedCode: 0, expectedOut: "ip2country-api dev"},
+		{name: "help", args: []string{"help"}, expectedCode: 0, expectedOut: "Commands:"},
+		{name: "unknown command", args: []string{"bogus"}, expectedCode: 2},
+		{name: "lookup found", args: []string{"lookup", "1.1.1.1"}, expectedCode: 0, expectedOut: "1.1.1.1\tAustralia\tSydney\n"},
+		{name: "lookup not found", args: []string{"lookup", "1.1.1.1", "9.9.9.9"}, expectedCode: 1, expectedOut: "9.9.9.9\terror: IP address not found"},
+		{name: "lookup json", args: []string{"lookup", "-json", "8.8.8.8"}, expectedCode: 0, expectedOut: `"country":"United States"`},
+		{name: "lookup without ip", args: []string{"lookup"}, expectedCode: 2},
+		{name: "validate ok", args: []string{"validate", dataset}, expectedCode: 0, expectedOut: "2 records, 0 errors, 0 warnings"},
+		{name: "validate invalid", args: []string{"validate", invalid}, expectedCode: 1, expectedOut: ":1: error: invalid CSV format"},
+		{name: "validate json", args: []string{"validate", "-json", invalid}, expectedCode: 1, expectedOut: `"code": "column_count"`},
+		{name: "validate warnings", args: []string{"validate", suspicious}, expectedCode: 0, expectedOut: "unknown_country"},
+		{name: "validate strict", args: []string{"validate", "-strict", suspicious}, expectedCode: 1},
+		{name: "validate delimiter and columns", args: []string{"validate", "-delimiter", ";", "-columns", "ip=network,city=locality,country=nation", semicolons}, expectedCode: 0, expectedOut: "1 records, 0 errors"},
+		{name: "validate invalid delimiter", args: []string{"validate", "-delimiter", ";;", semicolons}, expectedCode: 2},
+		{name: "validate missing file", args: []string{"validate", "missing.csv"}, expectedCode: 1},
+		{name: "validate jsonl", args: []string{"validate", "-from", "jsonl", jsonLines}, expectedCode: 0, expectedOut: `:1: warning: 1.1.1.1/32: unknown country "Narnia"`},
+		{name: "validate unsupported input", args: []string{"validate", "-from", "xml", dataset}, expectedCode: 2},
+		{name: "convert to csv", args: []string{"convert", "-to", "csv", dataset}, expectedCode: 0, expectedOut: "1.1.1.1,Sydney,Australia\n8.8.8.8,Mountain View,United States\n"},
+		{name: "convert to jsonl", args: []string{"convert", "-from", "csv", "-to", "jsonl", dataset}, expectedCode: 0, expectedOut: `{"cidr":"1.1.1.1/32","country":"Australia","city":"Sydney"}`},
+		{name: "convert unsupported format", args: []string{"convert", "-to", "xml", dataset}, expectedCode: 2},
+		{name: "convert unsupported input", args: []string{"convert", "-from", "xml", dataset}, expectedCode: 2},
+		{name: "diff identical", args: []string{"diff", dataset, dataset}, expectedCode: 0, expectedOut: "IPv4: 0 added, 0 removed, 0 changed, 0 moved"},
+		{name: "diff changes", args: []string{"diff", dataset, updated}, expectedCode: 0, expectedOut: "~ 1.1.1.1 Sydney, Australia -> Auckland, New Zealand\n"},
+		{name: "diff json", args: []string{"diff", "-json", dataset, updated}, expectedCode: 0, expectedOut: `"moved": 1`},
+		{name: "diff within limit", args: []string{"diff", "-max-moved", "1", dataset, updated}, expectedCode: 0},
+		{name: "diff over limit", args: []string{"diff", "-max-moved", "0", dataset, updated}, expectedCode: 1},
+		{name: "diff prefix limit", args: []string{"diff", "-max-moved", "/32", dataset, updated}, expectedCode: 0},
+		{name: "diff invalid limit", args: []string{"diff", "-max-moved", "/33", dataset, updated}, expectedCode: 2},
+		{name: "diff missing argument", args: []string{"diff", dataset}, expectedCode: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, &stdout, &stderr)
+
+			if code != tt.expectedCode {
+				t.Errorf("run(%v) = %d, want %d (stderr: %s)", tt.args, code, tt.expectedCode, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.expectedOut) {
+				t.Errorf("run(%v) output %q does not contain %q", tt.args, stdout.String(), tt.expectedOut)
+			}
+		})
+	}
+}
+
+func TestRunConvertToFile(t *testing.T) {
+	dataset := writeDataset(t, "1.1.1.1,Sydney,Australia\n")
+	out := filepath.Join(t.TempDir(), "out.jsonl")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"convert", "-to", "jsonl", "-out", out, dataset}, &stdout, &stderr); code != 0 {
+		t.Fatalf("convert failed with code %d: %s", code, stderr.String())
+	}
+
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if !strings.Contains(string(content), `"cidr":"1.1.1.1/32"`) {
+		t.Errorf("Unexpected output file content: %s", content)
+	}
+}
+
+func TestWriteOutputKeepsFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.csv")
+	if err := os.WriteFile(out, []byte("1.1.1.1,Sydney,Australia\n"), 0600); err != nil {
+		t.Fatalf("Failed to write output file: %v", err)
+	}
+	records := []ip2country.Record{{Prefix: netip.MustParsePrefix("2.2.2.2/32"), Result: ip2country.Result{City: "Paris", Country: "France"}}}
+
+	var stdout, stderr bytes.Buffer
+	if code := writeOutput(out, "unknown", records, &stdout, &stderr); code != 1 {
+		t.Fatalf("writeOutput with an unknown format returned %d, want 1", code)
+	}
+	if content, _ := os.ReadFile(out); string(content) != "1.1.1.1,Sydney,Australia\n" {
+		t.Errorf("Failed write changed the output file to %q", content)
+	}
+
+	if code := writeOutput(out, "csv", records, &stdout, &stderr); code != 0 {
+		t.Fatalf("writeOutput failed with code %d: %s", code, stderr.String())
+	}
+	if content, _ := os.ReadFile(out); string(content) != "2.2.2.2,Paris,France\n" {
+		t.Errorf("Output file content = %q, want the new records", content)
+	}
+	if stat, err := os.Stat(out); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Output file permissions = %v, %v, want the 0600 of the replaced file", stat.Mode().Perm(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the output file in %s, got %d entries", dir, len(entries))
+	}
+}
+
+func TestRunConvertRoundTrip(t *testing.T) {
+	dataset := writeDataset(t, "10.0.0.0-10.0.0.3,London,UK\n1.1.1.1,Sydney,Australia\n")
+	jsonl := filepath.Join(t.TempDir(), "data.jsonl")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"convert", "-to", "jsonl", "-out", jsonl, dataset}, &stdout, &stderr); code != 0 {
+		t.Fatalf("convert to jsonl failed with code %d: %s", code, stderr.String())
+	}
+	// The input format is guessed from the .jsonl extension
+	if code := run([]string{"convert", "-to", "csv", jsonl}, &stdout, &stderr); code != 0 {
+		t.Fatalf("convert from jsonl failed with code %d: %s", code, stderr.String())
+	}
+
+	expected := "1.1.1.1,Sydney,Australia\n10.0.0.0/30,London,UK\n"
+	if stdout.String() != expected {
+		t.Errorf("Round trip output = %q, want %q", stdout.String(), expected)
+	}
+}
+
+func TestRunCompile(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	dir := t.TempDir()
+	dataset := filepath.Join(dir, "raw.csv")
+	overrides := filepath.Join(dir, "overrides.csv")
+	os.WriteFile(dataset, []byte("10.0.0.0/8,Private,Private\n10.0.0.0/24,Private,Private\n1.1.1.0/25,Sydney,Australia\n1.1.1.128/25,Sydney,Australia\n"), 0644)
+	os.WriteFile(overrides, []byte("10.1.0.0/16,London,UK,,NET-1\n10.2.0.0/16,Paris,France,2000-01-01T00:00:00Z\n"), 0644)
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expectedOut  string
+	}{
+		{name: "compact", args: []string{"compile", dataset}, expectedCode: 0, expectedOut: "1.1.1.0/24,Sydney,Australia\n10.0.0.0/8,Private,Private\n"},
+		{name: "with overrides", args: []string{"compile", "-overrides", overrides, dataset}, expectedCode: 0, expectedOut: "1.1.1.0/24,Sydney,Australia\n10.0.0.0/8,Private,Private\n10.1.0.0/16,London,UK\n"},
+		{name: "missing overrides", args: []string{"compile", "-overrides", filepath.Join(dir, "missing.csv"), dataset}, expectedCode: 1},
+		{name: "unsupported format", args: []string{"compile", "-to", "xml", dataset}, expectedCode: 2},
+		{name: "missing argument", args: []string{"compile"}, expectedCode: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, &stdout, &stderr)
+
+			if code != tt.expectedCode {
+				t.Errorf("run(%v) = %d, want %d (stderr: %s)", tt.args, code, tt.expectedCode, stderr.String())
+			}
+			if stdout.String() != tt.expectedOut {
+				t.Errorf("run(%v) output = %q, want %q", tt.args, stdout.String(), tt.expectedOut)
+			}
+		})
+	}
+}
+
+func TestRunSign(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "release.pem")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	dataset := writeDataset(t, "1.1.1.1,Sydney,Australia\n")
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"sign", "-key", keyPath, dataset}, &stdout, &stderr); code != 0 {
+		t.Fatalf("sign failed with code %d: %s", code, stderr.String())
+	}
+	public := strings.TrimSpace(strings.TrimPrefix(stdout.String(), "public key: "))
+
+	// The signature verifies with the printed public key
+	verifier, err := ip2country.ParseTrustedKeys("release:" + public)
+	if err != nil {
+		t.Fatalf("Failed to parse printed key: %v", err)
+	}
+	service, err := ip2country.NewCSVServiceWithOptions(dataset, ip2country.CSVOptions{Verifier: verifier})
+	if err != nil {
+		t.Fatalf("Signed dataset failed to load: %v", err)
+	}
+	if signer := service.Datasets()[0].Signer; signer != "release" {
+		t.Errorf("Signer = %q, expected release", signer)
+	}
+
+	if code := run([]string{"sign", "-key", dataset, dataset}, &stdout, &stderr); code != 1 {
+		t.Errorf("sign with an invalid key = %d, want 1", code)
+	}
+	if code := run([]string{"sign", dataset}, &stdout, &stderr); code != 2 {
+		t.Errorf("sign without -key = %d, want 2", code)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -12,30 +13,62 @@ import (
 
 	"ip2country-api/internal/config"
 	"ip2country-api/internal/ip2country"
+	"ip2country-api/internal/middleware"
 	"ip2country-api/internal/routes"
 	"ip2country-api/pkg/ratelimit"
 )
 
-// setupServer initializes all components and returns the HTTP server
+// setupServer initializes all components and returns the HTTP server, and a
+// function releasing them once the server is shut down
 // This function is extracted to make it testable
-func setupServer() (*http.Server, error) {
+func setupServer() (*http.Server, func(), error) {
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load configuration: %v", err)
+		return nil, nil, fmt.Errorf("failed to load configuration: %v", err)
 	}
 
 	// init IP2country service with just the BackendConfig
 	ip2countryService, err := ip2country.NewService(cfg.IP2Country)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize IP2Country service: %v", err)
+		return nil, nil, fmt.Errorf("failed to initialize IP2Country service: %v", err)
+	}
+	closeService := func() {
+		if closer, ok := ip2countryService.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Failed to close IP2Country service: %v", err)
+			}
+		}
+	}
+
+	// Initialize API key quotas, which also list the API keys rate limits
+	// may be keyed by
+	quotas, closeQuotas, err := newQuotaLimiter(cfg)
+	if err != nil {
+		closeService()
+		return nil, nil, err
+	}
+
+	// Initialize rate limiting
+	rateLimit, err := newRateLimitMiddleware(cfg, quotas)
+	if err != nil {
+		closeQuotas()
+		closeService()
+		return nil, nil, err
 	}
 
-	// Initialize rate limiter
-	limiter := ratelimit.NewLimiter(cfg.RateLimit)
+	// Initialize adaptive concurrency limiting of lookups
+	var concurrency *ratelimit.AdaptiveLimiter
+	if cfg.AdaptiveConcurrency {
+		concurrency = ratelimit.NewAdaptiveLimiter(ratelimit.AdaptiveOptions{
+			InitialLimit: cfg.AdaptiveConcurrencyInitial,
+			MinLimit:     cfg.AdaptiveConcurrencyMin,
+			MaxLimit:     cfg.AdaptiveConcurrencyMax,
+		})
+	}
 
 	// Set up HTTP routes with middleware
-	handler := routes.RegisterRoutes(ip2countryService, limiter, cfg.AllowedOrigins)
+	handler := routes.RegisterRoutes(ip2countryService, rateLimit, quotas, concurrency, cfg.AllowedOrigins, cfg.AdminToken)
 
 	// Create HTTP server
 	addr := fmt.Sprintf(":%d", cfg.Port)
@@ -47,18 +80,210 @@ func setupServer() (*http.Server, error) {
 		IdleTimeout:  120 * time.Second,
 	}
 
-	log.Printf("Rate limit: %d requests per second", cfg.RateLimit)
+	if cfg.RateLimitBackend == "redis" {
+		log.Printf("Rate limit: %d requests per second (shared in redis at %s, burst %d, fail open %v)", cfg.RateLimit, cfg.RateLimitRedisAddr, cfg.RateLimitBurst, cfg.RateLimitRedisFailOpen)
+	} else {
+		log.Printf("Rate limit: %d requests per second (%s, burst %d)", cfg.RateLimit, cfg.RateLimitAlgorithm, cfg.RateLimitBurst)
+	}
+	if cfg.RateLimitKey != "" {
+		log.Printf("Rate limit per %s: %d requests per second (burst %d, at most %d clients)", cfg.RateLimitKey, cfg.RateLimitKeyRate, cfg.RateLimitKeyBurst, cfg.RateLimitMaxKeys)
+	}
+	if cfg.RateLimitPolicyFile != "" {
+		log.Printf("Rate limit route policies: %s", cfg.RateLimitPolicyFile)
+	}
+	if cfg.RateLimitMaxWait > 0 {
+		log.Printf("Rate limit queue: requests wait up to %v (at most %d waiting)", cfg.RateLimitMaxWait, cfg.RateLimitQueueSize)
+	}
+	if concurrency != nil {
+		log.Printf("Adaptive concurrency limit: %d lookups in flight at first (between %d and %d)", cfg.AdaptiveConcurrencyInitial, cfg.AdaptiveConcurrencyMin, cfg.AdaptiveConcurrencyMax)
+	}
+	if quotas != nil {
+		log.Printf("API key quotas: %s (usage counts in %s)", cfg.QuotaFile, cfg.QuotaStore)
+	}
 	log.Printf("IP2Country backend: %#v", cfg.IP2Country)
+	if cfg.IP2Country.Canary != nil {
+		log.Printf("Canary backend: %#v (%v%% of lookups)", *cfg.IP2Country.Canary, cfg.IP2Country.CanaryPercent)
+	}
+	if cfg.IP2Country.Shadow != nil {
+		log.Printf("Shadow backend: %#v (sample rate %v)", *cfg.IP2Country.Shadow, cfg.IP2Country.ShadowSampleRate)
+	}
 	log.Printf("CORS allowed origins: %v", cfg.AllowedOrigins)
+	if cfg.AdminToken == "" {
+		log.Printf("Admin API disabled: ADMIN_TOKEN is not set")
+	}
+
+	cleanup := func() {
+		closeQuotas()
+		closeService()
+	}
+	return server, cleanup, nil
+}
+
+// newRateLimiter creates a limiter of the given algorithm that allows rate
+// requests per second, and burst at once where the algorithm supports it
+func newRateLimiter(algorithm string, rate, burst int) (ratelimit.Allower, error) {
+	switch algorithm {
+	case "fixed_window":
+		return ratelimit.NewLimiter(rate), nil
+	case "token_bucket":
+		return ratelimit.NewTokenBucket(rate, burst), nil
+	case "sliding_log":
+		return ratelimit.NewSlidingWindowLog(rate, time.Second), nil
+	case "sliding_window":
+		return ratelimit.NewSlidingWindowCounter(rate, time.Second), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit algorithm: %s", algorithm)
+	}
+}
+
+// newRateLimitMiddleware creates the global rate limit and, when a rate limit
+// key is configured, a limit per client checked before it, so a client over
+// its own limit does not use up the global one. With a policy file, routes
+// matching a policy get their own limit instead of the global one. Clients can
+// be keyed by API key only when quotas lists the issued keys.
+func newRateLimitMiddleware(cfg *config.Config, quotas *ratelimit.QuotaLimiter) (func(http.Handler) http.Handler, error) {
+	var limiter middleware.RateLimiter
+	var keyed middleware.KeyedRateLimiter
+	var newRouteLimiter func(policy middleware.RoutePolicy) middleware.RateLimiter
+	switch cfg.RateLimitBackend {
+	case "memory":
+		global, err := newRateLimiter(cfg.RateLimitAlgorithm, cfg.RateLimit, cfg.RateLimitBurst)
+		if err != nil {
+			return nil, err
+		}
+		limiter = global
+		keyed = ratelimit.NewKeyedLimiter(ratelimit.KeyedOptions{
+			NewLimiter: func() ratelimit.Allower {
+				// The algorithm was validated by the global limiter
+				limiter, _ := newRateLimiter(cfg.RateLimitAlgorithm, cfg.RateLimitKeyRate, cfg.RateLimitKeyBurst)
+				return limiter
+			},
+			MaxKeys:     cfg.RateLimitMaxKeys,
+			IdleTimeout: cfg.RateLimitKeyIdleTimeout,
+		})
+		newRouteLimiter = func(policy middleware.RoutePolicy) middleware.RateLimiter {
+			limiter, _ := newRateLimiter(cfg.RateLimitAlgorithm, policy.Rate, policy.Burst)
+			return limiter
+		}
+	case "redis":
+		// Limits are shared by all replicas. Redis expires idle keys itself,
+		// so no keys are tracked locally.
+		client := ratelimit.NewRedisClient(cfg.RateLimitRedisAddr, cfg.RateLimitRedisTimeout)
+		limiter = ratelimit.NewRedisLimiter(client, ratelimit.RedisLimiterOptions{
+			Prefix:   cfg.RateLimitRedisPrefix,
+			Rate:     cfg.RateLimit,
+			Burst:    cfg.RateLimitBurst,
+			FailOpen: cfg.RateLimitRedisFailOpen,
+		})
+		keyed = ratelimit.NewRedisLimiter(client, ratelimit.RedisLimiterOptions{
+			Prefix:   cfg.RateLimitRedisPrefix + "key:",
+			Rate:     cfg.RateLimitKeyRate,
+			Burst:    cfg.RateLimitKeyBurst,
+			FailOpen: cfg.RateLimitRedisFailOpen,
+		})
+		newRouteLimiter = func(policy middleware.RoutePolicy) middleware.RateLimiter {
+			return ratelimit.NewRedisLimiter(client, ratelimit.RedisLimiterOptions{
+				Prefix:   cfg.RateLimitRedisPrefix + "route:" + policy.Pattern + ":",
+				Rate:     policy.Rate,
+				Burst:    policy.Burst,
+				FailOpen: cfg.RateLimitRedisFailOpen,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rate limit backend: %s", cfg.RateLimitBackend)
+	}
+
+	// With a max wait, requests over the limits are queued instead of
+	// rejected. All limits share one queue.
+	var queue *middleware.Queue
+	if cfg.RateLimitMaxWait > 0 {
+		queue = middleware.NewQueue(cfg.RateLimitMaxWait, cfg.RateLimitQueueSize)
+	}
+	limit := func(limiter middleware.RateLimiter) func(http.Handler) http.Handler {
+		if queue != nil {
+			return middleware.QueuedRateLimit(limiter, queue)
+		}
+		return middleware.RateLimit(limiter)
+	}
+	perClient := func(next http.Handler) http.Handler { return next }
+	if cfg.RateLimitKey != "" {
+		var known func(apiKey string) bool
+		if quotas != nil {
+			known = quotas.Known
+		}
+		key, err := middleware.ParseRateLimitKey(cfg.RateLimitKey, known)
+		if err != nil {
+			return nil, err
+		}
+		perClient = middleware.KeyedRateLimit(keyed, key)
+		if queue != nil {
+			perClient = middleware.QueuedKeyedRateLimit(keyed, key, queue)
+		}
+	}
+	withPerClient := func(limit func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return perClient(limit(next))
+		}
+	}
 
-	return server, nil
+	global := withPerClient(limit(limiter))
+	if cfg.RateLimitPolicyFile == "" {
+		return global, nil
+	}
+	policies, err := middleware.LoadPolicyFile(cfg.RateLimitPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.RoutePolicies(policies, func(policy middleware.RoutePolicy) func(http.Handler) http.Handler {
+		return withPerClient(limit(newRouteLimiter(policy)))
+	}, global)
+}
+
+// newQuotaLimiter loads the quota file and the usage counts. It returns a nil
+// limiter when quotas are disabled, and a function saving the usage counts
+// that must be called on shutdown.
+func newQuotaLimiter(cfg *config.Config) (*ratelimit.QuotaLimiter, func(), error) {
+	if cfg.QuotaFile == "" {
+		return nil, func() {}, nil
+	}
+	quotas, err := ratelimit.LoadQuotaFile(cfg.QuotaFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.QuotaStore {
+	case "file":
+		store, err := ratelimit.NewFileUsageStore(cfg.QuotaUsagePath, cfg.QuotaSaveInterval)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeStore := func() {
+			if err := store.Close(); err != nil {
+				log.Printf("Failed to save usage counts: %v", err)
+			}
+		}
+		return ratelimit.NewQuotaLimiter(quotas, store), closeStore, nil
+	case "redis":
+		client := ratelimit.NewRedisClient(cfg.RateLimitRedisAddr, cfg.RateLimitRedisTimeout)
+		store := ratelimit.NewRedisUsageStore(client, cfg.RateLimitRedisPrefix+"quota:", cfg.RateLimitRedisFailOpen)
+		return ratelimit.NewQuotaLimiter(quotas, store), func() { client.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported quota store: %s", cfg.QuotaStore)
+	}
 }
 
 func main() {
-	server, err := setupServer()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve starts the HTTP server and blocks until it is stopped by a signal
+func serve() int {
+	server, cleanup, err := setupServer()
 	if err != nil {
-		log.Fatalf("Server setup failed: %v", err)
+		log.Printf("Server setup failed: %v", err)
+		return 1
 	}
+	defer cleanup()
 
 	// Create channel to listen for interrupt signal
 	stop := make(chan os.Signal, 1)
@@ -82,7 +307,10 @@ func main() {
 
 	// Shutdown server gracefully
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed: %v", err)
+		log.Printf("Server shutdown failed: %v", err)
+		return 1
 	}
+
 	log.Println("Server gracefully stopped")
+	return 0
 }
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"ip2country-api/internal/config"
 	"ip2country-api/internal/handlers"
 	"ip2country-api/internal/ip2country"
 	"ip2country-api/internal/middleware"
@@ -27,11 +35,11 @@ type MockLimiter struct {
 }
 
 // Allow implements the middleware.RateLimiter interface
-func (m *MockLimiter) Allow() error {
+func (m *MockLimiter) Allow() (ratelimit.Result, error) {
 	if !m.shouldAllow {
-		return ratelimit.ErrRateLimitExceeded
+		return ratelimit.Result{}, ratelimit.ErrRateLimitExceeded
 	}
-	return nil
+	return ratelimit.Result{}, nil
 }
 
 // TestSetupServer tests the server setup functionality
@@ -69,7 +77,7 @@ func TestSetupServer(t *testing.T) {
 	http.DefaultServeMux = http.NewServeMux()
 
 	// Test the setupServer function
-	server, err := setupServer()
+	server, _, err := setupServer()
 	if err != nil {
 		t.Fatalf("setupServer() failed: %v", err)
 	}
@@ -96,7 +104,7 @@ func TestSetupServerErrors(t *testing.T) {
 		defer os.Setenv("PORT", origPort)
 
 		// Test the setupServer function
-		server, err := setupServer()
+		server, _, err := setupServer()
 
 		// Verify error is returned
 		if err == nil {
@@ -125,7 +133,7 @@ func TestSetupServerErrors(t *testing.T) {
 		}()
 
 		// Test the setupServer function
-		server, err := setupServer()
+		server, _, err := setupServer()
 
 		// Verify error is returned
 		if err == nil {
@@ -169,3 +177,263 @@ func TestServerIntegration(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", resp.StatusCode, http.StatusOK)
 	}
 }
+
+func TestNewRateLimiter(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		expected  string
+		wantErr   bool
+	}{
+		{algorithm: "fixed_window", expected: "*ratelimit.Limiter"},
+		{algorithm: "token_bucket", expected: "*ratelimit.TokenBucket"},
+		{algorithm: "sliding_log", expected: "*ratelimit.SlidingWindowLog"},
+		{algorithm: "sliding_window", expected: "*ratelimit.SlidingWindowCounter"},
+		{algorithm: "leaky_bucket", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			limiter, err := newRateLimiter(tt.algorithm, 10, 20)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := fmt.Sprintf("%T", limiter); got != tt.expected {
+				t.Errorf("newRateLimiter() = %s, want %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewRateLimitMiddleware(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit:               100,
+		RateLimitBurst:          100,
+		RateLimitAlgorithm:      "token_bucket",
+		RateLimitBackend:        "memory",
+		RateLimitKey:            "ip",
+		RateLimitKeyRate:        1,
+		RateLimitKeyBurst:       2,
+		RateLimitMaxKeys:        10,
+		RateLimitKeyIdleTimeout: time.Minute,
+	}
+	rateLimit, err := newRateLimitMiddleware(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRateLimitMiddleware() failed: %v", err)
+	}
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Each client gets its own burst, and IPv6 clients are limited per /64
+	clients := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{remoteAddr: "192.0.2.1:1000", expected: http.StatusOK},
+		{remoteAddr: "192.0.2.1:1001", expected: http.StatusOK},
+		{remoteAddr: "192.0.2.1:1002", expected: http.StatusTooManyRequests},
+		{remoteAddr: "192.0.2.2:1000", expected: http.StatusOK},
+		{remoteAddr: "[2001:db8::1]:1000", expected: http.StatusOK},
+		{remoteAddr: "[2001:db8::2]:1000", expected: http.StatusOK},
+		{remoteAddr: "[2001:db8::ffff]:1000", expected: http.StatusTooManyRequests},
+		{remoteAddr: "[2001:db8:0:1::1]:1000", expected: http.StatusOK},
+	}
+	for _, client := range clients {
+		if code := status(client.remoteAddr); code != client.expected {
+			t.Errorf("request from %s = %d, want %d", client.remoteAddr, code, client.expected)
+		}
+	}
+
+	cfg.RateLimitKey = "cookie"
+	if _, err := newRateLimitMiddleware(cfg, nil); err == nil {
+		t.Error("Expected error for an unknown rate limit key, got nil")
+	}
+
+	cfg.RateLimitKey = "api_key"
+	if _, err := newRateLimitMiddleware(cfg, nil); err == nil {
+		t.Error("Expected error for the api_key rate limit key without quotas, got nil")
+	}
+
+	cfg.RateLimitKey = ""
+	cfg.RateLimitBackend = "memcached"
+	if _, err := newRateLimitMiddleware(cfg, nil); err == nil {
+		t.Error("Expected error for an unknown rate limit backend, got nil")
+	}
+}
+
+func TestNewRateLimitMiddlewareQueued(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit:          100,
+		RateLimitBurst:     1,
+		RateLimitAlgorithm: "token_bucket",
+		RateLimitBackend:   "memory",
+		RateLimitMaxWait:   time.Second,
+		RateLimitQueueSize: 10,
+	}
+	rateLimit, err := newRateLimitMiddleware(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRateLimitMiddleware() failed: %v", err)
+	}
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Requests over the burst wait for a token instead of being rejected
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("request %d = %d, want %d", i, rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestNewRateLimitMiddlewarePolicies(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policies.csv")
+	policies := "route,GET /v1/find-countries,1,10,param:ip\nexempt,GET /healthz\n"
+	if err := os.WriteFile(policyFile, []byte(policies), 0o644); err != nil {
+		t.Fatalf("Failed to write policy file: %v", err)
+	}
+	cfg := &config.Config{
+		RateLimit:           1,
+		RateLimitBurst:      1,
+		RateLimitAlgorithm:  "token_bucket",
+		RateLimitBackend:    "memory",
+		RateLimitPolicyFile: policyFile,
+	}
+	rateLimit, err := newRateLimitMiddleware(cfg, nil)
+	if err != nil {
+		t.Fatalf("newRateLimitMiddleware() failed: %v", err)
+	}
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The batch route has its own limit charged per address, health checks
+	// are exempt and other routes share the global limit
+	requests := []struct {
+		target   string
+		expected int
+	}{
+		{target: "/v1/find-country?ip=1.1.1.1", expected: http.StatusOK},
+		{target: "/v1/find-country?ip=1.1.1.1", expected: http.StatusTooManyRequests},
+		{target: "/v1/find-countries?ip=" + strings.Repeat("1.1.1.1,", 11), expected: http.StatusRequestEntityTooLarge},
+		{target: "/v1/find-countries?ip=1.1.1.1,2.2.2.2&ip=3.3.3.3", expected: http.StatusOK},
+		{target: "/v1/find-countries?ip=" + strings.Repeat("1.1.1.1,", 7), expected: http.StatusOK},
+		{target: "/v1/find-countries?ip=1.1.1.1", expected: http.StatusTooManyRequests},
+		{target: "/healthz", expected: http.StatusOK},
+		{target: "/healthz", expected: http.StatusOK},
+	}
+	for _, request := range requests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", request.target, nil))
+		if rr.Code != request.expected {
+			t.Errorf("GET %s = %d, want %d", request.target, rr.Code, request.expected)
+		}
+	}
+
+	cfg.RateLimitPolicyFile = filepath.Join(t.TempDir(), "missing.csv")
+	if _, err := newRateLimitMiddleware(cfg, nil); err == nil {
+		t.Error("Expected error for a missing policy file, got nil")
+	}
+}
+
+func TestNewRateLimitMiddlewareRedisUnavailable(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	// Nothing listens on a closed listener's address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		expected int
+	}{
+		{name: "Fail open", failOpen: true, expected: http.StatusOK},
+		{name: "Fail closed", failOpen: false, expected: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimit, err := newRateLimitMiddleware(&config.Config{
+				RateLimit:              100,
+				RateLimitBurst:         100,
+				RateLimitKey:           "ip",
+				RateLimitKeyRate:       1,
+				RateLimitKeyBurst:      1,
+				RateLimitBackend:       "redis",
+				RateLimitRedisAddr:     addr,
+				RateLimitRedisFailOpen: tt.failOpen,
+				RateLimitRedisTimeout:  50 * time.Millisecond,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newRateLimitMiddleware() failed: %v", err)
+			}
+			handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil))
+			if rr.Code != tt.expected {
+				t.Errorf("status = %d, want %d", rr.Code, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewQuotaLimiter(t *testing.T) {
+	dir := t.TempDir()
+	quotaFile := filepath.Join(dir, "quotas.csv")
+	if err := os.WriteFile(quotaFile, []byte("plan,free,10,10,100,0\nkey,free-key,free\n"), 0644); err != nil {
+		t.Fatalf("Failed to write quota file: %v", err)
+	}
+
+	quotas, cleanup, err := newQuotaLimiter(&config.Config{})
+	if err != nil || quotas != nil {
+		t.Fatalf("newQuotaLimiter() without a quota file = %v, %v, want nil, nil", quotas, err)
+	}
+	cleanup()
+
+	cfg := &config.Config{
+		QuotaFile:         quotaFile,
+		QuotaStore:        "file",
+		QuotaUsagePath:    filepath.Join(dir, "usage.json"),
+		QuotaSaveInterval: time.Hour,
+	}
+	quotas, cleanup, err = newQuotaLimiter(cfg)
+	if err != nil {
+		t.Fatalf("newQuotaLimiter() failed: %v", err)
+	}
+	if _, err := quotas.AllowKey("free-key"); err != nil {
+		t.Errorf("AllowKey() = %v, want nil", err)
+	}
+	// The usage counts are saved on shutdown
+	cleanup()
+	if _, err := os.Stat(cfg.QuotaUsagePath); err != nil {
+		t.Errorf("usage file not saved on cleanup: %v", err)
+	}
+
+	cfg.QuotaStore = "memcached"
+	if _, _, err := newQuotaLimiter(cfg); err == nil {
+		t.Error("Expected error for an unknown quota store, got nil")
+	}
+	cfg.QuotaStore = "file"
+	cfg.QuotaFile = filepath.Join(dir, "missing.csv")
+	if _, _, err := newQuotaLimiter(cfg); err == nil {
+		t.Error("Expected error for a missing quota file, got nil")
+	}
+}
@@ -1,9 +1,10 @@
 module ip2country-api
 
-go 1.24.0
+go 1.25.0
 
 require (
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.20.1
 	github.com/rs/cors v1.11.1
 	github.com/unrolled/secure v1.17.0
 )
@@ -6,23 +6,116 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// DefaultCSVPath is the CSV dataset loaded when CSV_DATA_PATH is not set
+const DefaultCSVPath = "data/ip2country.csv"
+
 type BackendConfig struct {
-	Type      string // "csv", "mongo", "redis", etc.
-	CSVPath   string
-	MongoURI  string
-	RedisAddr string
+	Type         string // "csv", "snapshot", "mongo", "redis", etc.
+	CSVPath      string
+	SnapshotPath string
+	MongoURI     string
+	RedisAddr    string
+
+	// Layout of the CSV file: field delimiter, header column mapping such as
+	// "ip=network,city=city_name,country=country_name", and whether invalid
+	// rows are skipped instead of failing the load
+	CSVDelimiter string
+	CSVColumns   string
+	CSVLenient   bool
+
+	// Extra CSV columns returned as result attributes, such as "region,isp",
+	// or "*" for all of them
+	CSVAttributes string
+
+	// Expected SHA-256 of a dataset fetched from an http(s) URL, as a hex
+	// digest or the URL of a checksum file, and how often it is polled
+	DatasetSHA256       string
+	DatasetPollInterval time.Duration
+
+	// Trusted ed25519 public keys as a comma separated list of [id:]key. When
+	// set, dataset files must carry a valid detached signature.
+	TrustedKeys string
+
+	// Number of loaded dataset versions kept for rollback
+	HistorySize int
+
+	// Optional local overrides applied on top of the backend
+	OverridesPath           string
+	OverridesReloadInterval time.Duration
+
+	// Optional secondary backend compared against this one for a sample of lookups
+	Shadow           *BackendConfig
+	ShadowSampleRate float64
+
+	// Optional candidate backend serving a percentage of lookups
+	Canary        *BackendConfig
+	CanaryPercent float64
 }
 
 // Config holds the application-wide settings.
 type Config struct {
-	Port           int
-	RateLimit      int
+	Port      int
+	RateLimit int
+
+	// Rate limiting algorithm, fixed_window, token_bucket, sliding_log or
+	// sliding_window, and the number of requests a token bucket lets through
+	// at once
+	RateLimitAlgorithm string
+	RateLimitBurst     int
+
+	// Per-client rate limiting, disabled when RateLimitKey is empty. The key
+	// is ip, api_key or header:<name>, and each key gets its own limiter with
+	// the given rate and burst, in addition to the global one. At most
+	// RateLimitMaxKeys keys are tracked, and idle ones are forgotten.
+	RateLimitKey            string
+	RateLimitKeyRate        int
+	RateLimitKeyBurst       int
+	RateLimitMaxKeys        int
+	RateLimitKeyIdleTimeout time.Duration
+
+	// Adaptive concurrency limiting of lookups. The limit starts at
+	// AdaptiveConcurrencyInitial and adapts to the lookup latency between
+	// AdaptiveConcurrencyMin and AdaptiveConcurrencyMax.
+	AdaptiveConcurrency        bool
+	AdaptiveConcurrencyInitial int
+	AdaptiveConcurrencyMin     int
+	AdaptiveConcurrencyMax     int
+
+	// Requests over a rate limit wait up to RateLimitMaxWait for it instead
+	// of being rejected, with at most RateLimitQueueSize waiting at once.
+	// Zero rejects them at once.
+	RateLimitMaxWait   time.Duration
+	RateLimitQueueSize int
+
+	// RateLimitPolicyFile gives routes their own rate limits, exemptions and
+	// request costs instead of the global limit, see middleware.LoadPolicyFile
+	RateLimitPolicyFile string
+
+	// Where rate limits are counted: memory for each replica on its own, or
+	// redis to share them between replicas. RateLimitRedisFailOpen allows
+	// requests while Redis is unreachable instead of rejecting them.
+	RateLimitBackend       string
+	RateLimitRedisAddr     string
+	RateLimitRedisPrefix   string
+	RateLimitRedisFailOpen bool
+	RateLimitRedisTimeout  time.Duration
+
+	// API key quotas, disabled when QuotaFile is empty. Usage counts are
+	// kept in a file saved every QuotaSaveInterval, or in the rate limit
+	// Redis server when QuotaStore is redis.
+	QuotaFile         string
+	QuotaStore        string
+	QuotaUsagePath    string
+	QuotaSaveInterval time.Duration
+
 	IP2Country     BackendConfig
 	AllowedOrigins []string
+	AdminToken     string
 }
 
 // Load reads configuration from environment variables
@@ -42,6 +135,165 @@ func Load() (*Config, error) {
 		rateLimit = rateLimitInt
 	}
 
+	// Read rate limiting algorithm, validated when the limiter is created
+	rateLimitAlgorithm := "fixed_window"
+	if algorithm := os.Getenv("RATE_LIMIT_ALGORITHM"); algorithm != "" {
+		rateLimitAlgorithm = algorithm
+	}
+
+	// Read RATE_LIMIT_BURST, a burst of one second of traffic by default
+	rateLimitBurst := rateLimit
+	if burstStr := os.Getenv("RATE_LIMIT_BURST"); burstStr != "" {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_BURST value: %q", burstStr)
+		}
+		rateLimitBurst = burst
+	}
+
+	// Read per-client rate limiting settings, the key is validated when the
+	// limiter is created
+	rateLimitKey := os.Getenv("RATE_LIMIT_KEY")
+	rateLimitKeyRate := rateLimit
+	if rateStr := os.Getenv("RATE_LIMIT_KEY_RATE"); rateStr != "" {
+		rate, err := strconv.Atoi(rateStr)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_KEY_RATE value: %q", rateStr)
+		}
+		rateLimitKeyRate = rate
+	}
+	rateLimitKeyBurst := rateLimitKeyRate
+	if burstStr := os.Getenv("RATE_LIMIT_KEY_BURST"); burstStr != "" {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_KEY_BURST value: %q", burstStr)
+		}
+		rateLimitKeyBurst = burst
+	}
+	rateLimitMaxKeys := 100000
+	if maxKeysStr := os.Getenv("RATE_LIMIT_MAX_KEYS"); maxKeysStr != "" {
+		maxKeys, err := strconv.Atoi(maxKeysStr)
+		if err != nil || maxKeys < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_MAX_KEYS value: %q", maxKeysStr)
+		}
+		rateLimitMaxKeys = maxKeys
+	}
+	rateLimitKeyIdleTimeout := 10 * time.Minute
+	if idleStr := os.Getenv("RATE_LIMIT_KEY_IDLE_TIMEOUT"); idleStr != "" {
+		idle, err := time.ParseDuration(idleStr)
+		if err != nil || idle <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_KEY_IDLE_TIMEOUT value: %q", idleStr)
+		}
+		rateLimitKeyIdleTimeout = idle
+	}
+
+	// Read queueing settings
+	var rateLimitMaxWait time.Duration
+	if waitStr := os.Getenv("RATE_LIMIT_MAX_WAIT"); waitStr != "" {
+		wait, err := time.ParseDuration(waitStr)
+		if err != nil || wait < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_MAX_WAIT value: %q", waitStr)
+		}
+		rateLimitMaxWait = wait
+	}
+	rateLimitQueueSize := 100
+	if sizeStr := os.Getenv("RATE_LIMIT_QUEUE_SIZE"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_QUEUE_SIZE value: %q", sizeStr)
+		}
+		rateLimitQueueSize = size
+	}
+
+	// Read the route policy file, it is parsed when the limits are created
+	rateLimitPolicyFile := os.Getenv("RATE_LIMIT_POLICY_FILE")
+
+	// Read adaptive concurrency settings
+	adaptiveConcurrency := false
+	if adaptiveStr := os.Getenv("ADAPTIVE_CONCURRENCY"); adaptiveStr != "" {
+		adaptive, err := strconv.ParseBool(adaptiveStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ADAPTIVE_CONCURRENCY value: %v", err)
+		}
+		adaptiveConcurrency = adaptive
+	}
+	adaptiveConcurrencyInitial := 20
+	if initialStr := os.Getenv("ADAPTIVE_CONCURRENCY_INITIAL"); initialStr != "" {
+		initial, err := strconv.Atoi(initialStr)
+		if err != nil || initial < 1 {
+			return nil, fmt.Errorf("invalid ADAPTIVE_CONCURRENCY_INITIAL value: %q", initialStr)
+		}
+		adaptiveConcurrencyInitial = initial
+	}
+	adaptiveConcurrencyMin := 5
+	if minStr := os.Getenv("ADAPTIVE_CONCURRENCY_MIN"); minStr != "" {
+		minLimit, err := strconv.Atoi(minStr)
+		if err != nil || minLimit < 1 {
+			return nil, fmt.Errorf("invalid ADAPTIVE_CONCURRENCY_MIN value: %q", minStr)
+		}
+		adaptiveConcurrencyMin = minLimit
+	}
+	adaptiveConcurrencyMax := 500
+	if maxStr := os.Getenv("ADAPTIVE_CONCURRENCY_MAX"); maxStr != "" {
+		maxLimit, err := strconv.Atoi(maxStr)
+		if err != nil || maxLimit < 1 {
+			return nil, fmt.Errorf("invalid ADAPTIVE_CONCURRENCY_MAX value: %q", maxStr)
+		}
+		adaptiveConcurrencyMax = maxLimit
+	}
+	if adaptiveConcurrencyMin > adaptiveConcurrencyMax {
+		return nil, fmt.Errorf("invalid ADAPTIVE_CONCURRENCY_MIN value: %d is above the max of %d", adaptiveConcurrencyMin, adaptiveConcurrencyMax)
+	}
+
+	// Read rate limit backend settings
+	rateLimitBackend := "memory"
+	if backend := os.Getenv("RATE_LIMIT_BACKEND"); backend != "" {
+		rateLimitBackend = backend
+	}
+	rateLimitRedisAddr := "localhost:6379"
+	if addr := os.Getenv("RATE_LIMIT_REDIS_ADDR"); addr != "" {
+		rateLimitRedisAddr = addr
+	}
+	rateLimitRedisPrefix := "ip2country:ratelimit:"
+	if prefix := os.Getenv("RATE_LIMIT_REDIS_PREFIX"); prefix != "" {
+		rateLimitRedisPrefix = prefix
+	}
+	rateLimitRedisFailOpen := true
+	switch failStr := os.Getenv("RATE_LIMIT_REDIS_FAIL"); failStr {
+	case "", "open":
+	case "closed":
+		rateLimitRedisFailOpen = false
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_REDIS_FAIL value: %q, expected open or closed", failStr)
+	}
+	rateLimitRedisTimeout := 100 * time.Millisecond
+	if timeoutStr := os.Getenv("RATE_LIMIT_REDIS_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_REDIS_TIMEOUT value: %q", timeoutStr)
+		}
+		rateLimitRedisTimeout = timeout
+	}
+
+	// Read API key quota settings, the store is validated when it is created
+	quotaFile := os.Getenv("QUOTA_FILE")
+	quotaStore := "file"
+	if store := os.Getenv("QUOTA_STORE"); store != "" {
+		quotaStore = store
+	}
+	quotaUsagePath := "data/usage.json"
+	if path := os.Getenv("QUOTA_USAGE_PATH"); path != "" {
+		quotaUsagePath = path
+	}
+	quotaSaveInterval := 10 * time.Second
+	if intervalStr := os.Getenv("QUOTA_SAVE_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid QUOTA_SAVE_INTERVAL value: %q", intervalStr)
+		}
+		quotaSaveInterval = interval
+	}
+
 	// Read PORT
 	port := 8080
 	if portStr := os.Getenv("PORT"); portStr != "" {
@@ -59,11 +311,44 @@ func Load() (*Config, error) {
 	}
 
 	// Read CSV Path
-	dataPath := "data/ip2country.csv"
+	dataPath := DefaultCSVPath
 	if dataPathStr := os.Getenv("CSV_DATA_PATH"); dataPathStr != "" {
 		dataPath = dataPathStr
 	}
 
+	// Read CSV layout settings
+	csvDelimiter := os.Getenv("CSV_DELIMITER")
+	csvColumns := os.Getenv("CSV_COLUMNS")
+	csvAttributes := os.Getenv("CSV_ATTRIBUTES")
+	csvLenient := false
+	if lenientStr := os.Getenv("CSV_LENIENT"); lenientStr != "" {
+		lenient, err := strconv.ParseBool(lenientStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV_LENIENT value: %v", err)
+		}
+		csvLenient = lenient
+	}
+
+	// Read snapshot path
+	snapshotPath := "data/ip2country.snap"
+	if snapshotPathStr := os.Getenv("SNAPSHOT_PATH"); snapshotPathStr != "" {
+		snapshotPath = snapshotPathStr
+	}
+
+	// Read remote dataset settings, used when a dataset path is an http(s) URL
+	datasetSHA256 := os.Getenv("DATASET_SHA256")
+	datasetPollInterval := 5 * time.Minute
+	if intervalStr := os.Getenv("DATASET_POLL_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DATASET_POLL_INTERVAL value: %v", err)
+		}
+		datasetPollInterval = interval
+	}
+
+	// Read trusted signing keys, signatures are not required when empty
+	trustedKeys := os.Getenv("DATASET_TRUSTED_KEYS")
+
 	// Read Mongo URI
 	MongoURI := "mongodb://localhost:27017"
 	if mongoURI := os.Getenv("MONGO_URI"); mongoURI != "" {
@@ -76,23 +361,177 @@ func Load() (*Config, error) {
 		RedisAddr = redisAddr
 	}
 
+	// Read dataset history size
+	historySize := 5
+	if historySizeStr := os.Getenv("DATASET_HISTORY_SIZE"); historySizeStr != "" {
+		historySizeInt, err := strconv.Atoi(historySizeStr)
+		if err != nil || historySizeInt < 1 {
+			return nil, fmt.Errorf("invalid DATASET_HISTORY_SIZE value: %q", historySizeStr)
+		}
+		historySize = historySizeInt
+	}
+
+	// Read overrides file path, overrides are disabled when it is empty
+	overridesPath := os.Getenv("OVERRIDES_PATH")
+
+	// Read overrides reload interval
+	overridesReloadInterval := 30 * time.Second
+	if intervalStr := os.Getenv("OVERRIDES_RELOAD_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OVERRIDES_RELOAD_INTERVAL value: %v", err)
+		}
+		overridesReloadInterval = interval
+	}
+
+	// Read shadow backend, shadow comparisons are disabled when no type is set
+	shadow, err := loadSecondaryBackend("SHADOW_", datasetPollInterval, trustedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read shadow sample rate
+	shadowSampleRate := 0.1
+	if sampleRateStr := os.Getenv("SHADOW_SAMPLE_RATE"); sampleRateStr != "" {
+		sampleRate, err := strconv.ParseFloat(sampleRateStr, 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("invalid SHADOW_SAMPLE_RATE value: %q, expected a number between 0 and 1", sampleRateStr)
+		}
+		shadowSampleRate = sampleRate
+	}
+
+	// Read canary backend, canary routing is disabled when no type is set
+	canary, err := loadSecondaryBackend("CANARY_", datasetPollInterval, trustedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read canary percentage
+	canaryPercent := 0.0
+	if percentStr := os.Getenv("CANARY_PERCENT"); percentStr != "" {
+		percent, err := strconv.ParseFloat(percentStr, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid CANARY_PERCENT value: %q, expected a number between 0 and 100", percentStr)
+		}
+		canaryPercent = percent
+	}
+
 	// Read allowed origins for CORS
 	allowedOrigins := []string{"http://localhost:3000"}
 	if originsStr := os.Getenv("ALLOWED_ORIGINS"); originsStr != "" {
 		allowedOrigins = strings.Split(originsStr, ",")
 	}
 
+	// Read admin API token, admin endpoints are disabled when it is empty
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
 	config := &Config{
 		Port:           port,
 		RateLimit:      rateLimit,
 		AllowedOrigins: allowedOrigins,
+
+		RateLimitAlgorithm: rateLimitAlgorithm,
+		RateLimitBurst:     rateLimitBurst,
+
+		RateLimitKey:            rateLimitKey,
+		RateLimitKeyRate:        rateLimitKeyRate,
+		RateLimitKeyBurst:       rateLimitKeyBurst,
+		RateLimitMaxKeys:        rateLimitMaxKeys,
+		RateLimitKeyIdleTimeout: rateLimitKeyIdleTimeout,
+
+		AdaptiveConcurrency:        adaptiveConcurrency,
+		AdaptiveConcurrencyInitial: adaptiveConcurrencyInitial,
+		AdaptiveConcurrencyMin:     adaptiveConcurrencyMin,
+		AdaptiveConcurrencyMax:     adaptiveConcurrencyMax,
+
+		RateLimitMaxWait:   rateLimitMaxWait,
+		RateLimitQueueSize: rateLimitQueueSize,
+
+		RateLimitPolicyFile: rateLimitPolicyFile,
+
+		RateLimitBackend:       rateLimitBackend,
+		RateLimitRedisAddr:     rateLimitRedisAddr,
+		RateLimitRedisPrefix:   rateLimitRedisPrefix,
+		RateLimitRedisFailOpen: rateLimitRedisFailOpen,
+		RateLimitRedisTimeout:  rateLimitRedisTimeout,
+
+		QuotaFile:         quotaFile,
+		QuotaStore:        quotaStore,
+		QuotaUsagePath:    quotaUsagePath,
+		QuotaSaveInterval: quotaSaveInterval,
+
+		AdminToken: adminToken,
 		IP2Country: BackendConfig{
-			Type:      dbType,
-			CSVPath:   dataPath,
-			MongoURI:  MongoURI,
-			RedisAddr: RedisAddr,
+			Type:         dbType,
+			CSVPath:      dataPath,
+			SnapshotPath: snapshotPath,
+			MongoURI:     MongoURI,
+			RedisAddr:    RedisAddr,
+
+			CSVDelimiter: csvDelimiter,
+			CSVColumns:   csvColumns,
+			CSVLenient:   csvLenient,
+
+			CSVAttributes: csvAttributes,
+
+			DatasetSHA256:       datasetSHA256,
+			DatasetPollInterval: datasetPollInterval,
+
+			TrustedKeys: trustedKeys,
+
+			HistorySize: historySize,
+
+			OverridesPath:           overridesPath,
+			OverridesReloadInterval: overridesReloadInterval,
+
+			Shadow:           shadow,
+			ShadowSampleRate: shadowSampleRate,
+
+			Canary:        canary,
+			CanaryPercent: canaryPercent,
 		},
 	}
 
 	return config, nil
 }
+
+// loadSecondaryBackend reads the settings of an additional backend from
+// environment variables named like the primary ones with the given prefix,
+// e.g. SHADOW_DB_TYPE. Remote datasets are polled on the same interval as the
+// primary one and signatures are checked against the same trusted keys. It
+// returns nil when no type is set. File backed types require their path,
+// since a secondary backend serving the built-in dataset would answer real
+// traffic or comparisons from toy data.
+func loadSecondaryBackend(prefix string, pollInterval time.Duration, trustedKeys string) (*BackendConfig, error) {
+	backendType := os.Getenv(prefix + "DB_TYPE")
+	if backendType == "" {
+		return nil, nil
+	}
+	pathVar := map[string]string{"csv": "CSV_DATA_PATH", "snapshot": "SNAPSHOT_PATH"}[backendType]
+	if pathVar != "" && os.Getenv(prefix+pathVar) == "" {
+		return nil, fmt.Errorf("%s%s is required with %sDB_TYPE=%s", prefix, pathVar, prefix, backendType)
+	}
+	csvLenient := false
+	if lenientStr := os.Getenv(prefix + "CSV_LENIENT"); lenientStr != "" {
+		lenient, err := strconv.ParseBool(lenientStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sCSV_LENIENT value: %v", prefix, err)
+		}
+		csvLenient = lenient
+	}
+	return &BackendConfig{
+		Type:          backendType,
+		CSVPath:       os.Getenv(prefix + "CSV_DATA_PATH"),
+		SnapshotPath:  os.Getenv(prefix + "SNAPSHOT_PATH"),
+		MongoURI:      os.Getenv(prefix + "MONGO_URI"),
+		RedisAddr:     os.Getenv(prefix + "REDIS_ADDR"),
+		CSVDelimiter:  os.Getenv(prefix + "CSV_DELIMITER"),
+		CSVColumns:    os.Getenv(prefix + "CSV_COLUMNS"),
+		CSVAttributes: os.Getenv(prefix + "CSV_ATTRIBUTES"),
+		CSVLenient:    csvLenient,
+
+		DatasetSHA256:       os.Getenv(prefix + "DATASET_SHA256"),
+		DatasetPollInterval: pollInterval,
+		TrustedKeys:         trustedKeys,
+	}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -15,6 +16,32 @@ func TestLoad(t *testing.T) {
 	origMongoURI := os.Getenv("MONGO_URI")
 	origRedisAddr := os.Getenv("REDIS_ADDR")
 	origAllowedOrigins := os.Getenv("ALLOWED_ORIGINS")
+	origAdminToken := os.Getenv("ADMIN_TOKEN")
+	origOverridesPath := os.Getenv("OVERRIDES_PATH")
+	origHistorySize := os.Getenv("DATASET_HISTORY_SIZE")
+	origShadowType := os.Getenv("SHADOW_DB_TYPE")
+	origShadowPath := os.Getenv("SHADOW_CSV_DATA_PATH")
+	origShadowRate := os.Getenv("SHADOW_SAMPLE_RATE")
+	origCanaryType := os.Getenv("CANARY_DB_TYPE")
+	origCanaryPath := os.Getenv("CANARY_CSV_DATA_PATH")
+	origCanaryPercent := os.Getenv("CANARY_PERCENT")
+	origOverridesInterval := os.Getenv("OVERRIDES_RELOAD_INTERVAL")
+	origSnapshotPath := os.Getenv("SNAPSHOT_PATH")
+	origCSVDelimiter := os.Getenv("CSV_DELIMITER")
+	origCSVColumns := os.Getenv("CSV_COLUMNS")
+	origCSVLenient := os.Getenv("CSV_LENIENT")
+	origCSVAttributes := os.Getenv("CSV_ATTRIBUTES")
+	origDatasetSHA256 := os.Getenv("DATASET_SHA256")
+	origTrustedKeys := os.Getenv("DATASET_TRUSTED_KEYS")
+	origRateLimitAlgorithm := os.Getenv("RATE_LIMIT_ALGORITHM")
+	origRateLimitBurst := os.Getenv("RATE_LIMIT_BURST")
+	origRateLimitKey := os.Getenv("RATE_LIMIT_KEY")
+	origRateLimitBackend := os.Getenv("RATE_LIMIT_BACKEND")
+	origQuotaFile := os.Getenv("QUOTA_FILE")
+	origDatasetPollInterval := os.Getenv("DATASET_POLL_INTERVAL")
+	origShadowSHA256 := os.Getenv("SHADOW_DATASET_SHA256")
+	origShadowLenient := os.Getenv("SHADOW_CSV_LENIENT")
+	origCanaryLenient := os.Getenv("CANARY_CSV_LENIENT")
 	defer func() {
 		os.Setenv("CSV_DATA_PATH", origDataPath)
 		os.Setenv("RATE_LIMIT", origRateLimit)
@@ -23,6 +50,32 @@ func TestLoad(t *testing.T) {
 		os.Setenv("MONGO_URI", origMongoURI)
 		os.Setenv("REDIS_ADDR", origRedisAddr)
 		os.Setenv("ALLOWED_ORIGINS", origAllowedOrigins)
+		os.Setenv("ADMIN_TOKEN", origAdminToken)
+		os.Setenv("OVERRIDES_PATH", origOverridesPath)
+		os.Setenv("DATASET_HISTORY_SIZE", origHistorySize)
+		os.Setenv("SHADOW_DB_TYPE", origShadowType)
+		os.Setenv("SHADOW_CSV_DATA_PATH", origShadowPath)
+		os.Setenv("SHADOW_SAMPLE_RATE", origShadowRate)
+		os.Setenv("CANARY_DB_TYPE", origCanaryType)
+		os.Setenv("CANARY_CSV_DATA_PATH", origCanaryPath)
+		os.Setenv("CANARY_PERCENT", origCanaryPercent)
+		os.Setenv("OVERRIDES_RELOAD_INTERVAL", origOverridesInterval)
+		os.Setenv("SNAPSHOT_PATH", origSnapshotPath)
+		os.Setenv("CSV_DELIMITER", origCSVDelimiter)
+		os.Setenv("CSV_COLUMNS", origCSVColumns)
+		os.Setenv("CSV_LENIENT", origCSVLenient)
+		os.Setenv("CSV_ATTRIBUTES", origCSVAttributes)
+		os.Setenv("DATASET_SHA256", origDatasetSHA256)
+		os.Setenv("DATASET_TRUSTED_KEYS", origTrustedKeys)
+		os.Setenv("RATE_LIMIT_ALGORITHM", origRateLimitAlgorithm)
+		os.Setenv("RATE_LIMIT_BURST", origRateLimitBurst)
+		os.Setenv("RATE_LIMIT_KEY", origRateLimitKey)
+		os.Setenv("RATE_LIMIT_BACKEND", origRateLimitBackend)
+		os.Setenv("QUOTA_FILE", origQuotaFile)
+		os.Setenv("DATASET_POLL_INTERVAL", origDatasetPollInterval)
+		os.Setenv("SHADOW_DATASET_SHA256", origShadowSHA256)
+		os.Setenv("SHADOW_CSV_LENIENT", origShadowLenient)
+		os.Setenv("CANARY_CSV_LENIENT", origCanaryLenient)
 	}()
 
 	testCases := []struct {
@@ -34,6 +87,91 @@ func TestLoad(t *testing.T) {
 		{
 			name:    "Default values",
 			envVars: map[string]string{},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+
+					HistorySize:             5,
+					OverridesReloadInterval: 30 * time.Second,
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitAlgorithm: "fixed_window",
+				RateLimitBurst:     100,
+
+				RateLimitBackend:       "memory",
+				RateLimitRedisAddr:     "localhost:6379",
+				RateLimitRedisPrefix:   "ip2country:ratelimit:",
+				RateLimitRedisFailOpen: true,
+				RateLimitRedisTimeout:  100 * time.Millisecond,
+
+				QuotaStore:        "file",
+				QuotaUsagePath:    "data/usage.json",
+				QuotaSaveInterval: 10 * time.Second,
+			},
+			expectError: false,
+		},
+		{
+			name: "Token bucket",
+			envVars: map[string]string{
+				"RATE_LIMIT":           "20",
+				"RATE_LIMIT_ALGORITHM": "token_bucket",
+				"RATE_LIMIT_BURST":     "50",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      20,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitAlgorithm: "token_bucket",
+				RateLimitBurst:     50,
+			},
+			expectError: false,
+		},
+		{
+			name: "Per-client rate limit",
+			envVars: map[string]string{
+				"RATE_LIMIT_KEY":              "api_key",
+				"RATE_LIMIT_KEY_RATE":         "5",
+				"RATE_LIMIT_MAX_KEYS":         "1000",
+				"RATE_LIMIT_KEY_IDLE_TIMEOUT": "1m",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitKey:            "api_key",
+				RateLimitKeyRate:        5,
+				RateLimitKeyBurst:       5,
+				RateLimitMaxKeys:        1000,
+				RateLimitKeyIdleTimeout: time.Minute,
+			},
+			expectError: false,
+		},
+		{
+			name: "Queued rate limit",
+			envVars: map[string]string{
+				"RATE_LIMIT_MAX_WAIT":   "2s",
+				"RATE_LIMIT_QUEUE_SIZE": "500",
+			},
 			expectedConfig: &Config{
 				IP2Country: BackendConfig{
 					Type:      "csv",
@@ -44,6 +182,107 @@ func TestLoad(t *testing.T) {
 				RateLimit:      100,
 				Port:           8080,
 				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitMaxWait:   2 * time.Second,
+				RateLimitQueueSize: 500,
+			},
+			expectError: false,
+		},
+		{
+			name: "Rate limit policy file",
+			envVars: map[string]string{
+				"RATE_LIMIT_POLICY_FILE": "/etc/ip2country/policies.csv",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitPolicyFile: "/etc/ip2country/policies.csv",
+			},
+			expectError: false,
+		},
+		{
+			name: "Adaptive concurrency",
+			envVars: map[string]string{
+				"ADAPTIVE_CONCURRENCY":         "true",
+				"ADAPTIVE_CONCURRENCY_INITIAL": "50",
+				"ADAPTIVE_CONCURRENCY_MAX":     "100",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				AdaptiveConcurrency:        true,
+				AdaptiveConcurrencyInitial: 50,
+				AdaptiveConcurrencyMin:     5,
+				AdaptiveConcurrencyMax:     100,
+			},
+			expectError: false,
+		},
+		{
+			name: "Redis rate limit backend",
+			envVars: map[string]string{
+				"RATE_LIMIT_BACKEND":       "redis",
+				"RATE_LIMIT_REDIS_ADDR":    "redis:6379",
+				"RATE_LIMIT_REDIS_FAIL":    "closed",
+				"RATE_LIMIT_REDIS_TIMEOUT": "250ms",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				RateLimitBackend:       "redis",
+				RateLimitRedisAddr:     "redis:6379",
+				RateLimitRedisPrefix:   "ip2country:ratelimit:",
+				RateLimitRedisFailOpen: false,
+				RateLimitRedisTimeout:  250 * time.Millisecond,
+			},
+			expectError: false,
+		},
+		{
+			name: "API key quotas",
+			envVars: map[string]string{
+				"QUOTA_FILE":          "/etc/ip2country/quotas.csv",
+				"QUOTA_STORE":         "redis",
+				"QUOTA_USAGE_PATH":    "/var/lib/ip2country/usage.json",
+				"QUOTA_SAVE_INTERVAL": "1m",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+
+				QuotaFile:         "/etc/ip2country/quotas.csv",
+				QuotaStore:        "redis",
+				QuotaUsagePath:    "/var/lib/ip2country/usage.json",
+				QuotaSaveInterval: time.Minute,
 			},
 			expectError: false,
 		},
@@ -125,6 +364,239 @@ func TestLoad(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "Admin token",
+			envVars: map[string]string{
+				"ADMIN_TOKEN": "s3cret",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+				AdminToken:     "s3cret",
+			},
+			expectError: false,
+		},
+		{
+			name: "Snapshot backend",
+			envVars: map[string]string{
+				"IP2COUNTRY_DB_TYPE": "snapshot",
+				"SNAPSHOT_PATH":      "data/compiled.snap",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:         "snapshot",
+					CSVPath:      "data/ip2country.csv",
+					SnapshotPath: "data/compiled.snap",
+					MongoURI:     "mongodb://localhost:27017",
+					RedisAddr:    "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "CSV format",
+			envVars: map[string]string{
+				"CSV_DELIMITER":  ";",
+				"CSV_COLUMNS":    "ip=network,country=country_code",
+				"CSV_LENIENT":    "true",
+				"CSV_ATTRIBUTES": "region,isp",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:          "csv",
+					CSVPath:       "data/ip2country.csv",
+					CSVDelimiter:  ";",
+					CSVColumns:    "ip=network,country=country_code",
+					CSVLenient:    true,
+					CSVAttributes: "region,isp",
+					MongoURI:      "mongodb://localhost:27017",
+					RedisAddr:     "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Remote dataset",
+			envVars: map[string]string{
+				"CSV_DATA_PATH":         "https://artifacts.example.com/ip2country.csv",
+				"DATASET_SHA256":        "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				"DATASET_POLL_INTERVAL": "30s",
+				"DATASET_TRUSTED_KEYS":  "release:MCowBQYDK2VwAyEA",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:                "csv",
+					CSVPath:             "https://artifacts.example.com/ip2country.csv",
+					DatasetSHA256:       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+					DatasetPollInterval: 30 * time.Second,
+					TrustedKeys:         "release:MCowBQYDK2VwAyEA",
+					MongoURI:            "mongodb://localhost:27017",
+					RedisAddr:           "localhost:6379",
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Overrides configuration",
+			envVars: map[string]string{
+				"OVERRIDES_PATH":            "data/overrides.csv",
+				"OVERRIDES_RELOAD_INTERVAL": "5s",
+				"DATASET_HISTORY_SIZE":      "3",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+
+					HistorySize:             3,
+					OverridesPath:           "data/overrides.csv",
+					OverridesReloadInterval: 5 * time.Second,
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Shadow configuration",
+			envVars: map[string]string{
+				"SHADOW_DB_TYPE":        "csv",
+				"SHADOW_CSV_DATA_PATH":  "data/commercial.csv",
+				"SHADOW_SAMPLE_RATE":    "0.25",
+				"SHADOW_DATASET_SHA256": "https://artifacts.example.com/commercial.csv.sha256",
+				"DATASET_POLL_INTERVAL": "1m",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+
+					Shadow: &BackendConfig{
+						Type:                "csv",
+						CSVPath:             "data/commercial.csv",
+						DatasetSHA256:       "https://artifacts.example.com/commercial.csv.sha256",
+						DatasetPollInterval: time.Minute,
+					},
+					ShadowSampleRate: 0.25,
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Canary configuration",
+			envVars: map[string]string{
+				"CANARY_DB_TYPE":       "csv",
+				"CANARY_CSV_DATA_PATH": "data/next.csv",
+				"CANARY_CSV_LENIENT":   "true",
+				"CANARY_PERCENT":       "12.5",
+			},
+			expectedConfig: &Config{
+				IP2Country: BackendConfig{
+					Type:      "csv",
+					CSVPath:   "data/ip2country.csv",
+					MongoURI:  "mongodb://localhost:27017",
+					RedisAddr: "localhost:6379",
+
+					Canary:        &BackendConfig{Type: "csv", CSVPath: "data/next.csv", CSVLenient: true, DatasetPollInterval: 5 * time.Minute},
+					CanaryPercent: 12.5,
+				},
+				RateLimit:      100,
+				Port:           8080,
+				AllowedOrigins: []string{"http://localhost:3000"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid CANARY_PERCENT",
+			envVars: map[string]string{
+				"CANARY_PERCENT": "half",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid SHADOW_SAMPLE_RATE",
+			envVars: map[string]string{
+				"SHADOW_SAMPLE_RATE": "1.5",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid DATASET_HISTORY_SIZE",
+			envVars: map[string]string{
+				"DATASET_HISTORY_SIZE": "0",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid OVERRIDES_RELOAD_INTERVAL",
+			envVars: map[string]string{
+				"OVERRIDES_RELOAD_INTERVAL": "often",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid CSV_LENIENT",
+			envVars: map[string]string{
+				"CSV_LENIENT": "sometimes",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid SHADOW_CSV_LENIENT",
+			envVars: map[string]string{
+				"SHADOW_DB_TYPE":       "csv",
+				"SHADOW_CSV_DATA_PATH": "data/commercial.csv",
+				"SHADOW_CSV_LENIENT":   "sometimes",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Canary CSV backend without a path",
+			envVars: map[string]string{
+				"CANARY_DB_TYPE": "csv",
+				"CANARY_PERCENT": "10",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid DATASET_POLL_INTERVAL",
+			envVars: map[string]string{
+				"DATASET_POLL_INTERVAL": "hourly",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
 		{
 			name: "Invalid RATE_LIMIT",
 			envVars: map[string]string{
@@ -133,6 +605,79 @@ func TestLoad(t *testing.T) {
 			expectedConfig: nil,
 			expectError:    true,
 		},
+		{
+			name: "Invalid RATE_LIMIT_BURST",
+			envVars: map[string]string{
+				"RATE_LIMIT_BURST": "0",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid RATE_LIMIT_MAX_KEYS",
+			envVars: map[string]string{
+				"RATE_LIMIT_MAX_KEYS": "-1",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid RATE_LIMIT_KEY_IDLE_TIMEOUT",
+			envVars: map[string]string{
+				"RATE_LIMIT_KEY_IDLE_TIMEOUT": "0s",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid RATE_LIMIT_MAX_WAIT",
+			envVars: map[string]string{
+				"RATE_LIMIT_MAX_WAIT": "-1s",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid RATE_LIMIT_QUEUE_SIZE",
+			envVars: map[string]string{
+				"RATE_LIMIT_QUEUE_SIZE": "0",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid ADAPTIVE_CONCURRENCY",
+			envVars: map[string]string{
+				"ADAPTIVE_CONCURRENCY": "sometimes",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "ADAPTIVE_CONCURRENCY_MAX below the min",
+			envVars: map[string]string{
+				"ADAPTIVE_CONCURRENCY_MIN": "10",
+				"ADAPTIVE_CONCURRENCY_MAX": "5",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid RATE_LIMIT_REDIS_FAIL",
+			envVars: map[string]string{
+				"RATE_LIMIT_REDIS_FAIL": "sometimes",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
+		{
+			name: "Invalid QUOTA_SAVE_INTERVAL",
+			envVars: map[string]string{
+				"QUOTA_SAVE_INTERVAL": "often",
+			},
+			expectedConfig: nil,
+			expectError:    true,
+		},
 		{
 			name: "Invalid PORT",
 			envVars: map[string]string{
@@ -153,6 +698,50 @@ func TestLoad(t *testing.T) {
 			os.Unsetenv("MONGO_URI")
 			os.Unsetenv("REDIS_ADDR")
 			os.Unsetenv("ALLOWED_ORIGINS")
+			os.Unsetenv("ADMIN_TOKEN")
+			os.Unsetenv("OVERRIDES_PATH")
+			os.Unsetenv("DATASET_HISTORY_SIZE")
+			os.Unsetenv("SHADOW_DB_TYPE")
+			os.Unsetenv("SHADOW_CSV_DATA_PATH")
+			os.Unsetenv("SHADOW_SAMPLE_RATE")
+			os.Unsetenv("CANARY_DB_TYPE")
+			os.Unsetenv("CANARY_CSV_DATA_PATH")
+			os.Unsetenv("CANARY_PERCENT")
+			os.Unsetenv("OVERRIDES_RELOAD_INTERVAL")
+			os.Unsetenv("SNAPSHOT_PATH")
+			os.Unsetenv("CSV_DELIMITER")
+			os.Unsetenv("CSV_COLUMNS")
+			os.Unsetenv("CSV_LENIENT")
+			os.Unsetenv("CSV_ATTRIBUTES")
+			os.Unsetenv("DATASET_SHA256")
+			os.Unsetenv("DATASET_TRUSTED_KEYS")
+			os.Unsetenv("DATASET_POLL_INTERVAL")
+			os.Unsetenv("SHADOW_DATASET_SHA256")
+			os.Unsetenv("SHADOW_CSV_LENIENT")
+			os.Unsetenv("CANARY_CSV_LENIENT")
+			os.Unsetenv("RATE_LIMIT_ALGORITHM")
+			os.Unsetenv("RATE_LIMIT_BURST")
+			os.Unsetenv("RATE_LIMIT_KEY")
+			os.Unsetenv("RATE_LIMIT_KEY_RATE")
+			os.Unsetenv("RATE_LIMIT_KEY_BURST")
+			os.Unsetenv("RATE_LIMIT_MAX_KEYS")
+			os.Unsetenv("RATE_LIMIT_KEY_IDLE_TIMEOUT")
+			os.Unsetenv("ADAPTIVE_CONCURRENCY")
+			os.Unsetenv("ADAPTIVE_CONCURRENCY_INITIAL")
+			os.Unsetenv("ADAPTIVE_CONCURRENCY_MIN")
+			os.Unsetenv("ADAPTIVE_CONCURRENCY_MAX")
+			os.Unsetenv("RATE_LIMIT_MAX_WAIT")
+			os.Unsetenv("RATE_LIMIT_QUEUE_SIZE")
+			os.Unsetenv("RATE_LIMIT_POLICY_FILE")
+			os.Unsetenv("RATE_LIMIT_BACKEND")
+			os.Unsetenv("RATE_LIMIT_REDIS_ADDR")
+			os.Unsetenv("RATE_LIMIT_REDIS_PREFIX")
+			os.Unsetenv("RATE_LIMIT_REDIS_FAIL")
+			os.Unsetenv("RATE_LIMIT_REDIS_TIMEOUT")
+			os.Unsetenv("QUOTA_FILE")
+			os.Unsetenv("QUOTA_STORE")
+			os.Unsetenv("QUOTA_USAGE_PATH")
+			os.Unsetenv("QUOTA_SAVE_INTERVAL")
 
 			// Set environment variables for this test case
 			for k, v := range tc.envVars {
@@ -182,21 +771,144 @@ func TestLoad(t *testing.T) {
 			if config.IP2Country.CSVPath != tc.expectedConfig.IP2Country.CSVPath {
 				t.Errorf("IP2Country.CSVPath: expected %q, got %q", tc.expectedConfig.IP2Country.CSVPath, config.IP2Country.CSVPath)
 			}
+			if tc.expectedConfig.IP2Country.SnapshotPath != "" && config.IP2Country.SnapshotPath != tc.expectedConfig.IP2Country.SnapshotPath {
+				t.Errorf("IP2Country.SnapshotPath: expected %q, got %q", tc.expectedConfig.IP2Country.SnapshotPath, config.IP2Country.SnapshotPath)
+			}
+			if config.IP2Country.CSVDelimiter != tc.expectedConfig.IP2Country.CSVDelimiter {
+				t.Errorf("IP2Country.CSVDelimiter: expected %q, got %q", tc.expectedConfig.IP2Country.CSVDelimiter, config.IP2Country.CSVDelimiter)
+			}
+			if config.IP2Country.CSVColumns != tc.expectedConfig.IP2Country.CSVColumns {
+				t.Errorf("IP2Country.CSVColumns: expected %q, got %q", tc.expectedConfig.IP2Country.CSVColumns, config.IP2Country.CSVColumns)
+			}
+			if config.IP2Country.CSVLenient != tc.expectedConfig.IP2Country.CSVLenient {
+				t.Errorf("IP2Country.CSVLenient: expected %v, got %v", tc.expectedConfig.IP2Country.CSVLenient, config.IP2Country.CSVLenient)
+			}
+			if config.IP2Country.CSVAttributes != tc.expectedConfig.IP2Country.CSVAttributes {
+				t.Errorf("IP2Country.CSVAttributes: expected %q, got %q", tc.expectedConfig.IP2Country.CSVAttributes, config.IP2Country.CSVAttributes)
+			}
+			if config.IP2Country.TrustedKeys != tc.expectedConfig.IP2Country.TrustedKeys {
+				t.Errorf("IP2Country.TrustedKeys: expected %q, got %q", tc.expectedConfig.IP2Country.TrustedKeys, config.IP2Country.TrustedKeys)
+			}
+			if config.IP2Country.DatasetSHA256 != tc.expectedConfig.IP2Country.DatasetSHA256 {
+				t.Errorf("IP2Country.DatasetSHA256: expected %q, got %q", tc.expectedConfig.IP2Country.DatasetSHA256, config.IP2Country.DatasetSHA256)
+			}
+			if tc.expectedConfig.IP2Country.DatasetPollInterval != 0 && config.IP2Country.DatasetPollInterval != tc.expectedConfig.IP2Country.DatasetPollInterval {
+				t.Errorf("IP2Country.DatasetPollInterval: expected %v, got %v", tc.expectedConfig.IP2Country.DatasetPollInterval, config.IP2Country.DatasetPollInterval)
+			}
 			if config.IP2Country.MongoURI != tc.expectedConfig.IP2Country.MongoURI {
 				t.Errorf("IP2Country.MongoURI: expected %q, got %q", tc.expectedConfig.IP2Country.MongoURI, config.IP2Country.MongoURI)
 			}
 			if config.IP2Country.RedisAddr != tc.expectedConfig.IP2Country.RedisAddr {
 				t.Errorf("IP2Country.RedisAddr: expected %q, got %q", tc.expectedConfig.IP2Country.RedisAddr, config.IP2Country.RedisAddr)
 			}
+			if tc.expectedConfig.IP2Country.HistorySize != 0 && config.IP2Country.HistorySize != tc.expectedConfig.IP2Country.HistorySize {
+				t.Errorf("IP2Country.HistorySize: expected %d, got %d", tc.expectedConfig.IP2Country.HistorySize, config.IP2Country.HistorySize)
+			}
+			if config.IP2Country.OverridesPath != tc.expectedConfig.IP2Country.OverridesPath {
+				t.Errorf("IP2Country.OverridesPath: expected %q, got %q", tc.expectedConfig.IP2Country.OverridesPath, config.IP2Country.OverridesPath)
+			}
+			if tc.expectedConfig.IP2Country.OverridesReloadInterval != 0 && config.IP2Country.OverridesReloadInterval != tc.expectedConfig.IP2Country.OverridesReloadInterval {
+				t.Errorf("IP2Country.OverridesReloadInterval: expected %v, got %v", tc.expectedConfig.IP2Country.OverridesReloadInterval, config.IP2Country.OverridesReloadInterval)
+			}
+			if !reflect.DeepEqual(config.IP2Country.Shadow, tc.expectedConfig.IP2Country.Shadow) {
+				t.Errorf("IP2Country.Shadow: expected %+v, got %+v", tc.expectedConfig.IP2Country.Shadow, config.IP2Country.Shadow)
+			}
+			if tc.expectedConfig.IP2Country.ShadowSampleRate != 0 && config.IP2Country.ShadowSampleRate != tc.expectedConfig.IP2Country.ShadowSampleRate {
+				t.Errorf("IP2Country.ShadowSampleRate: expected %v, got %v", tc.expectedConfig.IP2Country.ShadowSampleRate, config.IP2Country.ShadowSampleRate)
+			}
+			if !reflect.DeepEqual(config.IP2Country.Canary, tc.expectedConfig.IP2Country.Canary) {
+				t.Errorf("IP2Country.Canary: expected %+v, got %+v", tc.expectedConfig.IP2Country.Canary, config.IP2Country.Canary)
+			}
+			if config.IP2Country.CanaryPercent != tc.expectedConfig.IP2Country.CanaryPercent {
+				t.Errorf("IP2Country.CanaryPercent: expected %v, got %v", tc.expectedConfig.IP2Country.CanaryPercent, config.IP2Country.CanaryPercent)
+			}
 			if config.RateLimit != tc.expectedConfig.RateLimit {
 				t.Errorf("RateLimit: expected %d, got %d", tc.expectedConfig.RateLimit, config.RateLimit)
 			}
+			if tc.expectedConfig.RateLimitAlgorithm != "" && config.RateLimitAlgorithm != tc.expectedConfig.RateLimitAlgorithm {
+				t.Errorf("RateLimitAlgorithm: expected %q, got %q", tc.expectedConfig.RateLimitAlgorithm, config.RateLimitAlgorithm)
+			}
+			if tc.expectedConfig.RateLimitBurst != 0 && config.RateLimitBurst != tc.expectedConfig.RateLimitBurst {
+				t.Errorf("RateLimitBurst: expected %d, got %d", tc.expectedConfig.RateLimitBurst, config.RateLimitBurst)
+			}
+			if config.RateLimitKey != tc.expectedConfig.RateLimitKey {
+				t.Errorf("RateLimitKey: expected %q, got %q", tc.expectedConfig.RateLimitKey, config.RateLimitKey)
+			}
+			if tc.expectedConfig.RateLimitKeyRate != 0 && config.RateLimitKeyRate != tc.expectedConfig.RateLimitKeyRate {
+				t.Errorf("RateLimitKeyRate: expected %d, got %d", tc.expectedConfig.RateLimitKeyRate, config.RateLimitKeyRate)
+			}
+			if tc.expectedConfig.RateLimitKeyBurst != 0 && config.RateLimitKeyBurst != tc.expectedConfig.RateLimitKeyBurst {
+				t.Errorf("RateLimitKeyBurst: expected %d, got %d", tc.expectedConfig.RateLimitKeyBurst, config.RateLimitKeyBurst)
+			}
+			if tc.expectedConfig.RateLimitMaxKeys != 0 && config.RateLimitMaxKeys != tc.expectedConfig.RateLimitMaxKeys {
+				t.Errorf("RateLimitMaxKeys: expected %d, got %d", tc.expectedConfig.RateLimitMaxKeys, config.RateLimitMaxKeys)
+			}
+			if tc.expectedConfig.RateLimitKeyIdleTimeout != 0 && config.RateLimitKeyIdleTimeout != tc.expectedConfig.RateLimitKeyIdleTimeout {
+				t.Errorf("RateLimitKeyIdleTimeout: expected %v, got %v", tc.expectedConfig.RateLimitKeyIdleTimeout, config.RateLimitKeyIdleTimeout)
+			}
+			if config.AdaptiveConcurrency != tc.expectedConfig.AdaptiveConcurrency {
+				t.Errorf("AdaptiveConcurrency: expected %v, got %v", tc.expectedConfig.AdaptiveConcurrency, config.AdaptiveConcurrency)
+			}
+			if tc.expectedConfig.AdaptiveConcurrency {
+				if config.AdaptiveConcurrencyInitial != tc.expectedConfig.AdaptiveConcurrencyInitial {
+					t.Errorf("AdaptiveConcurrencyInitial: expected %d, got %d", tc.expectedConfig.AdaptiveConcurrencyInitial, config.AdaptiveConcurrencyInitial)
+				}
+				if config.AdaptiveConcurrencyMin != tc.expectedConfig.AdaptiveConcurrencyMin {
+					t.Errorf("AdaptiveConcurrencyMin: expected %d, got %d", tc.expectedConfig.AdaptiveConcurrencyMin, config.AdaptiveConcurrencyMin)
+				}
+				if config.AdaptiveConcurrencyMax != tc.expectedConfig.AdaptiveConcurrencyMax {
+					t.Errorf("AdaptiveConcurrencyMax: expected %d, got %d", tc.expectedConfig.AdaptiveConcurrencyMax, config.AdaptiveConcurrencyMax)
+				}
+			}
+			if config.RateLimitMaxWait != tc.expectedConfig.RateLimitMaxWait {
+				t.Errorf("RateLimitMaxWait: expected %v, got %v", tc.expectedConfig.RateLimitMaxWait, config.RateLimitMaxWait)
+			}
+			if tc.expectedConfig.RateLimitQueueSize != 0 && config.RateLimitQueueSize != tc.expectedConfig.RateLimitQueueSize {
+				t.Errorf("RateLimitQueueSize: expected %d, got %d", tc.expectedConfig.RateLimitQueueSize, config.RateLimitQueueSize)
+			}
+			if config.RateLimitPolicyFile != tc.expectedConfig.RateLimitPolicyFile {
+				t.Errorf("RateLimitPolicyFile: expected %q, got %q", tc.expectedConfig.RateLimitPolicyFile, config.RateLimitPolicyFile)
+			}
+			if tc.expectedConfig.RateLimitBackend != "" {
+				if config.RateLimitBackend != tc.expectedConfig.RateLimitBackend {
+					t.Errorf("RateLimitBackend: expected %q, got %q", tc.expectedConfig.RateLimitBackend, config.RateLimitBackend)
+				}
+				if config.RateLimitRedisAddr != tc.expectedConfig.RateLimitRedisAddr {
+					t.Errorf("RateLimitRedisAddr: expected %q, got %q", tc.expectedConfig.RateLimitRedisAddr, config.RateLimitRedisAddr)
+				}
+				if config.RateLimitRedisPrefix != tc.expectedConfig.RateLimitRedisPrefix {
+					t.Errorf("RateLimitRedisPrefix: expected %q, got %q", tc.expectedConfig.RateLimitRedisPrefix, config.RateLimitRedisPrefix)
+				}
+				if config.RateLimitRedisFailOpen != tc.expectedConfig.RateLimitRedisFailOpen {
+					t.Errorf("RateLimitRedisFailOpen: expected %v, got %v", tc.expectedConfig.RateLimitRedisFailOpen, config.RateLimitRedisFailOpen)
+				}
+				if config.RateLimitRedisTimeout != tc.expectedConfig.RateLimitRedisTimeout {
+					t.Errorf("RateLimitRedisTimeout: expected %v, got %v", tc.expectedConfig.RateLimitRedisTimeout, config.RateLimitRedisTimeout)
+				}
+			}
+			if config.QuotaFile != tc.expectedConfig.QuotaFile {
+				t.Errorf("QuotaFile: expected %q, got %q", tc.expectedConfig.QuotaFile, config.QuotaFile)
+			}
+			if tc.expectedConfig.QuotaStore != "" {
+				if config.QuotaStore != tc.expectedConfig.QuotaStore {
+					t.Errorf("QuotaStore: expected %q, got %q", tc.expectedConfig.QuotaStore, config.QuotaStore)
+				}
+				if config.QuotaUsagePath != tc.expectedConfig.QuotaUsagePath {
+					t.Errorf("QuotaUsagePath: expected %q, got %q", tc.expectedConfig.QuotaUsagePath, config.QuotaUsagePath)
+				}
+				if config.QuotaSaveInterval != tc.expectedConfig.QuotaSaveInterval {
+					t.Errorf("QuotaSaveInterval: expected %v, got %v", tc.expectedConfig.QuotaSaveInterval, config.QuotaSaveInterval)
+				}
+			}
 			if config.Port != tc.expectedConfig.Port {
 				t.Errorf("Port: expected %d, got %d", tc.expectedConfig.Port, config.Port)
 			}
 			if !reflect.DeepEqual(config.AllowedOrigins, tc.expectedConfig.AllowedOrigins) {
 				t.Errorf("AllowedOrigins: expected %v, got %v", tc.expectedConfig.AllowedOrigins, config.AllowedOrigins)
 			}
+			if config.AdminToken != tc.expectedConfig.AdminToken {
+				t.Errorf("AdminToken: expected %q, got %q", tc.expectedConfig.AdminToken, config.AdminToken)
+			}
 		})
 	}
 }
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"ip2country-api/internal/ip2country"
+	"ip2country-api/internal/utils"
+)
+
+// recordResponse is the JSON representation of a dataset record
+type recordResponse struct {
+	CIDR       string                `json:"cidr"`
+	Country    string                `json:"country"`
+	City       string                `json:"city"`
+	Attributes ip2country.Attributes `json:"attributes,omitzero"`
+}
+
+// PutRecordHandler creates an HTTP handler function that adds or replaces the
+// record for the CIDR in the request path
+func PutRecordHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writable, ok := ip2country.As[ip2country.WritableService](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not support record updates"})
+			return
+		}
+
+		prefix, err := ip2country.ParsePrefix(r.PathValue("cidr"))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid CIDR"})
+			return
+		}
+
+		var body ip2country.Result
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		body.Country = strings.TrimSpace(body.Country)
+		body.City = strings.TrimSpace(body.City)
+		if body.Country == "" {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing 'country' field"})
+			return
+		}
+
+		if err := writable.PutRecord(prefix, body); err != nil {
+			if errors.Is(err, ip2country.ErrReadOnly) {
+				utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not support record updates"})
+				return
+			}
+			log.Printf("admin: failed to put record %s: %v", prefix, err)
+			utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to update record"})
+			return
+		}
+		log.Printf("admin: %s set %s to %q/%q", r.RemoteAddr, prefix, body.Country, body.City)
+
+		utils.WriteJSON(w, http.StatusOK, recordResponse{CIDR: prefix.String(), Country: body.Country, City: body.City, Attributes: body.Attributes})
+	}
+}
+
+// DeleteRecordHandler creates an HTTP handler function that removes the record
+// for the CIDR in the request path
+func DeleteRecordHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writable, ok := ip2country.As[ip2country.WritableService](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not support record updates"})
+			return
+		}
+
+		prefix, err := ip2country.ParsePrefix(r.PathValue("cidr"))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid CIDR"})
+			return
+		}
+
+		if err := writable.DeleteRecord(prefix); err != nil {
+			if errors.Is(err, ip2country.ErrRecordNotFound) {
+				utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "Record not found"})
+				return
+			}
+			if errors.Is(err, ip2country.ErrReadOnly) {
+				utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not support record updates"})
+				return
+			}
+			log.Printf("admin: failed to delete record %s: %v", prefix, err)
+			utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to delete record"})
+			return
+		}
+		log.Printf("admin: %s deleted %s", r.RemoteAddr, prefix)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SnapshotsHandler creates an HTTP handler function that lists the dataset
+// versions kept in memory for rollback
+func SnapshotsHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versioned, ok := ip2country.As[ip2country.VersionedService](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not keep dataset versions"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, map[string]any{"snapshots": versioned.Snapshots()})
+	}
+}
+
+// RollbackHandler creates an HTTP handler function that makes the dataset
+// version in the request path the active one
+func RollbackHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versioned, ok := ip2country.As[ip2country.VersionedService](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not keep dataset versions"})
+			return
+		}
+
+		version := r.PathValue("version")
+		if err := versioned.Rollback(version); err != nil {
+			if errors.Is(err, ip2country.ErrVersionNotFound) {
+				utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "Dataset version not found"})
+				return
+			}
+			// Switching a CSV dataset rewrites its file, which signed,
+			// compressed and built-in datasets never are
+			if errors.Is(err, ip2country.ErrReadOnly) {
+				utils.WriteJSON(w, http.StatusNotImplemented, map[string]string{"error": "Backend does not support record updates"})
+				return
+			}
+			log.Printf("admin: failed to roll back to %s: %v", version, err)
+			utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to switch dataset version"})
+			return
+		}
+		log.Printf("admin: %s switched active dataset to %s", r.RemoteAddr, version)
+
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"active": version})
+	}
+}
+
+// ShadowSummaryHandler creates an HTTP handler function that reports how often
+// the shadow backend disagreed with the primary one
+func ShadowSummaryHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reporter, ok := ip2country.As[ip2country.ShadowReporter](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "No shadow backend configured"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, reporter.Summary())
+	}
+}
+
+// CanaryStatsHandler creates an HTTP handler function that reports how lookups
+// are split between the stable and candidate backends
+func CanaryStatsHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		router, ok := ip2country.As[ip2country.CanaryRouter](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "No canary backend configured"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, router.Stats())
+	}
+}
+
+// SetCanaryPercentHandler creates an HTTP handler function that changes the
+// percentage of lookups routed to the candidate backend
+func SetCanaryPercentHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		router, ok := ip2country.As[ip2country.CanaryRouter](ip2countryService)
+		if !ok {
+			utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "No canary backend configured"})
+			return
+		}
+
+		var body struct {
+			Percent *float64 `json:"percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Percent == nil {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		if err := router.SetPercent(*body.Percent); err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Percent must be between 0 and 100"})
+			return
+		}
+		log.Printf("admin: %s set canary percent to %v", r.RemoteAddr, *body.Percent)
+
+		utils.WriteJSON(w, http.StatusOK, router.Stats())
+	}
+}
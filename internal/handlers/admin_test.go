@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"ip2country-api/internal/ip2country"
+)
+
+// MockWritableService is a mock implementation of ip2country.WritableService
+type MockWritableService struct {
+	MockService
+	records map[netip.Prefix]ip2country.Result
+}
+
+func (m *MockWritableService) PutRecord(prefix netip.Prefix, result ip2country.Result) error {
+	m.records[prefix] = result
+	return nil
+}
+
+func (m *MockWritableService) DeleteRecord(prefix netip.Prefix) error {
+	if _, found := m.records[prefix]; !found {
+		return ip2country.ErrRecordNotFound
+	}
+	delete(m.records, prefix)
+	return nil
+}
+
+func TestRecordHandlers(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	service := &MockWritableService{records: map[netip.Prefix]ip2country.Result{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /v1/admin/records/{cidr...}", PutRecordHandler(service))
+	mux.HandleFunc("DELETE /v1/admin/records/{cidr...}", DeleteRecordHandler(service))
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "put range", method: "PUT", path: "/v1/admin/records/10.0.0.0/8", body: `{"country":"Israel","city":"Tel Aviv"}`, expectedStatus: http.StatusOK},
+		{name: "put single ip", method: "PUT", path: "/v1/admin/records/2001:db8::1", body: `{"country":"France"}`, expectedStatus: http.StatusOK},
+		{name: "put invalid cidr", method: "PUT", path: "/v1/admin/records/10.0.0.0/99", body: `{"country":"Israel"}`, expectedStatus: http.StatusBadRequest},
+		{name: "put missing country", method: "PUT", path: "/v1/admin/records/10.0.0.0/8", body: `{"city":"Tel Aviv"}`, expectedStatus: http.StatusBadRequest},
+		{name: "put invalid body", method: "PUT", path: "/v1/admin/records/10.0.0.0/8", body: `not json`, expectedStatus: http.StatusBadRequest},
+		{name: "delete existing", method: "DELETE", path: "/v1/admin/records/10.0.0.0/8", expectedStatus: http.StatusNoContent},
+		{name: "delete missing", method: "DELETE", path: "/v1/admin/records/10.0.0.0/8", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			mux.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+		})
+	}
+
+	if result := service.records[netip.MustParsePrefix("2001:db8::1/128")]; result.Country != "France" {
+		t.Errorf("expected 2001:db8::1 to be stored as France, got %+v", result)
+	}
+}
+
+// MockVersionedService is a mock implementation of ip2country.VersionedService
+type MockVersionedService struct {
+	MockService
+	active string
+}
+
+func (m *MockVersionedService) Snapshots() []ip2country.Snapshot {
+	return []ip2country.Snapshot{
+		{DatasetInfo: ip2country.DatasetInfo{Version: "v2"}, Active: m.active == "v2"},
+		{DatasetInfo: ip2country.DatasetInfo{Version: "v1"}, Active: m.active == "v1"},
+	}
+}
+
+func (m *MockVersionedService) Rollback(version string) error {
+	if version == "read-only" {
+		return ip2country.ErrReadOnly
+	}
+	if version != "v1" && version != "v2" {
+		return ip2country.ErrVersionNotFound
+	}
+	m.active = version
+	return nil
+}
+
+func TestSnapshotHandlers(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	service := &MockVersionedService{active: "v2"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/admin/snapshots", SnapshotsHandler(service))
+	mux.HandleFunc("POST /v1/admin/snapshots/{version}/activate", RollbackHandler(service))
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{name: "list snapshots", method: "GET", path: "/v1/admin/snapshots", expectedStatus: http.StatusOK},
+		{name: "rollback", method: "POST", path: "/v1/admin/snapshots/v1/activate", expectedStatus: http.StatusOK},
+		{name: "rollback to unknown version", method: "POST", path: "/v1/admin/snapshots/v9/activate", expectedStatus: http.StatusNotFound},
+		{name: "rollback of a read-only dataset", method: "POST", path: "/v1/admin/snapshots/read-only/activate", expectedStatus: http.StatusNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			mux.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+		})
+	}
+
+	if service.active != "v1" {
+		t.Errorf("expected v1 to be active, got %s", service.active)
+	}
+
+	// Snapshots are not available on backends that do not keep versions
+	req, err := http.NewRequest("GET", "/v1/admin/snapshots", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	SnapshotsHandler(&MockService{}).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotImplemented {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotImplemented)
+	}
+}
+
+// MockShadowService is a mock implementation of ip2country.ShadowReporter
+type MockShadowService struct {
+	MockService
+}
+
+func (m *MockShadowService) Summary() ip2country.ShadowSummary {
+	return ip2country.ShadowSummary{
+		SampleRate: 0.1,
+		Countries:  map[string]ip2country.ShadowStats{"France": {Compared: 4, Disagreements: 1, DisagreementRate: 0.25}},
+	}
+}
+
+func TestShadowSummaryHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		service        ip2country.Service
+		expectedStatus int
+	}{
+		{name: "shadow configured", service: &MockShadowService{}, expectedStatus: http.StatusOK},
+		{name: "no shadow", service: &MockService{}, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/v1/admin/shadow", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			ShadowSummaryHandler(tt.service).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var summary ip2country.ShadowSummary
+			if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+				t.Fatalf("could not parse response body: %v", err)
+			}
+			if summary.Countries["France"].DisagreementRate != 0.25 {
+				t.Errorf("unexpected summary: %+v", summary)
+			}
+		})
+	}
+}
+
+// MockCanaryService is a mock implementation of ip2country.CanaryRouter
+type MockCanaryService struct {
+	MockService
+	percent float64
+}
+
+func (m *MockCanaryService) Stats() ip2country.CanaryStats {
+	return ip2country.CanaryStats{Percent: m.percent}
+}
+
+func (m *MockCanaryService) SetPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid percent")
+	}
+	m.percent = percent
+	return nil
+}
+
+func TestCanaryHandlers(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	service := &MockCanaryService{percent: 5}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/admin/canary", CanaryStatsHandler(service))
+	mux.HandleFunc("PUT /v1/admin/canary", SetCanaryPercentHandler(service))
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{name: "stats", method: "GET", expectedStatus: http.StatusOK},
+		{name: "set percent", method: "PUT", body: `{"percent":25}`, expectedStatus: http.StatusOK},
+		{name: "percent out of range", method: "PUT", body: `{"percent":250}`, expectedStatus: http.StatusBadRequest},
+		{name: "missing percent", method: "PUT", body: `{}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/v1/admin/canary", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			mux.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+		})
+	}
+
+	if service.percent != 25 {
+		t.Errorf("expected percent 25, got %v", service.percent)
+	}
+
+	// Without a canary the endpoints report it as not configured
+	req, err := http.NewRequest("GET", "/v1/admin/canary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	CanaryStatsHandler(&MockService{}).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestRecordHandlersReadOnlyBackend(t *testing.T) {
+	req, err := http.NewRequest("PUT", "/v1/admin/records/10.0.0.0/8", strings.NewReader(`{"country":"Israel"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetPathValue("cidr", "10.0.0.0/8")
+	rr := httptest.NewRecorder()
+
+	PutRecordHandler(&MockService{}).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotImplemented {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotImplemented)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("could not parse response body: %v", err)
+	}
+	if response["error"] == "" {
+		t.Error("expected an error message")
+	}
+}
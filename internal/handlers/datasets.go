@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"net/http"
+
+	"ip2country-api/internal/ip2country"
+	"ip2country-api/internal/utils"
+)
+
+// DatasetsHandler creates an HTTP handler function that reports metadata about
+// every dataset loaded by the IP-to-country service
+func DatasetsHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		datasets := []ip2country.DatasetInfo{}
+		if provider, ok := ip2countryService.(ip2country.MetadataProvider); ok {
+			datasets = append(datasets, provider.Datasets()...)
+		}
+
+		utils.WriteJSON(w, http.StatusOK, map[string]any{"datasets": datasets})
+	}
+}
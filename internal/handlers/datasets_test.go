@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ip2country-api/internal/ip2country"
+)
+
+// MockMetadataService is a mock service that also implements ip2country.MetadataProvider
+type MockMetadataService struct {
+	MockService
+	DatasetsFunc func() []ip2country.DatasetInfo
+}
+
+func (m *MockMetadataService) Datasets() []ip2country.DatasetInfo {
+	return m.DatasetsFunc()
+}
+
+func TestDatasetsHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		service       ip2country.Service
+		expectedCount int
+	}{
+		{
+			name: "service with metadata",
+			service: &MockMetadataService{
+				DatasetsFunc: func() []ip2country.DatasetInfo {
+					return []ip2country.DatasetInfo{{Type: "csv", Source: "data/ip2country.csv", Records: 5, Version: "sha256-abc"}}
+				},
+			},
+			expectedCount: 1,
+		},
+		{
+			name:          "service without metadata",
+			service:       &MockService{},
+			expectedCount: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/v1/datasets", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+
+			DatasetsHandler(tt.service).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+			}
+
+			var response struct {
+				Datasets []ip2country.DatasetInfo `json:"datasets"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("could not parse response body: %v", err)
+			}
+			if len(response.Datasets) != tt.expectedCount {
+				t.Errorf("expected %d datasets, got %d", tt.expectedCount, len(response.Datasets))
+			}
+		})
+	}
+}
@@ -2,12 +2,17 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 
 	"ip2country-api/internal/ip2country"
 	"ip2country-api/internal/utils"
 )
 
+// DatasetVersionHeader carries the version of the dataset that answered a lookup
+const DatasetVersionHeader = "X-Dataset-Version"
+
 // FindCountryHandler creates an HTTP handler function for the find-country endpoint
 func FindCountryHandler(ip2countryService ip2country.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -18,23 +23,106 @@ func FindCountryHandler(ip2countryService ip2country.Service) http.HandlerFunc {
 			return
 		}
 
-		// Look up IP information
-		result, err := ip2countryService.LookupIP(ip)
+		// Look up IP information on behalf of the client, whom a canary
+		// routes by
+		result, err := ip2country.LookupIPFor(ip2countryService, clientAddr(r), ip)
+		if err == nil && result == nil {
+			err = ip2country.ErrIPNotFound
+		}
 		if err != nil {
 			// Handle specific error cases
 			switch {
 			case errors.Is(err, ip2country.ErrInvalidIP):
 				utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid IP address"})
 			case errors.Is(err, ip2country.ErrIPNotFound):
+				// Tell the caller which dataset has no record for the address
+				var notFound *ip2country.NotFoundError
+				if errors.As(err, &notFound) && notFound.DatasetVersion != "" {
+					w.Header().Set(DatasetVersionHeader, notFound.DatasetVersion)
+				}
 				utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "IP address not found"})
+			case errors.Is(err, ip2country.ErrOverloaded):
+				// The limit adapts within a few lookups, so clients are asked
+				// to retry after a second
+				w.Header().Set("Retry-After", "1")
+				utils.WriteJSON(w, http.StatusServiceUnavailable, map[string]any{"error": "Service overloaded", "retry_after": 1})
 			default:
 				utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to look up IP information"})
 			}
 			return
 		}
 
+		// Tell the caller which dataset answered the lookup
+		if result.DatasetVersion != "" {
+			w.Header().Set(DatasetVersionHeader, result.DatasetVersion)
+		}
+
 		// Return JSON response
 		utils.WriteJSON(w, http.StatusOK, result)
 
 	}
 }
+
+// MaxBatchSize is the number of addresses a batch lookup accepts
+const MaxBatchSize = 1000
+
+// BatchResult is the answer for one address of a batch lookup: the fields of
+// its Result, or an error when the address is invalid or has no record
+type BatchResult struct {
+	IP string `json:"ip"`
+	*ip2country.Result
+	Error string `json:"error,omitempty"`
+}
+
+// FindCountriesHandler creates an HTTP handler function for the batch
+// find-countries endpoint, which looks up every value of the ip query
+// parameter, repeated or comma separated. Invalid and unknown addresses get
+// an error of their own rather than failing the batch.
+func FindCountriesHandler(ip2countryService ip2country.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ips := utils.QueryList(r, "ip")
+		if len(ips) == 0 {
+			utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Missing 'ip' parameter"})
+			return
+		}
+		if len(ips) > MaxBatchSize {
+			utils.WriteJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("At most %d addresses per batch", MaxBatchSize)})
+			return
+		}
+
+		client := clientAddr(r)
+		results := make([]BatchResult, 0, len(ips))
+		for _, ip := range ips {
+			result, err := ip2country.LookupIPFor(ip2countryService, client, ip)
+			if err == nil && result == nil {
+				err = ip2country.ErrIPNotFound
+			}
+			switch {
+			case err == nil:
+				results = append(results, BatchResult{IP: ip, Result: result})
+			case errors.Is(err, ip2country.ErrInvalidIP):
+				results = append(results, BatchResult{IP: ip, Error: "Invalid IP address"})
+			case errors.Is(err, ip2country.ErrIPNotFound):
+				results = append(results, BatchResult{IP: ip, Error: "IP address not found"})
+			case errors.Is(err, ip2country.ErrOverloaded):
+				w.Header().Set("Retry-After", "1")
+				utils.WriteJSON(w, http.StatusServiceUnavailable, map[string]any{"error": "Service overloaded", "retry_after": 1})
+				return
+			default:
+				utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to look up IP information"})
+				return
+			}
+		}
+		utils.WriteJSON(w, http.StatusOK, map[string]any{"results": results})
+	}
+}
+
+// clientAddr returns the address of the client of r, whom a canary routes
+// lookups by
+func clientAddr(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return client
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"ip2country-api/internal/ip2country"
@@ -20,7 +21,12 @@ func (m *MockService) LookupIP(ip string) (*ip2country.Result, error) {
 }
 
 func TestFindCountryHandler(t *testing.T) {
-	successfulLookup := &ip2country.Result{Country: "US", City: "New York"}
+	successfulLookup := &ip2country.Result{
+		Country:        "US",
+		City:           "New York",
+		Attributes:     ip2country.NewAttributes(map[string]string{"region": "NY", "isp": "Example ISP"}),
+		DatasetVersion: "sha256-0123456789ab",
+	}
 
 	tests := []struct {
 		name            string
@@ -28,6 +34,7 @@ func TestFindCountryHandler(t *testing.T) {
 		mockLookupIP    func(ip string) (*ip2country.Result, error)
 		expectedStatus  int
 		expectedMessage string
+		expectedVersion string
 	}{
 		{
 			name: "successful lookup",
@@ -64,6 +71,34 @@ func TestFindCountryHandler(t *testing.T) {
 			expectedStatus:  http.StatusNotFound,
 			expectedMessage: "IP address not found",
 		},
+		{
+			name: "ip not found in versioned dataset",
+			ip:   "10.0.0.1",
+			mockLookupIP: func(ip string) (*ip2country.Result, error) {
+				return nil, &ip2country.NotFoundError{DatasetVersion: "sha256-0123456789ab"}
+			},
+			expectedStatus:  http.StatusNotFound,
+			expectedMessage: "IP address not found",
+			expectedVersion: "sha256-0123456789ab",
+		},
+		{
+			name: "backend without a result",
+			ip:   "10.0.0.1",
+			mockLookupIP: func(ip string) (*ip2country.Result, error) {
+				return nil, nil
+			},
+			expectedStatus:  http.StatusNotFound,
+			expectedMessage: "IP address not found",
+		},
+		{
+			name: "backend overloaded",
+			ip:   "192.168.1.1",
+			mockLookupIP: func(ip string) (*ip2country.Result, error) {
+				return nil, ip2country.ErrOverloaded
+			},
+			expectedStatus:  http.StatusServiceUnavailable,
+			expectedMessage: "Service overloaded",
+		},
 		{
 			name: "server error",
 			ip:   "192.168.1.1",
@@ -113,22 +148,88 @@ func TestFindCountryHandler(t *testing.T) {
 				if err != nil {
 					t.Errorf("could not parse success response: %v", err)
 				}
-				if result.Country != successfulLookup.Country || result.City != successfulLookup.City {
+				if result.Country != successfulLookup.Country || result.City != successfulLookup.City || result.Attributes != successfulLookup.Attributes {
 					t.Errorf("unexpected result: got %+v", result)
 				}
+				if version := rr.Header().Get(DatasetVersionHeader); version != successfulLookup.DatasetVersion {
+					t.Errorf("expected %s header %q, got %q", DatasetVersionHeader, successfulLookup.DatasetVersion, version)
+				}
+			}
+
+			if tt.expectedStatus != http.StatusOK {
+				if version := rr.Header().Get(DatasetVersionHeader); version != tt.expectedVersion {
+					t.Errorf("expected %s header %q, got %q", DatasetVersionHeader, tt.expectedVersion, version)
+				}
 			}
 
 			// Check response message if expected
 			if tt.expectedMessage != "" {
-				var response map[string]string
+				var response map[string]any
 				err := json.Unmarshal(rr.Body.Bytes(), &response)
 				if err != nil {
 					t.Errorf("could not parse response body: %v", err)
 				}
 				if msg, exists := response["error"]; !exists || msg != tt.expectedMessage {
-					t.Errorf("expected error message %q, got %q", tt.expectedMessage, msg)
+					t.Errorf("expected error message %q, got %v", tt.expectedMessage, msg)
 				}
 			}
+			if tt.expectedStatus == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "1" {
+				t.Errorf("expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+			}
 		})
 	}
 }
+
+func TestFindCountriesHandler(t *testing.T) {
+	mockService := &MockService{
+		LookupIPFunc: func(ip string) (*ip2country.Result, error) {
+			switch ip {
+			case "1.1.1.1":
+				return &ip2country.Result{Country: "Australia", City: "Sydney"}, nil
+			case "10.0.0.1":
+				return nil, ip2country.ErrIPNotFound
+			case "overloaded":
+				return nil, ip2country.ErrOverloaded
+			default:
+				return nil, ip2country.ErrInvalidIP
+			}
+		},
+	}
+	handler := FindCountriesHandler(mockService)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/find-countries?ip=1.1.1.1,10.0.0.1&ip=invalid", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("batch lookup = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var response struct {
+		Results []map[string]string `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("could not parse response body: %v", err)
+	}
+	expected := []map[string]string{
+		{"ip": "1.1.1.1", "country": "Australia", "city": "Sydney"},
+		{"ip": "10.0.0.1", "error": "IP address not found"},
+		{"ip": "invalid", "error": "Invalid IP address"},
+	}
+	if fmt.Sprint(response.Results) != fmt.Sprint(expected) {
+		t.Errorf("results = %v, want %v", response.Results, expected)
+	}
+
+	tests := []struct {
+		target         string
+		expectedStatus int
+	}{
+		{target: "/v1/find-countries", expectedStatus: http.StatusBadRequest},
+		{target: "/v1/find-countries?ip=1.1.1.1,overloaded", expectedStatus: http.StatusServiceUnavailable},
+		{target: "/v1/find-countries?ip=" + strings.Repeat("1.1.1.1,", MaxBatchSize+1), expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", tc.target, nil))
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("GET %.60s = %d, want %d", tc.target, rr.Code, tc.expectedStatus)
+		}
+	}
+}
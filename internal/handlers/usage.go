@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"ip2country-api/internal/middleware"
+	"ip2country-api/internal/utils"
+	"ip2country-api/pkg/ratelimit"
+)
+
+// UsageReporter reports the plan and consumption of an API key
+type UsageReporter interface {
+	Usage(apiKey string) (ratelimit.Usage, error)
+}
+
+// periodUsageResponse is the JSON representation of the consumption of a
+// quota period. Limit and remaining are left out for periods without a cap.
+type periodUsageResponse struct {
+	Used      int64     `json:"used"`
+	Limit     *int64    `json:"limit,omitempty"`
+	Remaining *int64    `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// usageResponse is the JSON representation of the plan and consumption of an
+// API key
+type usageResponse struct {
+	Plan    string              `json:"plan"`
+	Owner   string              `json:"owner,omitempty"`
+	Rate    int                 `json:"rate"`
+	Burst   int                 `json:"burst"`
+	Daily   periodUsageResponse `json:"daily"`
+	Monthly periodUsageResponse `json:"monthly"`
+}
+
+func newPeriodUsageResponse(usage ratelimit.PeriodUsage) periodUsageResponse {
+	response := periodUsageResponse{Used: usage.Used, ResetsAt: usage.ResetsAt}
+	if usage.Limit > 0 {
+		remaining := max(0, usage.Limit-usage.Used)
+		response.Limit = &usage.Limit
+		response.Remaining = &remaining
+	}
+	return response
+}
+
+// UsageHandler creates an HTTP handler function that reports the plan and
+// consumption of the API key making the request. It does not count against
+// the quota.
+func UsageHandler(reporter UsageReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get(middleware.APIKeyHeader)
+		if apiKey == "" {
+			utils.WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "Missing API key"})
+			return
+		}
+
+		usage, err := reporter.Usage(apiKey)
+		if errors.Is(err, ratelimit.ErrUnknownAPIKey) {
+			utils.WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid API key"})
+			return
+		}
+		if err != nil {
+			log.Printf("usage: failed to read usage counts: %v", err)
+			utils.WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "Usage unavailable"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, usageResponse{
+			Plan:    usage.Plan.Name,
+			Owner:   usage.Owner,
+			Rate:    usage.Plan.Rate,
+			Burst:   usage.Plan.Burst,
+			Daily:   newPeriodUsageResponse(usage.Daily),
+			Monthly: newPeriodUsageResponse(usage.Monthly),
+		})
+	}
+}
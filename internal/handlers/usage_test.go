@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ip2country-api/internal/middleware"
+	"ip2country-api/pkg/ratelimit"
+)
+
+// MockUsageReporter is a mock implementation of the UsageReporter interface
+type MockUsageReporter struct {
+	UsageFunc func(apiKey string) (ratelimit.Usage, error)
+}
+
+func (m *MockUsageReporter) Usage(apiKey string) (ratelimit.Usage, error) {
+	return m.UsageFunc(apiKey)
+}
+
+func TestUsageHandler(t *testing.T) {
+	resetsAt := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	reporter := &MockUsageReporter{
+		UsageFunc: func(apiKey string) (ratelimit.Usage, error) {
+			switch apiKey {
+			case "partner-key":
+				return ratelimit.Usage{
+					Plan:    &ratelimit.QuotaPlan{Name: "partner", Rate: 50, Burst: 100, Daily: 1000},
+					Owner:   "search-team",
+					Daily:   ratelimit.PeriodUsage{Used: 1200, Limit: 1000, ResetsAt: resetsAt},
+					Monthly: ratelimit.PeriodUsage{Used: 5000, ResetsAt: resetsAt},
+				}, nil
+			case "broken-key":
+				return ratelimit.Usage{}, errors.New("connection refused")
+			default:
+				return ratelimit.Usage{}, ratelimit.ErrUnknownAPIKey
+			}
+		},
+	}
+
+	tests := []struct {
+		name           string
+		apiKey         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "known key",
+			apiKey:         "partner-key",
+			expectedStatus: http.StatusOK,
+			expectedBody: `{"plan":"partner","owner":"search-team","rate":50,"burst":100,` +
+				`"daily":{"used":1200,"limit":1000,"remaining":0,"resets_at":"2026-10-19T00:00:00Z"},` +
+				`"monthly":{"used":5000,"resets_at":"2026-10-19T00:00:00Z"}}`,
+		},
+		{name: "missing key", expectedStatus: http.StatusUnauthorized, expectedBody: `{"error":"Missing API key"}`},
+		{name: "unknown key", apiKey: "stolen-key", expectedStatus: http.StatusUnauthorized, expectedBody: `{"error":"Invalid API key"}`},
+		{name: "store unavailable", apiKey: "broken-key", expectedStatus: http.StatusServiceUnavailable, expectedBody: `{"error":"Usage unavailable"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/usage", nil)
+			if tt.apiKey != "" {
+				req.Header.Set(middleware.APIKeyHeader, tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+
+			UsageHandler(reporter).ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+			var got, want any
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("could not parse response body: %v", err)
+			}
+			json.Unmarshal([]byte(tt.expectedBody), &want)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("handler returned %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
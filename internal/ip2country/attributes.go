@@ -0,0 +1,152 @@
+package ip2country
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Attributes are extra columns of a dataset row, such as region or isp, that
+// are returned with lookup results. They are immutable and comparable, so
+// results carrying attributes can still be compared with == and used as map
+// keys. The zero value has no attributes.
+type Attributes struct {
+	// encoded holds "name\x00value\x00" pairs sorted by name
+	encoded string
+}
+
+// NewAttributes returns the attributes in values. Empty values are dropped.
+func NewAttributes(values map[string]string) Attributes {
+	names := slices.Sorted(maps.Keys(values))
+	ordered := make([]string, len(names))
+	for i, name := range names {
+		ordered[i] = values[name]
+	}
+	return encodeAttributes(names, ordered)
+}
+
+// encodeAttributes returns the attributes named by names, which must be sorted
+// and distinct, with the values at the same positions. Empty values are dropped.
+func encodeAttributes(names, values []string) Attributes {
+	var b strings.Builder
+	for i, name := range names {
+		if name == "" || values[i] == "" {
+			continue
+		}
+		b.WriteString(stripNUL(name))
+		b.WriteByte(0)
+		b.WriteString(stripNUL(values[i]))
+		b.WriteByte(0)
+	}
+	return Attributes{encoded: b.String()}
+}
+
+// stripNUL removes the separator of the encoding from s
+func stripNUL(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+// All iterates over the attributes sorted by name
+func (a Attributes) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		rest := a.encoded
+		for rest != "" {
+			name, after, _ := strings.Cut(rest, "\x00")
+			value, after, _ := strings.Cut(after, "\x00")
+			if !yield(name, value) {
+				return
+			}
+			rest = after
+		}
+	}
+}
+
+// Get returns the value of the named attribute
+func (a Attributes) Get(name string) (string, bool) {
+	for n, value := range a.All() {
+		if n == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Names returns the attribute names in sorted order
+func (a Attributes) Names() []string {
+	var names []string
+	for name := range a.All() {
+		names = append(names, name)
+	}
+	return names
+}
+
+// IsZero reports whether there are no attributes
+func (a Attributes) IsZero() bool {
+	return a.encoded == ""
+}
+
+// String formats the attributes as space separated name=value pairs
+func (a Attributes) String() string {
+	var pairs []string
+	for name, value := range a.All() {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// MarshalJSON encodes the attributes as a JSON object
+func (a Attributes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(maps.Collect(a.All()))
+}
+
+// UnmarshalJSON decodes a JSON object of string values
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*a = NewAttributes(values)
+	return nil
+}
+
+// ParseCSVAttributes parses a comma separated list of the extra columns to
+// expose as attributes. "*" selects every column that is not the ip, city or
+// country column.
+func ParseCSVAttributes(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("empty attribute name in %q", s)
+		case name == "*" && strings.TrimSpace(s) != "*":
+			return nil, fmt.Errorf("%q selects every column and cannot be combined with other names", "*")
+		case slices.ContainsFunc(names, func(other string) bool { return strings.EqualFold(other, name) }):
+			return nil, fmt.Errorf("duplicate attribute %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// attributeInterner shares the encoded attributes of rows that carry the same
+// ones, which is the common case for datasets with few distinct values
+type attributeInterner map[string]string
+
+// intern returns attributes backed by a shared copy of their encoding
+func (i attributeInterner) intern(attributes Attributes) Attributes {
+	if attributes.IsZero() {
+		return attributes
+	}
+	if shared, ok := i[attributes.encoded]; ok {
+		return Attributes{encoded: shared}
+	}
+	i[attributes.encoded] = attributes.encoded
+	return attributes
+}
@@ -0,0 +1,84 @@
+package ip2country
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	attributes := NewAttributes(map[string]string{"region": "NSW", "isp": "Cloudflare", "tags": ""})
+
+	if got := attributes.String(); got != "isp=Cloudflare region=NSW" {
+		t.Errorf("String() = %q, want sorted pairs without empty values", got)
+	}
+	if value, ok := attributes.Get("region"); !ok || value != "NSW" {
+		t.Errorf("Get(region) = %q, %v, want NSW", value, ok)
+	}
+	if _, ok := attributes.Get("tags"); ok {
+		t.Error("Get(tags) found an empty attribute")
+	}
+
+	// Attributes built in any order compare equal, so results stay comparable
+	same := NewAttributes(map[string]string{"isp": "Cloudflare", "region": "NSW"})
+	if (Result{Country: "AU", Attributes: attributes}) != (Result{Country: "AU", Attributes: same}) {
+		t.Error("Results with the same attributes are not equal")
+	}
+
+	data, err := json.Marshal(Result{Country: "Australia", City: "Sydney", Attributes: attributes})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `{"country":"Australia","city":"Sydney","attributes":{"isp":"Cloudflare","region":"NSW"}}`
+	if string(data) != expected {
+		t.Errorf("Marshal = %s, want %s", data, expected)
+	}
+
+	var decoded Result
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Attributes != attributes {
+		t.Errorf("Unmarshal attributes = %v, want %v", decoded.Attributes, attributes)
+	}
+
+	// Results without attributes keep their previous JSON form
+	data, _ = json.Marshal(Result{Country: "Australia", City: "Sydney"})
+	if string(data) != `{"country":"Australia","city":"Sydney"}` {
+		t.Errorf("Marshal without attributes = %s", data)
+	}
+}
+
+func TestParseCSVAttributes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		wantErr  bool
+	}{
+		{input: "", expected: nil},
+		{input: "region, isp ,tags", expected: []string{"region", "isp", "tags"}},
+		{input: "*", expected: []string{"*"}},
+		{input: "region,,isp", wantErr: true},
+		{input: "region,Region", wantErr: true},
+		{input: "*,region", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		names, err := ParseCSVAttributes(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseCSVAttributes(%q) expected error, got %v", tc.input, names)
+			}
+			continue
+		}
+		if err != nil || len(names) != len(tc.expected) {
+			t.Errorf("ParseCSVAttributes(%q) = %v, %v, want %v", tc.input, names, err, tc.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.expected[i] {
+				t.Errorf("ParseCSVAttributes(%q) = %v, want %v", tc.input, names, tc.expected)
+				break
+			}
+		}
+	}
+}
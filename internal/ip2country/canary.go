@@ -0,0 +1,201 @@
+package ip2country
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// canaryBuckets is the resolution of the canary split, allowing percentages
+// with two decimals
+const canaryBuckets = 10000
+
+// ArmStats reports lookups served by one arm of a CanaryService
+type ArmStats struct {
+	Lookups    int64         `json:"lookups"`
+	NotFound   int64         `json:"not_found"`
+	Errors     int64         `json:"errors"`
+	AvgLatency time.Duration `json:"avg_latency_ns"`
+	MaxLatency time.Duration `json:"max_latency_ns"`
+}
+
+// CanaryStats reports how lookups were split between the stable and candidate backends
+type CanaryStats struct {
+	Percent   float64  `json:"percent"`
+	Stable    ArmStats `json:"stable"`
+	Candidate ArmStats `json:"candidate"`
+}
+
+// armCounters counts the lookups of one arm without a lock, since every
+// lookup updates them
+type armCounters struct {
+	lookups      atomic.Int64
+	notFound     atomic.Int64
+	errors       atomic.Int64
+	totalLatency atomic.Int64
+	maxLatency   atomic.Int64
+}
+
+// CanaryService routes a percentage of lookups to a candidate Service and the
+// rest to a stable one. Routing is a hash of the client address, so a given
+// client is always answered by the same arm and sees consistent answers.
+// Lookups without a client hash the looked-up address instead.
+type CanaryService struct {
+	stable    Service
+	candidate Service
+
+	threshold      atomic.Uint64 // clients hashing below it go to the candidate
+	stableStats    armCounters
+	candidateStats armCounters
+
+	mu      sync.Mutex
+	percent float64
+}
+
+// NewCanaryService creates a new CanaryService sending percent (0 to 100) of
+// lookups to candidate
+func NewCanaryService(stable, candidate Service, percent float64) (*CanaryService, error) {
+	service := &CanaryService{
+		stable:    stable,
+		candidate: candidate,
+	}
+	if err := service.SetPercent(percent); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// SetPercent changes the share of lookups routed to the candidate. Raising it
+// keeps every client that was already on the candidate there.
+func (s *CanaryService) SetPercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("canary percent must be between 0 and 100")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.percent = percent
+	s.threshold.Store(uint64(percent * canaryBuckets / 100))
+	return nil
+}
+
+// LookupIP answers from the arm selected for ip
+func (s *CanaryService) LookupIP(ip string) (*Result, error) {
+	return s.LookupIPFor("", ip)
+}
+
+// LookupIPFor answers from the arm selected for client, or for ip when client
+// is not an IP address
+func (s *CanaryService) LookupIPFor(client, ip string) (*Result, error) {
+	if !isValidIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidIP
+	}
+	if clientAddr, err := netip.ParseAddr(client); err == nil {
+		addr = clientAddr
+	}
+
+	arm, stats := s.stable, &s.stableStats
+	if canaryBucket(addr) < s.threshold.Load() {
+		arm, stats = s.candidate, &s.candidateStats
+	}
+
+	start := time.Now()
+	result, err := arm.LookupIP(ip)
+	stats.record(time.Since(start), err)
+
+	return result, err
+}
+
+// canaryBucket maps an address to a stable bucket in [0, canaryBuckets).
+// IPv6 addresses are grouped per /64, so a client rotating addresses within
+// its block keeps its arm.
+func canaryBucket(addr netip.Addr) uint64 {
+	addr = addr.Unmap().WithZone("")
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		addr = prefix.Addr()
+	}
+	bytes := addr.As16()
+	hash := fnv.New64a()
+	hash.Write(bytes[:])
+	return hash.Sum64() % canaryBuckets
+}
+
+// record adds one lookup to the arm counters
+func (a *armCounters) record(latency time.Duration, err error) {
+	a.lookups.Add(1)
+	a.totalLatency.Add(int64(latency))
+	for {
+		current := a.maxLatency.Load()
+		if int64(latency) <= current || a.maxLatency.CompareAndSwap(current, int64(latency)) {
+			break
+		}
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrIPNotFound):
+		a.notFound.Add(1)
+	default:
+		a.errors.Add(1)
+	}
+}
+
+// stats returns the counters as ArmStats. Lookups in flight may be counted in
+// some counters and not yet in others.
+func (a *armCounters) stats() ArmStats {
+	stats := ArmStats{
+		Lookups:    a.lookups.Load(),
+		NotFound:   a.notFound.Load(),
+		Errors:     a.errors.Load(),
+		MaxLatency: time.Duration(a.maxLatency.Load()),
+	}
+	if stats.Lookups > 0 {
+		stats.AvgLatency = time.Duration(a.totalLatency.Load() / stats.Lookups)
+	}
+	return stats
+}
+
+// Stats returns the current split and per-arm statistics
+func (s *CanaryService) Stats() CanaryStats {
+	s.mu.Lock()
+	percent := s.percent
+	s.mu.Unlock()
+
+	return CanaryStats{
+		Percent:   percent,
+		Stable:    s.stableStats.stats(),
+		Candidate: s.candidateStats.stats(),
+	}
+}
+
+// Datasets returns metadata about the stable datasets followed by the candidate ones
+func (s *CanaryService) Datasets() []DatasetInfo {
+	var datasets []DatasetInfo
+	if provider, ok := s.stable.(MetadataProvider); ok {
+		datasets = append(datasets, provider.Datasets()...)
+	}
+	if provider, ok := s.candidate.(MetadataProvider); ok {
+		for _, info := range provider.Datasets() {
+			info.Role = "candidate"
+			datasets = append(datasets, info)
+		}
+	}
+	return datasets
+}
+
+// Unwrap returns the stable service
+func (s *CanaryService) Unwrap() Service {
+	return s.stable
+}
+
+// Close closes the stable and candidate services
+func (s *CanaryService) Close() error {
+	return closeServices(s.stable, s.candidate)
+}
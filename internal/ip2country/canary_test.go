@@ -0,0 +1,143 @@
+package ip2country
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCanaryServiceRouting(t *testing.T) {
+	stable := &stubService{results: map[string]*Result{}}
+	candidate := &stubService{results: map[string]*Result{}}
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		stable.results[ip] = &Result{Country: "Stable"}
+		candidate.results[ip] = &Result{Country: "Candidate"}
+	}
+
+	service, err := NewCanaryService(stable, candidate, 20)
+	if err != nil {
+		t.Fatalf("Failed to create canary service: %v", err)
+	}
+
+	routed := map[string]string{}
+	for ip := range stable.results {
+		result, err := service.LookupIP(ip)
+		if err != nil {
+			t.Fatalf("LookupIP(%s) failed: %v", ip, err)
+		}
+		routed[ip] = result.Country
+	}
+
+	stats := service.Stats()
+	if stats.Stable.Lookups+stats.Candidate.Lookups != 1000 {
+		t.Fatalf("Expected 1000 lookups, got %+v", stats)
+	}
+	// The split is a hash, so allow some slack around 20%
+	if stats.Candidate.Lookups < 150 || stats.Candidate.Lookups > 250 {
+		t.Errorf("Expected about 200 candidate lookups, got %d", stats.Candidate.Lookups)
+	}
+
+	// Repeated lookups of the same address always hit the same arm
+	for ip, country := range routed {
+		if result, _ := service.LookupIP(ip); result.Country != country {
+			t.Fatalf("LookupIP(%s) switched from %s to %s", ip, country, result.Country)
+		}
+	}
+
+	// Raising the percentage keeps addresses that were already on the candidate
+	if err := service.SetPercent(50); err != nil {
+		t.Fatalf("SetPercent failed: %v", err)
+	}
+	for ip, country := range routed {
+		if result, _ := service.LookupIP(ip); country == "Candidate" && result.Country != "Candidate" {
+			t.Fatalf("LookupIP(%s) moved back to the stable arm", ip)
+		}
+	}
+
+	if err := service.SetPercent(101); err == nil {
+		t.Error("Expected error for a percentage above 100")
+	}
+	if _, err := NewCanaryService(stable, candidate, -1); err == nil {
+		t.Error("Expected error for a negative percentage")
+	}
+}
+
+func TestCanaryServiceStats(t *testing.T) {
+	stable := &stubService{results: map[string]*Result{"1.1.1.1": {Country: "Australia"}}}
+	candidate := &stubService{err: errors.New("connection refused")}
+
+	service, err := NewCanaryService(stable, candidate, 0)
+	if err != nil {
+		t.Fatalf("Failed to create canary service: %v", err)
+	}
+	service.LookupIP("1.1.1.1")
+	service.LookupIP("8.8.8.8")
+	if _, err := service.LookupIP("invalid-ip"); err != ErrInvalidIP {
+		t.Errorf("LookupIP(invalid-ip) error = %v, want %v", err, ErrInvalidIP)
+	}
+
+	service.SetPercent(100)
+	if _, err := service.LookupIP("1.1.1.1"); err == nil {
+		t.Error("Expected the candidate error to be returned")
+	}
+
+	stats := service.Stats()
+	if stats.Percent != 100 {
+		t.Errorf("Expected percent 100, got %v", stats.Percent)
+	}
+	if stats.Stable.Lookups != 2 || stats.Stable.NotFound != 1 || stats.Stable.Errors != 0 {
+		t.Errorf("Unexpected stable stats: %+v", stats.Stable)
+	}
+	if stats.Candidate.Lookups != 1 || stats.Candidate.Errors != 1 {
+		t.Errorf("Unexpected candidate stats: %+v", stats.Candidate)
+	}
+	if stats.Stable.MaxLatency < stats.Stable.AvgLatency {
+		t.Errorf("Max latency %v below average %v", stats.Stable.MaxLatency, stats.Stable.AvgLatency)
+	}
+}
+
+func TestCanaryServiceRoutesByClient(t *testing.T) {
+	stable := &stubService{results: map[string]*Result{}}
+	candidate := &stubService{results: map[string]*Result{}}
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		stable.results[ip] = &Result{Country: "Stable"}
+		candidate.results[ip] = &Result{Country: "Candidate"}
+	}
+	canary, err := NewCanaryService(stable, candidate, 50)
+	if err != nil {
+		t.Fatalf("Failed to create canary service: %v", err)
+	}
+	// Wrappers pass the client on to the canary
+	service := NewShadowService(canary, stable, 0)
+
+	arms := map[string]int{}
+	for i := 0; i < 100; i++ {
+		client := fmt.Sprintf("192.0.2.%d", i)
+		// Every address a client looks up is answered by the same arm
+		first, _ := LookupIPFor(service, client, "10.0.0.0")
+		for ip := range stable.results {
+			result, err := LookupIPFor(service, client, ip)
+			if err != nil {
+				t.Fatalf("LookupIPFor(%s, %s) failed: %v", client, ip, err)
+			}
+			if result.Country != first.Country {
+				t.Fatalf("client %s was answered by both arms", client)
+			}
+		}
+		arms[first.Country]++
+	}
+	if arms["Stable"] == 0 || arms["Candidate"] == 0 {
+		t.Errorf("Expected clients on both arms, got %v", arms)
+	}
+
+	// Clients within an IPv6 /64 share their arm
+	for i := 0; i < 20; i++ {
+		a, _ := LookupIPFor(service, fmt.Sprintf("2001:db8:0:%x::1", i), "10.0.0.1")
+		b, _ := LookupIPFor(service, fmt.Sprintf("2001:db8:0:%x::ffff", i), "10.0.0.1")
+		if a.Country != b.Country {
+			t.Errorf("clients in 2001:db8:0:%x::/64 were answered by both arms", i)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package ip2country
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// CompactRecords normalizes a dataset into the smallest sorted list of CIDR
+// blocks that answers every lookup the same way. Adjacent and overlapping
+// blocks with identical results are merged and blocks are split where a more
+// specific result applies, nesting blocks wherever that saves rows.
+//
+// Each layer takes precedence over the previous ones for every address it
+// covers, the way an overrides file takes precedence over the base dataset.
+func CompactRecords(layers ...[]Record) []Record {
+	var segments []segment
+	for _, layer := range layers {
+		segments = overlaySegments(segments, flattenRecords(layer))
+	}
+
+	// The flattened blocks of each address family are the leaves of a prefix tree
+	c := &compactor{indexes: make(map[Result]int)}
+	var leaves [2][]compactLeaf
+	for _, s := range segments {
+		family := familyIndex(s.network.Start)
+		index := c.resultIndex(s.result)
+		for _, prefix := range s.network.Prefixes() {
+			leaves[family] = append(leaves[family], compactLeaf{prefix: prefix, result: index})
+		}
+	}
+
+	records := []Record{}
+	roots := [2]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	for family, root := range roots {
+		if len(leaves[family]) > 0 {
+			records = c.emit(records, c.build(root, leaves[family]), noResult)
+		}
+	}
+
+	slices.SortFunc(records, func(a, b Record) int {
+		return comparePrefixes(a.Prefix, b.Prefix)
+	})
+	return records
+}
+
+// overlaySegments merges two sorted lists of segments, letting top win
+// wherever both cover an address
+func overlaySegments(base, top []segment) []segment {
+	var segments []segment
+	walkSegments(base, top, func(network Range, fromBase, fromTop *segment) {
+		if fromTop != nil {
+			segments = appendSegment(segments, network, fromTop.result)
+		} else {
+			segments = appendSegment(segments, network, fromBase.result)
+		}
+	})
+	return segments
+}
+
+// noResult stands for addresses that no block covers
+const noResult = -1
+
+// compactor finds the smallest set of nested blocks equivalent to a set of
+// non-overlapping blocks under longest-prefix matching, using the Optimal
+// Routing Table Constructor algorithm (Draves et al., 1999). Addresses without
+// a result cannot be expressed under a covering block, so any subtree with a
+// gap is never covered and each fully covered subtree is compacted on its own.
+type compactor struct {
+	results []Result
+	indexes map[Result]int
+}
+
+// compactLeaf is a non-overlapping block and the index of its result
+type compactLeaf struct {
+	prefix netip.Prefix
+	result int
+}
+
+// compactNode is a node of the prefix tree. For fully covered nodes, results
+// holds the sorted indexes of the results that can cover the node in a
+// minimal encoding.
+type compactNode struct {
+	prefix      netip.Prefix
+	left, right *compactNode
+	full        bool
+	results     []int
+}
+
+// resultIndex returns the index of result, interning it on first use
+func (c *compactor) resultIndex(result Result) int {
+	index, ok := c.indexes[result]
+	if !ok {
+		index = len(c.results)
+		c.indexes[result] = index
+		c.results = append(c.results, result)
+	}
+	return index
+}
+
+// build returns the tree for prefix from the sorted leaves it contains,
+// computing the candidate results of each node bottom-up
+func (c *compactor) build(prefix netip.Prefix, leaves []compactLeaf) *compactNode {
+	node := &compactNode{prefix: prefix}
+	if len(leaves) == 1 && leaves[0].prefix == prefix {
+		node.full = true
+		node.results = []int{leaves[0].result}
+		return node
+	}
+
+	// Every leaf is strictly inside prefix, so it falls in one of its halves
+	low := netip.PrefixFrom(prefix.Addr(), prefix.Bits()+1)
+	high := netip.PrefixFrom(prefixRange(low).End.Next(), prefix.Bits()+1)
+	split, _ := slices.BinarySearchFunc(leaves, high.Addr(), func(leaf compactLeaf, addr netip.Addr) int {
+		return leaf.prefix.Addr().Compare(addr)
+	})
+	if split > 0 {
+		node.left = c.build(low, leaves[:split])
+	}
+	if split < len(leaves) {
+		node.right = c.build(high, leaves[split:])
+	}
+
+	if node.left != nil && node.right != nil && node.left.full && node.right.full {
+		node.full = true
+		if common := intersectSorted(node.left.results, node.right.results); len(common) > 0 {
+			node.results = common
+		} else {
+			node.results = unionSorted(node.left.results, node.right.results)
+		}
+	}
+	return node
+}
+
+// emit walks the tree top-down and appends a block wherever the result
+// inherited from the enclosing blocks is not a valid choice for the node
+func (c *compactor) emit(records []Record, node *compactNode, inherited int) []Record {
+	if node == nil {
+		return records
+	}
+	if node.full {
+		if _, found := slices.BinarySearch(node.results, inherited); !found {
+			inherited = node.results[0]
+			records = append(records, Record{Prefix: node.prefix, Result: c.results[inherited]})
+		}
+	}
+	records = c.emit(records, node.left, inherited)
+	return c.emit(records, node.right, inherited)
+}
+
+// intersectSorted returns the values present in both sorted slices
+func intersectSorted(a, b []int) []int {
+	var out []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// unionSorted returns the values present in either sorted slice
+func unionSorted(a, b []int) []int {
+	out := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
@@ -0,0 +1,77 @@
+package ip2country
+
+import (
+	"testing"
+)
+
+func TestCompactRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		layers   [][]string
+		expected []string
+	}{
+		{
+			name:     "merges adjacent blocks",
+			layers:   [][]string{{"1.1.1.0/25,Sydney,Australia", "1.1.1.128/25,Sydney,Australia", "1.1.2.0-1.1.3.255,Sydney,Australia"}},
+			expected: []string{"1.1.1.0/24 Australia", "1.1.2.0/23 Australia"},
+		},
+		{
+			name:     "drops redundant nested blocks",
+			layers:   [][]string{{"10.0.0.0/8,Private,Private", "10.0.0.0/24,Private,Private", "10.0.0.1,Private,Private"}},
+			expected: []string{"10.0.0.0/8 Private"},
+		},
+		{
+			name:     "keeps more specific results nested",
+			layers:   [][]string{{"10.0.0.0/8,Private,Private", "10.1.0.0/16,London,UK"}},
+			expected: []string{"10.0.0.0/8 Private", "10.1.0.0/16 UK"},
+		},
+		{
+			name:     "nests the majority result",
+			layers:   [][]string{{"10.0.0.0/25,London,UK", "10.0.0.128/26,London,UK", "10.0.0.192/26,Paris,France"}},
+			expected: []string{"10.0.0.0/24 UK", "10.0.0.192/26 France"},
+		},
+		{
+			name:     "does not cover gaps",
+			layers:   [][]string{{"10.0.0.0/25,London,UK", "10.0.0.192/26,London,UK"}},
+			expected: []string{"10.0.0.0/25 UK", "10.0.0.192/26 UK"},
+		},
+		{
+			name:     "later layers take precedence",
+			layers:   [][]string{{"10.0.0.0/8,Private,Private", "10.1.2.0/24,Paris,France"}, {"10.1.0.0/16,London,UK"}},
+			expected: []string{"10.0.0.0/8 Private", "10.1.0.0/16 UK"},
+		},
+		{
+			name:     "separates address families",
+			layers:   [][]string{{"2001:db8::/33,Berlin,Germany", "2001:db8:8000::/33,Berlin,Germany", "0.0.0.0/0,Anywhere,Earth"}},
+			expected: []string{"0.0.0.0/0 Earth", "2001:db8::/32 Germany"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var layers [][]Record
+			for _, lines := range tc.layers {
+				layers = append(layers, parseRecords(t, lines...))
+			}
+
+			records := CompactRecords(layers...)
+			if len(records) != len(tc.expected) {
+				t.Fatalf("CompactRecords returned %v, want %v", records, tc.expected)
+			}
+			for i, record := range records {
+				if got := record.Prefix.String() + " " + record.Result.Country; got != tc.expected[i] {
+					t.Errorf("record %d = %s, want %s", i, got, tc.expected[i])
+				}
+			}
+
+			// The compacted records must answer exactly like the layered input
+			merged := layers[0]
+			for _, layer := range layers[1:] {
+				merged = CompactRecords(merged, layer)
+			}
+			if diff := DiffDatasets(merged, records); len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+				t.Errorf("Compacted records differ from the input:\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package ip2country
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic bytes of the compression formats recognized in dataset files
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCompression names the compression of a file starting with header,
+// or returns an empty string for an uncompressed file
+func detectCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(header, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(header, zstdMagic):
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// decompress detects the compression of r from its first bytes and returns a
+// reader of the decompressed contents along with the compression name. Plain
+// input is returned as is with an empty name.
+func decompress(r io.Reader) (io.Reader, string, error) {
+	buffered := bufio.NewReader(r)
+	// A short or empty file cannot be compressed, so a failed peek just
+	// means plain input
+	header, _ := buffered.Peek(len(zstdMagic))
+
+	compression := detectCompression(header)
+	switch compression {
+	case "gzip":
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, compression, fmt.Errorf("invalid gzip data: %v", err)
+		}
+		return reader, compression, nil
+	case "bzip2":
+		return bzip2.NewReader(buffered), compression, nil
+	case "zstd":
+		// A single goroutine decodes in the caller's reads, so the decoder
+		// holds nothing that needs closing once the file is read. The window
+		// is capped at the default limit of the zstd tool to bound memory.
+		reader, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(128<<20))
+		if err != nil {
+			return nil, compression, fmt.Errorf("invalid zstd data: %v", err)
+		}
+		return reader, compression, nil
+	default:
+		return buffered, compression, nil
+	}
+}
+
+// trimCompressionExt removes a compression extension from filePath, so the
+// format of data.csv.gz is guessed from .csv
+func trimCompressionExt(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".gz", ".bz2", ".zst":
+		return strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	default:
+		return filePath
+	}
+}
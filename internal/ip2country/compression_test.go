@@ -0,0 +1,231 @@
+package ip2country
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ip2country-api/internal/config"
+)
+
+// gzipBytes compresses content with gzip
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(content)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// "1.1.1.1,Sydney,Australia\n" compressed with bzip2 -9 and zstd, which the
+// standard library cannot write
+const (
+	testBzip2Dataset = "QlpoOTFBWSZTWbJSB4QAAATfgAAQAAUgACAACAAmJR4gIAAhqB6QHqPUKGmmACGQDKxGlCWeeb638XckU4UJCyUgeEA="
+	testZstdDataset  = "KLUv/QRYyQAAMS4xLjEuMSxTeWRuZXksQXVzdHJhbGlhCghW+Pc="
+)
+
+func TestDecompress(t *testing.T) {
+	content := "1.1.1.1,Sydney,Australia\n"
+	bzip2Data, _ := base64.StdEncoding.DecodeString(testBzip2Dataset)
+	zstdData, _ := base64.StdEncoding.DecodeString(testZstdDataset)
+
+	tests := []struct {
+		name        string
+		input       []byte
+		expected    string
+		compression string
+		wantErr     error
+	}{
+		{name: "Plain", input: []byte(content), expected: content},
+		{name: "Empty", input: []byte{}},
+		{name: "Gzip", input: gzipBytes(t, []byte(content)), expected: content, compression: "gzip"},
+		{name: "Bzip2", input: bzip2Data, expected: content, compression: "bzip2"},
+		{name: "Zstd", input: zstdData, expected: content, compression: "zstd"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reader, compression, err := decompress(bytes.NewReader(tc.input))
+			if compression != tc.compression {
+				t.Errorf("compression = %q, expected %q", compression, tc.compression)
+			}
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Expected %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			output, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			if string(output) != tc.expected {
+				t.Errorf("output = %q, expected %q", output, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDatasetFormatCompressed(t *testing.T) {
+	tests := map[string]string{
+		"data.csv.gz":     "csv",
+		"data.jsonl.bz2":  "jsonl",
+		"data.snap.zst":   "snapshot",
+		"data.jsonl":      "jsonl",
+		"data.gz":         "csv",
+		"archive.tar.GZ":  "csv",
+		"data.snap":       "snapshot",
+		"ip2country.csv":  "csv",
+		"dataset.jsonl.Z": "csv",
+	}
+	for path, expected := range tests {
+		if format := DatasetFormat(path); format != expected {
+			t.Errorf("DatasetFormat(%q) = %q, expected %q", path, format, expected)
+		}
+	}
+}
+
+func TestCSVServiceCompressed(t *testing.T) {
+	dir := t.TempDir()
+	compressed := gzipBytes(t, []byte("1.1.1.1,Sydney,Australia\n8.8.8.0/24,Mountain View,United States\n"))
+	// Files are detected by content, not by extension
+	path := writeTestFile(t, dir, "ip2country.csv", string(compressed))
+
+	service, err := NewCSVService(path)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	if result, err := service.LookupIP("8.8.8.8"); err != nil || result.Country != "United States" {
+		t.Errorf("LookupIP(8.8.8.8) = %v, %v", result, err)
+	}
+
+	info := service.Datasets()[0]
+	sum := sha256.Sum256(compressed)
+	if info.Compression != "gzip" || info.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("Datasets() = %+v, expected gzip with the checksum of the compressed file", info)
+	}
+	if err := service.PutRecord(netip.MustParsePrefix("2.2.2.2/32"), Result{Country: "France"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PutRecord() = %v, expected %v", err, ErrReadOnly)
+	}
+
+	// The signature covers the compressed file
+	key, public := newTestKey(t)
+	verifier, _ := ParseTrustedKeys(public)
+	signTestFile(t, path, key)
+	if _, err := NewCSVServiceWithOptions(path, CSVOptions{Verifier: verifier}); err != nil {
+		t.Errorf("Failed to load a signed compressed dataset: %v", err)
+	}
+
+	// Corrupt compressed data fails the load
+	truncated := writeTestFile(t, dir, "truncated.csv.gz", string(compressed[:len(compressed)-10]))
+	if _, err := NewCSVService(truncated); err == nil {
+		t.Error("Expected error for truncated gzip data, got nil")
+	}
+
+	zstdData, _ := base64.StdEncoding.DecodeString(testZstdDataset)
+	zstdPath := writeTestFile(t, dir, "ip2country.csv.zst", string(zstdData))
+	zstdService, err := NewCSVService(zstdPath)
+	if err != nil {
+		t.Fatalf("Failed to load a zstd compressed dataset: %v", err)
+	}
+	if result, err := zstdService.LookupIP("1.1.1.1"); err != nil || result.City != "Sydney" {
+		t.Errorf("LookupIP(1.1.1.1) = %+v, %v, want Sydney", result, err)
+	}
+	if compression := zstdService.Datasets()[0].Compression; compression != "zstd" {
+		t.Errorf("Compression = %q, want zstd", compression)
+	}
+	truncated = writeTestFile(t, dir, "truncated.csv.zst", string(zstdData[:len(zstdData)-6]))
+	if _, err := NewCSVService(truncated); err == nil {
+		t.Error("Expected error for truncated zstd data, got nil")
+	}
+}
+
+func TestReadDatasetFileCompressed(t *testing.T) {
+	dir := t.TempDir()
+	bzip2Data, _ := base64.StdEncoding.DecodeString(testBzip2Dataset)
+	jsonl := gzipBytes(t, []byte(`{"cidr":"1.1.1.1/32","country":"Australia","city":"Sydney"}`+"\n"))
+
+	var snapshot bytes.Buffer
+	if err := WriteDataset(&snapshot, "snapshot", parseRecords(t, "1.1.1.1/32,Sydney,Australia")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	paths := []string{
+		writeTestFile(t, dir, "data.csv.bz2", string(bzip2Data)),
+		writeTestFile(t, dir, "data.jsonl.gz", string(jsonl)),
+		writeTestFile(t, dir, "data.snap.gz", string(gzipBytes(t, snapshot.Bytes()))),
+	}
+	for _, path := range paths {
+		records, err := ReadDatasetFile(path, "", CSVFormat{})
+		if err != nil {
+			t.Errorf("ReadDatasetFile(%s) failed: %v", filepath.Base(path), err)
+			continue
+		}
+		if len(records) != 1 || records[0].Result.Country != "Australia" {
+			t.Errorf("ReadDatasetFile(%s) = %v", filepath.Base(path), records)
+		}
+	}
+
+	report, err := ValidateCSV(paths[0], CSVFormat{})
+	if err != nil || report.Records != 1 || report.Errors != 0 {
+		t.Errorf("ValidateCSV() = %+v, %v", report, err)
+	}
+}
+
+func TestSnapshotServiceCompressed(t *testing.T) {
+	var snapshot bytes.Buffer
+	if err := WriteDataset(&snapshot, "snapshot", parseRecords(t, "1.1.1.0/24,Sydney,Australia")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "data.snap")
+	if err := os.WriteFile(path, gzipBytes(t, snapshot.Bytes()), 0644); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	key, public := newTestKey(t)
+	verifier, _ := ParseTrustedKeys(public)
+	signTestFile(t, path, key)
+
+	service, err := NewSnapshotServiceWithOptions(path, SnapshotOptions{Verifier: verifier})
+	if err != nil {
+		t.Fatalf("Failed to create snapshot service: %v", err)
+	}
+	defer service.Close()
+	if result, err := service.LookupIP("1.1.1.1"); err != nil || result.Country != "Australia" {
+		t.Errorf("LookupIP(1.1.1.1) = %v, %v", result, err)
+	}
+	if info := service.Datasets()[0]; info.Compression != "gzip" || info.Signer == "" {
+		t.Errorf("Datasets() = %+v, expected a signed gzip dataset", info)
+	}
+}
+
+func TestNewServiceDefaultDataset(t *testing.T) {
+	service, err := NewService(config.BackendConfig{Type: "csv", CSVPath: config.DefaultCSVPath})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	if result, err := service.LookupIP("8.8.8.8"); err != nil || result.Country != "United States" {
+		t.Errorf("LookupIP(8.8.8.8) = %v, %v", result, err)
+	}
+	provider, _ := As[MetadataProvider](service)
+	if info := provider.Datasets()[0]; info.Source != DefaultDatasetSource || info.Compression != "gzip" {
+		t.Errorf("Datasets() = %+v, expected the built-in dataset", info)
+	}
+	writable, _ := As[WritableService](service)
+	if err := writable.PutRecord(netip.MustParsePrefix("2.2.2.2/32"), Result{Country: "France"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PutRecord() = %v, expected %v", err, ErrReadOnly)
+	}
+}
@@ -0,0 +1,333 @@
+package ip2country
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVFormat describes the layout of a CSV dataset
+type CSVFormat struct {
+	// Delimiter separates the fields of a row, ',' when zero
+	Delimiter rune
+
+	// Columns holds the header names of the ip, city and country fields.
+	// When any of them is set the file must start with a header row.
+	Columns CSVColumns
+
+	// Attributes names the extra columns returned as result attributes, or
+	// is ["*"] for all of them. When set the file must start with a header row.
+	Attributes []string
+}
+
+// needsHeader reports whether the format can only be read with a header row
+func (f CSVFormat) needsHeader() bool {
+	return f.Columns != (CSVColumns{}) || len(f.Attributes) > 0
+}
+
+// selectAttributes returns the attributes the format reads from a file
+func (f CSVFormat) selectAttributes(attributes Attributes) Attributes {
+	if len(f.Attributes) == 1 && f.Attributes[0] == "*" {
+		return attributes
+	}
+	values := make(map[string]string)
+	for name, value := range attributes.All() {
+		if i := slices.IndexFunc(f.Attributes, func(selected string) bool { return strings.EqualFold(selected, name) }); i >= 0 {
+			values[f.Attributes[i]] = value
+		}
+	}
+	return NewAttributes(values)
+}
+
+// CSVColumns holds the header names of the fields of a dataset row. Empty
+// names fall back to the names recognized by default.
+type CSVColumns struct {
+	IP      string
+	City    string
+	Country string
+}
+
+// csvFields names the fields of a dataset row in the order they are used
+var csvFields = [3]string{"ip", "city", "country"}
+
+// defaultColumnNames are the header names recognized for each field when no
+// column mapping is configured
+var defaultColumnNames = [3][]string{
+	{"ip", "ip_address", "cidr", "network", "prefix", "range", "ip_range"},
+	{"city", "city_name"},
+	{"country", "country_name", "country_code"},
+}
+
+// ParseCSVColumns parses a column mapping such as
+// "ip=network,city=city_name,country=country_name"
+func ParseCSVColumns(s string) (CSVColumns, error) {
+	var columns CSVColumns
+	if strings.TrimSpace(s) == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		field, name, ok := strings.Cut(pair, "=")
+		field, name = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(name)
+		if !ok || name == "" {
+			return CSVColumns{}, fmt.Errorf("invalid column mapping %q, expected field=header", pair)
+		}
+		switch field {
+		case "ip":
+			columns.IP = name
+		case "city":
+			columns.City = name
+		case "country":
+			columns.Country = name
+		default:
+			return CSVColumns{}, fmt.Errorf("unknown field %q in column mapping, expected ip, city or country", field)
+		}
+	}
+	return columns, nil
+}
+
+// ParseCSVDelimiter parses a field delimiter given as a single character or as
+// "tab". An empty string is the default ','.
+func ParseCSVDelimiter(s string) (rune, error) {
+	switch s {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	delimiter, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || delimiter == utf8.RuneError || strings.ContainsRune("\"#\r\n", delimiter) {
+		return 0, fmt.Errorf("invalid delimiter %q, expected a single character", s)
+	}
+	return delimiter, nil
+}
+
+// names returns the header names accepted for each field
+func (c CSVColumns) names() [3][]string {
+	names := defaultColumnNames
+	for i, name := range []string{c.IP, c.City, c.Country} {
+		if name != "" {
+			names[i] = []string{name}
+		}
+	}
+	return names
+}
+
+// csvRow is a data row of a CSV dataset: its ip, city and country fields in
+// this order, the column of each field, the line it starts on and the
+// attributes selected by the format. Unread reports non-empty fields in
+// columns the format does not read.
+type csvRow struct {
+	line       int
+	fields     []string
+	columns    []int
+	attributes Attributes
+	unread     bool
+}
+
+// readCSVRows streams a CSV dataset and calls fn for each data row, or with the
+// error of a row that could not be read. A UTF-8 byte order mark and lines
+// starting with '#' are skipped and fields are trimmed. The first row is a
+// header when a column mapping or attributes are configured or when it names
+// an ip column; otherwise rows are ip,city,country. Extra columns are ignored
+// unless they are selected as attributes. Reading stops at the end of the
+// input, after reporting an unusable header or when fn returns an error.
+func readCSVRows(r io.Reader, format CSVFormat, fn func(row csvRow, err error) error) error {
+	buffered := bufio.NewReader(r)
+	if bom, _ := buffered.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		buffered.Discard(3)
+	}
+
+	reader := csv.NewReader(buffered)
+	if format.Delimiter != 0 {
+		reader.Comma = format.Delimiter
+	}
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	indexes := []int{0, 1, 2}
+	var attributes csvAttributeColumns
+	interner := attributeInterner{}
+	first := true
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		var parseErr *csv.ParseError
+		switch {
+		case errors.As(err, &parseErr):
+			err = fn(csvRow{line: parseErr.Line}, &rangeError{Code: "syntax", Message: parseErr.Err.Error(), Column: parseErr.Column})
+		case err != nil:
+			return fmt.Errorf("error reading CSV: %v", err)
+		default:
+			line, _ := reader.FieldPos(0)
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			if len(fields) == 1 && fields[0] == "" {
+				continue
+			}
+
+			if first {
+				first = false
+				header, isHeader, err := csvHeaderIndexes(fields, format)
+				if err == nil && isHeader {
+					attributes, err = csvAttributeIndexes(fields, header, format.Attributes)
+				}
+				if err != nil {
+					// Without the header the rows cannot be read
+					return fn(csvRow{line: line}, &rangeError{Code: "header", Message: err.Error()})
+				}
+				if isHeader {
+					indexes = header
+					continue
+				}
+			}
+
+			if needed := slices.Max(indexes) + 1; len(fields) < needed {
+				err = fn(csvRow{line: line}, &rangeError{
+					Code:    "column_count",
+					Message: fmt.Sprintf("invalid CSV format, expected at least %d columns, got %d", needed, len(fields)),
+				})
+				break
+			}
+			row := csvRow{line: line, fields: make([]string, len(indexes)), columns: make([]int, len(indexes))}
+			for i, index := range indexes {
+				row.fields[i] = fields[index]
+				_, row.columns[i] = reader.FieldPos(index)
+			}
+			row.attributes = interner.intern(attributes.read(fields))
+			for i, field := range fields {
+				if field != "" && !slices.Contains(indexes, i) && !slices.Contains(attributes.indexes, i) {
+					row.unread = true
+					break
+				}
+			}
+			err = fn(row, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// csvHeaderIndexes reports whether fields is a header row and returns the
+// positions of the ip, city and country columns in it
+func csvHeaderIndexes(fields []string, format CSVFormat) ([]int, bool, error) {
+	names := format.Columns.names()
+	find := func(candidates []string) int {
+		return slices.IndexFunc(fields, func(field string) bool {
+			return slices.ContainsFunc(candidates, func(name string) bool {
+				return strings.EqualFold(name, field)
+			})
+		})
+	}
+
+	if !format.needsHeader() && find(names[0]) < 0 {
+		return nil, false, nil
+	}
+
+	indexes := make([]int, len(names))
+	for i, candidates := range names {
+		if indexes[i] = find(candidates); indexes[i] < 0 {
+			return nil, true, fmt.Errorf("header has no %s column, expected one of: %s", csvFields[i], strings.Join(candidates, ", "))
+		}
+	}
+	return indexes, true, nil
+}
+
+// csvAttributeColumns holds the names of the attribute columns of a dataset,
+// sorted, and their positions
+type csvAttributeColumns struct {
+	names   []string
+	indexes []int
+}
+
+// csvAttributeIndexes finds the attribute columns selected by names in a
+// header, given the positions of the ip, city and country columns
+func csvAttributeIndexes(header []string, indexes []int, names []string) (csvAttributeColumns, error) {
+	type column struct {
+		name  string
+		index int
+	}
+	var selected []column
+	if len(names) == 1 && names[0] == "*" {
+		for i, name := range header {
+			if name != "" && !slices.Contains(indexes, i) {
+				selected = append(selected, column{name: name, index: i})
+			}
+		}
+	} else {
+		for _, name := range names {
+			index := slices.IndexFunc(header, func(field string) bool {
+				return strings.EqualFold(name, field)
+			})
+			if index < 0 {
+				return csvAttributeColumns{}, fmt.Errorf("header has no %s attribute column", name)
+			}
+			selected = append(selected, column{name: name, index: index})
+		}
+	}
+
+	// Sort the columns by name once so rows are encoded without sorting. A
+	// column repeated in the header is read from its first occurrence.
+	slices.SortStableFunc(selected, func(a, b column) int {
+		return strings.Compare(a.name, b.name)
+	})
+	selected = slices.CompactFunc(selected, func(a, b column) bool {
+		return a.name == b.name
+	})
+
+	var columns csvAttributeColumns
+	for _, c := range selected {
+		columns.names = append(columns.names, c.name)
+		columns.indexes = append(columns.indexes, c.index)
+	}
+	return columns, nil
+}
+
+// read returns the attributes of a row. Missing trailing fields are empty.
+func (c csvAttributeColumns) read(fields []string) Attributes {
+	if len(c.names) == 0 {
+		return Attributes{}
+	}
+	values := make([]string, len(c.indexes))
+	for i, index := range c.indexes {
+		if index < len(fields) {
+			values[i] = fields[index]
+		}
+	}
+	return encodeAttributes(c.names, values)
+}
+
+// parseCSVRecord parses a data row into its range and result
+func parseCSVRecord(row csvRow) (Range, Result, error) {
+	network, err := ParseRange(row.fields[0])
+	if err != nil {
+		var rangeErr *rangeError
+		if errors.As(err, &rangeErr) {
+			positioned := *rangeErr
+			positioned.Column = row.columns[0]
+			err = &positioned
+		}
+		return Range{}, Result{}, err
+	}
+	return network, Result{City: row.fields[1], Country: row.fields[2], Attributes: row.attributes}, nil
+}
+
+// rowError prefixes the error of a dataset row with its position
+func rowError(filePath string, line int, err error) error {
+	var rangeErr *rangeError
+	if errors.As(err, &rangeErr) && rangeErr.Column > 0 {
+		return fmt.Errorf("%s:%d:%d: %v", filePath, line, rangeErr.Column, err)
+	}
+	return fmt.Errorf("%s:%d: %v", filePath, line, err)
+}
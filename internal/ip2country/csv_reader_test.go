@@ -0,0 +1,293 @@
+package ip2country
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadCSVRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		format   CSVFormat
+		expected []string
+	}{
+		{
+			name:     "No header",
+			input:    "1.1.1.1,Sydney,Australia\n8.8.8.8,Mountain View,United States\n",
+			expected: []string{"1: 1.1.1.1|Sydney|Australia", "2: 8.8.8.8|Mountain View|United States"},
+		},
+		{
+			name:     "Header, comments, BOM and whitespace",
+			input:    "\ufeff# exported 2026-10-01\nip, city , country\n\n 1.1.1.1 , Sydney ,Australia \n# trailing comment\n",
+			expected: []string{"4: 1.1.1.1|Sydney|Australia"},
+		},
+		{
+			name:     "Header in another order with extra columns",
+			input:    "country_code,asn,network,city_name\nAU,13335,1.1.1.0/24,Sydney\n",
+			expected: []string{"2: 1.1.1.0/24|Sydney|AU"},
+		},
+		{
+			name:     "Extra columns without header",
+			input:    "1.1.1.1,Sydney,Australia,13335\n",
+			expected: []string{"1: 1.1.1.1|Sydney|Australia"},
+		},
+		{
+			name:     "Tab delimiter",
+			input:    "1.1.1.1\tSydney, NSW\tAustralia\n",
+			format:   CSVFormat{Delimiter: '\t'},
+			expected: []string{"1: 1.1.1.1|Sydney, NSW|Australia"},
+		},
+		{
+			name:     "Column mapping",
+			input:    "start_ip;locality;nation\n1.1.1.1;Sydney;Australia\n",
+			format:   CSVFormat{Delimiter: ';', Columns: CSVColumns{IP: "start_ip", City: "locality", Country: "nation"}},
+			expected: []string{"2: 1.1.1.1|Sydney|Australia"},
+		},
+		{
+			name:     "Partial column mapping",
+			input:    "start_ip,city,country\n1.1.1.1,Sydney,Australia\n",
+			format:   CSVFormat{Columns: CSVColumns{IP: "START_IP"}},
+			expected: []string{"2: 1.1.1.1|Sydney|Australia"},
+		},
+		{
+			name:     "Selected attributes",
+			input:    "ip,city,country,asn,region,isp\n1.1.1.1,Sydney,Australia,13335,NSW,Cloudflare\n8.8.8.8,Mountain View,United States,15169,,Google\n",
+			format:   CSVFormat{Attributes: []string{"Region", "isp"}},
+			expected: []string{"2: 1.1.1.1|Sydney|Australia Region=NSW isp=Cloudflare", "3: 8.8.8.8|Mountain View|United States isp=Google"},
+		},
+		{
+			name:     "All attributes",
+			input:    "network,asn,city,country,tags\n1.1.1.0/24,13335,Sydney,Australia,anycast\n1.0.0.0/24,13335,Sydney,Australia\n",
+			format:   CSVFormat{Attributes: []string{"*"}},
+			expected: []string{"2: 1.1.1.0/24|Sydney|Australia asn=13335 tags=anycast", "3: 1.0.0.0/24|Sydney|Australia asn=13335"},
+		},
+		{
+			name:     "Missing attribute column",
+			input:    "ip,city,country\n1.1.1.1,Sydney,Australia\n",
+			format:   CSVFormat{Attributes: []string{"isp"}},
+			expected: []string{"1: header header has no isp attribute column"},
+		},
+		{
+			name:     "Too few columns",
+			input:    "1.1.1.1,Sydney\n",
+			expected: []string{"1: column_count invalid CSV format, expected at least 3 columns, got 2"},
+		},
+		{
+			name:     "Syntax error",
+			input:    "1.1.1.1,\"Sydney,Australia\n",
+			expected: []string{"1:27: syntax extraneous or missing \" in quoted-field"},
+		},
+		{
+			name:     "Header without country column",
+			input:    "ip,city,nation\n1.1.1.1,Sydney,Australia\n",
+			expected: []string{"1: header header has no country column, expected one of: country, country_name, country_code"},
+		},
+		{
+			name:     "Mapped column missing from header",
+			input:    "1.1.1.1,Sydney,Australia\n",
+			format:   CSVFormat{Columns: CSVColumns{IP: "network"}},
+			expected: []string{"1: header header has no ip column, expected one of: network"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			err := readCSVRows(strings.NewReader(tc.input), tc.format, func(row csvRow, err error) error {
+				if rowErr, ok := err.(*rangeError); ok {
+					position := fmt.Sprint(row.line)
+					if rowErr.Column > 0 || rowErr.Code == "syntax" {
+						position += fmt.Sprintf(":%d", rowErr.Column)
+					}
+					got = append(got, fmt.Sprintf("%s: %s %s", position, rowErr.Code, rowErr.Message))
+					return nil
+				}
+				line := fmt.Sprintf("%d: %s", row.line, strings.Join(row.fields, "|"))
+				if !row.attributes.IsZero() {
+					line += " " + row.attributes.String()
+				}
+				got = append(got, line)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("readCSVRows failed: %v", err)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.expected, "\n") {
+				t.Errorf("readCSVRows rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tc.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseCSVColumns(t *testing.T) {
+	columns, err := ParseCSVColumns("ip=network, City = city_name,country=country_name")
+	if err != nil {
+		t.Fatalf("ParseCSVColumns failed: %v", err)
+	}
+	if columns != (CSVColumns{IP: "network", City: "city_name", Country: "country_name"}) {
+		t.Errorf("ParseCSVColumns = %+v", columns)
+	}
+
+	for _, input := range []string{"network", "ip=", "asn=asn"} {
+		if _, err := ParseCSVColumns(input); err == nil {
+			t.Errorf("ParseCSVColumns(%q) expected error, got nil", input)
+		}
+	}
+}
+
+func TestParseCSVDelimiter(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected rune
+		wantErr  bool
+	}{
+		{input: "", expected: ','},
+		{input: ";", expected: ';'},
+		{input: "tab", expected: '\t'},
+		{input: `\t`, expected: '\t'},
+		{input: "|", expected: '|'},
+		{input: ";;", wantErr: true},
+		{input: "\"", wantErr: true},
+		{input: "#", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		delimiter, err := ParseCSVDelimiter(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseCSVDelimiter(%q) expected error, got %q", tc.input, delimiter)
+			}
+			continue
+		}
+		if err != nil || delimiter != tc.expected {
+			t.Errorf("ParseCSVDelimiter(%q) = %q, %v, want %q", tc.input, delimiter, err, tc.expected)
+		}
+	}
+}
+
+func TestCSVServiceLenient(t *testing.T) {
+	testFile := "test_lenient_data.csv"
+	content := "ip,city,country\n1.1.1.1,Sydney,Australia\nnot-an-ip,Paris,France\n8.8.8.8,Mountain View\n9.9.9.9,Zurich,Switzerland\n"
+	if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	// Strict mode stops at the first bad row, pointing at the bad field
+	_, err := NewCSVService(testFile)
+	if err == nil || !strings.Contains(err.Error(), testFile+":3:1: invalid IP address") {
+		t.Errorf("Expected error at line 3 column 1, got %v", err)
+	}
+
+	service, err := NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 1, Lenient: true})
+	if err != nil {
+		t.Fatalf("Failed to create lenient CSV service: %v", err)
+	}
+	info := service.Datasets()[0]
+	if info.Records != 2 || info.SkippedRows != 2 {
+		t.Errorf("Records = %d, SkippedRows = %d, want 2 and 2", info.Records, info.SkippedRows)
+	}
+	if result, err := service.LookupIP("9.9.9.9"); err != nil || result.Country != "Switzerland" {
+		t.Errorf("LookupIP(9.9.9.9) = %v, %v, expected Switzerland", result, err)
+	}
+
+	// A broken header cannot be skipped
+	if err := os.WriteFile(testFile, []byte("ip,town,country\n1.1.1.1,Sydney,Australia\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if _, err := NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 1, Lenient: true}); err == nil {
+		t.Error("Expected error for a header without city column, got nil")
+	}
+}
+
+func TestCSVServiceWriteKeepsFormat(t *testing.T) {
+	testFile := "test_write_format_data.csv"
+	if err := os.WriteFile(testFile, []byte("network;locality;nation\n10.0.0.1;London;UK\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	format := CSVFormat{Delimiter: ';', Columns: CSVColumns{IP: "network", City: "locality", Country: "nation"}}
+	service, err := NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 1, Format: format})
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	if err := service.PutRecord(netip.MustParsePrefix("10.0.0.2/32"), Result{City: "Paris", Country: "France"}); err != nil {
+		t.Fatalf("PutRecord failed: %v", err)
+	}
+
+	content, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read data file: %v", err)
+	}
+	expected := "network;locality;nation\n10.0.0.1;London;UK\n10.0.0.2;Paris;France\n"
+	if string(content) != expected {
+		t.Errorf("Data file = %q, want %q", content, expected)
+	}
+}
+
+func TestCSVServiceAttributes(t *testing.T) {
+	testFile := "test_attributes_data.csv"
+	content := "ip,city,country,region,isp\n1.1.1.0/24,Sydney,Australia,NSW,Cloudflare\n8.8.8.8,Mountain View,United States,CA,Google\n"
+	if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	// Extra columns are only exposed when selected
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	if result, err := service.LookupIP("1.1.1.1"); err != nil || !result.Attributes.IsZero() {
+		t.Errorf("LookupIP(1.1.1.1) = %v, %v, expected no attributes", result, err)
+	}
+
+	format := CSVFormat{Attributes: []string{"region"}}
+	service, err = NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 1, Format: format})
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	result, err := service.LookupIP("1.1.1.1")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	if got := result.Attributes.String(); got != "region=NSW" {
+		t.Errorf("LookupIP(1.1.1.1) attributes = %q, want region=NSW", got)
+	}
+
+	// Rewriting the file would drop the isp column
+	attributes := NewAttributes(map[string]string{"region": "IDF", "isp": "Quad9"})
+	if err := service.PutRecord(netip.MustParsePrefix("9.9.9.9/32"), Result{City: "Paris", Country: "France", Attributes: attributes}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PutRecord() = %v, expected %v for a file with unread columns", err, ErrReadOnly)
+	}
+
+	// Updates are written back with the attribute columns
+	content = "ip,city,country,region\n1.1.1.0/24,Sydney,Australia,NSW\n8.8.8.8,Mountain View,United States,CA\n"
+	if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	service, err = NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 1, Format: format})
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	if err := service.PutRecord(netip.MustParsePrefix("9.9.9.9/32"), Result{City: "Paris", Country: "France", Attributes: attributes}); err != nil {
+		t.Fatalf("PutRecord failed: %v", err)
+	}
+	written, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read data file: %v", err)
+	}
+	expected := "ip,city,country,region\n1.1.1.0/24,Sydney,Australia,NSW\n8.8.8.8,Mountain View,United States,CA\n9.9.9.9,Paris,France,IDF\n"
+	if string(written) != expected {
+		t.Errorf("Data file = %q, want %q", written, expected)
+	}
+	if result, err := service.LookupIP("9.9.9.9"); err != nil || result.Attributes.String() != "region=IDF" {
+		t.Errorf("LookupIP(9.9.9.9) = %v, %v, expected only the selected attributes", result, err)
+	}
+}
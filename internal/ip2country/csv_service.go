@@ -1,24 +1,84 @@
 package ip2country
 
 import (
-	"encoding/csv"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"ip2country-api/pkg/fileutil"
 )
 
+// CSVOptions holds optional settings of a CSVService
+type CSVOptions struct {
+	// HistorySize is the number of loaded dataset snapshots kept in memory
+	// for rollback, including the active one. Values below 1 keep only the
+	// active one.
+	HistorySize int
+
+	// Format describes the delimiter and columns of the file
+	Format CSVFormat
+
+	// Lenient skips rows that cannot be parsed instead of failing the load.
+	// Skipped rows are counted in the dataset metadata.
+	Lenient bool
+
+	// Verifier, when set, requires a valid detached signature next to the
+	// file. Records of a signed dataset cannot be changed at runtime, since
+	// the rewritten file would no longer verify.
+	Verifier *DatasetVerifier
+}
+
+// csvSnapshot is a loaded version of the dataset. Lossy names what the file
+// holds beyond data, such as comments or unread columns, that rewriting it
+// from data would drop. Content holds the file exactly as it was loaded or
+// written, so rolling back restores it byte for byte, and is nil for files
+// that are never rewritten.
+type csvSnapshot struct {
+	data    *prefixTable
+	info    DatasetInfo
+	lossy   string
+	content []byte
+}
+
 // CSVService implements Service by reading data from a CSV file
 type CSVService struct {
 	filePath string
-	data     map[string]*Result
+	embedded []byte // contents of a built-in dataset, read instead of filePath
+	options  CSVOptions
+	data     *prefixTable
+	info     DatasetInfo
+	lossy    string
+	history  []csvSnapshot // most recent first
 	mu       sync.RWMutex
+	// writeMu serializes record updates so that each one is persisted
+	// before the next is applied
+	writeMu sync.Mutex
 }
 
 // NewCSVService creates a new CSVService with the given CSV file path
 func NewCSVService(filePath string) (*CSVService, error) {
+	return NewCSVServiceWithOptions(filePath, CSVOptions{})
+}
+
+// NewCSVServiceWithOptions creates a new CSVService with the given CSV file path and options
+func NewCSVServiceWithOptions(filePath string, options CSVOptions) (*CSVService, error) {
+	if options.HistorySize < 1 {
+		options.HistorySize = 1
+	}
+
 	service := &CSVService{
 		filePath: filePath,
-		data:     make(map[string]*Result),
+		options:  options,
+		data:     newPrefixTable(0),
 	}
 
 	if err := service.loadData(); err != nil {
@@ -28,38 +88,162 @@ func NewCSVService(filePath string) (*CSVService, error) {
 	return service, nil
 }
 
-// loadData reads the CSV file and loads the data into memory
+// loadData reads the CSV file, decompressing it if needed, and loads the data
+// into memory
 func (s *CSVService) loadData() error {
-	file, err := os.Open(s.filePath)
-	if err != nil {
-		return fmt.Errorf("error opening CSV file: %v", err)
+	start := time.Now()
+
+	var source io.Reader
+	if s.embedded != nil {
+		source = bytes.NewReader(s.embedded)
+	} else {
+		file, err := os.Open(s.filePath)
+		if err != nil {
+			return fmt.Errorf("error opening CSV file: %v", err)
+		}
+		defer file.Close()
+		source = file
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	// Hash the file as stored while it is being parsed so the checksum
+	// matches exactly the bytes that were loaded. Files that can be rolled
+	// back to are kept as loaded too.
+	hash := sha256.New()
+	var content *bytes.Buffer
+	var raw io.Reader = io.TeeReader(source, hash)
+	if s.options.HistorySize > 1 && s.options.Verifier == nil && s.embedded == nil {
+		content = &bytes.Buffer{}
+		raw = io.TeeReader(raw, content)
+	}
+	reader, compression, err := decompress(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.filePath, err)
+	}
+	comments := &commentDetector{r: reader, lineStart: true}
+	data := newPrefixTable(0)
+	skipped, unread := 0, 0
+	var firstSkipped error
+	err = readCSVRows(comments, s.options.Format, func(row csvRow, err error) error {
+		var network Range
+		var result Result
+		if err == nil {
+			network, result, err = parseCSVRecord(row)
+		}
+		if row.unread {
+			unread++
+		}
+		if err != nil {
+			var rowErr *rangeError
+			if !s.options.Lenient || (errors.As(err, &rowErr) && rowErr.Code == "header") {
+				return rowError(s.filePath, row.line, err)
+			}
+			if skipped == 0 {
+				firstSkipped = rowError(s.filePath, row.line, err)
+			}
+			skipped++
+			return nil
+		}
+		for _, prefix := range network.Prefixes() {
+			data.set(prefix, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Trailing bytes after the compressed stream are still part of the file
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return fmt.Errorf("error reading CSV file: %v", err)
+	}
+	digest := hash.Sum(nil)
+	signer, err := s.options.Verifier.verifyFile(s.filePath, digest)
 	if err != nil {
-		return fmt.Errorf("error reading CSV: %v", err)
+		return err
+	}
+	if skipped > 0 {
+		log.Printf("csv: skipped %d invalid rows in %s, the first one: %v", skipped, s.filePath, firstSkipped)
+	}
+
+	info := s.datasetInfo(data, hex.EncodeToString(digest))
+	info.LoadDuration = info.LoadedAt.Sub(start)
+	info.SkippedRows = skipped
+	info.Signer = signer
+	info.Compression = compression
+
+	var lossy []string
+	if comments.found {
+		lossy = append(lossy, "comments")
+	}
+	if unread > 0 {
+		lossy = append(lossy, fmt.Sprintf("%d rows with unread columns", unread))
+	}
+	if skipped > 0 {
+		lossy = append(lossy, fmt.Sprintf("%d skipped rows", skipped))
+	}
+
+	snapshot := csvSnapshot{data: data, info: info, lossy: strings.Join(lossy, ", ")}
+	if content != nil && compression == "" {
+		snapshot.content = content.Bytes()
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.activate(snapshot)
+
+	return nil
+}
+
+// commentDetector passes a CSV file through and records whether a line starts
+// with '#', which the CSV reader skips as a comment
+type commentDetector struct {
+	r         io.Reader
+	lineStart bool
+	found     bool
+}
 
-	for _, record := range records {
-		if len(record) != 3 {
-			return fmt.Errorf("invalid CSV format, expected 3 columns (ip,city,country)")
+func (d *commentDetector) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for _, b := range p[:n] {
+		if d.lineStart && b == '#' {
+			d.found = true
 		}
-		ip := record[0]
-		city := record[1]
-		country := record[2]
+		d.lineStart = b == '\n'
+	}
+	return n, err
+}
+
+// activate makes snapshot the active dataset and records it in the history,
+// dropping the oldest snapshots beyond the configured history size.
+// The caller must hold s.mu.
+func (s *CSVService) activate(snapshot csvSnapshot) {
+	s.data = snapshot.data
+	s.info = snapshot.info
+	s.lossy = snapshot.lossy
 
-		s.data[ip] = &Result{
-			Country: country,
-			City:    city,
+	history := []csvSnapshot{snapshot}
+	for _, previous := range s.history {
+		if previous.info.Version != snapshot.info.Version {
+			history = append(history, previous)
 		}
 	}
+	if len(history) > s.options.HistorySize {
+		history = history[:s.options.HistorySize]
+	}
+	s.history = history
+}
 
-	return nil
+// datasetInfo builds the metadata for a table loaded from this service's file
+func (s *CSVService) datasetInfo(data *prefixTable, checksum string) DatasetInfo {
+	info := DatasetInfo{
+		Type:     "csv",
+		Source:   s.filePath,
+		Records:  len(data.entries),
+		Checksum: checksum,
+		Version:  datasetVersion(checksum),
+		LoadedAt: time.Now(),
+	}
+	data.describe(&info)
+	return info
 }
 
 // LookupIP returns country information for a given IP address
@@ -68,14 +252,169 @@ func (s *CSVService) LookupIP(ip string) (*Result, error) {
 	if !isValidIP(ip) {
 		return nil, ErrInvalidIP
 	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidIP
+	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	result, found := s.data[ip]
+	result, found := s.data.lookup(addr)
 	if !found {
-		return nil, ErrIPNotFound
+		return nil, &NotFoundError{DatasetVersion: s.info.Version}
 	}
+	result.DatasetVersion = s.info.Version
+
+	return &result, nil
+}
+
+// Records returns the active dataset entries sorted by address
+func (s *CSVService) Records() []Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.data.records()
+}
 
-	return result, nil
+// Datasets returns metadata about the currently loaded CSV file
+func (s *CSVService) Datasets() []DatasetInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return []DatasetInfo{s.info}
+}
+
+// PutRecord adds or replaces the record for prefix and persists the dataset
+func (s *CSVService) PutRecord(prefix netip.Prefix, result Result) error {
+	return s.update(func(data *prefixTable) error {
+		// Only keep the attributes that are read back when the file is reloaded
+		attributes := s.options.Format.selectAttributes(result.Attributes)
+		data.set(prefix.Masked(), Result{Country: result.Country, City: result.City, Attributes: attributes})
+		return nil
+	})
+}
+
+// DeleteRecord removes the record for prefix and persists the dataset
+func (s *CSVService) DeleteRecord(prefix netip.Prefix) error {
+	return s.update(func(data *prefixTable) error {
+		if !data.remove(prefix.Masked()) {
+			return ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// update applies change to a copy of the active data, writes it to disk and only
+// then makes it visible to lookups as a new snapshot. Signed, compressed and
+// built-in datasets are never rewritten, and neither are files holding
+// comments, unread columns or skipped rows, which the rewrite would drop.
+func (s *CSVService) update(change func(data *prefixTable) error) error {
+	if s.options.Verifier != nil || s.embedded != nil {
+		return ErrReadOnly
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.RLock()
+	data := s.data.clone()
+	compressed := s.info.Compression != ""
+	lossy := s.lossy
+	s.mu.RUnlock()
+	if compressed {
+		return ErrReadOnly
+	}
+	if lossy != "" {
+		return fmt.Errorf("%w: %s has %s that rewriting it would drop", ErrReadOnly, s.filePath, lossy)
+	}
+
+	if err := change(data); err != nil {
+		return err
+	}
+
+	content, err := encodeCSV(data, s.options.Format)
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteFileAtomic(s.filePath, content); err != nil {
+		return err
+	}
+
+	checksum := sha256.Sum256(content)
+	info := s.datasetInfo(data, hex.EncodeToString(checksum[:]))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activate(csvSnapshot{data: data, info: info, content: content})
+
+	return nil
+}
+
+// Snapshots returns the dataset versions kept in memory, most recent first
+func (s *CSVService) Snapshots() []Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := make([]Snapshot, 0, len(s.history))
+	for _, snapshot := range s.history {
+		snapshots = append(snapshots, Snapshot{
+			DatasetInfo: snapshot.info,
+			Active:      snapshot.info.Version == s.info.Version,
+		})
+	}
+	return snapshots
+}
+
+// Rollback atomically switches lookups to a previously loaded dataset version
+// and writes the data file back as it was for that version, so that a restart
+// does not bring back the version rolled back from and loads the same checksum
+func (s *CSVService) Rollback(version string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// The history only changes under writeMu
+	s.mu.RLock()
+	active := s.info.Version
+	var target *csvSnapshot
+	for i := range s.history {
+		if s.history[i].info.Version == version {
+			target = &s.history[i]
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if target == nil {
+		return ErrVersionNotFound
+	}
+	if version == active {
+		return nil
+	}
+
+	// Only rewritable files have more than one version, but make sure
+	if s.options.Verifier != nil || s.embedded != nil || target.content == nil {
+		return ErrReadOnly
+	}
+	if err := fileutil.WriteFileAtomic(s.filePath, target.content); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = target.data
+	s.info = target.info
+	s.lossy = target.lossy
+
+	return nil
+}
+
+// encodeCSV renders the table as a CSV dataset sorted by address, keeping the
+// delimiter and header of the configured format. Columns other than ip, city
+// and country are not preserved.
+func encodeCSV(data *prefixTable, format CSVFormat) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, data.records(), format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
@@ -1,7 +1,10 @@
 package ip2country
 
 import (
+	"errors"
+	"net/netip"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -67,7 +70,7 @@ func TestCSVServiceLookupIP(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			result, err := service.LookupIP(tc.ip)
 
-			if err != tc.wantErr {
+			if !errors.Is(err, tc.wantErr) {
 				t.Errorf("LookupIP(%s) error = %v, want %v", tc.ip, err, tc.wantErr)
 				return
 			}
@@ -116,3 +119,324 @@ func TestCSVServiceReadError(t *testing.T) {
 		t.Fatal("Expected error when reading a directory as a file, got nil")
 	}
 }
+
+func TestCSVServiceDatasets(t *testing.T) {
+	// Create a test CSV file with both address families
+	testFile := "test_datasets_data.csv"
+	f, err := os.Create(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	f.WriteString("192.168.1.1,New York,USA\n")
+	f.WriteString("10.0.0.1,London,UK\n")
+	f.WriteString("2001:db8::1,Paris,France\n")
+	f.Close()
+	defer os.Remove(testFile)
+
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+
+	datasets := service.Datasets()
+	if len(datasets) != 1 {
+		t.Fatalf("Expected 1 dataset, got %d", len(datasets))
+	}
+
+	info := datasets[0]
+	if info.Type != "csv" || info.Source != testFile {
+		t.Errorf("Unexpected type/source: %q %q", info.Type, info.Source)
+	}
+	if info.Records != 3 || info.IPv4Records != 2 || info.IPv6Records != 1 {
+		t.Errorf("Unexpected record counts: %+v", info)
+	}
+	if len(info.Checksum) != 64 {
+		t.Errorf("Expected a hex sha256 checksum, got %q", info.Checksum)
+	}
+	if info.Version != datasetVersion(info.Checksum) {
+		t.Errorf("Version = %q, want %q", info.Version, datasetVersion(info.Checksum))
+	}
+	if info.LoadedAt.IsZero() {
+		t.Error("Expected LoadedAt to be set")
+	}
+
+	// Every lookup result should carry the dataset version
+	result, err := service.LookupIP("2001:db8::1")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	if result.DatasetVersion != info.Version {
+		t.Errorf("Result DatasetVersion = %q, want %q", result.DatasetVersion, info.Version)
+	}
+
+	// So should lookups the dataset has no record for
+	var notFound *NotFoundError
+	if _, err := service.LookupIP("172.16.0.1"); !errors.As(err, &notFound) || notFound.DatasetVersion != info.Version {
+		t.Errorf("LookupIP of a missing address = %v, want a NotFoundError of version %q", err, info.Version)
+	}
+}
+
+func TestCSVServiceCIDRRecords(t *testing.T) {
+	testFile := "test_cidr_data.csv"
+	f, err := os.Create(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	f.WriteString("10.0.0.0/8,Private,Private\n")
+	f.WriteString("10.0.0.1,London,UK\n")
+	f.Close()
+	defer os.Remove(testFile)
+
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+
+	if result, err := service.LookupIP("10.20.30.40"); err != nil || result.Country != "Private" {
+		t.Errorf("LookupIP(10.20.30.40) = %v, %v, expected Private", result, err)
+	}
+	if result, err := service.LookupIP("10.0.0.1"); err != nil || result.Country != "UK" {
+		t.Errorf("LookupIP(10.0.0.1) = %v, %v, expected UK", result, err)
+	}
+}
+
+func TestCSVServiceWriteRecords(t *testing.T) {
+	testFile := "test_write_data.csv"
+	if err := os.WriteFile(testFile, []byte("10.0.0.1,London,UK\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	versionBefore := service.Datasets()[0].Version
+
+	// Add a range and replace an existing record
+	if err := service.PutRecord(netip.MustParsePrefix("192.168.0.0/16"), Result{Country: "Israel", City: "Tel Aviv"}); err != nil {
+		t.Fatalf("PutRecord failed: %v", err)
+	}
+	if err := service.PutRecord(netip.MustParsePrefix("10.0.0.1/32"), Result{Country: "France", City: "Paris"}); err != nil {
+		t.Fatalf("PutRecord failed: %v", err)
+	}
+
+	if result, err := service.LookupIP("192.168.4.4"); err != nil || result.Country != "Israel" {
+		t.Errorf("LookupIP(192.168.4.4) = %v, %v, expected Israel", result, err)
+	}
+	if result, err := service.LookupIP("10.0.0.1"); err != nil || result.Country != "France" {
+		t.Errorf("LookupIP(10.0.0.1) = %v, %v, expected France", result, err)
+	}
+
+	info := service.Datasets()[0]
+	if info.Version == versionBefore {
+		t.Error("Expected dataset version to change after an update")
+	}
+	if info.Records != 2 {
+		t.Errorf("Expected 2 records, got %d", info.Records)
+	}
+
+	// The file on disk should reflect the updates
+	content, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	expected := "10.0.0.1,Paris,France\n192.168.0.0/16,Tel Aviv,Israel\n"
+	if string(content) != expected {
+		t.Errorf("Persisted file = %q, expected %q", content, expected)
+	}
+
+	// Delete a record and make sure a fresh load sees the change
+	if err := service.DeleteRecord(netip.MustParsePrefix("10.0.0.1/32")); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if err := service.DeleteRecord(netip.MustParsePrefix("10.0.0.1/32")); err != ErrRecordNotFound {
+		t.Errorf("DeleteRecord of missing record error = %v, want %v", err, ErrRecordNotFound)
+	}
+
+	reloaded, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to reload CSV service: %v", err)
+	}
+	if _, err := reloaded.LookupIP("10.0.0.1"); !errors.Is(err, ErrIPNotFound) {
+		t.Errorf("LookupIP(10.0.0.1) after delete error = %v, want %v", err, ErrIPNotFound)
+	}
+	if reloaded.Datasets()[0].Checksum != service.Datasets()[0].Checksum {
+		t.Error("Expected reloaded checksum to match the persisted checksum")
+	}
+}
+
+func TestCSVServiceLossyRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lenient bool
+	}{
+		{name: "comments", content: "# Source: registry export\n10.0.0.1,London,UK\n"},
+		{name: "unread columns", content: "10.0.0.1,London,UK,Example ISP\n"},
+		{name: "skipped rows", content: "10.0.0.1,London,UK\nnot an ip,Paris,France\n", lenient: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testFile := "test_lossy_data.csv"
+			if err := os.WriteFile(testFile, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+			defer os.Remove(testFile)
+
+			service, err := NewCSVServiceWithOptions(testFile, CSVOptions{Lenient: tc.lenient})
+			if err != nil {
+				t.Fatalf("Failed to create CSV service: %v", err)
+			}
+			if err := service.PutRecord(netip.MustParsePrefix("10.0.0.2/32"), Result{Country: "France", City: "Paris"}); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("PutRecord() = %v, want %v", err, ErrReadOnly)
+			}
+			if err := service.DeleteRecord(netip.MustParsePrefix("10.0.0.1/32")); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("DeleteRecord() = %v, want %v", err, ErrReadOnly)
+			}
+			if content, err := os.ReadFile(testFile); err != nil || string(content) != tc.content {
+				t.Errorf("Data file = %q, %v, want it unchanged", content, err)
+			}
+			if result, err := service.LookupIP("10.0.0.1"); err != nil || result.Country != "UK" {
+				t.Errorf("LookupIP(10.0.0.1) = %v, %v, want the record unchanged", result, err)
+			}
+		})
+	}
+
+	// Empty trailing columns hold nothing to lose
+	testFile := "test_lossy_data.csv"
+	if err := os.WriteFile(testFile, []byte("10.0.0.1,London,UK,\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	if err := service.PutRecord(netip.MustParsePrefix("10.0.0.2/32"), Result{Country: "France", City: "Paris"}); err != nil {
+		t.Errorf("PutRecord() = %v, want nil", err)
+	}
+}
+
+func TestCSVServiceRollback(t *testing.T) {
+	testFile := "test_rollback_data.csv"
+	if err := os.WriteFile(testFile, []byte("10.0.0.1,London,UK\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	service, err := NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	original := service.Datasets()[0].Version
+
+	// Two updates produce two new versions, the oldest one falls out of the history
+	service.PutRecord(netip.MustParsePrefix("10.0.0.1/32"), Result{Country: "France", City: "Paris"})
+	good := service.Datasets()[0].Version
+	service.PutRecord(netip.MustParsePrefix("10.0.0.1/32"), Result{Country: "Bad", City: "Bad"})
+	bad := service.Datasets()[0].Version
+
+	snapshots := service.Snapshots()
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %d", len(snapshots))
+	}
+	if snapshots[0].Version != bad || !snapshots[0].Active || snapshots[1].Version != good || snapshots[1].Active {
+		t.Errorf("Unexpected snapshots: %+v", snapshots)
+	}
+
+	if err := service.Rollback(original); err != ErrVersionNotFound {
+		t.Errorf("Rollback to evicted version error = %v, want %v", err, ErrVersionNotFound)
+	}
+
+	if err := service.Rollback(good); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	result, err := service.LookupIP("10.0.0.1")
+	if err != nil || result.Country != "France" || result.DatasetVersion != good {
+		t.Errorf("LookupIP after rollback = %+v, %v", result, err)
+	}
+	if active := service.Snapshots()[1]; !active.Active || active.Version != good {
+		t.Errorf("Expected %s to be active, got %+v", good, active)
+	}
+
+	// The rolled back version is persisted
+	reloaded, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to reload CSV service: %v", err)
+	}
+	if version := reloaded.Datasets()[0].Version; version != good {
+		t.Errorf("Reloaded version = %s, want %s", version, good)
+	}
+}
+
+func TestCSVServiceRollbackRestoresFile(t *testing.T) {
+	testFile := "test_rollback_restore_data.csv"
+	original := "network,city_name,country_name\n192.168.0.0-192.168.0.255,Tel Aviv,Israel\n10.0.0.1,London,UK\n"
+	if err := os.WriteFile(testFile, []byte(original), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	service, err := NewCSVServiceWithOptions(testFile, CSVOptions{HistorySize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	loaded := service.Datasets()[0]
+	if err := service.PutRecord(netip.MustParsePrefix("10.0.0.1/32"), Result{Country: "France", City: "Paris"}); err != nil {
+		t.Fatalf("PutRecord failed: %v", err)
+	}
+
+	// The file is written back as it was loaded rather than re-encoded, so
+	// it matches the checksum reported for the version
+	if err := service.Rollback(loaded.Version); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if content, err := os.ReadFile(testFile); err != nil || string(content) != original {
+		t.Errorf("Data file after rollback = %q, %v, want %q", content, err, original)
+	}
+	reloaded, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to reload CSV service: %v", err)
+	}
+	if checksum := reloaded.Datasets()[0].Checksum; checksum != loaded.Checksum || service.Datasets()[0].Checksum != loaded.Checksum {
+		t.Errorf("Checksum after rollback = %s, reloaded %s, want %s", service.Datasets()[0].Checksum, checksum, loaded.Checksum)
+	}
+}
+
+func TestCSVServiceRangeRecords(t *testing.T) {
+	testFile := "test_range_data.csv"
+	if err := os.WriteFile(testFile, []byte("10.0.0.5-10.0.0.9,London,UK\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	service, err := NewCSVService(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+
+	for _, ip := range []string{"10.0.0.5", "10.0.0.7", "10.0.0.9"} {
+		if result, err := service.LookupIP(ip); err != nil || result == nil || result.Country != "UK" {
+			t.Errorf("LookupIP(%s) = %v, %v, expected UK", ip, result, err)
+		}
+	}
+	for _, ip := range []string{"10.0.0.4", "10.0.0.10"} {
+		if result, _ := service.LookupIP(ip); result != nil {
+			t.Errorf("LookupIP(%s) = %v, expected no match", ip, result)
+		}
+	}
+}
+
+func TestCSVServiceErrorLine(t *testing.T) {
+	testFile := "test_error_line_data.csv"
+	if err := os.WriteFile(testFile, []byte("1.1.1.1,Sydney,Australia\n10.0.0.9-10.0.0.5,London,UK\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	_, err := NewCSVService(testFile)
+	if err == nil || !strings.Contains(err.Error(), testFile+":2:") {
+		t.Fatalf("Expected error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package ip2country
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Record is a single dataset entry
+type Record struct {
+	Prefix netip.Prefix
+	Result Result
+}
+
+// InputFormats lists the formats ReadDatasetFile can read
+var InputFormats = []string{"csv", "jsonl", "snapshot"}
+
+// OutputFormats lists the formats WriteDataset can produce
+var OutputFormats = []string{"csv", "jsonl", "snapshot"}
+
+// DatasetFormat guesses the format of a dataset file from its extension,
+// ignoring a compression extension such as .gz
+func DatasetFormat(filePath string) string {
+	switch strings.ToLower(filepath.Ext(trimCompressionExt(filePath))) {
+	case ".jsonl":
+		return "jsonl"
+	case ".snap":
+		return "snapshot"
+	default:
+		return "csv"
+	}
+}
+
+// ReadDatasetFile reads all records of a dataset file, which may be gzip or
+// bzip2 compressed. An empty format is guessed from the file extension, and
+// csvFormat describes the layout of CSV files.
+func ReadDatasetFile(filePath, format string, csvFormat CSVFormat) ([]Record, error) {
+	if format == "" {
+		format = DatasetFormat(filePath)
+	}
+
+	switch format {
+	case "csv":
+		service, err := NewCSVServiceWithOptions(filePath, CSVOptions{HistorySize: 1, Format: csvFormat})
+		if err != nil {
+			return nil, err
+		}
+		return service.Records(), nil
+	case "jsonl":
+		return readJSONLinesFile(filePath)
+	case "snapshot":
+		service, err := NewSnapshotService(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer service.Close()
+		return service.Records(), nil
+	default:
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+}
+
+// readJSONLinesFile reads a dataset written by writeJSONLines. As with CSV
+// files, a later line for the same block replaces an earlier one.
+func readJSONLinesFile(filePath string) ([]Record, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening JSON lines file: %v", err)
+	}
+	defer file.Close()
+
+	reader, _, err := decompress(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	data := newPrefixTable(0)
+	interner := attributeInterner{}
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var entry struct {
+			CIDR       string     `json:"cidr"`
+			Country    string     `json:"country"`
+			City       string     `json:"city"`
+			Attributes Attributes `json:"attributes"`
+		}
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid JSON: %v", filePath, line, err)
+		}
+		network, err := ParseRange(entry.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filePath, line, err)
+		}
+		for _, prefix := range network.Prefixes() {
+			data.set(prefix, Result{Country: entry.Country, City: entry.City, Attributes: interner.intern(entry.Attributes)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading JSON lines file: %v", err)
+	}
+
+	return data.records(), nil
+}
+
+// records returns the table entries sorted by address
+func (t *prefixTable) records() []Record {
+	records := make([]Record, 0, len(t.entries))
+	for prefix, result := range t.entries {
+		records = append(records, Record{Prefix: prefix, Result: result})
+	}
+	slices.SortFunc(records, func(a, b Record) int {
+		return comparePrefixes(a.Prefix, b.Prefix)
+	})
+	return records
+}
+
+// WriteDataset writes records to w in the given output format
+func WriteDataset(w io.Writer, format string, records []Record) error {
+	switch format {
+	case "csv":
+		return writeCSV(w, records, CSVFormat{})
+	case "jsonl":
+		return writeJSONLines(w, records)
+	case "snapshot":
+		return writeSnapshot(w, records)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// writeCSV writes records as ip,city,country rows, the format read by CSVService.
+// Attributes are written as extra columns after them. A header row is written
+// when format has a column mapping or records have attributes.
+func writeCSV(w io.Writer, records []Record, format CSVFormat) error {
+	writer := csv.NewWriter(w)
+	if format.Delimiter != 0 {
+		writer.Comma = format.Delimiter
+	}
+
+	var attributes []string
+	for _, record := range records {
+		for name := range record.Result.Attributes.All() {
+			if !slices.Contains(attributes, name) {
+				attributes = append(attributes, name)
+			}
+		}
+	}
+	slices.Sort(attributes)
+
+	if format.Columns != (CSVColumns{}) || len(attributes) > 0 {
+		names := format.Columns.names()
+		header := append([]string{names[0][0], names[1][0], names[2][0]}, attributes...)
+		if err := writer.Write(header); err != nil {
+			return fmt.Errorf("error encoding CSV: %v", err)
+		}
+	}
+	for _, record := range records {
+		row := []string{formatPrefix(record.Prefix), record.Result.City, record.Result.Country}
+		for _, name := range attributes {
+			value, _ := record.Result.Attributes.Get(name)
+			row = append(row, value)
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("error encoding CSV: %v", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error encoding CSV: %v", err)
+	}
+	return nil
+}
+
+// writeJSONLines writes one JSON object per record
+func writeJSONLines(w io.Writer, records []Record) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		line := struct {
+			CIDR       string     `json:"cidr"`
+			Country    string     `json:"country"`
+			City       string     `json:"city"`
+			Attributes Attributes `json:"attributes,omitzero"`
+		}{record.Prefix.String(), record.Result.Country, record.Result.City, record.Result.Attributes}
+		if err := encoder.Encode(line); err != nil {
+			return fmt.Errorf("error encoding JSON: %v", err)
+		}
+	}
+	return nil
+}
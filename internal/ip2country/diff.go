@@ -0,0 +1,360 @@
+package ip2country
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// RangeChange is a range of addresses whose lookup result differs between two
+// datasets. Old is nil for added ranges and New is nil for removed ones.
+type RangeChange struct {
+	Range     Range    `json:"range"`
+	Addresses *big.Int `json:"addresses"`
+	Old       *Result  `json:"old,omitempty"`
+	New       *Result  `json:"new,omitempty"`
+}
+
+// CountryDelta is the change in the number of addresses of one address family
+// that resolve to a country
+type CountryDelta struct {
+	Country string   `json:"country"`
+	Family  string   `json:"family"`
+	Before  *big.Int `json:"before"`
+	After   *big.Int `json:"after"`
+	Delta   *big.Int `json:"delta"`
+}
+
+// DiffTotals counts the addresses of one address family affected by a diff.
+// Moved addresses resolve to a country in both datasets, but not the same one.
+type DiffTotals struct {
+	Added   *big.Int `json:"added"`
+	Removed *big.Int `json:"removed"`
+	Changed *big.Int `json:"changed"`
+	Moved   *big.Int `json:"moved"`
+}
+
+// DatasetDiff describes how lookups change between two datasets
+type DatasetDiff struct {
+	Old       string         `json:"old"`
+	New       string         `json:"new"`
+	Added     []RangeChange  `json:"added"`
+	Removed   []RangeChange  `json:"removed"`
+	Changed   []RangeChange  `json:"changed"`
+	Countries []CountryDelta `json:"countries"`
+	IPv4      DiffTotals     `json:"ipv4"`
+	IPv6      DiffTotals     `json:"ipv6"`
+}
+
+// segment is a range of addresses that all resolve to the same result
+type segment struct {
+	network Range
+	result  Result
+}
+
+// DiffDatasets compares the lookups answered by two sets of records. Records
+// are compared by the addresses they resolve rather than by how they are
+// written, so splitting a block or rewriting a range as CIDR blocks is not a
+// change.
+func DiffDatasets(oldRecords, newRecords []Record) *DatasetDiff {
+	diff := &DatasetDiff{
+		Added:     []RangeChange{},
+		Removed:   []RangeChange{},
+		Changed:   []RangeChange{},
+		Countries: []CountryDelta{},
+		IPv4:      newDiffTotals(),
+		IPv6:      newDiffTotals(),
+	}
+
+	oldSegments := flattenRecords(oldRecords)
+	newSegments := flattenRecords(newRecords)
+
+	for _, change := range diffSegments(oldSegments, newSegments) {
+		totals := &diff.IPv6
+		if change.Range.Start.Is4() {
+			totals = &diff.IPv4
+		}
+
+		switch {
+		case change.Old == nil:
+			diff.Added = append(diff.Added, change)
+			totals.Added.Add(totals.Added, change.Addresses)
+		case change.New == nil:
+			diff.Removed = append(diff.Removed, change)
+			totals.Removed.Add(totals.Removed, change.Addresses)
+		default:
+			diff.Changed = append(diff.Changed, change)
+			totals.Changed.Add(totals.Changed, change.Addresses)
+			if change.Old.Country != change.New.Country {
+				totals.Moved.Add(totals.Moved, change.Addresses)
+			}
+		}
+	}
+
+	diff.Countries = countryDeltas(oldSegments, newSegments)
+	return diff
+}
+
+// newDiffTotals returns totals starting at zero
+func newDiffTotals() DiffTotals {
+	return DiffTotals{Added: new(big.Int), Removed: new(big.Int), Changed: new(big.Int), Moved: new(big.Int)}
+}
+
+// flattenRecords turns possibly nested records into sorted, non-overlapping
+// segments where each address resolves to its most specific record, the same
+// way lookups do
+func flattenRecords(records []Record) []segment {
+	records = slices.Clone(records)
+	slices.SortFunc(records, func(a, b Record) int {
+		return comparePrefixes(a.Prefix, b.Prefix)
+	})
+
+	var segments []segment
+	emit := func(start, end netip.Addr, result Result) {
+		if start.IsValid() && !end.Less(start) {
+			segments = appendSegment(segments, Range{Start: start, End: end}, result)
+		}
+	}
+
+	// open holds the enclosing records of the current position, innermost last.
+	// cursor is the first address not yet emitted for the innermost record.
+	var open []segment
+	var cursor netip.Addr
+	closeTop := func() {
+		top := open[len(open)-1]
+		open = open[:len(open)-1]
+		emit(cursor, top.network.End, top.result)
+		cursor = top.network.End.Next()
+	}
+
+	for _, record := range records {
+		network := prefixRange(record.Prefix)
+		for len(open) > 0 {
+			top := open[len(open)-1].network
+			if top.Start.Is4() == network.Start.Is4() && !top.End.Less(network.Start) {
+				break
+			}
+			closeTop()
+		}
+		if len(open) > 0 {
+			emit(cursor, network.Start.Prev(), open[len(open)-1].result)
+		}
+		open = append(open, segment{network: network, result: record.Result})
+		cursor = network.Start
+	}
+	for len(open) > 0 {
+		closeTop()
+	}
+	return segments
+}
+
+// appendSegment appends a segment to a sorted list, merging it with the last
+// segment when it continues it with the same result
+func appendSegment(segments []segment, network Range, result Result) []segment {
+	if n := len(segments); n > 0 && segments[n-1].result == result && segments[n-1].network.End.Next() == network.Start {
+		segments[n-1].network.End = network.End
+		return segments
+	}
+	return append(segments, segment{network: network, result: result})
+}
+
+// walkSegments walks two sorted lists of segments side by side and calls fn for
+// each range covered by either list, with the segment of each list covering it
+// or nil
+func walkSegments(a, b []segment, fn func(network Range, fromA, fromB *segment)) {
+	i, j := 0, 0
+	var cursor netip.Addr
+	for i < len(a) || j < len(b) {
+		var current [2]*segment
+		if i < len(a) && a[i].network.Contains(cursor) {
+			current[0] = &a[i]
+		}
+		if j < len(b) && b[j].network.Contains(cursor) {
+			current[1] = &b[j]
+		}
+		if current[0] == nil && current[1] == nil {
+			// Jump to the next segment start
+			switch {
+			case i >= len(a):
+				cursor = b[j].network.Start
+			case j >= len(b):
+				cursor = a[i].network.Start
+			default:
+				cursor = a[i].network.Start
+				if b[j].network.Start.Less(cursor) {
+					cursor = b[j].network.Start
+				}
+			}
+			continue
+		}
+
+		// The piece ends where either segment ends or the other one starts
+		end := netip.Addr{}
+		limit := func(segments []segment, k int, current *segment) {
+			var candidate netip.Addr
+			switch {
+			case current != nil:
+				candidate = current.network.End
+			case k < len(segments) && segments[k].network.Start.Is4() == cursor.Is4():
+				candidate = segments[k].network.Start.Prev()
+			default:
+				return
+			}
+			if !end.IsValid() || candidate.Less(end) {
+				end = candidate
+			}
+		}
+		limit(a, i, current[0])
+		limit(b, j, current[1])
+
+		fn(Range{Start: cursor, End: end}, current[0], current[1])
+		if current[0] != nil && current[0].network.End == end {
+			i++
+		}
+		if current[1] != nil && current[1].network.End == end {
+			j++
+		}
+		cursor = end.Next()
+	}
+}
+
+// diffSegments returns the ranges where two sorted lists of segments resolve
+// differently
+func diffSegments(oldSegments, newSegments []segment) []RangeChange {
+	var changes []RangeChange
+	walkSegments(oldSegments, newSegments, func(network Range, before, after *segment) {
+		var oldResult, newResult *Result
+		if before != nil {
+			oldResult = &before.result
+		}
+		if after != nil {
+			newResult = &after.result
+		}
+		if oldResult != nil && newResult != nil && *oldResult == *newResult {
+			return
+		}
+
+		// Merge with the previous change when it continues it
+		if n := len(changes); n > 0 {
+			last := &changes[n-1]
+			if last.Range.End.Next() == network.Start && sameResult(last.Old, oldResult) && sameResult(last.New, newResult) {
+				last.Range.End = network.End
+				last.Addresses = last.Range.Size()
+				return
+			}
+		}
+		changes = append(changes, RangeChange{Range: network, Addresses: network.Size(), Old: oldResult, New: newResult})
+	})
+	return changes
+}
+
+// sameResult reports whether two optional results are equal
+func sameResult(a, b *Result) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// countryDeltas sums the addresses resolving to each country before and after,
+// per address family, and returns the countries whose totals changed
+func countryDeltas(oldSegments, newSegments []segment) []CountryDelta {
+	type key struct{ country, family string }
+	totals := make(map[key][2]*big.Int)
+	count := func(segments []segment, side int) {
+		for _, s := range segments {
+			k := key{country: s.result.Country, family: addressFamily(s.network.Start)}
+			sums, ok := totals[k]
+			if !ok {
+				sums = [2]*big.Int{new(big.Int), new(big.Int)}
+				totals[k] = sums
+			}
+			sums[side].Add(sums[side], s.network.Size())
+		}
+	}
+	count(oldSegments, 0)
+	count(newSegments, 1)
+
+	deltas := []CountryDelta{}
+	for k, sums := range totals {
+		delta := new(big.Int).Sub(sums[1], sums[0])
+		if delta.Sign() == 0 {
+			continue
+		}
+		deltas = append(deltas, CountryDelta{Country: k.country, Family: k.family, Before: sums[0], After: sums[1], Delta: delta})
+	}
+	slices.SortFunc(deltas, func(a, b CountryDelta) int {
+		if c := strings.Compare(a.Family, b.Family); c != 0 {
+			return c
+		}
+		// Largest changes first
+		if c := new(big.Int).Abs(b.Delta).Cmp(new(big.Int).Abs(a.Delta)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Country, b.Country)
+	})
+	return deltas
+}
+
+// addressFamily names the address family of addr
+func addressFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// String formats the diff for humans: one line per changed range, followed by
+// the per-country deltas and the totals
+func (d *DatasetDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", d.Old, d.New)
+
+	changes := slices.Concat(d.Added, d.Removed, d.Changed)
+	slices.SortFunc(changes, func(a, b RangeChange) int {
+		return a.Range.Start.Compare(b.Range.Start)
+	})
+	for _, change := range changes {
+		switch {
+		case change.Old == nil:
+			fmt.Fprintf(&b, "+ %s %s\n", change.Range, formatResult(change.New))
+		case change.New == nil:
+			fmt.Fprintf(&b, "- %s %s\n", change.Range, formatResult(change.Old))
+		default:
+			fmt.Fprintf(&b, "~ %s %s -> %s\n", change.Range, formatResult(change.Old), formatResult(change.New))
+		}
+	}
+
+	if len(d.Countries) > 0 {
+		b.WriteString("\nCountries:\n")
+		for _, delta := range d.Countries {
+			fmt.Fprintf(&b, "  %s (%s): %s -> %s (%+d)\n", delta.Country, delta.Family, delta.Before, delta.After, delta.Delta)
+		}
+	}
+
+	b.WriteString("\n")
+	for _, family := range []struct {
+		name   string
+		totals DiffTotals
+	}{{"IPv4", d.IPv4}, {"IPv6", d.IPv6}} {
+		fmt.Fprintf(&b, "%s: %s added, %s removed, %s changed, %s moved between countries\n",
+			family.name, family.totals.Added, family.totals.Removed, family.totals.Changed, family.totals.Moved)
+	}
+	return b.String()
+}
+
+// formatResult formats a lookup result as "city, country", followed by its
+// attributes in brackets
+func formatResult(result *Result) string {
+	if !result.Attributes.IsZero() {
+		return result.City + ", " + result.Country + " [" + result.Attributes.String() + "]"
+	}
+	return result.City + ", " + result.Country
+}
+
+// MarshalText formats the range the way it is written in a dataset file
+func (r Range) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
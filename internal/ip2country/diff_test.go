@@ -0,0 +1,153 @@
+package ip2country
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// parseRecords builds records from "prefix,city,country" lines
+func parseRecords(t *testing.T, lines ...string) []Record {
+	var records []Record
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		network, err := ParseRange(fields[0])
+		if err != nil {
+			t.Fatalf("Invalid test range %q: %v", fields[0], err)
+		}
+		for _, prefix := range network.Prefixes() {
+			records = append(records, Record{Prefix: prefix, Result: Result{City: fields[1], Country: fields[2]}})
+		}
+	}
+	return records
+}
+
+func TestFlattenRecords(t *testing.T) {
+	records := parseRecords(t,
+		"10.0.0.0/8,Private,Private",
+		"10.0.0.0/24,London,UK",
+		"10.0.0.5,Paris,France",
+		"10.255.255.255,Rome,Italy",
+		"2001:db8::/32,Berlin,Germany",
+	)
+
+	expected := []string{
+		"10.0.0.0-10.0.0.4 UK",
+		"10.0.0.5 France",
+		"10.0.0.6-10.0.0.255 UK",
+		"10.0.1.0-10.255.255.254 Private",
+		"10.255.255.255 Italy",
+		"2001:db8::/32 Germany",
+	}
+
+	segments := flattenRecords(records)
+	if len(segments) != len(expected) {
+		t.Fatalf("flattenRecords returned %d segments, want %d: %v", len(segments), len(expected), segments)
+	}
+	for i, s := range segments {
+		if got := s.network.String() + " " + s.result.Country; got != expected[i] {
+			t.Errorf("segment %d = %s, want %s", i, got, expected[i])
+		}
+	}
+}
+
+func TestDiffDatasets(t *testing.T) {
+	oldRecords := parseRecords(t,
+		"1.1.1.0/24,Sydney,Australia",
+		"2.2.2.0/24,Paris,France",
+		"4.4.4.0/24,Berlin,Germany",
+		"10.0.0.0/8,Private,Private",
+		"10.0.0.1,London,UK",
+		"2001:db8::/32,Berlin,Germany",
+	)
+	newRecords := parseRecords(t,
+		"1.1.1.0/25,Sydney,Australia",
+		"1.1.1.128/25,Auckland,New Zealand",
+		"3.3.3.3,Rome,Italy",
+		"4.4.4.0-4.4.4.255,Munich,Germany",
+		"10.0.0.0/8,Private,Private",
+		"2001:db8::/33,Berlin,Germany",
+	)
+
+	diff := DiffDatasets(oldRecords, newRecords)
+
+	tests := []struct {
+		name     string
+		changes  []RangeChange
+		expected []string
+	}{
+		{name: "added", changes: diff.Added, expected: []string{"3.3.3.3"}},
+		{name: "removed", changes: diff.Removed, expected: []string{"2.2.2.0/24", "2001:db8:8000::/33"}},
+		{name: "changed", changes: diff.Changed, expected: []string{"1.1.1.128/25", "4.4.4.0/24", "10.0.0.1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.changes) != len(tc.expected) {
+				t.Fatalf("got %d ranges, want %d: %v", len(tc.changes), len(tc.expected), tc.changes)
+			}
+			for i, change := range tc.changes {
+				if change.Range.String() != tc.expected[i] {
+					t.Errorf("range %d = %s, want %s", i, change.Range, tc.expected[i])
+				}
+			}
+		})
+	}
+
+	// 1.1.1.128/25 moved to New Zealand and 10.0.0.1 went back to Private;
+	// the Berlin to Munich change stays within Germany
+	totals := map[string]string{
+		"IPv4 added":   diff.IPv4.Added.String(),
+		"IPv4 removed": diff.IPv4.Removed.String(),
+		"IPv4 changed": diff.IPv4.Changed.String(),
+		"IPv4 moved":   diff.IPv4.Moved.String(),
+		"IPv6 moved":   diff.IPv6.Moved.String(),
+	}
+	expectedTotals := map[string]string{
+		"IPv4 added":   "1",
+		"IPv4 removed": "256",
+		"IPv4 changed": "385",
+		"IPv4 moved":   "129",
+		"IPv6 moved":   "0",
+	}
+	for name, want := range expectedTotals {
+		if totals[name] != want {
+			t.Errorf("%s = %s, want %s", name, totals[name], want)
+		}
+	}
+
+	deltas := make(map[string]string)
+	for _, delta := range diff.Countries {
+		deltas[delta.Country+"/"+delta.Family] = delta.Delta.String()
+	}
+	expectedDeltas := map[string]string{
+		"France/ipv4":      "-256",
+		"Australia/ipv4":   "-128",
+		"New Zealand/ipv4": "128",
+		"Italy/ipv4":       "1",
+		"UK/ipv4":          "-1",
+		"Private/ipv4":     "1",
+		"Germany/ipv6":     "-39614081257132168796771975168",
+	}
+	if len(deltas) != len(expectedDeltas) {
+		t.Errorf("Countries = %v, want %v", deltas, expectedDeltas)
+	}
+	for key, want := range expectedDeltas {
+		if deltas[key] != want {
+			t.Errorf("delta %s = %s, want %s", key, deltas[key], want)
+		}
+	}
+}
+
+func TestDiffDatasetsIgnoresLayout(t *testing.T) {
+	// The same addresses written as one range or as several blocks
+	oldRecords := parseRecords(t, "10.0.0.0/23,London,UK")
+	newRecords := []Record{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/24"), Result: Result{City: "London", Country: "UK"}},
+		{Prefix: netip.MustParsePrefix("10.0.1.0/24"), Result: Result{City: "London", Country: "UK"}},
+	}
+
+	diff := DiffDatasets(oldRecords, newRecords)
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed)+len(diff.Countries) != 0 {
+		t.Errorf("Expected no differences, got %s", diff)
+	}
+}
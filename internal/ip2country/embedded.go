@@ -0,0 +1,30 @@
+package ip2country
+
+import _ "embed"
+
+// DefaultDatasetSource is the source reported for the built-in dataset
+const DefaultDatasetSource = "embedded:ip2country.csv.gz"
+
+// defaultDataset is a small gzip compressed CSV dataset built into the binary,
+// regenerated from data/ip2country.csv with make embed-data
+//
+//go:embed defaultdata/ip2country.csv.gz
+var defaultDataset []byte
+
+// NewDefaultCSVService serves lookups from the built-in dataset. It is used
+// when no dataset file is configured and is read-only. Being part of the
+// binary, it is neither signed nor affected by the CSV layout settings.
+func NewDefaultCSVService() (*CSVService, error) {
+	service := &CSVService{
+		filePath: DefaultDatasetSource,
+		embedded: defaultDataset,
+		options:  CSVOptions{HistorySize: 1},
+		data:     newPrefixTable(0),
+	}
+
+	if err := service.loadData(); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
@@ -1,9 +1,59 @@
 package ip2country
 
-import "net"
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+)
 
 // isValidIP checks if the provided string is a valid IP address
 func isValidIP(ip string) bool {
 	parsedIP := net.ParseIP(ip)
 	return parsedIP != nil
 }
+
+// isIPv6 reports whether ip is a valid address that is not IPv4
+func isIPv6(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	return parsedIP != nil && parsedIP.To4() == nil
+}
+
+// datasetVersion derives a short, stable version string from a dataset checksum,
+// so that replicas loading the same file report the same version
+func datasetVersion(checksum string) string {
+	if len(checksum) > 12 {
+		checksum = checksum[:12]
+	}
+	return "sha256-" + checksum
+}
+
+// redactURL returns rawURL without what it may carry besides the location of
+// a dataset: the password, as url.URL.Redacted hides it, a user name without
+// password, which usually is a token itself, and the query string and
+// fragment, which may hold signed tokens
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); !hasPassword {
+			u.User = url.User("xxxxx")
+		}
+	}
+	u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = "", false, "", ""
+	return u.Redacted()
+}
+
+// closeServices closes every service that holds resources, such as mapped
+// snapshots or polling goroutines, and returns the errors joined
+func closeServices(services ...Service) error {
+	var errs []error
+	for _, service := range services {
+		if closer, ok := service.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
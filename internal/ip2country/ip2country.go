@@ -1,7 +1,13 @@
 package ip2country
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
+	"net/netip"
+	"os"
+
 	"ip2country-api/internal/config"
 )
 
@@ -10,18 +16,227 @@ type Service interface {
 	LookupIP(ip string) (*Result, error)
 }
 
+// ClientLookup is implemented by services whose answer may depend on the
+// client asking, such as a canary routing each client to one backend
+type ClientLookup interface {
+	LookupIPFor(client, ip string) (*Result, error)
+}
+
+// LookupIPFor looks ip up on behalf of the client at address client. Services
+// that do not route by client answer as for LookupIP.
+func LookupIPFor(service Service, client, ip string) (*Result, error) {
+	if lookup, ok := service.(ClientLookup); ok {
+		return lookup.LookupIPFor(client, ip)
+	}
+	return service.LookupIP(ip)
+}
+
+// MetadataProvider is implemented by services that can describe the
+// datasets they serve lookups from
+type MetadataProvider interface {
+	Datasets() []DatasetInfo
+}
+
+// WritableService is implemented by services whose records can be changed at runtime
+type WritableService interface {
+	Service
+	PutRecord(prefix netip.Prefix, result Result) error
+	DeleteRecord(prefix netip.Prefix) error
+}
+
+// VersionedService is implemented by services that keep previously loaded
+// dataset versions and can switch back to one of them
+type VersionedService interface {
+	Service
+	Snapshots() []Snapshot
+	Rollback(version string) error
+}
+
+// Wrapper is implemented by services that layer behaviour over another Service
+type Wrapper interface {
+	Unwrap() Service
+}
+
+// As returns the first service in the chain of wrapped services that implements T,
+// so optional capabilities of a backend stay reachable through wrappers
+func As[T any](service Service) (T, bool) {
+	for service != nil {
+		if target, ok := service.(T); ok {
+			return target, true
+		}
+		wrapper, ok := service.(Wrapper)
+		if !ok {
+			break
+		}
+		service = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// ShadowReporter is implemented by services that compare lookups against a shadow backend
+type ShadowReporter interface {
+	Summary() ShadowSummary
+}
+
+// CanaryRouter is implemented by services that split lookups between a stable
+// and a candidate backend
+type CanaryRouter interface {
+	Stats() CanaryStats
+	SetPercent(percent float64) error
+}
+
 // NewService creates a new IP-to-country lookup service based on the configuration.
+// An optional canary backend takes a share of the lookups, an optional shadow
+// backend is compared against the result, and an optional overrides file is
+// layered on top of everything. Closing the service, when it implements
+// io.Closer, closes every backend it wraps. On error the backends created so
+// far are closed.
 func NewService(config config.BackendConfig) (Service, error) {
+	service, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
 
+	if config.Canary != nil {
+		candidate, err := newBackend(*config.Canary)
+		if err != nil {
+			closeServices(service)
+			return nil, fmt.Errorf("failed to initialize canary backend: %v", err)
+		}
+		canary, err := NewCanaryService(service, candidate, config.CanaryPercent)
+		if err != nil {
+			closeServices(service, candidate)
+			return nil, err
+		}
+		service = canary
+	}
+
+	if config.Shadow != nil {
+		shadow, err := newBackend(*config.Shadow)
+		if err != nil {
+			closeServices(service)
+			return nil, fmt.Errorf("failed to initialize shadow backend: %v", err)
+		}
+		service = NewShadowService(service, shadow, config.ShadowSampleRate)
+	}
+
+	if config.OverridesPath != "" {
+		verifier, err := ParseTrustedKeys(config.TrustedKeys)
+		if err != nil {
+			closeServices(service)
+			return nil, fmt.Errorf("invalid trusted keys: %v", err)
+		}
+		options := OverrideOptions{ReloadInterval: config.OverridesReloadInterval, Verifier: verifier}
+		overrides, err := NewOverrideServiceWithOptions(service, config.OverridesPath, options)
+		if err != nil {
+			closeServices(service)
+			return nil, err
+		}
+		service = overrides
+	}
+	return service, nil
+}
+
+// newBackend creates the lookup backend selected by config.Type
+func newBackend(config config.BackendConfig) (Service, error) {
 	switch config.Type {
 	case "csv":
-		return NewCSVService(config.CSVPath)
+		if usesDefaultDataset(config.CSVPath) {
+			// The built-in dataset is not signed
+			if config.TrustedKeys != "" {
+				return nil, errors.New("trusted keys are configured but no signed CSV dataset was found, refusing to serve the built-in dataset")
+			}
+			service, err := NewDefaultCSVService()
+			if err != nil {
+				return nil, err
+			}
+			if config.CSVPath != "" {
+				log.Printf("csv: %s not found, serving the built-in dataset", config.CSVPath)
+			}
+			return service, nil
+		}
+		format, err := csvFormat(config)
+		if err != nil {
+			return nil, err
+		}
+		verifier, err := ParseTrustedKeys(config.TrustedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted keys: %v", err)
+		}
+		options := CSVOptions{HistorySize: config.HistorySize, Format: format, Lenient: config.CSVLenient, Verifier: verifier}
+		return openDataset(config, config.CSVPath, func(path string) (Service, error) {
+			service, err := NewCSVServiceWithOptions(path, options)
+			if err != nil {
+				return nil, err
+			}
+			return service, nil
+		})
+	case "snapshot":
+		verifier, err := ParseTrustedKeys(config.TrustedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted keys: %v", err)
+		}
+		return openDataset(config, config.SnapshotPath, func(path string) (Service, error) {
+			service, err := NewSnapshotServiceWithOptions(path, SnapshotOptions{Verifier: verifier})
+			if err != nil {
+				return nil, err
+			}
+			return service, nil
+		})
 	case "mongodb":
 		return NewMongoDBService(config.MongoURI)
 	case "redis":
 		return NewRedisService(config.RedisAddr)
-
 	default:
 		return nil, fmt.Errorf("unsupported database type: %s", config.Type)
 	}
 }
+
+// usesDefaultDataset reports whether the built-in dataset is served instead of
+// the CSV file at path, which is only when the default path does not exist.
+// Secondary backends always have a path of their own.
+func usesDefaultDataset(path string) bool {
+	if path != config.DefaultCSVPath {
+		return false
+	}
+	_, err := os.Stat(path)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// openDataset opens the dataset file at path with open, or downloads and
+// polls it first, with its signature when keys are trusted, when path is an
+// http(s) URL
+func openDataset(config config.BackendConfig, path string, open func(path string) (Service, error)) (Service, error) {
+	if !IsRemoteDataset(path) {
+		return open(path)
+	}
+	options := RemoteOptions{
+		SHA256:       config.DatasetSHA256,
+		PollInterval: config.DatasetPollInterval,
+		Signed:       config.TrustedKeys != "",
+		HistorySize:  config.HistorySize,
+	}
+	service, err := NewRemoteService(path, open, options)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// csvFormat parses the CSV layout settings of a backend configuration
+func csvFormat(config config.BackendConfig) (CSVFormat, error) {
+	delimiter, err := ParseCSVDelimiter(config.CSVDelimiter)
+	if err != nil {
+		return CSVFormat{}, fmt.Errorf("invalid CSV delimiter: %v", err)
+	}
+	columns, err := ParseCSVColumns(config.CSVColumns)
+	if err != nil {
+		return CSVFormat{}, fmt.Errorf("invalid CSV columns: %v", err)
+	}
+	attributes, err := ParseCSVAttributes(config.CSVAttributes)
+	if err != nil {
+		return CSVFormat{}, fmt.Errorf("invalid CSV attributes: %v", err)
+	}
+	return CSVFormat{Delimiter: delimiter, Columns: columns, Attributes: attributes}, nil
+}
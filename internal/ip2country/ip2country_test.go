@@ -7,6 +7,7 @@ import (
 )
 
 func TestNewService(t *testing.T) {
+	_, public := newTestKey(t)
 	tests := []struct {
 		name        string
 		config      config.BackendConfig
@@ -20,6 +21,47 @@ func TestNewService(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "Missing default CSV file",
+			config: config.BackendConfig{
+				Type:    "csv",
+				CSVPath: config.DefaultCSVPath,
+			},
+			expectError: false,
+		},
+		{
+			name: "Missing default CSV file with trusted keys",
+			config: config.BackendConfig{
+				Type:        "csv",
+				CSVPath:     config.DefaultCSVPath,
+				TrustedKeys: public,
+			},
+			expectError: true,
+		},
+		{
+			name: "Missing CSV file",
+			config: config.BackendConfig{
+				Type:    "csv",
+				CSVPath: "missing.csv",
+			},
+			expectError: true,
+		},
+		{
+			name: "Snapshot Service",
+			config: config.BackendConfig{
+				Type:         "snapshot",
+				SnapshotPath: writeTestSnapshot(t, "1.1.1.0/24,Sydney,Australia"),
+			},
+			expectError: false,
+		},
+		{
+			name: "Missing snapshot file",
+			config: config.BackendConfig{
+				Type:         "snapshot",
+				SnapshotPath: "missing.snap",
+			},
+			expectError: true,
+		},
 		{
 			name: "MongoDB Service",
 			config: config.BackendConfig{
@@ -36,6 +78,62 @@ func TestNewService(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "Redis Service with overrides",
+			config: config.BackendConfig{
+				Type:          "redis",
+				RedisAddr:     "localhost:6379",
+				OverridesPath: createTestOverridesFile(t),
+			},
+			expectError: false,
+		},
+		{
+			name: "MongoDB Service with shadow",
+			config: config.BackendConfig{
+				Type:             "mongodb",
+				MongoURI:         "mongodb://localhost:27017",
+				Shadow:           &config.BackendConfig{Type: "redis", RedisAddr: "localhost:6379"},
+				ShadowSampleRate: 0.5,
+			},
+			expectError: false,
+		},
+		{
+			name: "Redis Service with canary",
+			config: config.BackendConfig{
+				Type:          "redis",
+				RedisAddr:     "localhost:6379",
+				Canary:        &config.BackendConfig{Type: "mongodb", MongoURI: "mongodb://localhost:27017"},
+				CanaryPercent: 10,
+			},
+			expectError: false,
+		},
+		{
+			name: "Unsupported canary",
+			config: config.BackendConfig{
+				Type:      "redis",
+				RedisAddr: "localhost:6379",
+				Canary:    &config.BackendConfig{Type: "unsupported"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Unsupported shadow",
+			config: config.BackendConfig{
+				Type:      "redis",
+				RedisAddr: "localhost:6379",
+				Shadow:    &config.BackendConfig{Type: "unsupported"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Missing overrides file",
+			config: config.BackendConfig{
+				Type:          "redis",
+				RedisAddr:     "localhost:6379",
+				OverridesPath: "missing_overrides.csv",
+			},
+			expectError: true,
+		},
 		{
 			name: "Unsupported Service",
 			config: config.BackendConfig{
@@ -66,6 +164,12 @@ func TestNewService(t *testing.T) {
 			if tc.config.Type == "csv" {
 				os.Remove(tc.config.CSVPath)
 			}
+			if tc.config.OverridesPath != "" {
+				os.Remove(tc.config.OverridesPath)
+			}
+			if closer, ok := service.(interface{ Close() error }); ok {
+				closer.Close()
+			}
 		})
 	}
 }
@@ -81,3 +185,82 @@ func createTestCSVFile(t *testing.T) string {
 	f.Close()
 	return testFile
 }
+
+// Helper function to create a test overrides file
+func createTestOverridesFile(t *testing.T) string {
+	testFile := "test_service_overrides.csv"
+	if err := os.WriteFile(testFile, []byte("10.0.0.0/8,Tel Aviv,Israel\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	return testFile
+}
+
+func TestAs(t *testing.T) {
+	testFile := createTestCSVFile(t)
+	defer os.Remove(testFile)
+	overridesFile := createTestOverridesFile(t)
+	defer os.Remove(overridesFile)
+
+	service, err := NewService(config.BackendConfig{
+		Type:          "csv",
+		CSVPath:       testFile,
+		Shadow:        &config.BackendConfig{Type: "redis", RedisAddr: "localhost:6379"},
+		OverridesPath: overridesFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.(*OverrideService).Close()
+
+	// Capabilities of the CSV backend are reachable through the wrappers
+	writable, ok := As[WritableService](service)
+	if !ok {
+		t.Fatal("Expected the CSV backend to be found as a WritableService")
+	}
+	if _, isCSV := writable.(*CSVService); !isCSV {
+		t.Errorf("Expected *CSVService, got %T", writable)
+	}
+	if _, ok := As[ShadowReporter](service); !ok {
+		t.Error("Expected the shadow service to be found as a ShadowReporter")
+	}
+
+	// Services without the capability are reported as such
+	if _, ok := As[WritableService](&MongoDBService{}); ok {
+		t.Error("Did not expect MongoDBService to be writable")
+	}
+}
+
+// closingService counts how often it is closed
+type closingService struct {
+	stubService
+	closed int
+}
+
+func (s *closingService) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestCloseClosesWrappedServices(t *testing.T) {
+	stable := &closingService{}
+	candidate := &closingService{}
+	shadow := &closingService{}
+
+	canary, err := NewCanaryService(stable, candidate, 10)
+	if err != nil {
+		t.Fatalf("Failed to create canary service: %v", err)
+	}
+	overrides, err := NewOverrideService(NewShadowService(canary, shadow, 1), createTestOverridesFile(t), 0)
+	if err != nil {
+		t.Fatalf("Failed to create override service: %v", err)
+	}
+
+	if err := overrides.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	for name, service := range map[string]*closingService{"stable": stable, "candidate": candidate, "shadow": shadow} {
+		if service.closed != 1 {
+			t.Errorf("Expected the %s service to be closed once, got %d", name, service.closed)
+		}
+	}
+}
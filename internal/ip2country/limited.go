@@ -0,0 +1,48 @@
+package ip2country
+
+import "time"
+
+// ConcurrencyLimiter limits the lookups in flight. Every lookup allowed by
+// Acquire must call Release with its latency.
+type ConcurrencyLimiter interface {
+	Acquire() error
+	Release(latency time.Duration)
+}
+
+// LimitedService limits the lookups in flight on another Service. Only the
+// lookup itself is timed, so the latency the limiter adapts to is the
+// backend's own and not that of encoding and writing the response.
+type LimitedService struct {
+	service Service
+	limiter ConcurrencyLimiter
+}
+
+// NewLimitedService creates a new LimitedService looking up in service while
+// limiter allows it
+func NewLimitedService(service Service, limiter ConcurrencyLimiter) *LimitedService {
+	return &LimitedService{service: service, limiter: limiter}
+}
+
+// LookupIP looks ip up, or returns ErrOverloaded while the limiter is full
+func (s *LimitedService) LookupIP(ip string) (*Result, error) {
+	return s.LookupIPFor("", ip)
+}
+
+// LookupIPFor is LookupIP on behalf of client. Malformed addresses are
+// rejected without taking a place, so they do not skew the latency measured.
+func (s *LimitedService) LookupIPFor(client, ip string) (*Result, error) {
+	if !isValidIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	if err := s.limiter.Acquire(); err != nil {
+		return nil, ErrOverloaded
+	}
+	start := time.Now()
+	defer func() { s.limiter.Release(time.Since(start)) }()
+	return LookupIPFor(s.service, client, ip)
+}
+
+// Unwrap returns the limited service
+func (s *LimitedService) Unwrap() Service {
+	return s.service
+}
@@ -0,0 +1,67 @@
+package ip2country
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// mockConcurrencyLimiter allows up to limit lookups at once and records the
+// latencies released
+type mockConcurrencyLimiter struct {
+	limit     int
+	inFlight  int
+	latencies []time.Duration
+}
+
+func (m *mockConcurrencyLimiter) Acquire() error {
+	if m.inFlight >= m.limit {
+		return errors.New("concurrency limit exceeded")
+	}
+	m.inFlight++
+	return nil
+}
+
+func (m *mockConcurrencyLimiter) Release(latency time.Duration) {
+	m.inFlight--
+	m.latencies = append(m.latencies, latency)
+}
+
+// funcService looks up with a function
+type funcService func(ip string) (*Result, error)
+
+func (f funcService) LookupIP(ip string) (*Result, error) {
+	return f(ip)
+}
+
+func TestLimitedService(t *testing.T) {
+	limiter := &mockConcurrencyLimiter{limit: 1}
+	var service *LimitedService
+	var nested error
+	service = NewLimitedService(funcService(func(ip string) (*Result, error) {
+		// A lookup arriving while this one is in flight is turned away
+		_, nested = service.LookupIP("8.8.8.8")
+		time.Sleep(time.Millisecond)
+		return &Result{Country: "Australia"}, nil
+	}), limiter)
+
+	result, err := service.LookupIP("1.1.1.1")
+	if err != nil || result.Country != "Australia" {
+		t.Errorf("LookupIP() = %+v, %v, want Australia", result, err)
+	}
+	if nested != ErrOverloaded {
+		t.Errorf("lookup over the limit = %v, want %v", nested, ErrOverloaded)
+	}
+	// Malformed addresses do not take a place
+	if _, err := service.LookupIP("invalid-ip"); err != ErrInvalidIP {
+		t.Errorf("LookupIP(invalid-ip) = %v, want %v", err, ErrInvalidIP)
+	}
+
+	// Only the lookup allowed in reports its latency, and its place is free
+	if len(limiter.latencies) != 1 || limiter.latencies[0] < time.Millisecond {
+		t.Errorf("latencies = %v, want one of at least 1ms", limiter.latencies)
+	}
+	if limiter.inFlight != 0 {
+		t.Errorf("in flight after the lookup = %d, want 0", limiter.inFlight)
+	}
+}
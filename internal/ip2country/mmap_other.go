@@ -0,0 +1,18 @@
+//go:build !unix
+
+package ip2country
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// mapFile reads size bytes of file into memory on platforms without mmap
+func mapFile(file *os.File, size int) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, nil, fmt.Errorf("error reading file: %v", err)
+	}
+	return data, func() error { return nil }, nil
+}
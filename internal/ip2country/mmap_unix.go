@@ -0,0 +1,19 @@
+//go:build unix
+
+package ip2country
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps size bytes of file read-only into memory. Pages are loaded on
+// first access and shared with every other process mapping the same file.
+func mapFile(file *os.File, size int) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error mapping file: %v", err)
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -1,5 +1,7 @@
 package ip2country
 
+import "net/url"
+
 // MongoDBService implements Service by reading data from a MongoDB database
 type MongoDBService struct {
 	uri string
@@ -14,3 +16,13 @@ func (s *MongoDBService) LookupIP(ip string) (*Result, error) {
 	// ... MongoDBService lookup implementation ...
 	return nil, nil
 }
+
+// Datasets returns metadata about the MongoDB dataset
+func (s *MongoDBService) Datasets() []DatasetInfo {
+	// Never expose credentials embedded in the connection string
+	source := s.uri
+	if u, err := url.Parse(s.uri); err == nil {
+		source = u.Redacted()
+	}
+	return []DatasetInfo{{Type: "mongodb", Source: source}}
+}
@@ -0,0 +1,335 @@
+package ip2country
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// override holds the bookkeeping fields of a local correction
+type override struct {
+	expires time.Time // zero means the override never expires
+	comment string
+}
+
+// OverrideOptions holds optional settings of an OverrideService
+type OverrideOptions struct {
+	// ReloadInterval is how often the overrides file is checked for changes.
+	// Zero disables reloading.
+	ReloadInterval time.Duration
+
+	// Verifier, when set, requires a valid detached signature next to the
+	// overrides file on every load
+	Verifier *DatasetVerifier
+}
+
+// OverrideService applies local corrections from an overrides file on top of
+// another Service. Overrides always take precedence over the base backend.
+//
+// The overrides file is a CSV file with the columns
+// cidr,city,country[,expires[,comment]] where expires is an RFC 3339 timestamp
+// (or empty) and comment is free text such as a ticket reference. Lines
+// starting with '#' are ignored.
+type OverrideService struct {
+	base     Service
+	filePath string
+	options  OverrideOptions
+
+	data      *prefixTable
+	overrides map[netip.Prefix]override
+	info      DatasetInfo
+	stamp     fileStamp
+	mu        sync.RWMutex
+
+	now       func() time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewOverrideService creates a new OverrideService layered over base. When
+// reloadInterval is positive the overrides file is checked for changes on that
+// interval and reloaded independently of the base backend.
+func NewOverrideService(base Service, filePath string, reloadInterval time.Duration) (*OverrideService, error) {
+	return NewOverrideServiceWithOptions(base, filePath, OverrideOptions{ReloadInterval: reloadInterval})
+}
+
+// NewOverrideServiceWithOptions creates a new OverrideService layered over base
+// with the given options
+func NewOverrideServiceWithOptions(base Service, filePath string, options OverrideOptions) (*OverrideService, error) {
+	service := &OverrideService{
+		base:      base,
+		filePath:  filePath,
+		options:   options,
+		data:      newPrefixTable(0),
+		overrides: make(map[netip.Prefix]override),
+		now:       time.Now,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	if err := service.loadData(); err != nil {
+		return nil, err
+	}
+
+	if options.ReloadInterval > 0 {
+		go service.watch(options.ReloadInterval)
+	} else {
+		close(service.done)
+	}
+
+	return service, nil
+}
+
+// loadData reads the overrides file and replaces the active overrides
+func (s *OverrideService) loadData() error {
+	start := time.Now()
+
+	file, err := os.Open(s.filePath)
+	if err != nil {
+		return fmt.Errorf("error opening overrides file: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading overrides file: %v", err)
+	}
+	stamp := s.fileStamp(stat)
+
+	hash := sha256.New()
+	reader := csv.NewReader(io.TeeReader(file, hash))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	data := newPrefixTable(0)
+	overrides := make(map[netip.Prefix]override)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading overrides file: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(record) < 3 || len(record) > 5 {
+			return fmt.Errorf("%s:%d: expected 3 to 5 columns (cidr,city,country[,expires[,comment]])", s.filePath, line)
+		}
+		prefix, err := ParsePrefix(record[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", s.filePath, line, err)
+		}
+		country := strings.TrimSpace(record[2])
+		if country == "" {
+			return fmt.Errorf("%s:%d: empty country", s.filePath, line)
+		}
+
+		var entry override
+		if len(record) > 3 && strings.TrimSpace(record[3]) != "" {
+			entry.expires, err = time.Parse(time.RFC3339, strings.TrimSpace(record[3]))
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid expiry %q, expected RFC 3339", s.filePath, line, record[3])
+			}
+		}
+		if len(record) > 4 {
+			entry.comment = strings.TrimSpace(record[4])
+		}
+
+		// Expired overrides no longer apply, flag them so that
+		// someone cleans up the file
+		if !entry.expires.IsZero() && !start.Before(entry.expires) {
+			log.Printf("overrides: %s:%d: %s expired at %s (%s)", s.filePath, line, prefix, entry.expires.Format(time.RFC3339), entry.comment)
+		}
+
+		data.set(prefix, Result{Country: country, City: strings.TrimSpace(record[1])})
+		overrides[prefix] = entry
+	}
+
+	// The reader reached the end of the file, so all of it was hashed
+	digest := hash.Sum(nil)
+	signer, err := s.options.Verifier.verifyFile(s.filePath, digest)
+	if err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(digest)
+	info := DatasetInfo{
+		Type:     "overrides",
+		Source:   s.filePath,
+		Records:  len(data.entries),
+		Checksum: checksum,
+		Version:  datasetVersion(checksum),
+		Signer:   signer,
+		LoadedAt: time.Now(),
+	}
+	info.LoadDuration = info.LoadedAt.Sub(start)
+	data.describe(&info)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	s.overrides = overrides
+	s.info = info
+	s.stamp = stamp
+
+	return nil
+}
+
+// fileStamp identifies a version of the overrides file and, when signatures
+// are verified, of its signature file, so that re-signing the same overrides
+// is picked up too
+type fileStamp struct {
+	modTime          time.Time
+	size             int64
+	signatureModTime time.Time
+	signatureSize    int64
+}
+
+// fileStamp returns the stamp of the overrides file described by stat. A
+// missing signature file leaves the signature fields zero.
+func (s *OverrideService) fileStamp(stat os.FileInfo) fileStamp {
+	stamp := fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+	if s.options.Verifier != nil {
+		if signature, err := os.Stat(s.filePath + SignatureSuffix); err == nil {
+			stamp.signatureModTime = signature.ModTime()
+			stamp.signatureSize = signature.Size()
+		}
+	}
+	return stamp
+}
+
+// watch polls the overrides file and reloads it when it changes. A file that
+// fails to load is logged and the previous overrides stay active.
+func (s *OverrideService) watch(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.reloadIfChanged(); err != nil {
+				log.Printf("overrides: keeping previous overrides: %v", err)
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the overrides file if the size or modification time
+// of the file or of its signature changed
+func (s *OverrideService) reloadIfChanged() error {
+	stat, err := os.Stat(s.filePath)
+	if err != nil {
+		return fmt.Errorf("error checking overrides file: %v", err)
+	}
+	stamp := s.fileStamp(stat)
+
+	s.mu.RLock()
+	unchanged := stamp.modTime.Equal(s.stamp.modTime) && stamp.size == s.stamp.size &&
+		stamp.signatureModTime.Equal(s.stamp.signatureModTime) && stamp.signatureSize == s.stamp.signatureSize
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	if err := s.loadData(); err != nil {
+		return err
+	}
+	log.Printf("overrides: reloaded %s", s.filePath)
+	return nil
+}
+
+// LookupIP returns the most specific unexpired override for ip, falling back
+// to the base service when no override applies
+func (s *OverrideService) LookupIP(ip string) (*Result, error) {
+	return s.LookupIPFor("", ip)
+}
+
+// LookupIPFor is LookupIP on behalf of client, which the base service may
+// route by
+func (s *OverrideService) LookupIPFor(client, ip string) (*Result, error) {
+	if !isValidIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidIP
+	}
+
+	now := s.now()
+
+	s.mu.RLock()
+	var result Result
+	found := s.data.match(addr, func(prefix netip.Prefix, candidate Result) bool {
+		expires := s.overrides[prefix].expires
+		if !expires.IsZero() && !now.Before(expires) {
+			return false
+		}
+		result = candidate
+		return true
+	})
+	result.DatasetVersion = s.info.Version
+	s.mu.RUnlock()
+
+	if found {
+		return &result, nil
+	}
+	return LookupIPFor(s.base, client, ip)
+}
+
+// Records returns the overrides that have not expired, sorted by address
+func (s *OverrideService) Records() []Record {
+	now := s.now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := []Record{}
+	for _, record := range s.data.records() {
+		expires := s.overrides[record.Prefix].expires
+		if expires.IsZero() || now.Before(expires) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Datasets returns metadata about the overrides file followed by the base datasets
+func (s *OverrideService) Datasets() []DatasetInfo {
+	s.mu.RLock()
+	datasets := []DatasetInfo{s.info}
+	s.mu.RUnlock()
+
+	if provider, ok := s.base.(MetadataProvider); ok {
+		datasets = append(datasets, provider.Datasets()...)
+	}
+	return datasets
+}
+
+// Unwrap returns the base service
+func (s *OverrideService) Unwrap() Service {
+	return s.base
+}
+
+// Close stops watching the overrides file and closes the base service
+func (s *OverrideService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return closeServices(s.base)
+}
@@ -0,0 +1,215 @@
+package ip2country
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes content to name inside a temporary directory
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	return path
+}
+
+func TestOverrideServiceLookupIP(t *testing.T) {
+	dir := t.TempDir()
+	base, err := NewCSVService(writeTestFile(t, dir, "base.csv", "10.0.0.1,London,UK\n10.0.0.2,Paris,France\n8.8.8.8,Mountain View,United States\n"))
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+
+	overridesFile := writeTestFile(t, dir, "overrides.csv", `# corporate VPN egress
+10.0.0.0/24,Tel Aviv,Israel,,NET-123
+10.0.0.2,Haifa,Israel,2020-01-01T00:00:00Z,NET-99 temporary
+`)
+
+	service, err := NewOverrideService(base, overridesFile, 0)
+	if err != nil {
+		t.Fatalf("Failed to create override service: %v", err)
+	}
+	defer service.Close()
+
+	tests := []struct {
+		name        string
+		ip          string
+		wantCity    string
+		wantCountry string
+		wantErr     error
+	}{
+		{name: "Override beats base", ip: "10.0.0.1", wantCity: "Tel Aviv", wantCountry: "Israel"},
+		{name: "Expired override falls back to broader override", ip: "10.0.0.2", wantCity: "Tel Aviv", wantCountry: "Israel"},
+		{name: "Not overridden", ip: "8.8.8.8", wantCity: "Mountain View", wantCountry: "United States"},
+		{name: "Override only", ip: "10.0.0.200", wantCity: "Tel Aviv", wantCountry: "Israel"},
+		{name: "Invalid IP", ip: "invalid-ip", wantErr: ErrInvalidIP},
+		{name: "Unknown IP", ip: "1.2.3.4", wantErr: ErrIPNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := service.LookupIP(tc.ip)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("LookupIP(%s) error = %v, want %v", tc.ip, err, tc.wantErr)
+			}
+			if err == nil && (result.City != tc.wantCity || result.Country != tc.wantCountry) {
+				t.Errorf("LookupIP(%s) = %s/%s, want %s/%s", tc.ip, result.City, result.Country, tc.wantCity, tc.wantCountry)
+			}
+		})
+	}
+
+	// Overrides report their own dataset version
+	datasets := service.Datasets()
+	if len(datasets) != 2 || datasets[0].Type != "overrides" || datasets[1].Type != "csv" {
+		t.Fatalf("Unexpected datasets: %+v", datasets)
+	}
+	if result, _ := service.LookupIP("10.0.0.1"); result.DatasetVersion != datasets[0].Version {
+		t.Errorf("Override result version = %q, want %q", result.DatasetVersion, datasets[0].Version)
+	}
+	if result, _ := service.LookupIP("8.8.8.8"); result.DatasetVersion != datasets[1].Version {
+		t.Errorf("Base result version = %q, want %q", result.DatasetVersion, datasets[1].Version)
+	}
+}
+
+func TestOverrideServiceExpiry(t *testing.T) {
+	dir := t.TempDir()
+	base, err := NewCSVService(writeTestFile(t, dir, "base.csv", "10.0.0.1,London,UK\n"))
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	service, err := NewOverrideService(base, writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Haifa,Israel,2030-01-01T00:00:00Z\n"), 0)
+	if err != nil {
+		t.Fatalf("Failed to create override service: %v", err)
+	}
+	defer service.Close()
+
+	service.now = func() time.Time { return time.Date(2029, 12, 31, 0, 0, 0, 0, time.UTC) }
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "Israel" {
+		t.Errorf("Expected override before expiry, got %s", result.Country)
+	}
+	if records := service.Records(); len(records) != 1 || records[0].Result.Country != "Israel" {
+		t.Errorf("Expected the override in Records before expiry, got %v", records)
+	}
+
+	service.now = func() time.Time { return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC) }
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "UK" {
+		t.Errorf("Expected base result after expiry, got %s", result.Country)
+	}
+	if records := service.Records(); len(records) != 0 {
+		t.Errorf("Expected no records after expiry, got %v", records)
+	}
+}
+
+func TestOverrideServiceReload(t *testing.T) {
+	dir := t.TempDir()
+	base, err := NewCSVService(writeTestFile(t, dir, "base.csv", "10.0.0.1,London,UK\n"))
+	if err != nil {
+		t.Fatalf("Failed to create CSV service: %v", err)
+	}
+	overridesFile := writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Haifa,Israel\n")
+	service, err := NewOverrideService(base, overridesFile, 0)
+	if err != nil {
+		t.Fatalf("Failed to create override service: %v", err)
+	}
+	defer service.Close()
+
+	// A changed file is picked up
+	writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Lyon,France,,NET-7\n")
+	if err := service.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged failed: %v", err)
+	}
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "France" {
+		t.Errorf("Expected reloaded override, got %s", result.Country)
+	}
+
+	// A broken file is rejected and the previous overrides stay active
+	writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Lyon,France,next tuesday\n")
+	if err := service.reloadIfChanged(); err == nil {
+		t.Fatal("Expected error when reloading an invalid overrides file")
+	}
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "France" {
+		t.Errorf("Expected previous override to stay active, got %s", result.Country)
+	}
+}
+
+func TestNewOverrideServiceErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "Too few columns", content: "10.0.0.1,London\n"},
+		{name: "Invalid CIDR", content: "10.0.0.1/40,London,UK\n"},
+		{name: "Empty country", content: "10.0.0.1,London,\n"},
+		{name: "Invalid expiry", content: "10.0.0.1,London,UK,tomorrow\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestFile(t, dir, "overrides.csv", tc.content)
+			if _, err := NewOverrideService(&CSVService{data: newPrefixTable(0)}, path, 0); err == nil {
+				t.Errorf("Expected error for %q", tc.content)
+			}
+		})
+	}
+
+	if _, err := NewOverrideService(&CSVService{data: newPrefixTable(0)}, filepath.Join(dir, "missing.csv"), 0); err == nil {
+		t.Error("Expected error for missing overrides file")
+	}
+}
+
+func TestOverrideServiceSignature(t *testing.T) {
+	dir := t.TempDir()
+	private, public := newTestKey(t)
+	rotated, rotatedPublic := newTestKey(t)
+	verifier, err := ParseTrustedKeys("ops:" + public + ",release:" + rotatedPublic)
+	if err != nil {
+		t.Fatalf("Failed to parse trusted keys: %v", err)
+	}
+	base := &CSVService{data: newPrefixTable(0)}
+	options := OverrideOptions{Verifier: verifier}
+
+	overridesFile := writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Haifa,Israel\n")
+	if _, err := NewOverrideServiceWithOptions(base, overridesFile, options); err == nil {
+		t.Fatal("Expected error for an unsigned overrides file")
+	}
+
+	signTestFile(t, overridesFile, private)
+	service, err := NewOverrideServiceWithOptions(base, overridesFile, options)
+	if err != nil {
+		t.Fatalf("Failed to create override service: %v", err)
+	}
+	defer service.Close()
+	if info := service.Datasets()[0]; info.Signer != "ops" {
+		t.Errorf("Datasets() = %+v, expected signer ops", info)
+	}
+
+	// A changed file is only picked up once it is signed again
+	writeTestFile(t, dir, "overrides.csv", "10.0.0.1,Lyon,France,,NET-7\n")
+	if err := service.reloadIfChanged(); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("reloadIfChanged() = %v, expected %v", err, ErrSignatureInvalid)
+	}
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "Israel" {
+		t.Errorf("Expected previous override to stay active, got %s", result.Country)
+	}
+	signTestFile(t, overridesFile, private)
+	if err := service.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged failed: %v", err)
+	}
+	if result, _ := service.LookupIP("10.0.0.1"); result.Country != "France" {
+		t.Errorf("Expected reloaded override, got %s", result.Country)
+	}
+
+	// Signing the same file with another key is picked up too
+	signTestFile(t, overridesFile, rotated)
+	if err := service.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged failed: %v", err)
+	}
+	if info := service.Datasets()[0]; info.Signer != "release" {
+		t.Errorf("Datasets() = %+v, expected signer release after re-signing", info)
+	}
+}
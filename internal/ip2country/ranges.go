@@ -0,0 +1,125 @@
+package ip2country
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"strings"
+)
+
+// Range is an inclusive span of addresses of a single address family
+type Range struct {
+	Start netip.Addr
+	End   netip.Addr
+}
+
+// rangeError describes why a dataset row could not be parsed. Code is a short
+// machine-readable identifier used in validation reports and Column, when
+// known, the position of the offending field.
+type rangeError struct {
+	Code    string
+	Message string
+	Column  int
+}
+
+func (e *rangeError) Error() string {
+	return e.Message
+}
+
+// ParseRange parses a single IP address, a CIDR block or an inclusive
+// "start-end" range of addresses
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		prefix, err := ParsePrefix(s)
+		if err != nil {
+			return Range{}, &rangeError{Code: "invalid_ip", Message: err.Error()}
+		}
+		return prefixRange(prefix), nil
+	}
+
+	start, err := parseAddr(startStr)
+	if err != nil {
+		return Range{}, &rangeError{Code: "invalid_ip", Message: err.Error()}
+	}
+	end, err := parseAddr(endStr)
+	if err != nil {
+		return Range{}, &rangeError{Code: "invalid_ip", Message: err.Error()}
+	}
+	if start.Is4() != end.Is4() {
+		return Range{}, &rangeError{Code: "mixed_family", Message: fmt.Sprintf("range %q mixes IPv4 and IPv6 addresses", s)}
+	}
+	if end.Less(start) {
+		return Range{}, &rangeError{Code: "inverted_range", Message: fmt.Sprintf("range %q ends before it starts", s)}
+	}
+	return Range{Start: start, End: end}, nil
+}
+
+// parseAddr parses a single address, treating IPv4-mapped IPv6 addresses as IPv4
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return addr.Unmap(), nil
+}
+
+// prefixRange returns the range of addresses covered by prefix
+func prefixRange(prefix netip.Prefix) Range {
+	start := prefix.Masked().Addr()
+	bytes := start.AsSlice()
+	for bit := prefix.Bits(); bit < start.BitLen(); bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	end, _ := netip.AddrFromSlice(bytes)
+	return Range{Start: start, End: end}
+}
+
+// Prefixes returns the smallest list of CIDR blocks that exactly cover the range
+func (r Range) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	start := r.Start
+	for {
+		// Grow the block from start while it stays aligned and inside the range
+		bits := start.BitLen()
+		for bits > 0 {
+			candidate := netip.PrefixFrom(start, bits-1)
+			if candidate.Masked().Addr() != start || r.End.Less(prefixRange(candidate).End) {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+
+		last := prefixRange(prefix).End
+		if last == r.End {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// Contains reports whether addr is inside the range
+func (r Range) Contains(addr netip.Addr) bool {
+	return addr.Is4() == r.Start.Is4() && !addr.Less(r.Start) && !r.End.Less(addr)
+}
+
+// Size returns the number of addresses in the range
+func (r Range) Size() *big.Int {
+	start := new(big.Int).SetBytes(r.Start.AsSlice())
+	end := new(big.Int).SetBytes(r.End.AsSlice())
+	size := end.Sub(end, start)
+	return size.Add(size, big.NewInt(1))
+}
+
+// String formats the range the way it is written in a dataset file
+func (r Range) String() string {
+	prefixes := r.Prefixes()
+	if len(prefixes) == 1 {
+		return formatPrefix(prefixes[0])
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
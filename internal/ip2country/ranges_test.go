@@ -0,0 +1,80 @@
+package ip2country
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		wantCode string
+	}{
+		{name: "IPv4 address", input: "1.2.3.4", expected: "1.2.3.4-1.2.3.4"},
+		{name: "IPv4 CIDR", input: "10.0.0.0/8", expected: "10.0.0.0-10.255.255.255"},
+		{name: "IPv6 CIDR", input: "2001:db8::/32", expected: "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{name: "IPv4 range", input: "10.0.0.5 - 10.0.0.9", expected: "10.0.0.5-10.0.0.9"},
+		{name: "IPv4-mapped range", input: "::ffff:1.1.1.1-1.1.1.2", expected: "1.1.1.1-1.1.1.2"},
+		{name: "Invalid address", input: "not-an-ip", wantCode: "invalid_ip"},
+		{name: "Invalid range end", input: "10.0.0.1-10.0.0", wantCode: "invalid_ip"},
+		{name: "Mixed families", input: "10.0.0.1-2001:db8::1", wantCode: "mixed_family"},
+		{name: "Inverted range", input: "10.0.0.9-10.0.0.5", wantCode: "inverted_range"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			network, err := ParseRange(tc.input)
+			if tc.wantCode != "" {
+				var rangeErr *rangeError
+				if !errors.As(err, &rangeErr) || rangeErr.Code != tc.wantCode {
+					t.Errorf("ParseRange(%q) error = %v, expected code %s", tc.input, err, tc.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRange(%q) unexpected error: %v", tc.input, err)
+			}
+			if got := fmt.Sprintf("%s-%s", network.Start, network.End); got != tc.expected {
+				t.Errorf("ParseRange(%q) = %s, expected %s", tc.input, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		size     string
+	}{
+		{input: "10.0.0.0/8", expected: []string{"10.0.0.0/8"}, size: "16777216"},
+		{input: "10.0.0.5-10.0.0.9", expected: []string{"10.0.0.5/32", "10.0.0.6/31", "10.0.0.8/31"}, size: "5"},
+		{input: "0.0.0.0-255.255.255.255", expected: []string{"0.0.0.0/0"}, size: "4294967296"},
+		{input: "2001:db8::-2001:db8::2", expected: []string{"2001:db8::/127", "2001:db8::2/128"}, size: "3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			network, err := ParseRange(tc.input)
+			if err != nil {
+				t.Fatalf("ParseRange(%q) unexpected error: %v", tc.input, err)
+			}
+
+			prefixes := network.Prefixes()
+			if len(prefixes) != len(tc.expected) {
+				t.Fatalf("Prefixes() = %v, expected %v", prefixes, tc.expected)
+			}
+			for i, prefix := range prefixes {
+				if prefix.String() != tc.expected[i] {
+					t.Errorf("Prefixes()[%d] = %s, expected %s", i, prefix, tc.expected[i])
+				}
+			}
+			if size := network.Size().String(); size != tc.size {
+				t.Errorf("Size() = %s, expected %s", size, tc.size)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package ip2country
 
+import "net/netip"
+
 // RedisService implements Service by reading data from a Redis database
 type RedisService struct {
 	addr string
@@ -15,3 +17,19 @@ func (s *RedisService) LookupIP(ip string) (*Result, error) {
 	// ... RedisService lookup implementation ...
 	return nil, nil
 }
+
+// Datasets returns metadata about the Redis dataset
+func (s *RedisService) Datasets() []DatasetInfo {
+	return []DatasetInfo{{Type: "redis", Source: s.addr}}
+}
+
+// PutRecord is not supported until lookups read from Redis, since a write
+// that lookups never see would be reported as applied
+func (s *RedisService) PutRecord(prefix netip.Prefix, result Result) error {
+	return ErrReadOnly
+}
+
+// DeleteRecord is not supported, like PutRecord
+func (s *RedisService) DeleteRecord(prefix netip.Prefix) error {
+	return ErrReadOnly
+}
@@ -1,6 +1,8 @@
 package ip2country
 
 import (
+	"errors"
+	"net/netip"
 	"testing"
 )
 
@@ -33,3 +35,15 @@ func TestRedisServiceLookupIP(t *testing.T) {
 		t.Errorf("Expected nil error, got %v", err)
 	}
 }
+
+func TestRedisServiceRecordUpdates(t *testing.T) {
+	service, _ := NewRedisService("localhost:6379")
+	prefix := netip.MustParsePrefix("203.0.113.0/24")
+
+	if err := service.PutRecord(prefix, Result{Country: "Israel"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("PutRecord() = %v, expected %v", err, ErrReadOnly)
+	}
+	if err := service.DeleteRecord(prefix); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteRecord() = %v, expected %v", err, ErrReadOnly)
+	}
+}
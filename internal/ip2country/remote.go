@@ -0,0 +1,435 @@
+package ip2country
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteFetchTimeout bounds a single download of a remote dataset
+const remoteFetchTimeout = 10 * time.Minute
+
+// RemoteOptions holds optional settings of a RemoteService
+type RemoteOptions struct {
+	// SHA256 is the expected hex digest of the dataset, or the http(s) URL of
+	// a checksum file published next to it in sha256sum format. Empty skips
+	// verification.
+	SHA256 string
+
+	// PollInterval is how often the dataset is checked for changes with a
+	// conditional request. Zero disables polling.
+	PollInterval time.Duration
+
+	// Signed downloads the detached signature published next to the dataset,
+	// at its URL with SignatureSuffix, for open to verify
+	Signed bool
+
+	// HistorySize is the number of downloaded versions kept loaded for
+	// rollback, including the active one. Values below 1 keep only the
+	// active one.
+	HistorySize int
+
+	// Client sends the requests, a client with remoteFetchTimeout when nil
+	Client *http.Client
+}
+
+// RemoteService serves lookups from a dataset published at an http(s) URL. The
+// dataset is downloaded to a temporary file, verified, and loaded by the
+// backend returned by open. It is then polled with If-None-Match and
+// If-Modified-Since and swapped in without interrupting lookups when it
+// changes. A download that fails, does not verify or does not load is logged
+// and the last good copy keeps serving.
+//
+// The last downloaded versions are kept loaded for rollback. Rolling back pins
+// the version: later downloads are kept for rollback but not activated, until
+// the latest version is activated again. Remote datasets are read-only:
+// records cannot be changed through the admin API since the next published
+// version would replace them.
+type RemoteService struct {
+	url     string
+	source  string // url without credentials or query, safe to report
+	open    func(path string) (Service, error)
+	options RemoteOptions
+
+	current  *remoteVersion
+	versions []*remoteVersion // most recent download first
+	pinned   bool             // current was activated by a rollback
+	etag     string
+	modified string
+	mu       sync.RWMutex
+
+	// fetchMu serializes downloads
+	fetchMu sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// remoteVersion is a downloaded version of the dataset
+type remoteVersion struct {
+	service  Service
+	filePath string // temporary file backing service
+	checksum string
+	version  string
+}
+
+// IsRemoteDataset reports whether path is an http(s) URL rather than a local file
+func IsRemoteDataset(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// NewRemoteService downloads the dataset at url and loads it with open. It
+// fails when the first download fails, since there is no previous copy to
+// serve from.
+func NewRemoteService(url string, open func(path string) (Service, error), options RemoteOptions) (*RemoteService, error) {
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: remoteFetchTimeout}
+	}
+	service := &RemoteService{
+		url:     url,
+		source:  redactURL(url),
+		open:    open,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if _, err := service.fetch(); err != nil {
+		return nil, err
+	}
+
+	if options.PollInterval > 0 {
+		go service.watch(options.PollInterval)
+	} else {
+		close(service.done)
+	}
+
+	return service, nil
+}
+
+// watch polls the dataset and swaps it in when it changes
+func (s *RemoteService) watch(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if _, err := s.fetch(); err != nil {
+				log.Printf("remote: keeping the last good copy of %s: %v", s.source, err)
+			}
+		}
+	}
+}
+
+// fetch downloads the dataset if it changed since the last successful fetch,
+// verifies and loads it, and makes it the active one. It reports whether a new
+// version was activated.
+func (s *RemoteService) fetch() (bool, error) {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	request, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("invalid dataset URL: %v", err)
+	}
+	s.mu.RLock()
+	if s.etag != "" {
+		request.Header.Set("If-None-Match", s.etag)
+	}
+	if s.modified != "" {
+		request.Header.Set("If-Modified-Since", s.modified)
+	}
+	s.mu.RUnlock()
+
+	response, err := s.options.Client.Do(request)
+	if err != nil {
+		return false, fmt.Errorf("error fetching dataset: %v", err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("error fetching dataset %s: unexpected status %s", s.source, response.Status)
+	}
+
+	filePath, checksum, err := download(response.Body)
+	if err != nil {
+		return false, err
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			removeDownload(filePath)
+		}
+	}()
+
+	etag, modified := response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+
+	// Servers without validators answer every poll in full
+	s.mu.RLock()
+	unchanged := len(s.versions) > 0 && checksum == s.versions[0].checksum
+	s.mu.RUnlock()
+	if unchanged {
+		s.mu.Lock()
+		s.etag, s.modified = etag, modified
+		s.mu.Unlock()
+		return false, nil
+	}
+
+	if err := s.verify(checksum); err != nil {
+		return false, err
+	}
+	if s.options.Signed {
+		if err := s.fetchSignature(filePath + SignatureSuffix); err != nil {
+			return false, err
+		}
+	}
+	service, err := s.open(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	latest := &remoteVersion{service: service, filePath: filePath, checksum: checksum, version: datasetVersion(checksum)}
+	if datasets := latest.datasets(s.source); len(datasets) > 0 && datasets[0].Version != "" {
+		latest.version = datasets[0].Version
+	}
+
+	s.mu.Lock()
+	previous := s.current
+	if !s.pinned || latest.version == s.current.version {
+		s.current, s.pinned = latest, false
+	}
+	activated := s.current == latest
+	dropped := s.record(latest)
+	s.etag, s.modified = etag, modified
+	s.mu.Unlock()
+	keep = true
+
+	// Lookups hold the read lock while they use the backend, so none is still
+	// running on the dropped versions
+	for _, version := range dropped {
+		version.close()
+	}
+	switch {
+	case previous == nil:
+	case activated:
+		log.Printf("remote: loaded new version %s of %s", latest.version, s.source)
+	default:
+		log.Printf("remote: downloaded new version %s of %s, keeping the pinned version %s active", latest.version, s.source, previous.version)
+	}
+	return activated, nil
+}
+
+// record adds latest to the versions kept for rollback and returns the ones
+// dropped beyond the history size. The active version is always kept, and
+// an earlier copy of the same version is replaced. The caller must hold s.mu.
+func (s *RemoteService) record(latest *remoteVersion) []*remoteVersion {
+	size := max(s.options.HistorySize, 1)
+	versions := []*remoteVersion{latest}
+	var dropped []*remoteVersion
+	for _, version := range s.versions {
+		if version != s.current && (version.version == latest.version || len(versions) >= size) {
+			dropped = append(dropped, version)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	s.versions = versions
+	return dropped
+}
+
+// datasets returns the metadata of the version, with source as its source
+func (v *remoteVersion) datasets(source string) []DatasetInfo {
+	provider, ok := v.service.(MetadataProvider)
+	if !ok {
+		return nil
+	}
+	datasets := provider.Datasets()
+	for i := range datasets {
+		datasets[i].Source = source
+	}
+	return datasets
+}
+
+// close releases the version and removes its temporary file
+func (v *remoteVersion) close() error {
+	var err error
+	if closer, ok := v.service.(io.Closer); ok {
+		err = closer.Close()
+	}
+	removeDownload(v.filePath)
+	return err
+}
+
+// download copies body to a temporary file and returns its path and SHA-256
+func download(body io.Reader) (string, string, error) {
+	file, err := os.CreateTemp("", "ip2country-remote-*")
+	if err != nil {
+		return "", "", fmt.Errorf("error creating temporary file: %v", err)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", fmt.Errorf("error downloading dataset: %v", err)
+	}
+	return file.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// removeDownload removes a downloaded dataset and its signature
+func removeDownload(filePath string) {
+	os.Remove(filePath)
+	os.Remove(filePath + SignatureSuffix)
+}
+
+// fetchSignature downloads the signature of the dataset to path
+func (s *RemoteService) fetchSignature(path string) error {
+	url := s.url + SignatureSuffix
+	response, err := s.options.Client.Get(url)
+	if err != nil {
+		return fmt.Errorf("error fetching signature: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching signature %s: unexpected status %s", s.source+SignatureSuffix, response.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("error fetching signature: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("error writing signature: %v", err)
+	}
+	return nil
+}
+
+// verify checks a downloaded dataset against the configured SHA-256
+func (s *RemoteService) verify(checksum string) error {
+	expected := s.options.SHA256
+	if expected == "" {
+		return nil
+	}
+	if IsRemoteDataset(expected) {
+		var err error
+		if expected, err = s.fetchChecksum(expected); err != nil {
+			return err
+		}
+	}
+	if !strings.EqualFold(expected, checksum) {
+		return fmt.Errorf("checksum mismatch for %s: got %s, expected %s", s.source, checksum, expected)
+	}
+	return nil
+}
+
+// fetchChecksum reads the digest from a checksum file, whose first field is
+// the hex digest as written by sha256sum
+func (s *RemoteService) fetchChecksum(url string) (string, error) {
+	response, err := s.options.Client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("error fetching checksum: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching checksum %s: unexpected status %s", url, response.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("error fetching checksum: %v", err)
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file %s is empty", url)
+	}
+	return fields[0], nil
+}
+
+// LookupIP returns country information from the active copy of the dataset
+func (s *RemoteService) LookupIP(ip string) (*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current.service.LookupIP(ip)
+}
+
+// Datasets returns metadata about the active copy, with the redacted URL as
+// its source
+func (s *RemoteService) Datasets() []DatasetInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current.datasets(s.source)
+}
+
+// Snapshots returns the downloaded versions kept for rollback, most recent first
+func (s *RemoteService) Snapshots() []Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := make([]Snapshot, 0, len(s.versions))
+	for _, version := range s.versions {
+		info := DatasetInfo{Source: s.source, Checksum: version.checksum, Version: version.version}
+		if datasets := version.datasets(s.source); len(datasets) > 0 {
+			info = datasets[0]
+		}
+		snapshots = append(snapshots, Snapshot{DatasetInfo: info, Active: version == s.current})
+	}
+	return snapshots
+}
+
+// Rollback atomically switches lookups to a previously downloaded version.
+// Any version but the latest stays pinned until the latest is activated
+// again, so that polling does not bring back the version rolled back from.
+func (s *RemoteService) Rollback(version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, candidate := range s.versions {
+		if candidate.version == version {
+			s.current = candidate
+			s.pinned = candidate != s.versions[0]
+			return nil
+		}
+	}
+	return ErrVersionNotFound
+}
+
+// Close stops polling and releases every kept copy
+func (s *RemoteService) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, version := range s.versions {
+		if closeErr := version.close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.versions = nil
+	return err
+}
@@ -0,0 +1,318 @@
+package ip2country
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ip2country-api/internal/config"
+)
+
+// datasetServer publishes a dataset that tests can replace or break. It
+// answers conditional requests through http.ServeContent.
+type datasetServer struct {
+	mu         sync.Mutex
+	content    string
+	modified   time.Time
+	status     int
+	conditions []string
+}
+
+func (d *datasetServer) set(content string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.content = content
+	d.modified = d.modified.Add(time.Minute)
+}
+
+func (d *datasetServer) fail(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
+
+func (d *datasetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conditions = append(d.conditions, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+	if d.status != 0 {
+		w.WriteHeader(d.status)
+		return
+	}
+	checksum := sha256.Sum256([]byte(d.content))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(checksum[:8])+`"`)
+	http.ServeContent(w, r, "ip2country.csv", d.modified, strings.NewReader(d.content))
+}
+
+func newDatasetServer(t *testing.T, content string) (*datasetServer, *httptest.Server) {
+	dataset := &datasetServer{content: content, modified: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server := httptest.NewTLSServer(dataset)
+	t.Cleanup(server.Close)
+	return dataset, server
+}
+
+func openTestCSV(path string) (Service, error) {
+	service, err := NewCSVService(path)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+func TestRemoteServiceFetch(t *testing.T) {
+	dataset, server := newDatasetServer(t, "1.1.1.1,Sydney,Australia\n")
+	url := server.URL + "/ip2country.csv"
+
+	service, err := NewRemoteService(url, openTestCSV, RemoteOptions{Client: server.Client()})
+	if err != nil {
+		t.Fatalf("Failed to create remote service: %v", err)
+	}
+	defer service.Close()
+
+	expectCountry := func(ip, country string) {
+		t.Helper()
+		if result, err := service.LookupIP(ip); err != nil || result.Country != country {
+			t.Errorf("LookupIP(%s) = %v, %v, expected %s", ip, result, err, country)
+		}
+	}
+	expectCountry("1.1.1.1", "Australia")
+	if info := service.Datasets()[0]; info.Source != url || info.Type != "csv" {
+		t.Errorf("Datasets() = %+v, expected the URL as source", info)
+	}
+
+	// An unchanged dataset is not downloaded again
+	if changed, err := service.fetch(); changed || err != nil {
+		t.Errorf("fetch() of an unchanged dataset = %v, %v", changed, err)
+	}
+	if last := dataset.conditions[len(dataset.conditions)-1]; !strings.HasPrefix(last, `"`) || !strings.HasSuffix(last, "GMT") {
+		t.Errorf("Expected If-None-Match and If-Modified-Since, got %q", last)
+	}
+
+	// A new version is swapped in and the previous temporary file removed
+	previousPath := service.current.filePath
+	dataset.set("1.1.1.1,Auckland,New Zealand\n")
+	if changed, err := service.fetch(); !changed || err != nil {
+		t.Fatalf("fetch() of a new version = %v, %v", changed, err)
+	}
+	expectCountry("1.1.1.1", "New Zealand")
+	if _, err := os.Stat(previousPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous copy to be removed, got %v", err)
+	}
+
+	// Broken versions and failed requests keep the last good copy
+	dataset.set("1.1.1.1,Sydney\n")
+	if _, err := service.fetch(); err == nil {
+		t.Error("Expected error for an invalid dataset, got nil")
+	}
+	expectCountry("1.1.1.1", "New Zealand")
+
+	dataset.fail(http.StatusBadGateway)
+	if _, err := service.fetch(); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Expected error for status 502, got %v", err)
+	}
+	expectCountry("1.1.1.1", "New Zealand")
+}
+
+func TestRemoteServiceRedactsURL(t *testing.T) {
+	_, server := newDatasetServer(t, "1.1.1.1,Sydney,Australia\n")
+	secretURL := strings.Replace(server.URL, "https://", "https://reader:hunter2@", 1) + "/ip2country.csv?token=s3cr3t"
+
+	service, err := NewRemoteService(secretURL, openTestCSV, RemoteOptions{Client: server.Client()})
+	if err != nil {
+		t.Fatalf("Failed to create remote service: %v", err)
+	}
+	defer service.Close()
+
+	// Both are served to callers, the datasets without authentication
+	response, err := json.Marshal(map[string]any{"datasets": service.Datasets(), "snapshots": service.Snapshots()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "s3cr3t", "token="} {
+		if strings.Contains(string(response), secret) {
+			t.Errorf("response contains %q: %s", secret, response)
+		}
+	}
+	if expected := strings.Replace(server.URL, "https://", "https://reader:xxxxx@", 1) + "/ip2country.csv"; service.Datasets()[0].Source != expected {
+		t.Errorf("Source = %q, want %q", service.Datasets()[0].Source, expected)
+	}
+}
+
+func TestRemoteServiceChecksum(t *testing.T) {
+	content := "1.1.1.1,Sydney,Australia\n"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+
+	_, server := newDatasetServer(t, content)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip2country.csv.sha256", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  ip2country.csv\n", checksum)
+	})
+	checksums := httptest.NewTLSServer(mux)
+	defer checksums.Close()
+
+	tests := []struct {
+		name    string
+		sha256  string
+		wantErr bool
+	}{
+		{name: "Matching digest", sha256: strings.ToUpper(checksum)},
+		{name: "Checksum file", sha256: checksums.URL + "/ip2country.csv.sha256"},
+		{name: "Wrong digest", sha256: strings.Repeat("0", 64), wantErr: true},
+		{name: "Missing checksum file", sha256: checksums.URL + "/missing.sha256", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Both test servers share the same test certificate
+			service, err := NewRemoteService(server.URL+"/ip2country.csv", openTestCSV, RemoteOptions{SHA256: tc.sha256, Client: server.Client()})
+			if tc.wantErr {
+				if err == nil {
+					service.Close()
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create remote service: %v", err)
+			}
+			service.Close()
+		})
+	}
+}
+
+func TestRemoteServicePolling(t *testing.T) {
+	dataset, server := newDatasetServer(t, "1.1.1.1,Sydney,Australia\n")
+	service, err := NewRemoteService(server.URL+"/ip2country.csv", openTestCSV, RemoteOptions{PollInterval: 10 * time.Millisecond, Client: server.Client()})
+	if err != nil {
+		t.Fatalf("Failed to create remote service: %v", err)
+	}
+	defer service.Close()
+
+	dataset.set("1.1.1.1,Auckland,New Zealand\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result, err := service.LookupIP("1.1.1.1")
+		if err == nil && result.Country == "New Zealand" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dataset was not reloaded, last lookup: %v, %v", result, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteServiceRollback(t *testing.T) {
+	dataset, server := newDatasetServer(t, "1.1.1.1,Sydney,Australia\n")
+	service, err := NewRemoteService(server.URL+"/ip2country.csv", openTestCSV, RemoteOptions{HistorySize: 2, Client: server.Client()})
+	if err != nil {
+		t.Fatalf("Failed to create remote service: %v", err)
+	}
+	defer service.Close()
+
+	expectCountry := func(country string) {
+		t.Helper()
+		if result, err := service.LookupIP("1.1.1.1"); err != nil || result.Country != country {
+			t.Errorf("LookupIP(1.1.1.1) = %v, %v, expected %s", result, err, country)
+		}
+	}
+	publish := func(content string) {
+		t.Helper()
+		dataset.set(content)
+		if _, err := service.fetch(); err != nil {
+			t.Fatalf("fetch() failed: %v", err)
+		}
+	}
+	first := service.Datasets()[0].Version
+	firstPath := service.current.filePath
+
+	publish("1.1.1.1,Auckland,New Zealand\n")
+	expectCountry("New Zealand")
+	snapshots := service.Snapshots()
+	if len(snapshots) != 2 || snapshots[1].Version != first || snapshots[1].Active || !snapshots[0].Active {
+		t.Fatalf("Snapshots() = %+v, expected the new version active and the first one kept", snapshots)
+	}
+	second := snapshots[0].Version
+
+	if err := service.Rollback(first); err != nil {
+		t.Fatalf("Rollback() failed: %v", err)
+	}
+	expectCountry("Australia")
+	if err := service.Rollback("sha256-000000000000"); err != ErrVersionNotFound {
+		t.Errorf("Rollback() of an unknown version = %v, expected %v", err, ErrVersionNotFound)
+	}
+
+	// The rolled back version stays pinned while newer versions are published
+	publish("1.1.1.1,London,United Kingdom\n")
+	expectCountry("Australia")
+	snapshots = service.Snapshots()
+	if len(snapshots) != 3 || snapshots[0].Active || snapshots[2].Version != first || !snapshots[2].Active {
+		t.Fatalf("Snapshots() = %+v, expected the pinned version to be kept active", snapshots)
+	}
+	third := snapshots[0].Version
+	if _, err := os.Stat(firstPath); err != nil {
+		t.Errorf("Expected the pinned copy to be kept, got %v", err)
+	}
+
+	// Activating the latest version unpins, and drops versions beyond the history size
+	if err := service.Rollback(third); err != nil {
+		t.Fatalf("Rollback() failed: %v", err)
+	}
+	expectCountry("United Kingdom")
+	publish("1.1.1.1,Paris,France\n")
+	expectCountry("France")
+	snapshots = service.Snapshots()
+	if len(snapshots) != 2 || snapshots[1].Version != third {
+		t.Errorf("Snapshots() = %+v, expected the last 2 versions", snapshots)
+	}
+	if err := service.Rollback(second); err != ErrVersionNotFound {
+		t.Errorf("Rollback() of a dropped version = %v, expected %v", err, ErrVersionNotFound)
+	}
+	if _, err := os.Stat(firstPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the dropped copy to be removed, got %v", err)
+	}
+}
+
+func TestNewServiceRemoteSnapshot(t *testing.T) {
+	var snapshot bytes.Buffer
+	if err := WriteDataset(&snapshot, "snapshot", parseRecords(t, "1.1.1.0/24,Sydney,Australia")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(snapshot.Bytes())
+	}))
+	defer server.Close()
+
+	service, err := NewService(config.BackendConfig{Type: "snapshot", SnapshotPath: server.URL + "/ip2country.snap"})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	remote, ok := service.(*RemoteService)
+	if !ok {
+		t.Fatalf("NewService returned %T, expected *RemoteService", service)
+	}
+	defer remote.Close()
+
+	if result, err := service.LookupIP("1.1.1.1"); err != nil || result.Country != "Australia" {
+		t.Errorf("LookupIP(1.1.1.1) = %v, %v, expected Australia", result, err)
+	}
+	if _, ok := As[WritableService](service); ok {
+		t.Error("Remote datasets should not accept record updates")
+	}
+
+	// The first download must succeed
+	_, err = NewService(config.BackendConfig{Type: "snapshot", SnapshotPath: server.URL + "/ip2country.csv", DatasetSHA256: strings.Repeat("0", 64)})
+	if err == nil {
+		t.Error("Expected error for a checksum mismatch, got nil")
+	}
+}
@@ -0,0 +1,212 @@
+package ip2country
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+)
+
+// maxShadowInFlight bounds the number of concurrent shadow lookups. Sampled
+// lookups beyond it are dropped rather than queued.
+const maxShadowInFlight = 64
+
+// ShadowStats counts shadow comparisons for one country
+type ShadowStats struct {
+	Compared          int64   `json:"compared"`
+	CountryMismatches int64   `json:"country_mismatches"`
+	CityMismatches    int64   `json:"city_mismatches"`
+	Disagreements     int64   `json:"disagreements"`
+	ShadowErrors      int64   `json:"shadow_errors"`
+	DisagreementRate  float64 `json:"disagreement_rate"`
+}
+
+// ShadowSummary summarizes how often the shadow backend disagreed with the primary
+type ShadowSummary struct {
+	SampleRate float64 `json:"sample_rate"`
+	Dropped    int64   `json:"dropped"`
+	ShadowStats
+	// Countries is keyed by the country returned by the primary backend
+	Countries map[string]ShadowStats `json:"countries"`
+}
+
+// ShadowService serves lookups from a primary Service and compares a sample of
+// them against a shadow Service in the background. The shadow never affects
+// the response.
+type ShadowService struct {
+	primary    Service
+	shadow     Service
+	sampleRate float64
+
+	sample   func() bool
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	countries map[string]*ShadowStats
+	dropped   int64
+}
+
+// NewShadowService creates a new ShadowService that compares the given fraction
+// (0 to 1) of lookups against shadow
+func NewShadowService(primary, shadow Service, sampleRate float64) *ShadowService {
+	service := &ShadowService{
+		primary:    primary,
+		shadow:     shadow,
+		sampleRate: sampleRate,
+		inFlight:   make(chan struct{}, maxShadowInFlight),
+		countries:  make(map[string]*ShadowStats),
+	}
+	service.sample = func() bool {
+		return rand.Float64() < service.sampleRate
+	}
+	return service
+}
+
+// LookupIP returns the primary backend's answer and may schedule a comparison
+// with the shadow backend
+func (s *ShadowService) LookupIP(ip string) (*Result, error) {
+	return s.LookupIPFor("", ip)
+}
+
+// LookupIPFor is LookupIP on behalf of client, which the primary backend may
+// route by
+func (s *ShadowService) LookupIPFor(client, ip string) (*Result, error) {
+	result, err := LookupIPFor(s.primary, client, ip)
+
+	// Only compare answers, not malformed input or primary failures
+	if (err == nil || errors.Is(err, ErrIPNotFound)) && s.sample() {
+		select {
+		case s.inFlight <- struct{}{}:
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer func() { <-s.inFlight }()
+				s.compare(ip, result)
+			}()
+		default:
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+	}
+
+	return result, err
+}
+
+// compare looks ip up in the shadow backend and records whether it agrees
+// with the primary result, which is nil when the primary had no match
+func (s *ShadowService) compare(ip string, primary *Result) {
+	shadow, err := s.shadow.LookupIP(ip)
+	if errors.Is(err, ErrIPNotFound) {
+		shadow, err = nil, nil
+	}
+
+	country := "unknown"
+	if primary != nil {
+		country = primary.Country
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, found := s.countries[country]
+	if !found {
+		stats = &ShadowStats{}
+		s.countries[country] = stats
+	}
+
+	if err != nil {
+		stats.ShadowErrors++
+		return
+	}
+
+	stats.Compared++
+	countryMismatch, cityMismatch := false, false
+	switch {
+	case primary == nil && shadow == nil:
+	case primary == nil || shadow == nil:
+		countryMismatch, cityMismatch = true, true
+	default:
+		countryMismatch = primary.Country != shadow.Country
+		cityMismatch = primary.City != shadow.City
+	}
+	if countryMismatch {
+		stats.CountryMismatches++
+	}
+	if cityMismatch {
+		stats.CityMismatches++
+	}
+	if countryMismatch || cityMismatch {
+		stats.Disagreements++
+		log.Printf("shadow: disagreement for %s: primary=%s shadow=%s", ip, describeResult(primary), describeResult(shadow))
+	}
+}
+
+// describeResult formats a possibly missing result for logging
+func describeResult(result *Result) string {
+	if result == nil {
+		return "not found"
+	}
+	return result.City + "/" + result.Country
+}
+
+// Summary returns the comparison statistics collected so far
+func (s *ShadowService) Summary() ShadowSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := ShadowSummary{
+		SampleRate: s.sampleRate,
+		Dropped:    s.dropped,
+		Countries:  make(map[string]ShadowStats, len(s.countries)),
+	}
+	for country, stats := range s.countries {
+		countryStats := *stats
+		countryStats.DisagreementRate = disagreementRate(countryStats)
+		summary.Countries[country] = countryStats
+
+		summary.Compared += stats.Compared
+		summary.CountryMismatches += stats.CountryMismatches
+		summary.CityMismatches += stats.CityMismatches
+		summary.Disagreements += stats.Disagreements
+		summary.ShadowErrors += stats.ShadowErrors
+	}
+	summary.DisagreementRate = disagreementRate(summary.ShadowStats)
+	return summary
+}
+
+// disagreementRate returns the share of compared lookups that disagreed
+func disagreementRate(stats ShadowStats) float64 {
+	if stats.Compared == 0 {
+		return 0
+	}
+	return float64(stats.Disagreements) / float64(stats.Compared)
+}
+
+// Datasets returns metadata about the primary datasets followed by the shadow ones
+func (s *ShadowService) Datasets() []DatasetInfo {
+	var datasets []DatasetInfo
+	if provider, ok := s.primary.(MetadataProvider); ok {
+		datasets = append(datasets, provider.Datasets()...)
+	}
+	if provider, ok := s.shadow.(MetadataProvider); ok {
+		for _, info := range provider.Datasets() {
+			info.Role = "shadow"
+			datasets = append(datasets, info)
+		}
+	}
+	return datasets
+}
+
+// Unwrap returns the primary service
+func (s *ShadowService) Unwrap() Service {
+	return s.primary
+}
+
+// Close waits for in-flight shadow lookups to finish, then closes the primary
+// and shadow services
+func (s *ShadowService) Close() error {
+	s.wg.Wait()
+	return closeServices(s.primary, s.shadow)
+}
@@ -0,0 +1,100 @@
+package ip2country
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+)
+
+// stubService answers lookups from a fixed map
+type stubService struct {
+	results map[string]*Result
+	err     error
+}
+
+func (s *stubService) LookupIP(ip string) (*Result, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if !isValidIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	result, found := s.results[ip]
+	if !found {
+		return nil, ErrIPNotFound
+	}
+	return result, nil
+}
+
+func TestShadowService(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	primary := &stubService{results: map[string]*Result{
+		"1.1.1.1": {Country: "Australia", City: "Sydney"},
+		"2.2.2.2": {Country: "Australia", City: "Sydney"},
+		"3.3.3.3": {Country: "France", City: "Paris"},
+	}}
+	shadow := &stubService{results: map[string]*Result{
+		"1.1.1.1": {Country: "Australia", City: "Sydney"},
+		"2.2.2.2": {Country: "Australia", City: "Melbourne"},
+		"3.3.3.3": {Country: "Germany", City: "Berlin"},
+		"4.4.4.4": {Country: "Spain", City: "Madrid"},
+	}}
+
+	service := NewShadowService(primary, shadow, 1)
+	service.sample = func() bool { return true }
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "invalid-ip"} {
+		primaryResult, primaryErr := primary.LookupIP(ip)
+		result, err := service.LookupIP(ip)
+		if result != primaryResult || err != primaryErr {
+			t.Errorf("LookupIP(%s) = %v, %v, want primary answer %v, %v", ip, result, err, primaryResult, primaryErr)
+		}
+	}
+	service.Close()
+
+	summary := service.Summary()
+	if summary.Compared != 4 || summary.Disagreements != 3 {
+		t.Errorf("Expected 4 comparisons and 3 disagreements, got %+v", summary.ShadowStats)
+	}
+
+	australia := summary.Countries["Australia"]
+	if australia.Compared != 2 || australia.CityMismatches != 1 || australia.CountryMismatches != 0 || australia.DisagreementRate != 0.5 {
+		t.Errorf("Unexpected Australia stats: %+v", australia)
+	}
+	if france := summary.Countries["France"]; france.CountryMismatches != 1 || france.DisagreementRate != 1 {
+		t.Errorf("Unexpected France stats: %+v", france)
+	}
+	if unknown := summary.Countries["unknown"]; unknown.Disagreements != 1 {
+		t.Errorf("Expected primary miss vs shadow hit to count as disagreement, got %+v", unknown)
+	}
+}
+
+func TestShadowServiceErrorsAndSampling(t *testing.T) {
+	primary := &stubService{results: map[string]*Result{"1.1.1.1": {Country: "Australia", City: "Sydney"}}}
+	shadow := &stubService{err: errors.New("connection refused")}
+
+	service := NewShadowService(primary, shadow, 0)
+	if _, err := service.LookupIP("1.1.1.1"); err != nil {
+		t.Fatalf("LookupIP failed: %v", err)
+	}
+	service.Close()
+	if summary := service.Summary(); len(summary.Countries) != 0 {
+		t.Errorf("Expected no comparisons with a zero sample rate, got %+v", summary)
+	}
+
+	service.sample = func() bool { return true }
+	if _, err := service.LookupIP("1.1.1.1"); err != nil {
+		t.Fatalf("LookupIP failed despite shadow error: %v", err)
+	}
+	service.Close()
+
+	summary := service.Summary()
+	if summary.ShadowErrors != 1 || summary.Compared != 0 {
+		t.Errorf("Expected one shadow error and no comparisons, got %+v", summary.ShadowStats)
+	}
+}
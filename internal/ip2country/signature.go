@@ -0,0 +1,170 @@
+package ip2country
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SignatureSuffix is appended to the path of a dataset file to find its
+// detached signature. A signature is an ed25519 signature of the 32-byte
+// SHA-256 digest of the dataset file, stored raw or base64 encoded. Signing the
+// digest lets loaders verify exactly the bytes they parsed while streaming the
+// file.
+const SignatureSuffix = ".sig"
+
+// TrustedKey is a public key accepted for dataset signatures
+type TrustedKey struct {
+	ID  string
+	Key ed25519.PublicKey
+}
+
+// DatasetVerifier checks dataset signatures against a set of trusted keys. A
+// nil verifier accepts every dataset without a signature.
+type DatasetVerifier struct {
+	keys []TrustedKey
+}
+
+// ErrSignatureInvalid is returned when a dataset signature does not verify
+// against any trusted key
+var ErrSignatureInvalid = errors.New("dataset signature does not verify against any trusted key")
+
+// NewDatasetVerifier returns a verifier trusting keys
+func NewDatasetVerifier(keys ...TrustedKey) *DatasetVerifier {
+	return &DatasetVerifier{keys: keys}
+}
+
+// ParseTrustedKeys parses a comma separated list of trusted public keys, each
+// written as [id:]key where key is the base64 encoding of a raw ed25519 public
+// key or of its DER encoding (openssl pkey -pubout -outform DER). Keys without
+// an id are named by their fingerprint. An empty list returns a nil verifier.
+func ParseTrustedKeys(s string) (*DatasetVerifier, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	verifier := &DatasetVerifier{}
+	for _, entry := range strings.Split(s, ",") {
+		id, encoded, named := strings.Cut(strings.TrimSpace(entry), ":")
+		if !named {
+			id, encoded = "", strings.TrimSpace(entry)
+		}
+		key, err := parsePublicKey(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", strings.TrimSpace(entry), err)
+		}
+		id = strings.TrimSpace(id)
+		if id == "" {
+			id = KeyFingerprint(key)
+		}
+		for _, other := range verifier.keys {
+			if other.ID == id {
+				return nil, fmt.Errorf("duplicate key id %q", id)
+			}
+		}
+		verifier.keys = append(verifier.keys, TrustedKey{ID: id, Key: key})
+	}
+	return verifier, nil
+}
+
+// parsePublicKey decodes a base64 raw or DER encoded ed25519 public key
+func parsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("expected base64: %v", err)
+	}
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("expected a raw or DER encoded ed25519 public key")
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 public key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// KeyFingerprint names a public key by the first bytes of its SHA-256
+func KeyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "ed25519-" + hex.EncodeToString(sum[:8])
+}
+
+// verifyFile checks the signature stored next to filePath against digest, the
+// SHA-256 of the file contents as they were loaded, and returns the id of the
+// key that signed it. A nil verifier returns an empty id.
+func (v *DatasetVerifier) verifyFile(filePath string, digest []byte) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	signature, err := readSignature(filePath + SignatureSuffix)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", filePath, err)
+	}
+	for _, key := range v.keys {
+		if ed25519.Verify(key.Key, digest, signature) {
+			return key.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", filePath, ErrSignatureInvalid)
+}
+
+// readSignature reads a raw or base64 encoded detached signature
+func readSignature(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %v", err)
+	}
+	if len(content) == ed25519.SignatureSize {
+		return content, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature file %s: expected a raw or base64 ed25519 signature", path)
+	}
+	return signature, nil
+}
+
+// ParsePrivateKey decodes a PEM encoded PKCS #8 ed25519 private key, as
+// written by openssl genpkey -algorithm ed25519
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("expected a PEM encoded private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 private key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// SignDataset signs the dataset file at filePath and returns the base64
+// encoded detached signature
+func SignDataset(filePath string, key ed25519.PrivateKey) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening dataset file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading dataset file: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, hash.Sum(nil))), nil
+}
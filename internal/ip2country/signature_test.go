@@ -0,0 +1,226 @@
+package ip2country
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKey generates a signing key and returns it with its base64 public key
+func newTestKey(t *testing.T) (ed25519.PrivateKey, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return private, base64.StdEncoding.EncodeToString(public)
+}
+
+// signTestFile writes the detached signature of path
+func signTestFile(t *testing.T, path string, key ed25519.PrivateKey) {
+	signature, err := SignDataset(path, key)
+	if err != nil {
+		t.Fatalf("Failed to sign %s: %v", path, err)
+	}
+	if err := os.WriteFile(path+SignatureSuffix, []byte(signature+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write signature: %v", err)
+	}
+}
+
+func TestParseTrustedKeys(t *testing.T) {
+	_, raw := newTestKey(t)
+	private, _ := newTestKey(t)
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	derKey := base64.StdEncoding.EncodeToString(der)
+	derFingerprint := KeyFingerprint(private.Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name    string
+		input   string
+		ids     []string
+		wantErr bool
+	}{
+		{name: "Empty", input: " "},
+		{name: "Named raw key", input: "release:" + raw, ids: []string{"release"}},
+		{name: "DER key named by fingerprint", input: derKey, ids: []string{derFingerprint}},
+		{name: "Several keys", input: "old:" + raw + ", " + derKey, ids: []string{"old", derFingerprint}},
+		{name: "Duplicate id", input: "a:" + raw + ",a:" + derKey, wantErr: true},
+		{name: "Not base64", input: "a:not base64", wantErr: true},
+		{name: "Wrong length", input: base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier, err := ParseTrustedKeys(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.ids == nil {
+				if verifier != nil {
+					t.Errorf("Expected a nil verifier, got %+v", verifier)
+				}
+				return
+			}
+			var ids []string
+			for _, key := range verifier.keys {
+				ids = append(ids, key.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.ids, ",") {
+				t.Errorf("Key ids = %v, expected %v", ids, tc.ids)
+			}
+		})
+	}
+}
+
+func TestCSVServiceSignature(t *testing.T) {
+	key, public := newTestKey(t)
+	other, _ := newTestKey(t)
+	verifier, err := ParseTrustedKeys("release:" + public)
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %v", err)
+	}
+	dir := t.TempDir()
+	content := "1.1.1.1,Sydney,Australia\n"
+
+	tests := []struct {
+		name    string
+		prepare func(path string)
+		wantErr bool
+		errIs   error
+	}{
+		{name: "Valid signature", prepare: func(path string) { signTestFile(t, path, key) }},
+		{name: "Missing signature", prepare: func(path string) {}, wantErr: true},
+		{name: "Untrusted key", prepare: func(path string) { signTestFile(t, path, other) }, wantErr: true, errIs: ErrSignatureInvalid},
+		{name: "Modified after signing", prepare: func(path string) {
+			signTestFile(t, path, key)
+			os.WriteFile(path, []byte("1.1.1.1,Auckland,New Zealand\n"), 0644)
+		}, wantErr: true, errIs: ErrSignatureInvalid},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestFile(t, dir, "data"+string(rune('a'+i))+".csv", content)
+			tc.prepare(path)
+
+			service, err := NewCSVServiceWithOptions(path, CSVOptions{Verifier: verifier})
+			if tc.wantErr {
+				if err == nil || (tc.errIs != nil && !errors.Is(err, tc.errIs)) {
+					t.Fatalf("Expected error %v, got %v", tc.errIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create CSV service: %v", err)
+			}
+			if signer := service.Datasets()[0].Signer; signer != "release" {
+				t.Errorf("Signer = %q, expected release", signer)
+			}
+			// A rewritten file would no longer match its signature
+			err = service.PutRecord(netip.MustParsePrefix("2.2.2.2/32"), Result{Country: "France"})
+			if !errors.Is(err, ErrReadOnly) {
+				t.Errorf("PutRecord() = %v, expected %v", err, ErrReadOnly)
+			}
+		})
+	}
+}
+
+func TestSnapshotServiceSignature(t *testing.T) {
+	key, public := newTestKey(t)
+	verifier, err := ParseTrustedKeys(public)
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.snap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if err := WriteDataset(file, "snapshot", parseRecords(t, "1.1.1.0/24,Sydney,Australia")); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	file.Close()
+
+	if _, err := NewSnapshotServiceWithOptions(path, SnapshotOptions{Verifier: verifier}); err == nil {
+		t.Fatal("Expected error for an unsigned snapshot, got nil")
+	}
+
+	signTestFile(t, path, key)
+	service, err := NewSnapshotServiceWithOptions(path, SnapshotOptions{Verifier: verifier})
+	if err != nil {
+		t.Fatalf("Failed to create snapshot service: %v", err)
+	}
+	defer service.Close()
+	if signer := service.Datasets()[0].Signer; signer != KeyFingerprint(key.Public().(ed25519.PublicKey)) {
+		t.Errorf("Signer = %q, expected the key fingerprint", signer)
+	}
+}
+
+func TestRemoteServiceSignature(t *testing.T) {
+	key, public := newTestKey(t)
+	verifier, err := ParseTrustedKeys(public)
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %v", err)
+	}
+
+	content := "1.1.1.1,Sydney,Australia\n"
+	signed := writeTestFile(t, t.TempDir(), "ip2country.csv", content)
+	signTestFile(t, signed, key)
+	signature, _ := os.ReadFile(signed + SignatureSuffix)
+
+	_, datasets := newDatasetServer(t, content)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip2country.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	})
+	mux.HandleFunc("/ip2country.csv.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signature)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	open := func(path string) (Service, error) {
+		service, err := NewCSVServiceWithOptions(path, CSVOptions{Verifier: verifier})
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	}
+
+	service, err := NewRemoteService(server.URL+"/ip2country.csv", open, RemoteOptions{Signed: true})
+	if err != nil {
+		t.Fatalf("Failed to create remote service: %v", err)
+	}
+	if info := service.Datasets()[0]; info.Signer == "" {
+		t.Errorf("Datasets() = %+v, expected a signer", info)
+	}
+	filePath := service.current.filePath
+	service.Close()
+	if _, err := os.Stat(filePath + SignatureSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the downloaded signature to be removed, got %v", err)
+	}
+
+	// The plain dataset server answers every path with the dataset, which is
+	// not a valid signature
+	_, err = NewRemoteService(datasets.URL+"/ip2country.csv", open, RemoteOptions{Signed: true, Client: datasets.Client()})
+	if err == nil {
+		t.Error("Expected error for a dataset without a signature, got nil")
+	}
+}
@@ -0,0 +1,118 @@
+package ip2country
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A snapshot is a compiled dataset in a binary format that can be used without
+// parsing. All integers are big-endian and the file is laid out as follows:
+//
+//	header, 64 bytes
+//	  magic         [8]byte   "IP2CSNAP"
+//	  version       uint32    snapshotFormatVersion
+//	  ipv4Count     uint32    number of IPv4 ranges
+//	  ipv6Count     uint32    number of IPv6 ranges
+//	  resultCount   uint32    number of results
+//	  stringsSize   uint32    size of the string table in bytes
+//	  reserved      [4]byte
+//	  checksum      [32]byte  SHA-256 of everything after the header
+//	IPv4 ranges     ipv4Count × (start [4]byte, end [4]byte, result uint32)
+//	IPv6 ranges     ipv6Count × (start [16]byte, end [16]byte, result uint32)
+//	results         resultCount × (country offset, country length, city offset, city length,
+//	                attributes offset, attributes length uint32)
+//	strings         stringsSize bytes, every distinct string stored once
+//
+// Ranges are inclusive, sorted by start address and never overlap, so a lookup
+// is a binary search. Result and string offsets index the results and strings
+// sections. Attributes are stored in their encoded form. Version 1 snapshots,
+// written before results had attributes, have 16-byte results without them.
+const (
+	snapshotMagic         = "IP2CSNAP"
+	snapshotFormatVersion = 2
+
+	snapshotHeaderSize     = 64
+	snapshotIPv4RangeSize  = 4 + 4 + 4
+	snapshotIPv6RangeSize  = 16 + 16 + 4
+	snapshotResultSize     = 6 * 4
+	snapshotV1ResultSize   = 4 * 4
+	snapshotChecksumOffset = snapshotHeaderSize - sha256.Size
+)
+
+// writeSnapshot compiles records into a snapshot. Nested records are flattened
+// so that every address keeps resolving to its most specific record.
+func writeSnapshot(w io.Writer, records []Record) error {
+	segments := flattenRecords(records)
+
+	// Intern results and strings so that each one is stored once
+	var strs bytes.Buffer
+	stringOffsets := make(map[string]uint32)
+	intern := func(s string) uint32 {
+		offset, ok := stringOffsets[s]
+		if !ok {
+			offset = uint32(strs.Len())
+			stringOffsets[s] = offset
+			strs.WriteString(s)
+		}
+		return offset
+	}
+	var results bytes.Buffer
+	resultIndexes := make(map[Result]uint32)
+	resultIndex := func(result Result) uint32 {
+		index, ok := resultIndexes[result]
+		if !ok {
+			index = uint32(len(resultIndexes))
+			resultIndexes[result] = index
+			results.Write(binary.BigEndian.AppendUint32(nil, intern(result.Country)))
+			results.Write(binary.BigEndian.AppendUint32(nil, uint32(len(result.Country))))
+			results.Write(binary.BigEndian.AppendUint32(nil, intern(result.City)))
+			results.Write(binary.BigEndian.AppendUint32(nil, uint32(len(result.City))))
+			results.Write(binary.BigEndian.AppendUint32(nil, intern(result.Attributes.encoded)))
+			results.Write(binary.BigEndian.AppendUint32(nil, uint32(len(result.Attributes.encoded))))
+		}
+		return index
+	}
+
+	var ipv4, ipv6 bytes.Buffer
+	var ipv4Count, ipv6Count uint32
+	for _, s := range segments {
+		table := &ipv6
+		if s.network.Start.Is4() {
+			table = &ipv4
+			ipv4Count++
+		} else {
+			ipv6Count++
+		}
+		table.Write(s.network.Start.AsSlice())
+		table.Write(s.network.End.AsSlice())
+		table.Write(binary.BigEndian.AppendUint32(nil, resultIndex(s.result)))
+	}
+	if uint64(strs.Len()) > math.MaxUint32 {
+		return fmt.Errorf("error encoding snapshot: string table too large")
+	}
+
+	hash := sha256.New()
+	for _, section := range []*bytes.Buffer{&ipv4, &ipv6, &results, &strs} {
+		hash.Write(section.Bytes())
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[8:], snapshotFormatVersion)
+	binary.BigEndian.PutUint32(header[12:], ipv4Count)
+	binary.BigEndian.PutUint32(header[16:], ipv6Count)
+	binary.BigEndian.PutUint32(header[20:], uint32(len(resultIndexes)))
+	binary.BigEndian.PutUint32(header[24:], uint32(strs.Len()))
+	copy(header[snapshotChecksumOffset:], hash.Sum(nil))
+
+	for _, section := range [][]byte{header, ipv4.Bytes(), ipv6.Bytes(), results.Bytes(), strs.Bytes()} {
+		if _, err := w.Write(section); err != nil {
+			return fmt.Errorf("error writing snapshot: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package ip2country
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SnapshotService implements Service by memory-mapping a binary snapshot
+// written by the compile command. Nothing is parsed or copied at startup, but
+// the whole mapping is read once to verify its checksum, so loading takes as
+// long as hashing the file. Processes serving the same file share its pages.
+type SnapshotService struct {
+	filePath string
+	data     []byte
+	unmap    func() error
+	info     DatasetInfo
+
+	// resultSize is the size of a result entry in this format version
+	resultSize uint64
+
+	// Sections of data, see the format description in snapshot.go
+	ipv4    []byte
+	ipv6    []byte
+	results []byte
+	strings []byte
+
+	closeOnce sync.Once
+}
+
+// SnapshotOptions holds optional settings of a SnapshotService
+type SnapshotOptions struct {
+	// Verifier, when set, requires a valid detached signature next to the file
+	Verifier *DatasetVerifier
+}
+
+// NewSnapshotService maps the snapshot at filePath and verifies its header and checksum
+func NewSnapshotService(filePath string) (*SnapshotService, error) {
+	return NewSnapshotServiceWithOptions(filePath, SnapshotOptions{})
+}
+
+// NewSnapshotServiceWithOptions maps the snapshot at filePath with the given
+// options. A compressed snapshot is decompressed into memory instead, so it
+// loads slower and its pages are not shared between processes.
+func NewSnapshotServiceWithOptions(filePath string, options SnapshotOptions) (*SnapshotService, error) {
+	start := time.Now()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening snapshot file: %v", err)
+	}
+	defer file.Close()
+
+	loaded, err := loadSnapshotFile(file, options.Verifier != nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	if len(loaded.data) < snapshotHeaderSize {
+		loaded.unmap()
+		return nil, fmt.Errorf("%s: invalid snapshot: file too short", filePath)
+	}
+
+	service := &SnapshotService{filePath: filePath, data: loaded.data, unmap: loaded.unmap}
+	if err := service.parse(); err != nil {
+		loaded.unmap()
+		return nil, fmt.Errorf("%s: invalid snapshot: %v", filePath, err)
+	}
+	if options.Verifier != nil {
+		// The signature covers the whole file as stored, header included
+		signer, err := options.Verifier.verifyFile(filePath, loaded.digest)
+		if err != nil {
+			loaded.unmap()
+			return nil, err
+		}
+		service.info.Signer = signer
+	}
+
+	service.info.Compression = loaded.compression
+	service.info.LoadDuration = service.info.LoadedAt.Sub(start)
+	return service, nil
+}
+
+// snapshotFile holds the contents of a snapshot file in memory
+type snapshotFile struct {
+	data        []byte
+	unmap       func() error
+	compression string
+	digest      []byte // SHA-256 of the file as stored, when computed
+}
+
+// loadSnapshotFile maps an uncompressed snapshot file or decompresses a
+// compressed one into memory. The digest of a mapped file is only computed
+// when withDigest is set, since it reads every page.
+func loadSnapshotFile(file *os.File, withDigest bool) (snapshotFile, error) {
+	header := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return snapshotFile{}, fmt.Errorf("error reading snapshot file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return snapshotFile{}, fmt.Errorf("error reading snapshot file: %v", err)
+	}
+
+	if detectCompression(header[:n]) != "" {
+		hash := sha256.New()
+		raw := io.TeeReader(file, hash)
+		reader, compression, err := decompress(raw)
+		if err != nil {
+			return snapshotFile{}, err
+		}
+		data, err := io.ReadAll(reader)
+		if err == nil {
+			// Trailing bytes after the compressed stream are still part of the file
+			_, err = io.Copy(io.Discard, raw)
+		}
+		if err != nil {
+			return snapshotFile{}, fmt.Errorf("error decompressing snapshot file: %v", err)
+		}
+		return snapshotFile{data: data, unmap: func() error { return nil }, compression: compression, digest: hash.Sum(nil)}, nil
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("error reading snapshot file: %v", err)
+	}
+	if stat.Size() < snapshotHeaderSize {
+		return snapshotFile{}, fmt.Errorf("invalid snapshot: file too short")
+	}
+	data, unmap, err := mapFile(file, int(stat.Size()))
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	loaded := snapshotFile{data: data, unmap: unmap}
+	if withDigest {
+		sum := sha256.Sum256(data)
+		loaded.digest = sum[:]
+	}
+	return loaded, nil
+}
+
+// parse validates the header and slices the mapped file into its sections
+func (s *SnapshotService) parse() error {
+	header := s.data[:snapshotHeaderSize]
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("not a snapshot file")
+	}
+	switch version := binary.BigEndian.Uint32(header[8:]); version {
+	case 1:
+		s.resultSize = snapshotV1ResultSize
+	case snapshotFormatVersion:
+		s.resultSize = snapshotResultSize
+	default:
+		return fmt.Errorf("unsupported format version %d, expected %d", version, snapshotFormatVersion)
+	}
+
+	ipv4Count := uint64(binary.BigEndian.Uint32(header[12:]))
+	ipv6Count := uint64(binary.BigEndian.Uint32(header[16:]))
+	resultCount := uint64(binary.BigEndian.Uint32(header[20:]))
+	stringsSize := uint64(binary.BigEndian.Uint32(header[24:]))
+
+	body := s.data[snapshotHeaderSize:]
+	sizes := []uint64{
+		ipv4Count * snapshotIPv4RangeSize,
+		ipv6Count * snapshotIPv6RangeSize,
+		resultCount * s.resultSize,
+		stringsSize,
+	}
+	var total uint64
+	for _, size := range sizes {
+		total += size
+	}
+	if total != uint64(len(body)) {
+		return fmt.Errorf("header describes %d bytes of data, file has %d", total, len(body))
+	}
+
+	checksum := sha256.Sum256(body)
+	if !bytes.Equal(checksum[:], header[snapshotChecksumOffset:]) {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	sections := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		sections[i], body = body[:size], body[size:]
+	}
+	s.ipv4, s.ipv6, s.results, s.strings = sections[0], sections[1], sections[2], sections[3]
+
+	// Every result must point inside the string table, and ranges must be
+	// sorted and point at an existing result, so lookups never read out of
+	// bounds
+	for i := uint64(0); i < resultCount; i++ {
+		entry := s.results[i*s.resultSize:]
+		for field := 0; field < int(s.resultSize); field += 8 {
+			offset := uint64(binary.BigEndian.Uint32(entry[field:]))
+			length := uint64(binary.BigEndian.Uint32(entry[field+4:]))
+			if offset+length > stringsSize {
+				return fmt.Errorf("result %d points outside the string table", i)
+			}
+		}
+	}
+	// The ranges are disjoint, so the addresses they cover add up
+	var covered [2]float64
+	for family, table := range []struct {
+		data  []byte
+		width int
+	}{{s.ipv4, 4}, {s.ipv6, 16}} {
+		size := 2*table.width + 4
+		var previousEnd []byte
+		for i := 0; i < len(table.data); i += size {
+			entry := table.data[i : i+size]
+			start, end := entry[:table.width], entry[table.width:2*table.width]
+			if bytes.Compare(start, end) > 0 || (previousEnd != nil && bytes.Compare(previousEnd, start) >= 0) {
+				return fmt.Errorf("range %d is not sorted", i/size)
+			}
+			if uint64(binary.BigEndian.Uint32(entry[2*table.width:])) >= resultCount {
+				return fmt.Errorf("range %d points at a missing result", i/size)
+			}
+			covered[family] += rangeSize(start, end)
+			previousEnd = end
+		}
+	}
+
+	hexChecksum := hex.EncodeToString(checksum[:])
+	s.info = DatasetInfo{
+		Type:         "snapshot",
+		Source:       s.filePath,
+		Records:      int(ipv4Count + ipv6Count),
+		IPv4Records:  int(ipv4Count),
+		IPv6Records:  int(ipv6Count),
+		IPv4Coverage: coveragePercent(covered[0], 32),
+		IPv6Coverage: coveragePercent(covered[1], 128),
+		Checksum:     hexChecksum,
+		Version:      datasetVersion(hexChecksum),
+		LoadedAt:     time.Now(),
+	}
+	return nil
+}
+
+// LookupIP returns country information for a given IP address
+func (s *SnapshotService) LookupIP(ip string) (*Result, error) {
+	if !isValidIP(ip) {
+		return nil, ErrInvalidIP
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidIP
+	}
+	addr = addr.Unmap().WithZone("")
+
+	table, width := s.ipv6, 16
+	if addr.Is4() {
+		table, width = s.ipv4, 4
+	}
+	size := 2*width + 4
+	key := addr.AsSlice()
+
+	// Find the last range starting at or before addr
+	i := sort.Search(len(table)/size, func(i int) bool {
+		return bytes.Compare(table[i*size:i*size+width], key) > 0
+	}) - 1
+	if i < 0 {
+		return nil, &NotFoundError{DatasetVersion: s.info.Version}
+	}
+	entry := table[i*size : (i+1)*size]
+	if bytes.Compare(entry[width:2*width], key) < 0 {
+		return nil, &NotFoundError{DatasetVersion: s.info.Version}
+	}
+
+	result := s.result(binary.BigEndian.Uint32(entry[2*width:]))
+	result.DatasetVersion = s.info.Version
+	return &result, nil
+}
+
+// result decodes the result at index
+func (s *SnapshotService) result(index uint32) Result {
+	entry := s.results[uint64(index)*s.resultSize:]
+	str := func(field int) string {
+		offset := binary.BigEndian.Uint32(entry[field:])
+		length := binary.BigEndian.Uint32(entry[field+4:])
+		return string(s.strings[offset : offset+length])
+	}
+	result := Result{Country: str(0), City: str(8)}
+	if s.resultSize == snapshotResultSize {
+		result.Attributes = Attributes{encoded: str(16)}
+	}
+	return result
+}
+
+// Records returns the ranges of the snapshot as CIDR blocks sorted by address
+func (s *SnapshotService) Records() []Record {
+	records := []Record{}
+	for _, table := range []struct {
+		data  []byte
+		width int
+	}{{s.ipv4, 4}, {s.ipv6, 16}} {
+		size := 2*table.width + 4
+		for i := 0; i < len(table.data); i += size {
+			entry := table.data[i : i+size]
+			start, _ := netip.AddrFromSlice(entry[:table.width])
+			end, _ := netip.AddrFromSlice(entry[table.width : 2*table.width])
+			result := s.result(binary.BigEndian.Uint32(entry[2*table.width:]))
+			for _, prefix := range (Range{Start: start, End: end}).Prefixes() {
+				records = append(records, Record{Prefix: prefix, Result: result})
+			}
+		}
+	}
+	return records
+}
+
+// Datasets returns metadata about the mapped snapshot
+func (s *SnapshotService) Datasets() []DatasetInfo {
+	return []DatasetInfo{s.info}
+}
+
+// Close unmaps the snapshot. The service must not be used afterwards.
+func (s *SnapshotService) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.unmap()
+	})
+	return err
+}
+
+// rangeSize returns the number of addresses from start to end inclusive,
+// given as big-endian addresses of 4 or 16 bytes
+func rangeSize(start, end []byte) float64 {
+	var first, last [16]byte
+	copy(first[16-len(start):], start)
+	copy(last[16-len(end):], end)
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(last[8:]), binary.BigEndian.Uint64(first[8:]), 0)
+	hi, _ := bits.Sub64(binary.BigEndian.Uint64(last[:8]), binary.BigEndian.Uint64(first[:8]), borrow)
+	return math.Ldexp(float64(hi), 64) + float64(lo) + 1
+}
@@ -0,0 +1,169 @@
+package ip2country
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeTestSnapshot compiles lines of "range,city,country" into a snapshot file
+func writeTestSnapshot(t *testing.T, lines ...string) string {
+	var buf bytes.Buffer
+	if err := WriteDataset(&buf, "snapshot", parseRecords(t, lines...)); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	return writeTestFile(t, t.TempDir(), "test.snap", buf.String())
+}
+
+func TestSnapshotServiceLookupIP(t *testing.T) {
+	path := writeTestSnapshot(t,
+		"1.1.1.0/24,Sydney,Australia",
+		"10.0.0.0/8,Private,Private",
+		"10.1.0.0/16,London,UK",
+		"2001:db8::/32,Berlin,Germany",
+	)
+	service, err := NewSnapshotService(path)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot service: %v", err)
+	}
+	defer service.Close()
+
+	tests := []struct {
+		name        string
+		ip          string
+		wantCountry string
+		wantErr     error
+	}{
+		{name: "First range", ip: "1.1.1.0", wantCountry: "Australia"},
+		{name: "End of range", ip: "1.1.1.255", wantCountry: "Australia"},
+		{name: "Nested range", ip: "10.1.2.3", wantCountry: "UK"},
+		{name: "Around nested range", ip: "10.2.0.0", wantCountry: "Private"},
+		{name: "IPv6", ip: "2001:db8::1", wantCountry: "Germany"},
+		{name: "IPv4-mapped IPv6", ip: "::ffff:10.1.0.1", wantCountry: "UK"},
+		{name: "Before first range", ip: "0.0.0.1", wantErr: ErrIPNotFound},
+		{name: "Gap between ranges", ip: "1.1.2.0", wantErr: ErrIPNotFound},
+		{name: "After last range", ip: "2001:db9::", wantErr: ErrIPNotFound},
+		{name: "Invalid IP", ip: "invalid-ip", wantErr: ErrInvalidIP},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := service.LookupIP(tc.ip)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("LookupIP(%s) error = %v, want %v", tc.ip, err, tc.wantErr)
+			}
+			if err == nil && result.Country != tc.wantCountry {
+				t.Errorf("LookupIP(%s) country = %s, want %s", tc.ip, result.Country, tc.wantCountry)
+			}
+		})
+	}
+
+	info := service.Datasets()[0]
+	if info.Type != "snapshot" || info.Records != 5 || info.IPv4Records != 4 || info.IPv6Records != 1 {
+		t.Errorf("Unexpected dataset info: %+v", info)
+	}
+	// The ranges cover 1.1.1.0/24 and 10.0.0.0/8, nested ranges only once
+	if expected := (256 + math.Ldexp(1, 24)) / math.Ldexp(1, 32) * 100; info.IPv4Coverage != expected {
+		t.Errorf("IPv4Coverage = %v, want %v", info.IPv4Coverage, expected)
+	}
+	if expected := 100 / math.Ldexp(1, 32); info.IPv6Coverage != expected {
+		t.Errorf("IPv6Coverage = %v, want %v", info.IPv6Coverage, expected)
+	}
+	if result, _ := service.LookupIP("1.1.1.1"); result.DatasetVersion != info.Version {
+		t.Errorf("Result DatasetVersion = %q, want %q", result.DatasetVersion, info.Version)
+	}
+}
+
+func TestSnapshotServiceRecords(t *testing.T) {
+	lines := []string{"10.0.0.0/8,Private,Private", "10.1.0.0/16,London,UK", "2001:db8::/32,Berlin,Germany"}
+	records, err := ReadDatasetFile(writeTestSnapshot(t, lines...), "", CSVFormat{})
+	if err != nil {
+		t.Fatalf("ReadDatasetFile failed: %v", err)
+	}
+
+	if diff := DiffDatasets(parseRecords(t, lines...), records); len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+		t.Errorf("Snapshot records differ from the input:\n%s", diff)
+	}
+}
+
+func TestSnapshotServiceAttributes(t *testing.T) {
+	records := []Record{{
+		Prefix: netip.MustParsePrefix("1.1.1.0/24"),
+		Result: Result{City: "Sydney", Country: "Australia", Attributes: NewAttributes(map[string]string{"isp": "Cloudflare"})},
+	}}
+	var buf bytes.Buffer
+	if err := WriteDataset(&buf, "snapshot", records); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	data := buf.Bytes()
+
+	service, err := NewSnapshotService(writeTestFile(t, t.TempDir(), "test.snap", string(data)))
+	if err != nil {
+		t.Fatalf("Failed to create snapshot service: %v", err)
+	}
+	defer service.Close()
+	if result, err := service.LookupIP("1.1.1.1"); err != nil || result.Attributes != records[0].Result.Attributes {
+		t.Errorf("LookupIP(1.1.1.1) = %v, %v, want attributes %v", result, err, records[0].Result.Attributes)
+	}
+
+	// Rewrite the snapshot in the version 1 layout, whose results have no attributes
+	ipv4 := int(binary.BigEndian.Uint32(data[12:])) * snapshotIPv4RangeSize
+	results := snapshotHeaderSize + ipv4
+	v1 := slices.Concat(data[:results], data[results:results+snapshotV1ResultSize], data[results+snapshotResultSize:])
+	binary.BigEndian.PutUint32(v1[8:], 1)
+	checksum := sha256.Sum256(v1[snapshotHeaderSize:])
+	copy(v1[snapshotChecksumOffset:], checksum[:])
+
+	v1Service, err := NewSnapshotService(writeTestFile(t, t.TempDir(), "v1.snap", string(v1)))
+	if err != nil {
+		t.Fatalf("Failed to read version 1 snapshot: %v", err)
+	}
+	defer v1Service.Close()
+	if result, err := v1Service.LookupIP("1.1.1.1"); err != nil || result.Country != "Australia" || !result.Attributes.IsZero() {
+		t.Errorf("LookupIP(1.1.1.1) on version 1 = %v, %v, want Australia without attributes", result, err)
+	}
+}
+
+func TestNewSnapshotServiceErrors(t *testing.T) {
+	valid, err := os.ReadFile(writeTestSnapshot(t, "1.1.1.0/24,Sydney,Australia"))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	corrupt := func(change func(data []byte) []byte) []byte {
+		return change(bytes.Clone(valid))
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "Too short", data: valid[:10], wantErr: "file too short"},
+		{name: "Wrong magic", data: corrupt(func(d []byte) []byte { d[0] = 'X'; return d }), wantErr: "not a snapshot file"},
+		{name: "Unsupported version", data: corrupt(func(d []byte) []byte { binary.BigEndian.PutUint32(d[8:], 99); return d }), wantErr: "unsupported format version 99"},
+		{name: "Truncated", data: valid[:len(valid)-1], wantErr: "header describes"},
+		{name: "Corrupted data", data: corrupt(func(d []byte) []byte { d[len(d)-1] ^= 0xff; return d }), wantErr: "checksum mismatch"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestFile(t, t.TempDir(), "test.snap", string(tc.data))
+			_, err := NewSnapshotService(path)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("NewSnapshotService error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewSnapshotService(filepath.Join(t.TempDir(), "missing.snap")); err == nil {
+		t.Error("Expected error for missing file, got nil")
+	}
+}
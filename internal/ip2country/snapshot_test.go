@@ -0,0 +1,55 @@
+package ip2country
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	records := parseRecords(t,
+		"1.1.1.0/24,Sydney,Australia",
+		"10.0.0.0/8,Sydney,Australia",
+		"10.1.0.0/16,London,UK",
+		"2001:db8::/32,London,UK",
+	)
+
+	var buf bytes.Buffer
+	if err := WriteDataset(&buf, "snapshot", records); err != nil {
+		t.Fatalf("WriteDataset failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	if string(data[:8]) != snapshotMagic {
+		t.Errorf("magic = %q, want %q", data[:8], snapshotMagic)
+	}
+	header := map[string]uint32{
+		"version":     binary.BigEndian.Uint32(data[8:]),
+		"ipv4Count":   binary.BigEndian.Uint32(data[12:]),
+		"ipv6Count":   binary.BigEndian.Uint32(data[16:]),
+		"resultCount": binary.BigEndian.Uint32(data[20:]),
+		"stringsSize": binary.BigEndian.Uint32(data[24:]),
+	}
+	// 10.0.0.0/8 is split around 10.1.0.0/16, and strings are stored once
+	expected := map[string]uint32{
+		"version":     snapshotFormatVersion,
+		"ipv4Count":   4,
+		"ipv6Count":   1,
+		"resultCount": 2,
+		"stringsSize": uint32(len("AustraliaSydneyUKLondon")),
+	}
+	for field, want := range expected {
+		if header[field] != want {
+			t.Errorf("%s = %d, want %d", field, header[field], want)
+		}
+	}
+
+	size := snapshotHeaderSize + 4*snapshotIPv4RangeSize + snapshotIPv6RangeSize + 2*snapshotResultSize + len("AustraliaSydneyUKLondon")
+	if len(data) != size {
+		t.Fatalf("snapshot size = %d, want %d", len(data), size)
+	}
+	if checksum := sha256.Sum256(data[snapshotHeaderSize:]); !bytes.Equal(checksum[:], data[snapshotChecksumOffset:snapshotHeaderSize]) {
+		t.Error("header checksum does not match the snapshot contents")
+	}
+}
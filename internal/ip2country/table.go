@@ -0,0 +1,172 @@
+package ip2country
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// prefixTable maps IP prefixes to results and answers longest-prefix-match lookups.
+// Single addresses are stored as /32 (IPv4) or /128 (IPv6) prefixes.
+type prefixTable struct {
+	entries map[netip.Prefix]Result
+	// lengths counts the entries per address family and prefix length,
+	// so lookups only probe the lengths that are actually present
+	lengths [2][129]int
+}
+
+func newPrefixTable(size int) *prefixTable {
+	return &prefixTable{entries: make(map[netip.Prefix]Result, size)}
+}
+
+// familyIndex returns 0 for IPv4 and 1 for IPv6 addresses
+func familyIndex(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
+
+// set adds or replaces the result for prefix
+func (t *prefixTable) set(prefix netip.Prefix, result Result) {
+	if _, exists := t.entries[prefix]; !exists {
+		t.lengths[familyIndex(prefix.Addr())][prefix.Bits()]++
+	}
+	t.entries[prefix] = result
+}
+
+// remove deletes prefix from the table and reports whether it was present
+func (t *prefixTable) remove(prefix netip.Prefix) bool {
+	if _, exists := t.entries[prefix]; !exists {
+		return false
+	}
+	delete(t.entries, prefix)
+	t.lengths[familyIndex(prefix.Addr())][prefix.Bits()]--
+	return true
+}
+
+// lookup returns the result of the most specific prefix containing addr
+func (t *prefixTable) lookup(addr netip.Addr) (Result, bool) {
+	var match Result
+	found := t.match(addr, func(_ netip.Prefix, result Result) bool {
+		match = result
+		return true
+	})
+	return match, found
+}
+
+// match calls accept for every prefix containing addr, most specific first,
+// until accept returns true. It reports whether any prefix was accepted.
+func (t *prefixTable) match(addr netip.Addr, accept func(netip.Prefix, Result) bool) bool {
+	addr = addr.Unmap().WithZone("")
+	family := familyIndex(addr)
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		if t.lengths[family][bits] == 0 {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if result, found := t.entries[prefix]; found && accept(prefix, result) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a deep copy of the table so it can be modified without
+// affecting concurrent readers of the original
+func (t *prefixTable) clone() *prefixTable {
+	c := newPrefixTable(len(t.entries))
+	for prefix, result := range t.entries {
+		c.entries[prefix] = result
+	}
+	c.lengths = t.lengths
+	return c
+}
+
+// describe counts the records of the table per address family in info, along
+// with the share of each address space they cover
+func (t *prefixTable) describe(info *DatasetInfo) {
+	var prefixes [2][]netip.Prefix
+	for prefix := range t.entries {
+		family := familyIndex(prefix.Addr())
+		prefixes[family] = append(prefixes[family], prefix)
+	}
+	info.IPv4Records, info.IPv6Records = len(prefixes[0]), len(prefixes[1])
+	info.IPv4Coverage = coveragePercent(coveredAddresses(prefixes[0]), 32)
+	info.IPv6Coverage = coveragePercent(coveredAddresses(prefixes[1]), 128)
+}
+
+// coveredAddresses returns the number of addresses in the union of prefixes.
+// Two prefixes either nest or are disjoint, so once sorted by address with
+// the shortest first, a prefix is either inside the last one counted or
+// after it.
+func coveredAddresses(prefixes []netip.Prefix) float64 {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+	var covered float64
+	var last netip.Prefix
+	for _, prefix := range prefixes {
+		if last.IsValid() && last.Contains(prefix.Addr()) {
+			continue
+		}
+		covered += math.Ldexp(1, prefix.Addr().BitLen()-prefix.Bits())
+		last = prefix
+	}
+	return covered
+}
+
+// coveragePercent returns the percentage of an address space of bitLen bits
+// that addresses make up
+func coveragePercent(addresses float64, bitLen int) float64 {
+	return addresses / math.Ldexp(1, bitLen) * 100
+}
+
+// ParsePrefix parses a single IP address or a CIDR block into a canonical prefix.
+// Host bits are masked off and IPv4-mapped IPv6 addresses are treated as IPv4.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// formatPrefix renders a prefix the way it is written in a dataset file:
+// single addresses without a prefix length, blocks in CIDR notation
+func formatPrefix(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// comparePrefixes orders prefixes by address family, address and length
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
@@ -0,0 +1,102 @@
+package ip2country
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{name: "IPv4 address", input: "1.2.3.4", expected: "1.2.3.4/32"},
+		{name: "IPv6 address", input: "2001:db8::1", expected: "2001:db8::1/128"},
+		{name: "IPv4 CIDR", input: "10.0.0.0/8", expected: "10.0.0.0/8"},
+		{name: "CIDR with host bits", input: "10.1.2.3/8", expected: "10.0.0.0/8"},
+		{name: "IPv4-mapped address", input: "::ffff:1.2.3.4", expected: "1.2.3.4/32"},
+		{name: "Surrounding whitespace", input: " 1.2.3.4 ", expected: "1.2.3.4/32"},
+		{name: "Invalid address", input: "not-an-ip", wantErr: true},
+		{name: "Invalid CIDR", input: "10.0.0.0/33", wantErr: true},
+		{name: "Zoned address", input: "fe80::1%eth0", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix, err := ParsePrefix(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParsePrefix(%q) expected error, got %v", tc.input, prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePrefix(%q) unexpected error: %v", tc.input, err)
+			}
+			if prefix.String() != tc.expected {
+				t.Errorf("ParsePrefix(%q) = %v, expected %v", tc.input, prefix, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPrefixTableLookup(t *testing.T) {
+	table := newPrefixTable(0)
+	table.set(netip.MustParsePrefix("10.0.0.0/8"), Result{Country: "Wide"})
+	table.set(netip.MustParsePrefix("10.1.0.0/16"), Result{Country: "Narrow"})
+	table.set(netip.MustParsePrefix("10.1.2.3/32"), Result{Country: "Host"})
+	table.set(netip.MustParsePrefix("2001:db8::/32"), Result{Country: "V6"})
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "10.200.0.1", expected: "Wide"},
+		{ip: "10.1.200.1", expected: "Narrow"},
+		{ip: "10.1.2.3", expected: "Host"},
+		{ip: "::ffff:10.1.2.3", expected: "Host"},
+		{ip: "2001:db8::42", expected: "V6"},
+		{ip: "11.0.0.1", expected: ""},
+	}
+
+	for _, tc := range tests {
+		result, found := table.lookup(netip.MustParseAddr(tc.ip))
+		if found != (tc.expected != "") || result.Country != tc.expected {
+			t.Errorf("lookup(%s) = %q, %v, expected %q", tc.ip, result.Country, found, tc.expected)
+		}
+	}
+
+	// Removing the most specific prefix falls back to the next one
+	if !table.remove(netip.MustParsePrefix("10.1.2.3/32")) {
+		t.Fatal("remove() did not find existing prefix")
+	}
+	if table.remove(netip.MustParsePrefix("10.1.2.3/32")) {
+		t.Error("remove() reported a missing prefix as removed")
+	}
+	if result, _ := table.lookup(netip.MustParseAddr("10.1.2.3")); result.Country != "Narrow" {
+		t.Errorf("lookup after remove = %q, expected Narrow", result.Country)
+	}
+}
+
+func TestPrefixTableDescribe(t *testing.T) {
+	table := newPrefixTable(0)
+	for _, prefix := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3/32", "128.0.0.0/1", "2001:db8::/32"} {
+		table.set(netip.MustParsePrefix(prefix), Result{Country: "Test"})
+	}
+
+	// Nested prefixes are counted as records but not covered twice
+	var info DatasetInfo
+	table.describe(&info)
+	if info.IPv4Records != 4 || info.IPv6Records != 1 {
+		t.Errorf("describe() = %d IPv4 and %d IPv6 records, want 4 and 1", info.IPv4Records, info.IPv6Records)
+	}
+	if info.IPv4Coverage != 50.390625 {
+		t.Errorf("IPv4Coverage = %v, want 50.390625 for a /1 and a /8", info.IPv4Coverage)
+	}
+	if expected := 100 / math.Ldexp(1, 32); info.IPv6Coverage != expected {
+		t.Errorf("IPv6Coverage = %v, want %v for a /32", info.IPv6Coverage, expected)
+	}
+}
@@ -1,15 +1,73 @@
 package ip2country
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // Result represents the result of an IP lookup
 type Result struct {
 	Country string `json:"country"`
 	City    string `json:"city"`
+
+	// Attributes holds the extra dataset columns selected for exposure
+	Attributes Attributes `json:"attributes,omitzero"`
+
+	// DatasetVersion identifies the dataset that answered the lookup.
+	// It is reported through a response header, not the JSON body.
+	DatasetVersion string `json:"-"`
+}
+
+// DatasetInfo describes the provenance of a loaded dataset
+type DatasetInfo struct {
+	Type        string `json:"type"`
+	Role        string `json:"role,omitempty"`
+	Source      string `json:"source"`
+	Records     int    `json:"records"`
+	IPv4Records int    `json:"ipv4_records"`
+	IPv6Records int    `json:"ipv6_records"`
+	// IPv4Coverage and IPv6Coverage are the percentages of each address
+	// space covered by at least one record, whatever the number of records
+	IPv4Coverage float64       `json:"ipv4_coverage"`
+	IPv6Coverage float64       `json:"ipv6_coverage"`
+	SkippedRows  int           `json:"skipped_rows,omitempty"`
+	LoadedAt     time.Time     `json:"loaded_at,omitzero"`
+	LoadDuration time.Duration `json:"load_duration_ns,omitempty"`
+	Checksum     string        `json:"checksum,omitempty"`
+	Version      string        `json:"version,omitempty"`
+	Signer       string        `json:"signer,omitempty"`
+	Compression  string        `json:"compression,omitempty"`
+}
+
+// Snapshot describes a dataset version kept in memory for rollback
+type Snapshot struct {
+	DatasetInfo
+	Active bool `json:"active"`
+}
+
+// NotFoundError reports that the dataset of DatasetVersion has no record for
+// a looked up address. It matches ErrIPNotFound.
+type NotFoundError struct {
+	DatasetVersion string
+}
+
+func (e *NotFoundError) Error() string {
+	return ErrIPNotFound.Error()
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrIPNotFound
 }
 
 // Custom errors
 var (
 	ErrInvalidIP  = errors.New("invalid IP address")
 	ErrIPNotFound = errors.New("IP address not found")
+
+	ErrRecordNotFound = errors.New("record not found")
+	ErrReadOnly       = errors.New("backend does not support record updates")
+
+	ErrVersionNotFound = errors.New("dataset version not found")
+
+	ErrOverloaded = errors.New("too many lookups in flight")
 )
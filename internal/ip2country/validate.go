@@ -0,0 +1,232 @@
+package ip2country
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Issue severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Block sizes above which a single range is reported as suspicious:
+// more addresses than an IPv4 /8 or an IPv6 /16
+var (
+	hugeIPv4Block = new(big.Int).Lsh(big.NewInt(1), 32-8)
+	hugeIPv6Block = new(big.Int).Lsh(big.NewInt(1), 128-16)
+)
+
+// Issue is a problem found in a dataset
+type Issue struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// ValidationReport lists the problems found in a dataset
+type ValidationReport struct {
+	Source   string  `json:"source"`
+	Records  int     `json:"records"`
+	Errors   int     `json:"errors"`
+	Warnings int     `json:"warnings"`
+	Issues   []Issue `json:"issues"`
+}
+
+// validatedRange is a parsed dataset row kept for the overlap checks
+type validatedRange struct {
+	line    int
+	network Range
+	result  Result
+}
+
+// add records an issue and updates the counters
+func (r *ValidationReport) add(line int, severity, code, format string, args ...any) {
+	r.addAt(line, 0, severity, code, format, args...)
+}
+
+// addAt records an issue at a known column and updates the counters
+func (r *ValidationReport) addAt(line, column int, severity, code, format string, args ...any) {
+	r.Issues = append(r.Issues, Issue{Line: line, Column: column, Severity: severity, Code: code, Message: fmt.Sprintf(format, args...)})
+	if severity == SeverityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// ValidateCSV reads a CSV dataset, which may be compressed, with the same
+// parser as CSVService and reports
+// every problem it finds instead of stopping at the first one. It only returns
+// an error when the file cannot be read at all.
+func ValidateCSV(filePath string, format CSVFormat) (*ValidationReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening CSV file: %v", err)
+	}
+	defer file.Close()
+
+	reader, _, err := decompress(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	report := &ValidationReport{Source: filePath, Issues: []Issue{}}
+	var ranges []validatedRange
+
+	err = readCSVRows(reader, format, func(row csvRow, err error) error {
+		if err == nil {
+			report.Records++
+			var network Range
+			var result Result
+			network, result, err = parseCSVRecord(row)
+			if err == nil {
+				validateRecord(report, row.line, network, result)
+				ranges = append(ranges, validatedRange{line: row.line, network: network, result: result})
+				return nil
+			}
+		}
+
+		var rowErr *rangeError
+		if errors.As(err, &rowErr) {
+			// A row with too few columns was still read as a record
+			if rowErr.Code == "column_count" {
+				report.Records++
+			}
+			report.addAt(row.line, rowErr.Column, SeverityError, rowErr.Code, "%s", rowErr.Message)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	validateOverlaps(report, ranges)
+
+	slices.SortStableFunc(report.Issues, func(a, b Issue) int {
+		return a.Line - b.Line
+	})
+	return report, nil
+}
+
+// ValidateDataset validates a dataset file in any of the InputFormats. An empty
+// format is guessed from the file extension. CSV files are checked row by row
+// with ValidateCSV. Other formats are read with ReadDatasetFile, which stops at
+// the first unparsable entry and keeps one result per range, so their issues
+// give the record number in address order, and the message names the range.
+func ValidateDataset(filePath, format string, csvFormat CSVFormat) (*ValidationReport, error) {
+	if format == "" {
+		format = DatasetFormat(filePath)
+	}
+	if format == "csv" {
+		return ValidateCSV(filePath, csvFormat)
+	}
+
+	records, err := ReadDatasetFile(filePath, format, csvFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ValidationReport{Source: filePath, Records: len(records), Issues: []Issue{}}
+	ranges := make([]validatedRange, len(records))
+	for i, record := range records {
+		network := prefixRange(record.Prefix)
+		validateRecord(report, i+1, network, record.Result)
+		ranges[i] = validatedRange{line: i + 1, network: network, result: record.Result}
+	}
+	validateOverlaps(report, ranges)
+
+	for i, issue := range report.Issues {
+		if !strings.HasPrefix(issue.Message, "range ") {
+			report.Issues[i].Message = fmt.Sprintf("%s: %s", records[issue.Line-1].Prefix, issue.Message)
+		}
+	}
+	slices.SortStableFunc(report.Issues, func(a, b Issue) int {
+		return a.Line - b.Line
+	})
+	return report, nil
+}
+
+// validateRecord checks the fields of a single parsed row
+func validateRecord(report *ValidationReport, line int, network Range, result Result) {
+	if strings.TrimSpace(result.Country) == "" {
+		report.add(line, SeverityError, "empty_field", "empty country")
+	} else if !isKnownCountry(result.Country) {
+		report.add(line, SeverityWarning, "unknown_country", "unknown country %q", result.Country)
+	}
+	if strings.TrimSpace(result.City) == "" {
+		report.add(line, SeverityWarning, "empty_field", "empty city")
+	}
+
+	limit := hugeIPv6Block
+	if network.Start.Is4() {
+		limit = hugeIPv4Block
+	}
+	if size := network.Size(); size.Cmp(limit) > 0 {
+		report.add(line, SeverityWarning, "huge_block", "range %s covers %s addresses", network, size)
+	}
+}
+
+// validateOverlaps reports duplicate, nested and partially overlapping ranges.
+// Ranges are sorted by start address (widest first) and swept with a stack of
+// the ranges that enclose the current position.
+func validateOverlaps(report *ValidationReport, ranges []validatedRange) {
+	slices.SortStableFunc(ranges, func(a, b validatedRange) int {
+		if c := a.network.Start.Compare(b.network.Start); c != 0 {
+			return c
+		}
+		return b.network.End.Compare(a.network.End)
+	})
+
+	var open []validatedRange
+	for _, current := range ranges {
+		for len(open) > 0 {
+			top := open[len(open)-1]
+			if top.network.Start.Is4() == current.network.Start.Is4() && !top.network.End.Less(current.network.Start) {
+				break
+			}
+			open = open[:len(open)-1]
+		}
+
+		if len(open) > 0 {
+			enclosing := open[len(open)-1]
+			switch {
+			case enclosing.network == current.network && enclosing.result == current.result:
+				report.add(current.line, SeverityWarning, "duplicate", "duplicate of line %d", enclosing.line)
+			case enclosing.network == current.network:
+				report.add(current.line, SeverityError, "conflicting_duplicate",
+					"range %s is also defined on line %d with a different result", current.network, enclosing.line)
+			case current.network.End.Less(enclosing.network.End) || current.network.End == enclosing.network.End:
+				report.add(current.line, SeverityWarning, "nested_range",
+					"range %s is inside range %s from line %d, the more specific one wins", current.network, enclosing.network, enclosing.line)
+			default:
+				report.add(current.line, SeverityError, "overlap",
+					"range %s partially overlaps range %s from line %d", current.network, enclosing.network, enclosing.line)
+			}
+		}
+
+		open = append(open, current)
+	}
+}
+
+// String formats the report for humans, one line per issue followed by a summary
+func (r *ValidationReport) String() string {
+	var b strings.Builder
+	for _, issue := range r.Issues {
+		position := fmt.Sprintf("%s:%d", r.Source, issue.Line)
+		if issue.Column > 0 {
+			position += fmt.Sprintf(":%d", issue.Column)
+		}
+		fmt.Fprintf(&b, "%s: %s: %s [%s]\n", position, issue.Severity, issue.Message, issue.Code)
+	}
+	fmt.Fprintf(&b, "%s: %d records, %d errors, %d warnings\n", r.Source, r.Records, r.Errors, r.Warnings)
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package ip2country
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateCSV(t *testing.T) {
+	testFile := "test_validate_data.csv"
+	data := strings.Join([]string{
+		"10.0.0.0/8,Private,Private",         // 1: nested ranges below sit inside this block
+		"10.0.0.1,London,United Kingdom",     // 2: nested_range
+		"10.0.0.1,London,United Kingdom",     // 3: duplicate
+		"10.0.0.1,Paris,France",              // 4: conflicting_duplicate
+		"not-an-ip,Sydney,Australia",         // 5: invalid_ip
+		"1.1.1.1,Sydney",                     // 6: column_count
+		"2.2.2.2,Springfield,Freedonia",      // 7: unknown_country
+		"3.3.3.3,,Australia",                 // 8: empty_field warning
+		"4.4.4.4,Sydney,",                    // 9: empty_field error
+		"11.0.0.0-13.0.0.0,Somewhere,Canada", // 10: huge_block
+		"12.5.0.0-14.0.0.0,Elsewhere,Canada", // 11: overlap
+		"20.0.0.9-20.0.0.5,Nowhere,Canada",   // 12: inverted_range
+	}, "\n") + "\n"
+	if err := os.WriteFile(testFile, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFile)
+
+	report, err := ValidateCSV(testFile, CSVFormat{})
+	if err != nil {
+		t.Fatalf("ValidateCSV failed: %v", err)
+	}
+
+	expected := []struct {
+		line     int
+		severity string
+		code     string
+	}{
+		{2, SeverityWarning, "nested_range"},
+		{3, SeverityWarning, "duplicate"},
+		{4, SeverityError, "conflicting_duplicate"},
+		{5, SeverityError, "invalid_ip"},
+		{6, SeverityError, "column_count"},
+		{7, SeverityWarning, "unknown_country"},
+		{8, SeverityWarning, "empty_field"},
+		{9, SeverityError, "empty_field"},
+		{10, SeverityWarning, "huge_block"},
+		{11, SeverityWarning, "huge_block"},
+		{11, SeverityError, "overlap"},
+		{12, SeverityError, "inverted_range"},
+	}
+	if len(report.Issues) != len(expected) {
+		t.Fatalf("Expected %d issues, got %d:\n%s", len(expected), len(report.Issues), report)
+	}
+	for i, want := range expected {
+		got := report.Issues[i]
+		if got.Line != want.line || got.Severity != want.severity || got.Code != want.code {
+			t.Errorf("Issue %d = %+v, expected line %d %s %s", i, got, want.line, want.severity, want.code)
+		}
+	}
+
+	if report.Records != 12 || report.Errors != 6 || report.Warnings != 6 {
+		t.Errorf("Unexpected counters: %d records, %d errors, %d warnings", report.Records, report.Errors, report.Warnings)
+	}
+	if !strings.Contains(report.String(), testFile+":4: error:") {
+		t.Errorf("String() missing file:line prefix:\n%s", report)
+	}
+}
+
+func TestValidateCSVMissingFile(t *testing.T) {
+	if _, err := ValidateCSV("does_not_exist.csv", CSVFormat{}); err == nil {
+		t.Fatal("Expected error for missing file, got nil")
+	}
+}
+
+func TestValidateDatasetJSONLines(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "data.jsonl")
+	data := strings.Join([]string{
+		`{"cidr":"10.0.0.0/8","city":"Private","country":"Private"}`, // record 2
+		`{"cidr":"10.0.0.1/32","city":"Paris","country":"France"}`,   // record 3: nested_range
+		`{"cidr":"2.2.2.2/32","city":"","country":"Freedonia"}`,      // record 1: unknown_country, empty_field
+	}, "\n") + "\n"
+	if err := os.WriteFile(testFile, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	report, err := ValidateDataset(testFile, "", CSVFormat{})
+	if err != nil {
+		t.Fatalf("ValidateDataset failed: %v", err)
+	}
+
+	codes := []string{}
+	for _, issue := range report.Issues {
+		codes = append(codes, fmt.Sprintf("%d:%s", issue.Line, issue.Code))
+	}
+	// Records are numbered in address order
+	expected := []string{"1:unknown_country", "1:empty_field", "3:nested_range"}
+	if !slices.Equal(codes, expected) {
+		t.Errorf("Issues = %v, want %v", codes, expected)
+	}
+	if !strings.Contains(report.String(), testFile+":1: warning: 2.2.2.2/32: empty city") {
+		t.Errorf("String() does not name the range of the record:\n%s", report)
+	}
+	if report.Records != 3 || report.Errors != 0 || report.Warnings != 3 {
+		t.Errorf("Unexpected counters: %d records, %d errors, %d warnings", report.Records, report.Errors, report.Warnings)
+	}
+
+	if _, err := ValidateDataset(testFile, "xml", CSVFormat{}); err == nil || !strings.Contains(err.Error(), "unsupported input format") {
+		t.Errorf("Expected an unsupported format error, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "valid token", token: "secret", authorization: "Bearer secret", expectedStatus: http.StatusOK},
+		{name: "wrong token", token: "secret", authorization: "Bearer nope", expectedStatus: http.StatusUnauthorized},
+		{name: "missing header", token: "secret", authorization: "", expectedStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", token: "secret", authorization: "Basic secret", expectedStatus: http.StatusUnauthorized},
+		{name: "admin disabled", token: "", authorization: "Bearer ", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := AdminAuth(tt.token)(nextHandler)
+
+			req, err := http.NewRequest("PUT", "/v1/admin/records/10.0.0.0/8", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedStatus {
+				t.Errorf("middleware returned wrong status code: got %v want %v", status, tt.expectedStatus)
+			}
+		})
+	}
+}
@@ -11,9 +11,11 @@ func CORS(origins []string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		// Create a CORS handler with our settings
 		corsMiddleware := cors.New(cors.Options{
-			AllowedOrigins:   origins,
-			AllowedMethods:   []string{"GET", "OPTIONS"}, // Only GET and OPTIONS (required for preflight) since the service only handles GET requests
-			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowedOrigins: origins,
+			AllowedMethods: []string{"GET", "OPTIONS"}, // Only GET and OPTIONS (required for preflight) since the service only handles GET requests
+			AllowedHeaders: []string{"Content-Type", "Authorization"},
+			// Let browser clients read the rate limit headers to pace themselves
+			ExposedHeaders:   []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 			AllowCredentials: true,
 			MaxAge:           43200, // 12 hours in seconds
 			Debug:            false,
@@ -3,6 +3,7 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -42,6 +43,11 @@ func TestCORS(t *testing.T) {
 		if resp.Header.Get("Access-Control-Allow-Origin") != "http://example.com" {
 			t.Errorf("Expected Access-Control-Allow-Origin header to be http://example.com")
 		}
+
+		// Check that browser clients can read the rate limit headers
+		if exposed := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Ratelimit-Remaining") {
+			t.Errorf("Expected Access-Control-Expose-Headers to include RateLimit-Remaining, got %q", exposed)
+		}
 	})
 
 	// Test 2: Request from disallowed origin
@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"ip2country-api/internal/utils"
+)
+
+// CostFunc returns the number of requests a request counts as against rate
+// limits, such as the number of addresses in a batch lookup
+type CostFunc func(r *http.Request) int
+
+// FixedCost charges every request n requests
+func FixedCost(n int) CostFunc {
+	return func(r *http.Request) int { return n }
+}
+
+// ParamCost charges a request one request per value of the query parameter
+// name, whether the values are repeated or comma separated, and at least one
+func ParamCost(name string) CostFunc {
+	return func(r *http.Request) int {
+		return max(len(utils.QueryList(r, name)), 1)
+	}
+}
+
+// costKey is the context key of the cost of a request
+type costKey struct{}
+
+// RouteCosts creates a middleware charging the requests matching a pattern of
+// costs, in http.ServeMux syntax, what its CostFunc returns in every rate
+// limit they go through. It must wrap the limits, and a route policy with a
+// cost of its own overrides it.
+func RouteCosts(costs map[string]CostFunc) func(http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	for pattern := range costs {
+		mux.Handle(pattern, http.NotFoundHandler())
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, pattern := mux.Handler(r); costs[pattern] != nil {
+				r = r.WithContext(context.WithValue(r.Context(), costKey{}, costs[pattern](r)))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestCost returns the cost set by the route policy of r, one by default
+func requestCost(r *http.Request) int {
+	if cost, ok := r.Context().Value(costKey{}).(int); ok {
+		return cost
+	}
+	return 1
+}
+
+// RoutePolicy is the rate limit of the requests matching a route
+type RoutePolicy struct {
+	// Pattern selects the requests of the policy, in the syntax of
+	// http.ServeMux patterns such as "GET /v1/find-country" or "/v1/admin/".
+	// When several policies match a request, the most specific one applies.
+	Pattern string
+
+	// Exempt requests skip rate limiting entirely
+	Exempt bool
+
+	// Rate is the number of requests allowed per second on average, and
+	// Burst the number allowed at once, in a limit of the route's own
+	Rate  int
+	Burst int
+
+	// Cost weighs each request, one request when nil
+	Cost CostFunc
+}
+
+// LoadPolicyFile reads route policies from a policy file.
+//
+// The policy file is a CSV file with one policy per line:
+//
+//	route,<pattern>,<rate>,<burst>[,<cost>]
+//	exempt,<pattern>
+//
+// where the cost is a number of requests or param:<name> to charge one
+// request per value of a query parameter. Lines starting with '#' are
+// ignored.
+func LoadPolicyFile(path string) ([]RoutePolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening policy file: %v", err)
+	}
+	defer file.Close()
+	return ParsePolicies(file, path)
+}
+
+// ParsePolicies reads route policies in the policy file format from r. Name
+// identifies r in error messages.
+func ParsePolicies(r io.Reader, name string) ([]RoutePolicy, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var policies []RoutePolicy
+	// Patterns are checked by registering them like the policies will be
+	mux := http.NewServeMux()
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy file: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		var policy RoutePolicy
+		switch record[0] {
+		case "route":
+			policy, err = parseRoutePolicy(record)
+		case "exempt":
+			if len(record) != 2 || record[1] == "" {
+				err = fmt.Errorf("expected exempt,<pattern>")
+			}
+			policy = RoutePolicy{Pattern: record[len(record)-1], Exempt: true}
+		default:
+			err = fmt.Errorf("unknown line type %q, expected route or exempt", record[0])
+		}
+		if err == nil {
+			err = registerPattern(mux, policy.Pattern)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// parseRoutePolicy parses a route line
+func parseRoutePolicy(record []string) (RoutePolicy, error) {
+	if len(record) < 4 || len(record) > 5 || record[1] == "" {
+		return RoutePolicy{}, fmt.Errorf("expected route,<pattern>,<rate>,<burst>[,<cost>]")
+	}
+	policy := RoutePolicy{Pattern: record[1]}
+	var err error
+	if policy.Rate, err = strconv.Atoi(record[2]); err != nil || policy.Rate < 0 {
+		return RoutePolicy{}, fmt.Errorf("invalid rate %q", record[2])
+	}
+	if policy.Burst, err = strconv.Atoi(record[3]); err != nil || policy.Burst < 1 {
+		return RoutePolicy{}, fmt.Errorf("invalid burst %q", record[3])
+	}
+	if len(record) == 5 {
+		if policy.Cost, err = parseCost(record[4]); err != nil {
+			return RoutePolicy{}, err
+		}
+	}
+	return policy, nil
+}
+
+// parseCost parses the cost of a route line
+func parseCost(s string) (CostFunc, error) {
+	if param, ok := strings.CutPrefix(s, "param:"); ok && param != "" {
+		return ParamCost(param), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid cost %q, expected a number or param:<name>", s)
+	}
+	return FixedCost(n), nil
+}
+
+// registerPattern adds pattern to mux, returning the error ServeMux panics
+// with for invalid or conflicting patterns
+func registerPattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid pattern %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// RoutePolicies creates a middleware applying the policy of the route each
+// request matches. Limit creates the middleware enforcing the limit of a
+// policy that is not exempt, and requests matching no policy go through
+// defaultLimit. The cost of a policy applies to every limit its requests go
+// through.
+func RoutePolicies(policies []RoutePolicy, limit func(RoutePolicy) func(http.Handler) http.Handler, defaultLimit func(http.Handler) http.Handler) (func(http.Handler) http.Handler, error) {
+	mux := http.NewServeMux()
+	limits := make(map[string]func(http.Handler) http.Handler, len(policies))
+	for _, policy := range policies {
+		if err := registerPattern(mux, policy.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, policy := range policies {
+		if !policy.Exempt {
+			limits[policy.Pattern] = limit(policy)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		handlers := make(map[string]http.Handler, len(policies))
+		costs := make(map[string]CostFunc, len(policies))
+		for _, policy := range policies {
+			handlers[policy.Pattern] = next
+			if limit, ok := limits[policy.Pattern]; ok {
+				handlers[policy.Pattern] = limit(next)
+			}
+			costs[policy.Pattern] = policy.Cost
+		}
+		unmatched := defaultLimit(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := mux.Handler(r)
+			handler, ok := handlers[pattern]
+			if !ok {
+				unmatched.ServeHTTP(w, r)
+				return
+			}
+			if cost := costs[pattern]; cost != nil {
+				r = r.WithContext(context.WithValue(r.Context(), costKey{}, cost(r)))
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ip2country-api/pkg/ratelimit"
+)
+
+const testPolicyFile = `# Batch lookups are charged per address
+route,POST /v1/batch,10,100,param:ip
+route,/v1/admin/,1,5,2
+exempt,GET /healthz
+`
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies(strings.NewReader(testPolicyFile), "policies.csv")
+	if err != nil {
+		t.Fatalf("ParsePolicies() failed: %v", err)
+	}
+	if len(policies) != 3 {
+		t.Fatalf("ParsePolicies() = %d policies, want 3", len(policies))
+	}
+	batch := policies[0]
+	if batch.Pattern != "POST /v1/batch" || batch.Rate != 10 || batch.Burst != 100 || batch.Exempt {
+		t.Errorf("batch policy = %+v", batch)
+	}
+	req := httptest.NewRequest("POST", "/v1/batch?ip=1.1.1.1,2.2.2.2&ip=3.3.3.3", nil)
+	if cost := batch.Cost(req); cost != 3 {
+		t.Errorf("batch cost = %d, want 3", cost)
+	}
+	if cost := policies[1].Cost(req); cost != 2 {
+		t.Errorf("admin cost = %d, want 2", cost)
+	}
+	if !policies[2].Exempt || policies[2].Pattern != "GET /healthz" {
+		t.Errorf("health policy = %+v, want GET /healthz exempt", policies[2])
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{name: "Unknown line type", content: "limit,/v1/,1,1\n", message: `policies.csv:1: unknown line type "limit"`},
+		{name: "Missing route columns", content: "route,/v1/,1\n", message: "policies.csv:1: expected route"},
+		{name: "Invalid rate", content: "route,/v1/,fast,1\n", message: `invalid rate "fast"`},
+		{name: "Zero burst", content: "route,/v1/,1,0\n", message: `invalid burst "0"`},
+		{name: "Invalid cost", content: "route,/v1/,1,1,0\n", message: `invalid cost "0"`},
+		{name: "Empty cost param", content: "route,/v1/,1,1,param:\n", message: `invalid cost "param:"`},
+		{name: "Extra exempt column", content: "exempt,/healthz,1\n", message: "policies.csv:1: expected exempt"},
+		{name: "Invalid pattern", content: "exempt,healthz\n", message: `policies.csv:1: invalid pattern "healthz"`},
+		{name: "Duplicate pattern", content: "exempt,/healthz\nroute,/healthz,1,1\n", message: `policies.csv:2: invalid pattern "/healthz"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePolicies(strings.NewReader(tc.content), "policies.csv")
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Errorf("ParsePolicies() error = %v, want it to contain %q", err, tc.message)
+			}
+		})
+	}
+}
+
+func TestParamCost(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected int
+	}{
+		{target: "/v1/batch", expected: 1},
+		{target: "/v1/batch?ip=", expected: 1},
+		{target: "/v1/batch?ip=1.1.1.1", expected: 1},
+		{target: "/v1/batch?ip=1.1.1.1,2.2.2.2,,", expected: 2},
+		{target: "/v1/batch?ip=1.1.1.1&ip=2.2.2.2&other=3.3.3.3", expected: 2},
+	}
+	cost := ParamCost("ip")
+	for _, tc := range tests {
+		if got := cost(httptest.NewRequest("GET", tc.target, nil)); got != tc.expected {
+			t.Errorf("ParamCost(%q) = %d, want %d", tc.target, got, tc.expected)
+		}
+	}
+}
+
+// recordingLimiter records the cost of every request checked against it
+type recordingLimiter struct {
+	costs []int
+}
+
+func (l *recordingLimiter) Allow() (ratelimit.Result, error) {
+	return l.AllowN(1)
+}
+
+func (l *recordingLimiter) AllowN(n int) (ratelimit.Result, error) {
+	l.costs = append(l.costs, n)
+	return ratelimit.Result{}, nil
+}
+
+func TestRouteCosts(t *testing.T) {
+	limiter := &recordingLimiter{}
+	handler := RouteCosts(map[string]CostFunc{"GET /v1/find-countries": ParamCost("ip")})(
+		RateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, target := range []string{"/v1/find-countries?ip=1.1.1.1,2.2.2.2&ip=3.3.3.3", "/v1/find-country?ip=1.1.1.1,2.2.2.2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	if len(limiter.costs) != 2 || limiter.costs[0] != 3 || limiter.costs[1] != 1 {
+		t.Errorf("costs = %v, want [3 1]", limiter.costs)
+	}
+}
+
+func TestRoutePolicies(t *testing.T) {
+	policies, err := ParsePolicies(strings.NewReader(testPolicyFile), "policies.csv")
+	if err != nil {
+		t.Fatalf("ParsePolicies() failed: %v", err)
+	}
+	limiters := make(map[string]*recordingLimiter)
+	global := &recordingLimiter{}
+	routePolicies, err := RoutePolicies(policies, func(policy RoutePolicy) func(http.Handler) http.Handler {
+		limiters[policy.Pattern] = &recordingLimiter{}
+		return RateLimit(limiters[policy.Pattern])
+	}, RateLimit(global))
+	if err != nil {
+		t.Fatalf("RoutePolicies() failed: %v", err)
+	}
+	if _, ok := limiters["GET /healthz"]; ok {
+		t.Error("RoutePolicies() created a limit for an exempt route")
+	}
+	handler := routePolicies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	requests := []struct {
+		method string
+		target string
+	}{
+		{method: "POST", target: "/v1/batch?ip=1.1.1.1,2.2.2.2"},
+		{method: "GET", target: "/v1/batch?ip=1.1.1.1,2.2.2.2"},
+		{method: "DELETE", target: "/v1/admin/datasets/1"},
+		{method: "GET", target: "/healthz"},
+		{method: "POST", target: "/healthz"},
+		{method: "GET", target: "/v1/find-country?ip=1.1.1.1"},
+	}
+	for _, request := range requests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(request.method, request.target, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s = %d, want %d", request.method, request.target, rr.Code, http.StatusOK)
+		}
+	}
+
+	// Only POST matches the batch route, and unmatched requests cost one
+	// request against the global limit
+	expected := map[string][]int{
+		"POST /v1/batch": {2},
+		"/v1/admin/":     {2},
+		"global":         {1, 1, 1},
+	}
+	got := map[string][]int{
+		"POST /v1/batch": limiters["POST /v1/batch"].costs,
+		"/v1/admin/":     limiters["/v1/admin/"].costs,
+		"global":         global.costs,
+	}
+	for name, costs := range expected {
+		if len(got[name]) != len(costs) {
+			t.Errorf("%s costs = %v, want %v", name, got[name], costs)
+			continue
+		}
+		for i := range costs {
+			if got[name][i] != costs[i] {
+				t.Errorf("%s costs = %v, want %v", name, got[name], costs)
+				break
+			}
+		}
+	}
+
+	if _, err := RoutePolicies([]RoutePolicy{{Pattern: "/a"}, {Pattern: "/a"}}, nil, RateLimit(global)); err == nil {
+		t.Error("Expected error for conflicting patterns, got nil")
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"ip2country-api/pkg/ratelimit"
+)
+
+// APIKeyQuota creates a middleware that charges every request to the quota of
+// the API key in the X-API-Key header, at the cost of the request when it has
+// one. Requests without a known API key are rejected.
+func APIKeyQuota(limiter KeyedRateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey := r.Header.Get(APIKeyHeader)
+			if apiKey == "" {
+				writeUnauthorized(w, "Missing API key")
+				return
+			}
+
+			result, err := ratelimit.AllowKeyN(limiter, apiKey, requestCost(r))
+			if errors.Is(err, ratelimit.ErrUnknownAPIKey) {
+				writeUnauthorized(w, "Invalid API key")
+				return
+			}
+			setRateLimitHeaders(w, result)
+			if err != nil {
+				rejectRequest(r)
+				writeRateLimited(w, result, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeUnauthorized rejects a request without valid credentials
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
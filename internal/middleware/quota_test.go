@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ip2country-api/pkg/ratelimit"
+)
+
+// mockQuotaLimiter knows one API key, which has used up its quota
+type mockQuotaLimiter struct{}
+
+func (m *mockQuotaLimiter) AllowKey(key string) (ratelimit.Result, error) {
+	switch key {
+	case "valid-key":
+		return ratelimit.Result{Limit: 1000, Remaining: 999, Reset: time.Hour}, nil
+	case "exhausted-key":
+		return ratelimit.Result{Limit: 1000, Reset: time.Hour, RetryAfter: time.Hour}, ratelimit.ErrQuotaExceeded
+	default:
+		return ratelimit.Result{}, ratelimit.ErrUnknownAPIKey
+	}
+}
+
+func TestAPIKeyQuota(t *testing.T) {
+	handler := APIKeyQuota(&mockQuotaLimiter{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name               string
+		apiKey             string
+		expectedStatus     int
+		expectedMessage    string
+		expectedRetryAfter string
+	}{
+		{name: "valid key", apiKey: "valid-key", expectedStatus: http.StatusOK},
+		{name: "missing key", apiKey: "", expectedStatus: http.StatusUnauthorized, expectedMessage: "Missing API key"},
+		{name: "unknown key", apiKey: "stolen-key", expectedStatus: http.StatusUnauthorized, expectedMessage: "Invalid API key"},
+		{name: "quota exceeded", apiKey: "exhausted-key", expectedStatus: http.StatusTooManyRequests, expectedMessage: "Quota exceeded", expectedRetryAfter: "3600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil)
+			if tt.apiKey != "" {
+				req.Header.Set(APIKeyHeader, tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.expectedStatus)
+			}
+			if retryAfter := rr.Header().Get("Retry-After"); retryAfter != tt.expectedRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", retryAfter, tt.expectedRetryAfter)
+			}
+			if tt.expectedMessage != "" {
+				var response map[string]any
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatalf("could not parse response body: %v", err)
+				}
+				if response["error"] != tt.expectedMessage {
+					t.Errorf("error = %v, want %q", response["error"], tt.expectedMessage)
+				}
+			}
+		})
+	}
+}
+
+// costQuotaLimiter records the cost it was charged
+type costQuotaLimiter struct {
+	charged int
+}
+
+func (m *costQuotaLimiter) AllowKey(key string) (ratelimit.Result, error) {
+	return m.AllowKeyN(key, 1)
+}
+
+func (m *costQuotaLimiter) AllowKeyN(key string, n int) (ratelimit.Result, error) {
+	m.charged += n
+	return ratelimit.Result{Limit: 1000, Remaining: 1000 - m.charged}, nil
+}
+
+func TestAPIKeyQuotaChargesCost(t *testing.T) {
+	limiter := &costQuotaLimiter{}
+	handler := APIKeyQuota(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil)
+	req.Header.Set(APIKeyHeader, "valid-key")
+	req = req.WithContext(context.WithValue(req.Context(), costKey{}, 3))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if limiter.charged != 3 {
+		t.Errorf("quota charged %d requests, want the cost of 3", limiter.charged)
+	}
+}
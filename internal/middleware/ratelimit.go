@@ -1,29 +1,331 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"ip2country-api/pkg/ratelimit"
 )
 
-// RateLimiter defines the interface for rate limiting
+// RateLimiter defines the interface for rate limiting. The result describes
+// the state of the limit for the rate limit headers.
 type RateLimiter interface {
-	Allow() error
+	Allow() (ratelimit.Result, error)
+}
+
+// KeyedRateLimiter defines the interface for rate limiting each client separately
+type KeyedRateLimiter interface {
+	AllowKey(key string) (ratelimit.Result, error)
+}
+
+// KeyFunc identifies the client of a request for keyed rate limiting
+type KeyFunc func(r *http.Request) string
+
+// admission follows a request through the rate limits it passes: the
+// deadline shared by every queue it waits in, so that it never waits longer
+// than the max wait in total, and how to give back what the limits it passed
+// charged when a later one rejects it
+type admission struct {
+	deadline time.Time // zero until the request first waits
+	refunds  []func()
+}
+
+type admissionKey struct{}
+
+// admit returns the admission of r, attaching a new one to the request when
+// it is the first limit the request goes through
+func admit(r *http.Request) (*http.Request, *admission) {
+	if a, ok := r.Context().Value(admissionKey{}).(*admission); ok {
+		return r, a
+	}
+	a := &admission{}
+	return r.WithContext(context.WithValue(r.Context(), admissionKey{}, a)), a
+}
+
+// charged records how to give back what a limit charged the request
+func (a *admission) charged(refund func()) {
+	a.refunds = append(a.refunds, refund)
+}
+
+// reject gives back what the limits the request already passed charged it
+func (a *admission) reject() {
+	for _, refund := range a.refunds {
+		refund()
+	}
+	a.refunds = nil
+}
+
+// rejectRequest gives back what the limits r passed charged it, when it went
+// through any
+func rejectRequest(r *http.Request) {
+	if a, ok := r.Context().Value(admissionKey{}).(*admission); ok {
+		a.reject()
+	}
 }
 
 // RateLimit creates a middleware that applies rate limiting to all requests
 func RateLimit(limiter RateLimiter) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, a := admit(r)
+			cost := requestCost(r)
+
 			// Apply rate limiting
-			if err := limiter.Allow(); err != nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				json.NewEncoder(w).Encode(map[string]string{"error": "Too many requests"})
+			result, err := ratelimit.AllowN(limiter, cost)
+			setRateLimitHeaders(w, result)
+			if err != nil {
+				a.reject()
+				writeRateLimited(w, result, err)
 				return
 			}
+			a.charged(func() { ratelimit.RefundN(limiter, cost) })
 
 			// Pass to the next handler if rate limit not exceeded
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// KeyedRateLimit creates a middleware that applies a separate limit to each
+// client, as identified by key
+func KeyedRateLimit(limiter KeyedRateLimiter, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, a := admit(r)
+			clientKey, cost := key(r), requestCost(r)
+			result, err := ratelimit.AllowKeyN(limiter, clientKey, cost)
+			setRateLimitHeaders(w, result)
+			if err != nil {
+				a.reject()
+				writeRateLimited(w, result, err)
+				return
+			}
+			a.charged(func() { ratelimit.RefundKeyN(limiter, clientKey, cost) })
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Queue holds requests over a rate limit until they are allowed instead of
+// rejecting them at once. A request is held for at most the max wait of the
+// queue, and only while fewer than its size are already waiting.
+type Queue struct {
+	maxWait time.Duration
+	slots   chan struct{}
+}
+
+// errQueueFull rejects a request arriving while the queue is full
+var errQueueFull = errors.New("rate limit queue full")
+
+// NewQueue creates a queue holding up to size requests for at most maxWait
+// each
+func NewQueue(maxWait time.Duration, size int) *Queue {
+	return &Queue{maxWait: maxWait, slots: make(chan struct{}, size)}
+}
+
+// wait takes a place in the queue and calls wait with a context ending when
+// the client goes away, or once the request waited for the max wait in all
+// the queued limits it went through
+func (q *Queue) wait(r *http.Request, a *admission, wait func(ctx context.Context) (ratelimit.Result, error)) (ratelimit.Result, error) {
+	select {
+	case q.slots <- struct{}{}:
+		defer func() { <-q.slots }()
+	default:
+		return ratelimit.Result{}, errQueueFull
+	}
+	if a.deadline.IsZero() {
+		a.deadline = time.Now().Add(q.maxWait)
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), a.deadline)
+	defer cancel()
+	return wait(ctx)
+}
+
+// QueuedRateLimit creates a middleware that applies rate limiting to all
+// requests like RateLimit, but holds requests over the limit in queue until
+// they are allowed. Requests are rejected when they would wait longer than
+// the max wait of the queue or the queue is full.
+func QueuedRateLimit(limiter RateLimiter, queue *Queue) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, a := admit(r)
+			cost := requestCost(r)
+			result, err := queue.wait(r, a, func(ctx context.Context) (ratelimit.Result, error) {
+				return ratelimit.WaitN(ctx, limiter, cost)
+			})
+			if err == nil {
+				a.charged(func() { ratelimit.RefundN(limiter, cost) })
+			}
+			serveLimited(w, r, a, next, result, err)
+		})
+	}
+}
+
+// QueuedKeyedRateLimit creates a middleware that applies a separate limit to
+// each client like KeyedRateLimit, but holds requests over the limit in queue
+// until they are allowed
+func QueuedKeyedRateLimit(limiter KeyedRateLimiter, key KeyFunc, queue *Queue) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, a := admit(r)
+			clientKey, cost := key(r), requestCost(r)
+			result, err := queue.wait(r, a, func(ctx context.Context) (ratelimit.Result, error) {
+				return ratelimit.WaitKeyN(ctx, limiter, clientKey, cost)
+			})
+			if err == nil {
+				a.charged(func() { ratelimit.RefundKeyN(limiter, clientKey, cost) })
+			}
+			serveLimited(w, r, a, next, result, err)
+		})
+	}
+}
+
+// serveLimited passes a request that waited for its rate limit to next, or
+// rejects it. Nothing is written for a client that went away while waiting.
+func serveLimited(w http.ResponseWriter, r *http.Request, a *admission, next http.Handler, result ratelimit.Result, err error) {
+	if r.Context().Err() != nil {
+		a.reject()
+		return
+	}
+	setRateLimitHeaders(w, result)
+	if err != nil {
+		a.reject()
+		writeRateLimited(w, result, err)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// setRateLimitHeaders describes the limit in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the IETF draft, with the
+// reset in seconds. When a request passes several limits the one with the
+// fewest requests remaining is reported. Nothing is set when the state of the
+// limit is unknown.
+func setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	if result.Limit <= 0 {
+		return
+	}
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err == nil && remaining <= result.Remaining {
+		return
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(max(result.Remaining, 0)))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// ceilSeconds rounds a delay up to whole seconds, so a client waiting that
+// long is never early
+func ceilSeconds(d time.Duration) int {
+	return int((max(d, 0) + time.Second - 1) / time.Second)
+}
+
+// writeRateLimited rejects a request that exceeded its rate limit or quota,
+// telling the client how long to wait in the Retry-After header and the
+// response, or that could not be checked because a limiter that fails closed
+// is unavailable. A request costing more than a limit allows at once is
+// rejected with 413 and no Retry-After, as retrying never helps.
+func writeRateLimited(w http.ResponseWriter, result ratelimit.Result, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, ratelimit.ErrLimiterUnavailable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Rate limiter unavailable"})
+		return
+	}
+	var costErr *ratelimit.CostError
+	if errors.As(err, &costErr) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": fmt.Sprintf("Request costs %d requests, more than the limit of %d allows at once", costErr.Cost, costErr.Limit),
+			"cost":  costErr.Cost,
+			"limit": costErr.Limit,
+		})
+		return
+	}
+	// Clients retrying at once are what made them hit the limit, so always
+	// ask them to wait at least a second
+	retryAfter := max(ceilSeconds(result.RetryAfter), 1)
+	message := "Too many requests"
+	if errors.Is(err, ratelimit.ErrQuotaExceeded) {
+		message = "Quota exceeded"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]any{"error": message, "retry_after": retryAfter})
+}
+
+// ClientIPKey keys requests by the address of the client connection. IPv6
+// clients are grouped per /64, the smallest block usually assigned to a
+// single subscriber, so rotating addresses within it does not escape the
+// limit.
+func ClientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "ip:" + host
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return "ip:" + prefix.String()
+	}
+	return "ip:" + addr.String()
+}
+
+// HeaderKey keys requests by the value of a request header, falling back to
+// the client address when it is missing so anonymous clients are still
+// limited separately
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return "header:" + value
+		}
+		return ClientIPKey(r)
+	}
+}
+
+// APIKeyHeader is the request header carrying a client's API key
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyKey keys requests by the API key header when known reports the key
+// as issued, and by the client address otherwise, so clients cannot get a
+// fresh limit by sending made up keys
+func APIKeyKey(known func(apiKey string) bool) KeyFunc {
+	return func(r *http.Request) string {
+		if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" && known(apiKey) {
+			return "api_key:" + apiKey
+		}
+		return ClientIPKey(r)
+	}
+}
+
+// ParseRateLimitKey returns the KeyFunc named by s: "ip" for the client
+// address, "api_key" for the API keys known reports as issued, or
+// "header:<name>" for any other request header. known may be nil when no API
+// keys are issued, which rules out "api_key".
+func ParseRateLimitKey(s string, known func(apiKey string) bool) (KeyFunc, error) {
+	switch {
+	case s == "ip":
+		return ClientIPKey, nil
+	case s == "api_key":
+		if known == nil {
+			return nil, errors.New("rate limit key api_key requires a quota file listing the API keys")
+		}
+		return APIKeyKey(known), nil
+	case strings.HasPrefix(s, "header:") && strings.TrimPrefix(s, "header:") != "":
+		return HeaderKey(strings.TrimPrefix(s, "header:")), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q, expected ip, api_key or header:<name>", s)
+	}
+}
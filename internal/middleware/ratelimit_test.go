@@ -1,20 +1,25 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"ip2country-api/pkg/ratelimit"
 )
 
 // MockRateLimiter implements the RateLimiter interface for testing
 type MockRateLimiter struct {
 	AllowFunc func() error
+	Result    ratelimit.Result
 }
 
-func (m *MockRateLimiter) Allow() error {
-	return m.AllowFunc()
+func (m *MockRateLimiter) Allow() (ratelimit.Result, error) {
+	return m.Result, m.AllowFunc()
 }
 
 func TestRateLimit(t *testing.T) {
@@ -35,6 +40,12 @@ func TestRateLimit(t *testing.T) {
 			expectedStatus:  http.StatusTooManyRequests,
 			expectedMessage: "Too many requests",
 		},
+		{
+			name:            "limiter unavailable",
+			allowResult:     ratelimit.ErrLimiterUnavailable,
+			expectedStatus:  http.StatusServiceUnavailable,
+			expectedMessage: "Rate limiter unavailable",
+		},
 	}
 
 	for _, tt := range tests {
@@ -73,7 +84,7 @@ func TestRateLimit(t *testing.T) {
 
 			// Check response message if rate limited
 			if tt.allowResult != nil {
-				var response map[string]string
+				var response map[string]any
 				err := json.Unmarshal(rr.Body.Bytes(), &response)
 				if err != nil {
 					t.Errorf("could not parse response body: %v", err)
@@ -85,3 +96,399 @@ func TestRateLimit(t *testing.T) {
 		})
 	}
 }
+
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name              string
+		result            ratelimit.Result
+		allowResult       error
+		expectedHeaders   map[string]string
+		expectedRetryBody float64
+	}{
+		{
+			name:   "allowed request",
+			result: ratelimit.Result{Limit: 10, Remaining: 7, Reset: 1500 * time.Millisecond},
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "7",
+				"RateLimit-Reset":     "2",
+				"Retry-After":         "",
+			},
+		},
+		{
+			name:        "rate limited request",
+			result:      ratelimit.Result{Limit: 10, Remaining: 0, Reset: 4 * time.Second, RetryAfter: 2100 * time.Millisecond},
+			allowResult: ratelimit.ErrRateLimitExceeded,
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "4",
+				"Retry-After":         "3",
+			},
+			expectedRetryBody: 3,
+		},
+		{
+			name:        "retry within a second",
+			result:      ratelimit.Result{Limit: 10, RetryAfter: 100 * time.Millisecond},
+			allowResult: ratelimit.ErrRateLimitExceeded,
+			expectedHeaders: map[string]string{
+				"Retry-After": "1",
+			},
+			expectedRetryBody: 1,
+		},
+		{
+			name:   "unknown limit state",
+			result: ratelimit.Result{},
+			expectedHeaders: map[string]string{
+				"RateLimit-Limit":     "",
+				"RateLimit-Remaining": "",
+				"RateLimit-Reset":     "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &MockRateLimiter{
+				AllowFunc: func() error { return tt.allowResult },
+				Result:    tt.result,
+			}
+			handler := RateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+
+			for header, expected := range tt.expectedHeaders {
+				if actual := rr.Header().Get(header); actual != expected {
+					t.Errorf("header %s = %q, want %q", header, actual, expected)
+				}
+			}
+			if tt.allowResult != nil {
+				var response map[string]any
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatalf("could not parse response body: %v", err)
+				}
+				if response["retry_after"] != tt.expectedRetryBody {
+					t.Errorf("retry_after = %v, want %v", response["retry_after"], tt.expectedRetryBody)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitHeadersMostRestrictive(t *testing.T) {
+	// The per-client limit is nearly used up, the global one is not
+	perClient := RateLimit(&MockRateLimiter{
+		AllowFunc: func() error { return nil },
+		Result:    ratelimit.Result{Limit: 5, Remaining: 1, Reset: time.Second},
+	})
+	global := RateLimit(&MockRateLimiter{
+		AllowFunc: func() error { return nil },
+		Result:    ratelimit.Result{Limit: 100, Remaining: 90, Reset: time.Second},
+	})
+	handler := perClient(global(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+
+	if limit, remaining := rr.Header().Get("RateLimit-Limit"), rr.Header().Get("RateLimit-Remaining"); limit != "5" || remaining != "1" {
+		t.Errorf("RateLimit-Limit, RateLimit-Remaining = %s, %s, want 5, 1", limit, remaining)
+	}
+}
+
+func TestQueuedRateLimit(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxWait        time.Duration
+		expectedStatus int
+		minDelay       time.Duration
+	}{
+		{
+			name:           "waits for a token",
+			maxWait:        time.Second,
+			expectedStatus: http.StatusOK,
+			minDelay:       10 * time.Millisecond,
+		},
+		{
+			name:           "rejects a wait longer than the max",
+			maxWait:        5 * time.Millisecond,
+			expectedStatus: http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One token at once, then one every 10ms
+			limiter := ratelimit.NewTokenBucket(100, 1)
+			handler := QueuedRateLimit(limiter, NewQueue(tt.maxWait, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("first request = %d, want %d", rr.Code, http.StatusOK)
+			}
+
+			start := time.Now()
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("second request = %d, want %d", rr.Code, tt.expectedStatus)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("second request took %v, want at least %v", elapsed, tt.minDelay)
+			}
+			if tt.expectedStatus == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "1" {
+				t.Errorf("Retry-After = %q, want 1", rr.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// blockingLimiter holds every request in WaitN until release is closed
+type blockingLimiter struct {
+	waiting chan struct{}
+	release chan struct{}
+}
+
+func (l *blockingLimiter) Allow() (ratelimit.Result, error) {
+	return ratelimit.Result{}, nil
+}
+
+func (l *blockingLimiter) WaitN(ctx context.Context, n int) (ratelimit.Result, error) {
+	l.waiting <- struct{}{}
+	select {
+	case <-l.release:
+		return ratelimit.Result{}, nil
+	case <-ctx.Done():
+		return ratelimit.Result{}, ctx.Err()
+	}
+}
+
+func TestQueuedRateLimitQueueFull(t *testing.T) {
+	limiter := &blockingLimiter{waiting: make(chan struct{}, 1), release: make(chan struct{})}
+	handler := QueuedRateLimit(limiter, NewQueue(time.Minute, 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+		done <- rr.Code
+	}()
+	<-limiter.waiting
+
+	// The only place in the queue is taken
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request to a full queue = %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+
+	close(limiter.release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("queued request = %d, want %d", code, http.StatusOK)
+	}
+	// The place is free again
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("request after the queue drained = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestQueuedRateLimitClientGone(t *testing.T) {
+	limiter := &blockingLimiter{waiting: make(chan struct{}, 1), release: make(chan struct{})}
+	called := false
+	handler := QueuedRateLimit(limiter, NewQueue(time.Minute, 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-limiter.waiting
+		cancel()
+	}()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil).WithContext(ctx))
+	if called || rr.Body.Len() != 0 || rr.Header().Get("Retry-After") != "" {
+		t.Errorf("request of a client gone while waiting was answered: %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestQueuedKeyedRateLimit(t *testing.T) {
+	limiter := ratelimit.NewKeyedLimiter(ratelimit.KeyedOptions{
+		NewLimiter: func() ratelimit.Allower { return ratelimit.NewTokenBucket(100, 1) },
+	})
+	handler := QueuedKeyedRateLimit(limiter, HeaderKey("X-Client"), NewQueue(5*time.Millisecond, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	status := func(client string) int {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Client", client)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := status("a"); code != http.StatusOK {
+		t.Errorf("first request of a = %d, want %d", code, http.StatusOK)
+	}
+	if code := status("a"); code != http.StatusTooManyRequests {
+		t.Errorf("second request of a = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := status("b"); code != http.StatusOK {
+		t.Errorf("first request of b = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestQueuedRateLimitSharedDeadline(t *testing.T) {
+	// A token every 100ms for the outer limit and every 250ms for the inner
+	// one, both used up
+	outer, inner := ratelimit.NewTokenBucket(10, 1), ratelimit.NewTokenBucket(4, 1)
+	outer.Allow()
+	inner.Allow()
+	queue := NewQueue(200*time.Millisecond, 10)
+	handler := QueuedRateLimit(outer, queue)(QueuedRateLimit(inner, queue)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// After waiting 100ms for the outer limit, the inner one would take
+	// another 150ms, beyond the max wait of the request as a whole
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request = %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("request was rejected after %v, want before the max wait", elapsed)
+	}
+
+	// The outer token taken by the rejected request was given back
+	if _, err := outer.Allow(); err != nil {
+		t.Errorf("outer Allow() after the rejection = %v, want nil", err)
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	global := ratelimit.NewTokenBucket(1, 2)
+	perClient := &mockKeyedLimiter{seen: map[string]bool{}}
+	handler := RateLimit(global)(KeyedRateLimit(perClient, HeaderKey(APIKeyHeader))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// The second request of alice is rejected by her own limit, which gives
+	// the global token back for bob
+	for i, tt := range []struct {
+		apiKey         string
+		expectedStatus int
+	}{
+		{apiKey: "alice", expectedStatus: http.StatusOK},
+		{apiKey: "alice", expectedStatus: http.StatusTooManyRequests},
+		{apiKey: "bob", expectedStatus: http.StatusOK},
+		{apiKey: "carol", expectedStatus: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set(APIKeyHeader, tt.apiKey)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("request %d with key %q: got status %d, want %d", i, tt.apiKey, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+// mockKeyedLimiter allows the first request of every key
+type mockKeyedLimiter struct {
+	seen map[string]bool
+}
+
+func (m *mockKeyedLimiter) AllowKey(key string) (ratelimit.Result, error) {
+	if m.seen[key] {
+		return ratelimit.Result{}, errors.New("rate limit exceeded")
+	}
+	m.seen[key] = true
+	return ratelimit.Result{}, nil
+}
+
+func TestKeyedRateLimit(t *testing.T) {
+	limiter := &mockKeyedLimiter{seen: map[string]bool{}}
+	handler := KeyedRateLimit(limiter, HeaderKey(APIKeyHeader))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	requests := []struct {
+		apiKey         string
+		expectedStatus int
+	}{
+		{apiKey: "alice", expectedStatus: http.StatusOK},
+		{apiKey: "bob", expectedStatus: http.StatusOK},
+		{apiKey: "alice", expectedStatus: http.StatusTooManyRequests},
+		{apiKey: "", expectedStatus: http.StatusOK},
+		{apiKey: "", expectedStatus: http.StatusTooManyRequests},
+	}
+	for i, tt := range requests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		if tt.apiKey != "" {
+			req.Header.Set(APIKeyHeader, tt.apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("request %d with key %q: got status %d, want %d", i, tt.apiKey, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestClientIPKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expected: "ip:192.0.2.1"},
+		{remoteAddr: "[::ffff:192.0.2.1]:1234", expected: "ip:192.0.2.1"},
+		{remoteAddr: "[2001:db8:1:2:3:4:5:6]:1234", expected: "ip:2001:db8:1:2::/64"},
+		{remoteAddr: "[fe80::1%eth0]:1234", expected: "ip:fe80::/64"},
+		{remoteAddr: "unix-socket", expected: "ip:unix-socket"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if key := ClientIPKey(req); key != tt.expected {
+			t.Errorf("ClientIPKey(%s) = %q, want %q", tt.remoteAddr, key, tt.expected)
+		}
+	}
+}
+
+func TestParseRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Tenant", "acme")
+
+	issued := func(apiKey string) bool { return apiKey == "alice" }
+
+	tests := []struct {
+		spec     string
+		apiKey   string
+		known    func(string) bool
+		expected string
+		wantErr  bool
+	}{
+		{spec: "ip", expected: "ip:192.0.2.1"},
+		{spec: "api_key", apiKey: "alice", known: issued, expected: "api_key:alice"},
+		// Made up keys do not get a limit of their own
+		{spec: "api_key", apiKey: "mallory", known: issued, expected: "ip:192.0.2.1"},
+		{spec: "api_key", known: issued, expected: "ip:192.0.2.1"},
+		{spec: "api_key", wantErr: true},
+		{spec: "header:X-Tenant", expected: "header:acme"},
+		{spec: "header:", wantErr: true},
+		{spec: "cookie", wantErr: true},
+	}
+	for _, tt := range tests {
+		req.Header.Set(APIKeyHeader, tt.apiKey)
+		key, err := ParseRateLimitKey(tt.spec, tt.known)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRateLimitKey(%q) expected error, got nil", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRateLimitKey(%q) unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if got := key(req); got != tt.expected {
+			t.Errorf("ParseRateLimitKey(%q) key = %q, want %q", tt.spec, got, tt.expected)
+		}
+	}
+}
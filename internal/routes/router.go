@@ -6,19 +6,49 @@ import (
 	"ip2country-api/internal/handlers"
 	"ip2country-api/internal/ip2country"
 	"ip2country-api/internal/middleware"
+	"ip2country-api/pkg/ratelimit"
 )
 
-// RegisterRoutes sets up all API routes
+// RegisterRoutes sets up all API routes. When quotas is not nil, lookups
+// require an API key and are charged to its quota. When concurrency is not
+// nil, it limits the lookups in flight.
 func RegisterRoutes(
 	ip2countryService ip2country.Service,
-	limiter middleware.RateLimiter,
+	rateLimit func(http.Handler) http.Handler,
+	quotas *ratelimit.QuotaLimiter,
+	concurrency *ratelimit.AdaptiveLimiter,
 	allowedOrigins []string,
+	adminToken string,
 ) http.Handler {
 	// Create a new ServeMux
 	mux := http.NewServeMux()
 
-	// IP-to-country API endpoints
-	mux.HandleFunc("/v1/find-country", handlers.FindCountryHandler(ip2countryService))
+	// IP-to-country API endpoints. The concurrency limit wraps the service
+	// rather than the handler, so the latency measured is the lookup's own.
+	lookups := ip2countryService
+	if concurrency != nil {
+		lookups = ip2country.NewLimitedService(ip2countryService, concurrency)
+	}
+	var findCountry http.Handler = handlers.FindCountryHandler(lookups)
+	var findCountries http.Handler = handlers.FindCountriesHandler(lookups)
+	if quotas != nil {
+		findCountry = middleware.APIKeyQuota(quotas)(findCountry)
+		findCountries = middleware.APIKeyQuota(quotas)(findCountries)
+		mux.HandleFunc("GET /v1/usage", handlers.UsageHandler(quotas))
+	}
+	mux.Handle("/v1/find-country", findCountry)
+	mux.Handle("GET /v1/find-countries", findCountries)
+	mux.HandleFunc("GET /v1/datasets", handlers.DatasetsHandler(ip2countryService))
+
+	// Admin endpoints, only reachable with the admin token
+	adminAuth := middleware.AdminAuth(adminToken)
+	mux.Handle("PUT /v1/admin/records/{cidr...}", adminAuth(handlers.PutRecordHandler(ip2countryService)))
+	mux.Handle("DELETE /v1/admin/records/{cidr...}", adminAuth(handlers.DeleteRecordHandler(ip2countryService)))
+	mux.Handle("GET /v1/admin/snapshots", adminAuth(handlers.SnapshotsHandler(ip2countryService)))
+	mux.Handle("POST /v1/admin/snapshots/{version}/activate", adminAuth(handlers.RollbackHandler(ip2countryService)))
+	mux.Handle("GET /v1/admin/shadow", adminAuth(handlers.ShadowSummaryHandler(ip2countryService)))
+	mux.Handle("GET /v1/admin/canary", adminAuth(handlers.CanaryStatsHandler(ip2countryService)))
+	mux.Handle("PUT /v1/admin/canary", adminAuth(handlers.SetCanaryPercentHandler(ip2countryService)))
 
 	// Additional routes can be added here as the API grows
 
@@ -31,8 +61,11 @@ func RegisterRoutes(
 	// Log every request
 	handler = middleware.Logger(handler)
 
-	// Rate limiting middleware
-	handler = middleware.RateLimit(limiter)(handler)
+	// Rate limiting middleware. Batch lookups cost one request per address.
+	handler = rateLimit(handler)
+	handler = middleware.RouteCosts(map[string]middleware.CostFunc{
+		"GET /v1/find-countries": middleware.ParamCost("ip"),
+	})(handler)
 
 	// CORS middleware (allow specific origins)
 	handler = middleware.CORS(allowedOrigins)(handler)
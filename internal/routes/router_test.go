@@ -5,9 +5,13 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"ip2country-api/internal/ip2country"
+	"ip2country-api/internal/middleware"
+	"ip2country-api/pkg/ratelimit"
 )
 
 // MockRateLimiter is a mock implementation for the middleware.RateLimiter interface
@@ -15,8 +19,8 @@ type MockRateLimiter struct {
 	AllowFunc func() error
 }
 
-func (m *MockRateLimiter) Allow() error {
-	return m.AllowFunc()
+func (m *MockRateLimiter) Allow() (ratelimit.Result, error) {
+	return ratelimit.Result{}, m.AllowFunc()
 }
 
 // MockService is a mock implementation of the ip2country.Service interface
@@ -49,7 +53,7 @@ func TestRegisterRoutes(t *testing.T) {
 	}
 
 	// Register routes
-	handler := RegisterRoutes(mockIp2countryService, mockRateLimiter, []string{"http://localhost:3000"})
+	handler := RegisterRoutes(mockIp2countryService, middleware.RateLimit(mockRateLimiter), nil, nil, []string{"http://localhost:3000"}, "admin-secret")
 
 	// Test cases
 	tests := []struct {
@@ -81,6 +85,34 @@ func TestRegisterRoutes(t *testing.T) {
 				"Access-Control-Allow-Origin": "http://localhost:3000",
 			},
 		},
+		{
+			name:           "batch find countries",
+			path:           "/v1/find-countries?ip=192.168.1.1,10.0.0.1",
+			method:         "GET",
+			origin:         "http://localhost:3000",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "datasets metadata",
+			path:           "/v1/datasets",
+			method:         "GET",
+			origin:         "http://localhost:3000",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "admin route without token",
+			path:           "/v1/admin/records/10.0.0.0/8",
+			method:         "DELETE",
+			origin:         "http://localhost:3000",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "usage without quotas",
+			path:           "/v1/usage",
+			method:         "GET",
+			origin:         "http://localhost:3000",
+			expectedStatus: http.StatusNotFound,
+		},
 		{
 			name:           "non-existent route",
 			path:           "/not-found",
@@ -126,3 +158,89 @@ func TestRegisterRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterRoutesWithQuotas(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	mockIp2countryService := &MockIp2countryService{
+		LookupIPFunc: func(ip string) (*ip2country.Result, error) {
+			return &ip2country.Result{Country: "US", City: "New York"}, nil
+		},
+	}
+	quotaFile := "plan,free,10,10,2,0\nkey,free-key,free,web\n"
+	quotas, err := ratelimit.ParseQuotas(strings.NewReader(quotaFile), "quotas.csv")
+	if err != nil {
+		t.Fatalf("ParseQuotas() failed: %v", err)
+	}
+	store, err := ratelimit.NewFileUsageStore(filepath.Join(t.TempDir(), "usage.json"), 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	allowAll := middleware.RateLimit(&MockRateLimiter{AllowFunc: func() error { return nil }})
+	handler := RegisterRoutes(mockIp2countryService, allowAll, ratelimit.NewQuotaLimiter(quotas, store), nil, nil, "")
+
+	// Checking usage does not count against the daily cap of 2, and a batch
+	// costing more than the cap is never allowed
+	requests := []struct {
+		path           string
+		apiKey         string
+		expectedStatus int
+	}{
+		{path: "/v1/find-country?ip=1.1.1.1", apiKey: "", expectedStatus: http.StatusUnauthorized},
+		{path: "/v1/find-countries?ip=1.1.1.1,2.2.2.2,3.3.3.3", apiKey: "free-key", expectedStatus: http.StatusRequestEntityTooLarge},
+		{path: "/v1/find-country?ip=1.1.1.1", apiKey: "free-key", expectedStatus: http.StatusOK},
+		{path: "/v1/usage", apiKey: "free-key", expectedStatus: http.StatusOK},
+		{path: "/v1/usage", apiKey: "free-key", expectedStatus: http.StatusOK},
+		{path: "/v1/find-country?ip=1.1.1.1", apiKey: "free-key", expectedStatus: http.StatusOK},
+		{path: "/v1/find-country?ip=1.1.1.1", apiKey: "free-key", expectedStatus: http.StatusTooManyRequests},
+		{path: "/v1/datasets", apiKey: "", expectedStatus: http.StatusOK},
+	}
+	for i, tt := range requests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.apiKey != "" {
+			req.Header.Set(middleware.APIKeyHeader, tt.apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("request %d to %s: got status %d, want %d", i, tt.path, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestRegisterRoutesWithConcurrencyLimit(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	concurrency := ratelimit.NewAdaptiveLimiter(ratelimit.AdaptiveOptions{InitialLimit: 1, MinLimit: 1, MaxLimit: 1})
+	var handler http.Handler
+	nested := 0
+	mockIp2countryService := &MockIp2countryService{
+		LookupIPFunc: func(ip string) (*ip2country.Result, error) {
+			// A lookup arriving while this one is in flight is turned away
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/find-country?ip=8.8.8.8", nil))
+			nested = rr.Code
+			return &ip2country.Result{Country: "US", City: "New York"}, nil
+		},
+	}
+	allowAll := middleware.RateLimit(&MockRateLimiter{AllowFunc: func() error { return nil }})
+	handler = RegisterRoutes(mockIp2countryService, allowAll, nil, concurrency, nil, "")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/find-country?ip=1.1.1.1", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("lookup = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if nested != http.StatusServiceUnavailable {
+		t.Errorf("lookup over the concurrency limit = %d, want %d", nested, http.StatusServiceUnavailable)
+	}
+	if n := concurrency.InFlight(); n != 0 {
+		t.Errorf("lookups in flight afterwards = %d, want 0", n)
+	}
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+)
+
+// QueryList returns the values of the query parameter name of r, whether
+// repeated or comma separated, leaving out empty ones
+func QueryList(r *http.Request, name string) []string {
+	var list []string
+	for _, value := range r.URL.Query()[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestQueryList(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected []string
+	}{
+		{target: "/", expected: nil},
+		{target: "/?ip=1.1.1.1", expected: []string{"1.1.1.1"}},
+		{target: "/?ip=1.1.1.1,%202.2.2.2&ip=3.3.3.3", expected: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+		{target: "/?ip=,&ip=", expected: nil},
+	}
+	for _, tc := range tests {
+		if got := QueryList(httptest.NewRequest("GET", tc.target, nil), "ip"); !slices.Equal(got, tc.expected) {
+			t.Errorf("QueryList(%q) = %q, want %q", tc.target, got, tc.expected)
+		}
+	}
+}
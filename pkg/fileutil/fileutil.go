@@ -0,0 +1,45 @@
+// Package fileutil holds file helpers shared by the datasets and the rate
+// limiting state written to disk
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces path with content by writing a temporary file in
+// the same directory and renaming it over the original, so readers and
+// crashes see either the old or the new content. A replaced file keeps its
+// permissions.
+func WriteFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// Keep the permissions of the file being replaced
+	if stat, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(stat.Mode().Perm()); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error setting file permissions: %v", err)
+		}
+	}
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temporary file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.csv")
+
+	if err := WriteFileAtomic(path, []byte("first")); err != nil {
+		t.Fatalf("WriteFileAtomic() failed: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("second")); err != nil {
+		t.Fatalf("WriteFileAtomic() over an existing file failed: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "second" {
+		t.Errorf("content = %q, %v, want %q", content, err, "second")
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("permissions = %v, %v, want the 0600 of the replaced file", stat.Mode().Perm(), err)
+	}
+	// No temporary file is left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want 1", len(entries))
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "data.csv"), nil); err == nil {
+		t.Error("Expected error for a missing directory, got nil")
+	}
+}
@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrConcurrencyLimitExceeded is returned when as many requests as the
+// adaptive limit allows are already in flight
+var ErrConcurrencyLimitExceeded = errors.New("concurrency limit exceeded")
+
+// Defaults of AdaptiveOptions
+const (
+	DefaultInitialConcurrency = 20
+	DefaultMinConcurrency     = 5
+	DefaultMaxConcurrency     = 500
+	DefaultLatencyTolerance   = 1.5
+	DefaultBaselineWindow     = time.Minute
+)
+
+// shortLatencyWindow is about the number of requests the average of the
+// current latency spans
+const shortLatencyWindow = 10
+
+// adaptiveSmoothing is the share of each new estimate taken into the limit,
+// so a single slow request does not halve it
+const adaptiveSmoothing = 0.2
+
+// AdaptiveOptions holds the settings of an AdaptiveLimiter
+type AdaptiveOptions struct {
+	// InitialLimit is the number of requests allowed in flight at first.
+	// MinLimit and MaxLimit bound the limit as it adapts.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+
+	// Tolerance is how many times slower than the baseline requests may get
+	// before the limit shrinks
+	Tolerance float64
+
+	// BaselineWindow is how long the fastest latency seen is kept as the
+	// baseline, so the limit recovers when the backend stays slower for good
+	BaselineWindow time.Duration
+
+	// Clock reads the time for the baseline window, time.Now when nil
+	Clock Clock
+}
+
+// AdaptiveLimiter limits the requests in flight to what the backend can
+// handle, without a configured capacity. It follows the gradient algorithm of
+// Netflix's concurrency-limits: the latency of recent requests is compared to
+// a baseline, the fastest latency seen over the last one or two baseline
+// windows. While it stays within the tolerance the limit grows by about its
+// square root, leaving room for a queue. When latency rises the limit shrinks
+// in proportion, down to half at a time, so requests are turned away before
+// they pile up in a saturated backend.
+type AdaptiveLimiter struct {
+	options AdaptiveOptions
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+
+	// latency is an exponential moving average of the latency in
+	// nanoseconds, zero until the first sample
+	latency float64
+
+	// fastest and previousFastest are the lowest latencies of the current
+	// and previous baseline windows, zero before any sample
+	fastest         time.Duration
+	previousFastest time.Duration
+	windowStart     time.Time
+}
+
+// NewAdaptiveLimiter creates an adaptive limiter. Zero options take their
+// defaults, and the initial limit is kept within the bounds.
+func NewAdaptiveLimiter(options AdaptiveOptions) *AdaptiveLimiter {
+	if options.InitialLimit <= 0 {
+		options.InitialLimit = DefaultInitialConcurrency
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = DefaultMinConcurrency
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = DefaultMaxConcurrency
+	}
+	if options.Tolerance <= 0 {
+		options.Tolerance = DefaultLatencyTolerance
+	}
+	if options.BaselineWindow <= 0 {
+		options.BaselineWindow = DefaultBaselineWindow
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+	limit := float64(min(max(options.InitialLimit, options.MinLimit), options.MaxLimit))
+	return &AdaptiveLimiter{options: options, limit: limit, windowStart: options.Clock()}
+}
+
+// Acquire takes a place for a request, or returns
+// ErrConcurrencyLimitExceeded when none is left. A request that acquired a
+// place must call Release when it is done.
+func (l *AdaptiveLimiter) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= int(l.limit) {
+		return ErrConcurrencyLimitExceeded
+	}
+	l.inFlight++
+	return nil
+}
+
+// Release frees the place of a request and adapts the limit to its latency
+func (l *AdaptiveLimiter) Release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+
+	latency = max(latency, 1)
+	if l.latency == 0 {
+		l.latency = float64(latency)
+	} else {
+		l.latency += (float64(latency) - l.latency) * 2 / (shortLatencyWindow + 1)
+	}
+	baseline := l.baseline(latency)
+
+	// A limit far from being used says nothing about the capacity
+	if float64(inFlight) < l.limit/2 {
+		return
+	}
+	gradient := min(max(l.options.Tolerance*float64(baseline)/l.latency, 0.5), 1)
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*(1-adaptiveSmoothing) + estimate*adaptiveSmoothing
+	l.limit = min(max(l.limit, float64(l.options.MinLimit)), float64(l.options.MaxLimit))
+}
+
+// baseline records latency in the current baseline window and returns the
+// fastest latency of the current and previous windows. Keeping the previous
+// window means the baseline never starts over from a single sample.
+func (l *AdaptiveLimiter) baseline(latency time.Duration) time.Duration {
+	if now := l.options.Clock(); now.Sub(l.windowStart) >= l.options.BaselineWindow {
+		l.previousFastest, l.fastest = l.fastest, 0
+		l.windowStart = now
+	}
+	if l.fastest == 0 || latency < l.fastest {
+		l.fastest = latency
+	}
+	if l.previousFastest == 0 {
+		return l.fastest
+	}
+	return min(l.fastest, l.previousFastest)
+}
+
+// Limit returns the number of requests currently allowed in flight
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// InFlight returns the number of requests holding a place
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
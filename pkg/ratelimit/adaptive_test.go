@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// saturate fills every place of limiter, then releases them all with the
+// latency of a backend handling that many requests at once, rounds times
+func saturate(limiter *AdaptiveLimiter, latency func(inFlight int) time.Duration, rounds int) {
+	for range rounds {
+		inFlight := 0
+		for limiter.Acquire() == nil {
+			inFlight++
+		}
+		for range inFlight {
+			limiter.Release(latency(inFlight))
+		}
+	}
+}
+
+// steady is a backend answering in the same time whatever the load
+func steady(d time.Duration) func(int) time.Duration {
+	return func(int) time.Duration { return d }
+}
+
+func TestAdaptiveLimiterRejectsOverLimit(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveOptions{InitialLimit: 3, MinLimit: 1, MaxLimit: 10})
+	for i := 0; i < 3; i++ {
+		if err := limiter.Acquire(); err != nil {
+			t.Fatalf("Acquire() %d = %v, want nil", i, err)
+		}
+	}
+	if err := limiter.Acquire(); err != ErrConcurrencyLimitExceeded {
+		t.Errorf("Acquire() over the limit = %v, want %v", err, ErrConcurrencyLimitExceeded)
+	}
+	limiter.Release(time.Millisecond)
+	if err := limiter.Acquire(); err != nil {
+		t.Errorf("Acquire() after a release = %v, want nil", err)
+	}
+	if n := limiter.InFlight(); n != 3 {
+		t.Errorf("InFlight() = %d, want 3", n)
+	}
+}
+
+func TestAdaptiveLimiterAdapts(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewAdaptiveLimiter(AdaptiveOptions{InitialLimit: 10, MinLimit: 2, MaxLimit: 100, Clock: clock.Now})
+
+	// A backend answering steadily lets the limit grow up to the max
+	saturate(limiter, steady(10*time.Millisecond), 50)
+	if limit := limiter.Limit(); limit != 100 {
+		t.Errorf("limit with steady latency = %d, want the max of 100", limit)
+	}
+
+	// A backend serving 20 requests at once queues the others, so its latency
+	// grows with the load. The limit settles a little above its capacity.
+	overloaded := func(inFlight int) time.Duration {
+		return 10 * time.Millisecond * time.Duration(max(inFlight, 20)) / 20
+	}
+	saturate(limiter, overloaded, 200)
+	if limit := limiter.Limit(); limit < 20 || limit > 40 {
+		t.Errorf("limit of an overloaded backend = %d, want between 20 and 40", limit)
+	}
+
+	// A backend getting slower for good first brings the limit down
+	saturate(limiter, steady(100*time.Millisecond), 1)
+	if limit := limiter.Limit(); limit > 20 {
+		t.Errorf("limit after latency rose tenfold = %d, want at most 20", limit)
+	}
+	// Once the fast requests left the baseline, the new latency is the norm
+	clock.Advance(DefaultBaselineWindow)
+	saturate(limiter, steady(100*time.Millisecond), 1)
+	clock.Advance(DefaultBaselineWindow)
+	saturate(limiter, steady(100*time.Millisecond), 50)
+	if limit := limiter.Limit(); limit != 100 {
+		t.Errorf("limit after the baseline windows passed = %d, want the max of 100", limit)
+	}
+}
+
+func TestAdaptiveLimiterIdle(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveOptions{InitialLimit: 10, MinLimit: 2, MaxLimit: 100})
+
+	// One request at a time says nothing about the capacity, however slow
+	for i := 0; i < 100; i++ {
+		limiter.Acquire()
+		limiter.Release(time.Duration(i+1) * time.Millisecond)
+	}
+	if limit := limiter.Limit(); limit != 10 {
+		t.Errorf("limit of an idle limiter = %d, want 10", limit)
+	}
+}
+
+func TestAdaptiveLimiterDefaults(t *testing.T) {
+	if limit := NewAdaptiveLimiter(AdaptiveOptions{}).Limit(); limit != DefaultInitialConcurrency {
+		t.Errorf("default limit = %d, want %d", limit, DefaultInitialConcurrency)
+	}
+	// The initial limit is kept within the bounds
+	if limit := NewAdaptiveLimiter(AdaptiveOptions{InitialLimit: 50, MaxLimit: 10}).Limit(); limit != 10 {
+		t.Errorf("limit above the max = %d, want 10", limit)
+	}
+}
+
+func TestAdaptiveLimiterConcurrent(t *testing.T) {
+	limiter := NewAdaptiveLimiter(AdaptiveOptions{InitialLimit: 10, MinLimit: 10, MaxLimit: 10})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	peak := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if limiter.Acquire() != nil {
+					continue
+				}
+				mu.Lock()
+				peak = max(peak, limiter.InFlight())
+				mu.Unlock()
+				limiter.Release(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak > 10 {
+		t.Errorf("peak in flight = %d, want at most 10", peak)
+	}
+	if n := limiter.InFlight(); n != 0 {
+		t.Errorf("InFlight() after all requests = %d, want 0", n)
+	}
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import "fmt"
+
+// CostAllower is implemented by limiters that can charge a request as
+// several, such as a batch of lookups
+type CostAllower interface {
+	AllowN(n int) (Result, error)
+}
+
+// KeyCostAllower is implemented by keyed limiters that can charge a request
+// as several
+type KeyCostAllower interface {
+	AllowKeyN(key string, n int) (Result, error)
+}
+
+// AllowN checks a request costing n requests against limiter. Limiters that
+// cannot weigh requests charge it once.
+func AllowN(limiter Allower, n int) (Result, error) {
+	if costAllower, ok := limiter.(CostAllower); ok {
+		return costAllower.AllowN(n)
+	}
+	return limiter.Allow()
+}
+
+// AllowKeyN checks a request costing n requests against the limit of key
+func AllowKeyN(limiter KeyAllower, key string, n int) (Result, error) {
+	if costAllower, ok := limiter.(KeyCostAllower); ok {
+		return costAllower.AllowKeyN(key, n)
+	}
+	return limiter.AllowKey(key)
+}
+
+// Refunder is implemented by limiters that can give back what they charged a
+// request that a later limit rejected
+type Refunder interface {
+	RefundN(n int)
+}
+
+// KeyRefunder is implemented by keyed limiters that can give back what they
+// charged a request
+type KeyRefunder interface {
+	RefundKeyN(key string, n int)
+}
+
+// RefundN gives back the n requests limiter charged a request. Limiters that
+// cannot refund keep them charged.
+func RefundN(limiter Allower, n int) {
+	if refunder, ok := limiter.(Refunder); ok {
+		refunder.RefundN(n)
+	}
+}
+
+// RefundKeyN gives back the n requests limiter charged a request of key
+func RefundKeyN(limiter KeyAllower, key string, n int) {
+	if refunder, ok := limiter.(KeyRefunder); ok {
+		refunder.RefundKeyN(key, n)
+	}
+}
+
+// CostError rejects a request costing more than a limiter allows at once.
+// Unlike ErrRateLimitExceeded, waiting never lets such a request through.
+type CostError struct {
+	Cost  int
+	Limit int
+}
+
+func (e *CostError) Error() string {
+	return fmt.Sprintf("request costs %d requests, more than the limit of %d allows at once", e.Cost, e.Limit)
+}
+
+// checkCost returns the cost charged for a request costing n against a limit
+// of capacity, at least one, or a *CostError when the limiter can never allow
+// it
+func checkCost(n, capacity int) (int, error) {
+	n = max(n, 1)
+	if n > max(capacity, 1) {
+		return 0, &CostError{Cost: n, Limit: capacity}
+	}
+	return n, nil
+}
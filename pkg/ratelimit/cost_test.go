@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAllowN(t *testing.T) {
+	limiters := []struct {
+		name    string
+		limiter func(clock Clock) CostAllower
+	}{
+		{name: "Fixed window", limiter: func(clock Clock) CostAllower { return NewLimiterWithClock(10, clock) }},
+		{name: "Token bucket", limiter: func(clock Clock) CostAllower { return NewTokenBucketWithClock(10, 10, clock) }},
+		{name: "Sliding log", limiter: func(clock Clock) CostAllower { return NewSlidingWindowLogWithClock(10, time.Second, clock) }},
+		{name: "Sliding window", limiter: func(clock Clock) CostAllower { return NewSlidingWindowCounterWithClock(10, time.Second, clock) }},
+	}
+	// Every limiter allows 10 requests at once
+	steps := []struct {
+		cost      int
+		expected  error
+		remaining int
+	}{
+		{cost: 4, expected: nil, remaining: 6},
+		{cost: 7, expected: ErrRateLimitExceeded, remaining: 6},
+		{cost: 6, expected: nil, remaining: 0},
+		{cost: 1, expected: ErrRateLimitExceeded, remaining: 0},
+	}
+	for _, tc := range limiters {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := tc.limiter(clock.Now)
+			for i, step := range steps {
+				result, err := limiter.AllowN(step.cost)
+				if err != step.expected || result.Remaining != step.remaining {
+					t.Errorf("step %d: AllowN(%d) = %d remaining, %v, want %d remaining, %v", i, step.cost, result.Remaining, err, step.remaining, step.expected)
+				}
+			}
+
+			// A cost above the limit is rejected for good and charges nothing
+			clock.Advance(2 * time.Second)
+			var costErr *CostError
+			if _, err := limiter.AllowN(100); !errors.As(err, &costErr) || costErr.Cost != 100 || costErr.Limit != 10 {
+				t.Errorf("AllowN(100) = %v, want a cost of 100 over the limit of 10", err)
+			}
+			if result, err := limiter.AllowN(10); err != nil || result.Remaining != 0 {
+				t.Errorf("AllowN(10) after a rejected cost = %d remaining, %v, want 0 remaining, nil", result.Remaining, err)
+			}
+		})
+	}
+}
+
+func TestRefundN(t *testing.T) {
+	limiters := []struct {
+		name    string
+		limiter func(clock Clock) Allower
+	}{
+		{name: "Fixed window", limiter: func(clock Clock) Allower { return NewLimiterWithClock(10, clock) }},
+		{name: "Token bucket", limiter: func(clock Clock) Allower { return NewTokenBucketWithClock(10, 10, clock) }},
+		{name: "Sliding log", limiter: func(clock Clock) Allower { return NewSlidingWindowLogWithClock(10, time.Second, clock) }},
+		{name: "Sliding window", limiter: func(clock Clock) Allower { return NewSlidingWindowCounterWithClock(10, time.Second, clock) }},
+	}
+	for _, tc := range limiters {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := tc.limiter(newFakeClock().Now)
+			AllowN(limiter, 6)
+			RefundN(limiter, 4)
+			if result, err := AllowN(limiter, 8); err != nil || result.Remaining != 0 {
+				t.Errorf("AllowN(8) after a refund of 4 = %d remaining, %v, want 0 remaining, nil", result.Remaining, err)
+			}
+
+			// A refund never gives back more than the limit
+			RefundN(limiter, 100)
+			RefundN(limiter, 100)
+			if got := allowN(limiter, 20); got != 10 {
+				t.Errorf("allowed %d requests after refunds above the limit, want 10", got)
+			}
+		})
+	}
+}
+
+func TestAllowNRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewTokenBucketWithClock(10, 10, clock.Now)
+	bucket.AllowN(8)
+	// 5 tokens take 300ms to earn with 2 left
+	if result, err := bucket.AllowN(5); err != ErrRateLimitExceeded || result.RetryAfter != 300*time.Millisecond {
+		t.Errorf("token bucket AllowN(5) = %v, %v, want a 300ms retry", result.RetryAfter, err)
+	}
+
+	log := NewSlidingWindowLogWithClock(10, time.Second, clock.Now)
+	log.AllowN(4)
+	clock.Advance(100 * time.Millisecond)
+	log.AllowN(6)
+	// 5 more fit once the first 4 and one of the next 6 left the window
+	if result, err := log.AllowN(5); err != ErrRateLimitExceeded || result.RetryAfter != time.Second {
+		t.Errorf("sliding log AllowN(5) = %v, %v, want a 1s retry", result.RetryAfter, err)
+	}
+	if result, err := log.AllowN(4); err != ErrRateLimitExceeded || result.RetryAfter != 900*time.Millisecond {
+		t.Errorf("sliding log AllowN(4) = %v, %v, want a 900ms retry", result.RetryAfter, err)
+	}
+}
+
+// countingLimiter cannot weigh requests
+type countingLimiter struct {
+	calls int
+}
+
+func (l *countingLimiter) Allow() (Result, error) {
+	l.calls++
+	return Result{}, nil
+}
+
+func (l *countingLimiter) AllowKey(key string) (Result, error) {
+	return l.Allow()
+}
+
+func TestWaitNCostAboveLimit(t *testing.T) {
+	// Waiting never earns more tokens than the burst, so the request is
+	// rejected at once
+	bucket := NewTokenBucket(10, 10)
+	var costErr *CostError
+	if _, err := WaitN(context.Background(), bucket, 11); !errors.As(err, &costErr) {
+		t.Errorf("token bucket WaitN(11) = %v, want a *CostError", err)
+	}
+	log := NewSlidingWindowLog(10, time.Second)
+	if _, err := WaitN(context.Background(), log, 11); !errors.As(err, &costErr) {
+		t.Errorf("sliding log WaitN(11) = %v, want a *CostError", err)
+	}
+}
+
+func TestAllowNFallback(t *testing.T) {
+	limiter := &countingLimiter{}
+	AllowN(limiter, 5)
+	AllowKeyN(limiter, "client", 5)
+	if limiter.calls != 2 {
+		t.Errorf("limiter without costs called %d times, want once per request", limiter.calls)
+	}
+
+	keyed := NewKeyedLimiter(KeyedOptions{NewLimiter: func() Allower { return NewTokenBucket(0, 10) }})
+	if result, err := AllowKeyN(keyed, "client", 7); err != nil || result.Remaining != 3 {
+		t.Errorf("keyed AllowKeyN(7) = %d remaining, %v, want 3 remaining, nil", result.Remaining, err)
+	}
+}
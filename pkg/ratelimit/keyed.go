@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// Allower is implemented by every limiter in this package
+type Allower interface {
+	Allow() (Result, error)
+}
+
+// Default settings of a KeyedLimiter
+const (
+	DefaultKeyShards   = 32
+	DefaultMaxKeys     = 100000
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+// KeyedOptions holds the settings of a KeyedLimiter
+type KeyedOptions struct {
+	// NewLimiter creates the limiter of a key seen for the first time
+	NewLimiter func() Allower
+
+	// MaxKeys is a hard cap on the number of keys tracked at once, which
+	// bounds memory. When it is reached the least recently used key is
+	// forgotten and starts over with a fresh limiter if it comes back.
+	MaxKeys int
+
+	// IdleTimeout forgets keys that made no request for that long
+	IdleTimeout time.Duration
+
+	// Shards splits the keys over independently locked maps to reduce lock
+	// contention
+	Shards int
+
+	// Clock reads the time for idle eviction, time.Now when nil
+	Clock Clock
+}
+
+// KeyedLimiter keeps a separate limiter per key, such as a client address or
+// API key, so one noisy client cannot use up the limit of the others
+type KeyedLimiter struct {
+	options KeyedOptions
+	seed    maphash.Seed
+	shards  []keyedShard
+}
+
+// keyedShard is a map of keys to limiters with least recently used order
+type keyedShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   list.List // of *keyedEntry, most recently used first
+	maxKeys int
+}
+
+type keyedEntry struct {
+	key      string
+	limiter  Allower
+	lastSeen time.Time
+}
+
+// NewKeyedLimiter creates a keyed limiter. Zero values of MaxKeys,
+// IdleTimeout and Shards take their defaults.
+func NewKeyedLimiter(options KeyedOptions) *KeyedLimiter {
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = DefaultMaxKeys
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = DefaultIdleTimeout
+	}
+	if options.Shards <= 0 {
+		options.Shards = DefaultKeyShards
+	}
+	// Every shard holds at least one key, so a small cap means fewer shards
+	options.Shards = min(options.Shards, options.MaxKeys)
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	l := &KeyedLimiter{
+		options: options,
+		seed:    maphash.MakeSeed(),
+		shards:  make([]keyedShard, options.Shards),
+	}
+	// Spread the cap over the shards without exceeding it in total
+	for i := range l.shards {
+		l.shards[i].entries = make(map[string]*list.Element)
+		l.shards[i].maxKeys = options.MaxKeys / options.Shards
+		if i < options.MaxKeys%options.Shards {
+			l.shards[i].maxKeys++
+		}
+	}
+	return l
+}
+
+// AllowKey checks the request against the limiter of key
+func (l *KeyedLimiter) AllowKey(key string) (Result, error) {
+	return l.limiter(key).Allow()
+}
+
+// AllowKeyN checks a request costing n requests against the limiter of key
+func (l *KeyedLimiter) AllowKeyN(key string, n int) (Result, error) {
+	return AllowN(l.limiter(key), n)
+}
+
+// RefundKeyN gives back what the limiter of key charged a request costing n
+func (l *KeyedLimiter) RefundKeyN(key string, n int) {
+	RefundN(l.limiter(key), n)
+}
+
+// WaitKey holds the request until the limiter of key allows it, see WaitN
+func (l *KeyedLimiter) WaitKey(ctx context.Context, key string) (Result, error) {
+	return l.WaitKeyN(ctx, key, 1)
+}
+
+// WaitKeyN holds a request costing n requests until the limiter of key
+// allows it
+func (l *KeyedLimiter) WaitKeyN(ctx context.Context, key string, n int) (Result, error) {
+	return WaitN(ctx, l.limiter(key), n)
+}
+
+// limiter returns the limiter of key, creating it if needed, and marks the
+// key as recently used
+func (l *KeyedLimiter) limiter(key string) Allower {
+	shard := &l.shards[maphash.String(l.seed, key)%uint64(len(l.shards))]
+	now := l.options.Clock()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.evictIdle(now.Add(-l.options.IdleTimeout))
+
+	if element, ok := shard.entries[key]; ok {
+		entry := element.Value.(*keyedEntry)
+		entry.lastSeen = now
+		shard.order.MoveToFront(element)
+		return entry.limiter
+	}
+
+	if len(shard.entries) >= shard.maxKeys {
+		shard.remove(shard.order.Back())
+	}
+	entry := &keyedEntry{key: key, limiter: l.options.NewLimiter(), lastSeen: now}
+	shard.entries[key] = shard.order.PushFront(entry)
+	return entry.limiter
+}
+
+// Len returns the number of keys currently tracked
+func (l *KeyedLimiter) Len() int {
+	total := 0
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		total += len(shard.entries)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// evictIdle removes the keys last seen before cutoff. Since keys are kept in
+// order of use, it stops at the first recent one. The caller must hold s.mu.
+func (s *keyedShard) evictIdle(cutoff time.Time) {
+	for element := s.order.Back(); element != nil; element = s.order.Back() {
+		if element.Value.(*keyedEntry).lastSeen.After(cutoff) {
+			return
+		}
+		s.remove(element)
+	}
+}
+
+// remove forgets a key. The caller must hold s.mu.
+func (s *keyedShard) remove(element *list.Element) {
+	entry := s.order.Remove(element).(*keyedEntry)
+	delete(s.entries, entry.key)
+}
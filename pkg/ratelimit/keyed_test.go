@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestKeyed creates a keyed limiter allowing one request per key
+func newTestKeyed(maxKeys, shards int, clock *fakeClock) *KeyedLimiter {
+	return NewKeyedLimiter(KeyedOptions{
+		NewLimiter: func() Allower {
+			return NewTokenBucketWithClock(0, 1, clock.Now)
+		},
+		MaxKeys:     maxKeys,
+		IdleTimeout: time.Minute,
+		Shards:      shards,
+		Clock:       clock.Now,
+	})
+}
+
+func TestKeyedLimiterSeparatesKeys(t *testing.T) {
+	limiter := newTestKeyed(100, 4, newFakeClock())
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := limiter.AllowKey(key); err != nil {
+			t.Errorf("AllowKey(%s) first request = %v, want nil", key, err)
+		}
+		if _, err := limiter.AllowKey(key); err != ErrRateLimitExceeded {
+			t.Errorf("AllowKey(%s) second request = %v, want %v", key, err, ErrRateLimitExceeded)
+		}
+	}
+	if n := limiter.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+}
+
+func TestKeyedLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	// A single shard makes the eviction order predictable
+	limiter := newTestKeyed(2, 1, newFakeClock())
+
+	limiter.AllowKey("a")
+	limiter.AllowKey("b")
+	limiter.AllowKey("a") // a is now more recently used than b
+	limiter.AllowKey("c") // evicts b
+
+	if n := limiter.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	if _, err := limiter.AllowKey("a"); err != ErrRateLimitExceeded {
+		t.Errorf("AllowKey(a) = %v, want a remembered key to stay limited", err)
+	}
+	if _, err := limiter.AllowKey("b"); err != nil {
+		t.Errorf("AllowKey(b) = %v, want an evicted key to start over", err)
+	}
+}
+
+func TestKeyedLimiterEvictsIdleKeys(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTestKeyed(100, 1, clock)
+
+	limiter.AllowKey("idle")
+	clock.Advance(30 * time.Second)
+	limiter.AllowKey("active")
+	clock.Advance(31 * time.Second)
+	limiter.AllowKey("active")
+
+	if n := limiter.Len(); n != 1 {
+		t.Errorf("Len() = %d, want the idle key evicted", n)
+	}
+	if _, err := limiter.AllowKey("idle"); err != nil {
+		t.Errorf("AllowKey(idle) = %v, want an evicted key to start over", err)
+	}
+}
+
+func TestKeyedLimiterMemoryCap(t *testing.T) {
+	limiter := newTestKeyed(1000, 0, newFakeClock())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				limiter.AllowKey(fmt.Sprintf("%d-%d", g, i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := limiter.Len(); n > 1000 {
+		t.Errorf("Len() = %d, want at most 1000", n)
+	}
+}
+
+func TestKeyedLimiterSmallCap(t *testing.T) {
+	// A cap below the shard count still holds
+	limiter := newTestKeyed(3, 0, newFakeClock())
+	for i := 0; i < 100; i++ {
+		limiter.AllowKey(fmt.Sprint(i))
+	}
+	if n := limiter.Len(); n > 3 {
+		t.Errorf("Len() = %d, want at most 3", n)
+	}
+}
+
+func TestKeyedLimiterRefund(t *testing.T) {
+	limiter := NewKeyedLimiter(KeyedOptions{NewLimiter: func() Allower { return NewTokenBucket(1, 2) }})
+	limiter.AllowKeyN("a", 2)
+	limiter.AllowKeyN("b", 2)
+	RefundKeyN(limiter, "a", 1)
+	if _, err := limiter.AllowKey("a"); err != nil {
+		t.Errorf("AllowKey(a) after a refund = %v, want nil", err)
+	}
+	if _, err := limiter.AllowKey("b"); err != ErrRateLimitExceeded {
+		t.Errorf("AllowKey(b) = %v, want %v", err, ErrRateLimitExceeded)
+	}
+}
@@ -0,0 +1,328 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrQuotaExceeded is returned when an API key used up its daily or
+	// monthly quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrUnknownAPIKey is returned for an API key missing from the quota file
+	ErrUnknownAPIKey = errors.New("unknown API key")
+)
+
+// QuotaPlan is a tier of service assigned to API keys
+type QuotaPlan struct {
+	Name string
+
+	// Rate is the number of requests allowed per second on average, and
+	// Burst the number allowed at once
+	Rate  int
+	Burst int
+
+	// Daily and Monthly cap the requests of each key per UTC calendar day
+	// and month, zero for no cap
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaKey is an API key and the plan assigned to it
+type QuotaKey struct {
+	Plan *QuotaPlan
+
+	// Owner names the team using the key, for reporting
+	Owner string
+}
+
+// Quotas holds the plans and API keys of a quota file
+type Quotas struct {
+	Plans map[string]*QuotaPlan
+	Keys  map[string]QuotaKey
+}
+
+// LoadQuotaFile reads plans and API keys from a quota file.
+//
+// The quota file is a CSV file with two kinds of lines, in any order:
+//
+//	plan,<name>,<rate>,<burst>,<daily>,<monthly>
+//	key,<api key>,<plan>[,<owner>]
+//
+// where a daily or monthly cap of 0 means no cap. Lines starting with '#' are
+// ignored.
+func LoadQuotaFile(path string) (*Quotas, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening quota file: %v", err)
+	}
+	defer file.Close()
+	return ParseQuotas(file, path)
+}
+
+// ParseQuotas reads plans and API keys in the quota file format from r. Name
+// identifies r in error messages.
+func ParseQuotas(r io.Reader, name string) (*Quotas, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	quotas := &Quotas{Plans: make(map[string]*QuotaPlan), Keys: make(map[string]QuotaKey)}
+	// Keys are resolved once every plan is known
+	type keyLine struct {
+		line             int
+		key, plan, owner string
+	}
+	var keys []keyLine
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading quota file: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		switch record[0] {
+		case "plan":
+			plan, err := parseQuotaPlan(record)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+			if _, ok := quotas.Plans[plan.Name]; ok {
+				return nil, fmt.Errorf("%s:%d: duplicate plan %q", name, line, plan.Name)
+			}
+			quotas.Plans[plan.Name] = plan
+		case "key":
+			if len(record) < 3 || len(record) > 4 || record[1] == "" {
+				return nil, fmt.Errorf("%s:%d: expected key,<api key>,<plan>[,<owner>]", name, line)
+			}
+			entry := keyLine{line: line, key: record[1], plan: record[2]}
+			if len(record) > 3 {
+				entry.owner = record[3]
+			}
+			keys = append(keys, entry)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown line type %q, expected plan or key", name, line, record[0])
+		}
+	}
+
+	for _, entry := range keys {
+		plan, ok := quotas.Plans[entry.plan]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown plan %q", name, entry.line, entry.plan)
+		}
+		if _, ok := quotas.Keys[entry.key]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate API key", name, entry.line)
+		}
+		quotas.Keys[entry.key] = QuotaKey{Plan: plan, Owner: entry.owner}
+	}
+	return quotas, nil
+}
+
+// parseQuotaPlan parses a plan line
+func parseQuotaPlan(record []string) (*QuotaPlan, error) {
+	if len(record) != 6 || record[1] == "" {
+		return nil, fmt.Errorf("expected plan,<name>,<rate>,<burst>,<daily>,<monthly>")
+	}
+	plan := &QuotaPlan{Name: record[1]}
+	var err error
+	if plan.Rate, err = strconv.Atoi(record[2]); err != nil || plan.Rate < 0 {
+		return nil, fmt.Errorf("invalid rate %q", record[2])
+	}
+	if plan.Burst, err = strconv.Atoi(record[3]); err != nil || plan.Burst < 1 {
+		return nil, fmt.Errorf("invalid burst %q", record[3])
+	}
+	if plan.Daily, err = strconv.ParseInt(record[4], 10, 64); err != nil || plan.Daily < 0 {
+		return nil, fmt.Errorf("invalid daily cap %q", record[4])
+	}
+	if plan.Monthly, err = strconv.ParseInt(record[5], 10, 64); err != nil || plan.Monthly < 0 {
+		return nil, fmt.Errorf("invalid monthly cap %q", record[5])
+	}
+	return plan, nil
+}
+
+// UsageCounter counts the requests of one API key in one quota period
+type UsageCounter struct {
+	// Key identifies the API key and the period
+	Key string
+
+	// Limit is the cap of the period, zero for no cap
+	Limit int64
+
+	// Expires is the end of the period, after which the count is dropped
+	Expires time.Time
+}
+
+// UsageStore keeps the request counts of API keys so they survive restarts
+type UsageStore interface {
+	// Take counts a request costing n requests in every counter, unless it
+	// would take one of them over its limit, and returns the counts including
+	// the request
+	Take(counters []UsageCounter, n int64) (counts []int64, allowed bool, err error)
+
+	// Counts returns the counts without changing them
+	Counts(counters []UsageCounter) ([]int64, error)
+}
+
+// PeriodUsage is the consumption of an API key in a quota period
+type PeriodUsage struct {
+	Used  int64
+	Limit int64 // zero for no cap
+
+	// ResetsAt is when the period ends and the count starts over
+	ResetsAt time.Time
+}
+
+// Usage is the plan and consumption of an API key
+type Usage struct {
+	Plan    *QuotaPlan
+	Owner   string
+	Daily   PeriodUsage
+	Monthly PeriodUsage
+}
+
+// QuotaLimiter enforces the plan of each API key: a per-second rate limit
+// kept in memory, and daily and monthly caps counted in a UsageStore
+type QuotaLimiter struct {
+	quotas   *Quotas
+	store    UsageStore
+	limiters map[string]Allower
+	now      Clock
+}
+
+// NewQuotaLimiter creates a limiter enforcing quotas with counts kept in store
+func NewQuotaLimiter(quotas *Quotas, store UsageStore) *QuotaLimiter {
+	return NewQuotaLimiterWithClock(quotas, store, time.Now)
+}
+
+// NewQuotaLimiterWithClock creates a quota limiter that reads the time from
+// clock
+func NewQuotaLimiterWithClock(quotas *Quotas, store UsageStore, clock Clock) *QuotaLimiter {
+	limiters := make(map[string]Allower, len(quotas.Keys))
+	for apiKey, key := range quotas.Keys {
+		limiters[apiKey] = NewTokenBucketWithClock(key.Plan.Rate, key.Plan.Burst, clock)
+	}
+	return &QuotaLimiter{quotas: quotas, store: store, limiters: limiters, now: clock}
+}
+
+// Known reports whether apiKey is assigned a plan in the quota file
+func (q *QuotaLimiter) Known(apiKey string) bool {
+	_, ok := q.quotas.Keys[apiKey]
+	return ok
+}
+
+// AllowKey checks a request of apiKey against the rate of its plan, then
+// counts it against its daily and monthly caps. The result describes the
+// limit with the fewest requests remaining.
+func (q *QuotaLimiter) AllowKey(apiKey string) (Result, error) {
+	return q.AllowKeyN(apiKey, 1)
+}
+
+// AllowKeyN checks a request of apiKey costing n requests like AllowKey. A
+// request costing more than the burst of the plan or its daily or monthly cap
+// is never allowed and is rejected with a *CostError.
+func (q *QuotaLimiter) AllowKeyN(apiKey string, n int) (Result, error) {
+	key, ok := q.quotas.Keys[apiKey]
+	if !ok {
+		return Result{}, ErrUnknownAPIKey
+	}
+	now := q.now()
+	cost := int64(max(n, 1))
+	counters := quotaCounters(apiKey, key.Plan, now)
+	for _, counter := range counters {
+		if counter.Limit > 0 && cost > counter.Limit {
+			return Result{}, &CostError{Cost: int(cost), Limit: int(counter.Limit)}
+		}
+	}
+	limiter := q.limiters[apiKey]
+	result, err := AllowN(limiter, n)
+	if err != nil {
+		return result, err
+	}
+
+	counts, allowed, err := q.store.Take(counters, cost)
+	if err != nil {
+		// Nor was it used by a request whose caps could not be checked
+		RefundN(limiter, n)
+		return Result{}, err
+	}
+	if !allowed {
+		// The rate was not used by a request the caps reject
+		RefundN(limiter, n)
+	}
+
+	var exceeded Result
+	for i, counter := range counters {
+		if counter.Limit == 0 {
+			continue
+		}
+		period := Result{
+			Limit:     int(counter.Limit),
+			Remaining: int(max(0, counter.Limit-counts[i])),
+			Reset:     counter.Expires.Sub(now),
+		}
+		// A request over several caps waits for the last one to reset
+		if !allowed && counts[i]+cost > counter.Limit && period.Reset > exceeded.RetryAfter {
+			exceeded = period
+			exceeded.RetryAfter = period.Reset
+		}
+		// On a tie the limit taking longer to reset is the one that matters
+		if period.Remaining < result.Remaining || period.Remaining == result.Remaining && period.Reset > result.Reset {
+			result = period
+		}
+	}
+	if !allowed {
+		return exceeded, ErrQuotaExceeded
+	}
+	return result, nil
+}
+
+// Usage returns the plan and consumption of apiKey
+func (q *QuotaLimiter) Usage(apiKey string) (Usage, error) {
+	key, ok := q.quotas.Keys[apiKey]
+	if !ok {
+		return Usage{}, ErrUnknownAPIKey
+	}
+	counters := quotaCounters(apiKey, key.Plan, q.now())
+	counts, err := q.store.Counts(counters)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		Plan:    key.Plan,
+		Owner:   key.Owner,
+		Daily:   PeriodUsage{Used: counts[0], Limit: counters[0].Limit, ResetsAt: counters[0].Expires},
+		Monthly: PeriodUsage{Used: counts[1], Limit: counters[1].Limit, ResetsAt: counters[1].Expires},
+	}, nil
+}
+
+// quotaCounters returns the daily and monthly counters of apiKey at now. The
+// API key is stored hashed, so the usage store holds no credentials.
+func quotaCounters(apiKey string, plan *QuotaPlan, now time.Time) []UsageCounter {
+	sum := sha256.Sum256([]byte(apiKey))
+	id := hex.EncodeToString(sum[:8])
+
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []UsageCounter{
+		{Key: id + ":day:" + day.Format("2006-01-02"), Limit: plan.Daily, Expires: day.AddDate(0, 0, 1)},
+		{Key: id + ":month:" + month.Format("2006-01"), Limit: plan.Monthly, Expires: month.AddDate(0, 1, 0)},
+	}
+}
@@ -0,0 +1,296 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ip2country-api/pkg/fileutil"
+)
+
+// FileUsageStore keeps usage counts in memory and saves them to a JSON file
+// on an interval and when closed, so they survive restarts. Counts made since
+// the last save are lost if the process crashes. Each process has its own
+// counts, use a RedisUsageStore to share them between replicas.
+type FileUsageStore struct {
+	path string
+	now  Clock
+
+	counts map[string]*fileUsage
+	dirty  bool
+	mu     sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// fileUsage is a count as saved in the usage file
+type fileUsage struct {
+	Count   int64     `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewFileUsageStore creates a store saved at path, loading the counts saved
+// there by a previous run if the file exists. When saveInterval is positive
+// the counts are saved on that interval.
+func NewFileUsageStore(path string, saveInterval time.Duration) (*FileUsageStore, error) {
+	store := &FileUsageStore{
+		path:   path,
+		now:    time.Now,
+		counts: make(map[string]*fileUsage),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	content, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("error reading usage file: %v", err)
+	default:
+		if err := json.Unmarshal(content, &store.counts); err != nil {
+			return nil, fmt.Errorf("error reading usage file %s: %v", path, err)
+		}
+	}
+
+	if saveInterval > 0 {
+		go store.saveEvery(saveInterval)
+	} else {
+		close(store.done)
+	}
+	return store, nil
+}
+
+// Take counts a request costing n in every counter unless it would take one
+// of them over its limit
+func (s *FileUsageStore) Take(counters []UsageCounter, n int64) ([]int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]int64, len(counters))
+	allowed := true
+	for i, counter := range counters {
+		if usage, ok := s.counts[counter.Key]; ok {
+			counts[i] = usage.Count
+		}
+		if counter.Limit > 0 && counts[i]+n > counter.Limit {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return counts, false, nil
+	}
+
+	for i, counter := range counters {
+		usage, ok := s.counts[counter.Key]
+		if !ok {
+			usage = &fileUsage{Expires: counter.Expires}
+			s.counts[counter.Key] = usage
+		}
+		usage.Count += n
+		counts[i] = usage.Count
+	}
+	s.dirty = true
+	return counts, true, nil
+}
+
+// Counts returns the counts of counters
+func (s *FileUsageStore) Counts(counters []UsageCounter) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]int64, len(counters))
+	for i, counter := range counters {
+		if usage, ok := s.counts[counter.Key]; ok {
+			counts[i] = usage.Count
+		}
+	}
+	return counts, nil
+}
+
+// Save writes the counts to the usage file if they changed, dropping the
+// counts of periods that ended
+func (s *FileUsageStore) Save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	now := s.now()
+	for key, usage := range s.counts {
+		if !now.Before(usage.Expires) {
+			delete(s.counts, key)
+		}
+	}
+	content, err := json.Marshal(s.counts)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding usage: %v", err)
+	}
+
+	if err := fileutil.WriteFileAtomic(s.path, content); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveEvery saves the counts on an interval until the store is closed. A
+// failed save is logged and retried on the next interval.
+func (s *FileUsageStore) saveEvery(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Printf("ratelimit: failed to save usage: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops saving on an interval and saves the counts one last time
+func (s *FileUsageStore) Close() error {
+	s.closeOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return s.Save()
+}
+
+// quotaScript counts a request costing several requests in every counter
+// atomically, unless it would take one of them over its limit. Each key
+// expires at the end of its period. It returns whether the request is allowed
+// followed by the counts.
+//
+// KEYS the counters, ARGV[i] the limit of KEYS[i] or 0 for no limit,
+// ARGV[#KEYS+i] its expiry in Unix milliseconds, ARGV[2*#KEYS+1] the cost of
+// the request
+const quotaScript = `
+local n = #KEYS
+local cost = tonumber(ARGV[2 * n + 1])
+local counts = {}
+local allowed = 1
+for i = 1, n do
+  counts[i] = tonumber(redis.call('GET', KEYS[i]) or 0)
+  local limit = tonumber(ARGV[i])
+  if limit > 0 and counts[i] + cost > limit then
+    allowed = 0
+  end
+end
+if allowed == 1 then
+  for i = 1, n do
+    counts[i] = redis.call('INCRBY', KEYS[i], cost)
+    redis.call('PEXPIREAT', KEYS[i], ARGV[n + i])
+  end
+end
+table.insert(counts, 1, allowed)
+return counts
+`
+
+var quota = newRedisScript(quotaScript)
+
+// RedisUsageStore keeps usage counts in Redis, shared by every replica
+// connected to the same server
+type RedisUsageStore struct {
+	client *RedisClient
+	prefix string
+
+	// failOpen allows requests when Redis cannot be reached, otherwise they
+	// are rejected with ErrLimiterUnavailable
+	failOpen bool
+	failing  atomic.Bool
+}
+
+// NewRedisUsageStore creates a store keeping counts under prefix in Redis
+func NewRedisUsageStore(client *RedisClient, prefix string, failOpen bool) *RedisUsageStore {
+	return &RedisUsageStore{client: client, prefix: prefix, failOpen: failOpen}
+}
+
+// Take counts a request costing n in every counter unless it would take one
+// of them over its limit
+func (s *RedisUsageStore) Take(counters []UsageCounter, n int64) ([]int64, bool, error) {
+	keys := make([]string, len(counters))
+	args := make([]string, 2*len(counters)+1)
+	for i, counter := range counters {
+		keys[i] = s.prefix + counter.Key
+		args[i] = strconv.FormatInt(counter.Limit, 10)
+		args[len(counters)+i] = strconv.FormatInt(counter.Expires.UnixMilli(), 10)
+	}
+	args[2*len(counters)] = strconv.FormatInt(n, 10)
+
+	reply, err := quota.run(s.client, keys, args...)
+	var counts []int64
+	if err == nil {
+		counts, err = redisIntegers(reply, len(counters)+1)
+	}
+	if err != nil {
+		if !s.failing.Swap(true) {
+			log.Printf("ratelimit: redis unavailable for usage counts, failing %s: %v", failPolicy(s.failOpen), err)
+		}
+		if s.failOpen {
+			return make([]int64, len(counters)), true, nil
+		}
+		return nil, false, ErrLimiterUnavailable
+	}
+	if s.failing.Swap(false) {
+		log.Printf("ratelimit: redis available again for usage counts")
+	}
+	return counts[1:], counts[0] == 1, nil
+}
+
+// Counts returns the counts of counters
+func (s *RedisUsageStore) Counts(counters []UsageCounter) ([]int64, error) {
+	command := []string{"MGET"}
+	for _, counter := range counters {
+		command = append(command, s.prefix+counter.Key)
+	}
+	reply, err := s.client.Do(command...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != len(counters) {
+		return nil, fmt.Errorf("unexpected MGET reply %v", reply)
+	}
+	counts := make([]int64, len(items))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		value, _ := item.(string)
+		if counts[i], err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected MGET reply %v", reply)
+		}
+	}
+	return counts, nil
+}
+
+// redisIntegers converts an array reply of n integers
+func redisIntegers(reply any, n int) ([]int64, error) {
+	items, ok := reply.([]any)
+	if !ok || len(items) != n {
+		return nil, fmt.Errorf("unexpected script reply %v", reply)
+	}
+	values := make([]int64, n)
+	for i, item := range items {
+		if values[i], ok = item.(int64); !ok {
+			return nil, fmt.Errorf("unexpected script reply %v", reply)
+		}
+	}
+	return values, nil
+}
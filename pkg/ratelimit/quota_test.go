@@ -0,0 +1,307 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testQuotaFile = `# name, rate, burst, daily, monthly
+plan,free,2,2,3,5
+plan,partner,100,100,0,0
+
+key,free-key,free,web
+key,partner-key,partner,search-team
+`
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas(strings.NewReader(testQuotaFile), "quotas.csv")
+	if err != nil {
+		t.Fatalf("ParseQuotas() failed: %v", err)
+	}
+	if len(quotas.Plans) != 2 || len(quotas.Keys) != 2 {
+		t.Fatalf("ParseQuotas() = %d plans and %d keys, want 2 and 2", len(quotas.Plans), len(quotas.Keys))
+	}
+	free := quotas.Keys["free-key"]
+	expected := QuotaPlan{Name: "free", Rate: 2, Burst: 2, Daily: 3, Monthly: 5}
+	if *free.Plan != expected || free.Owner != "web" {
+		t.Errorf("free-key = %+v owned by %q, want %+v owned by web", *free.Plan, free.Owner, expected)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{name: "Unknown line type", content: "user,alice,free\n", message: `quotas.csv:1: unknown line type "user"`},
+		{name: "Missing plan columns", content: "plan,free,2,2,3\n", message: "quotas.csv:1: expected plan"},
+		{name: "Invalid rate", content: "plan,free,fast,2,3,5\n", message: `invalid rate "fast"`},
+		{name: "Zero burst", content: "plan,free,2,0,3,5\n", message: `invalid burst "0"`},
+		{name: "Negative cap", content: "plan,free,2,2,-1,5\n", message: `invalid daily cap "-1"`},
+		{name: "Duplicate plan", content: "plan,free,2,2,3,5\nplan,free,1,1,1,1\n", message: `quotas.csv:2: duplicate plan "free"`},
+		{name: "Unknown plan", content: "key,alice-key,gold\n", message: `quotas.csv:1: unknown plan "gold"`},
+		{name: "Duplicate key", content: "plan,free,2,2,3,5\nkey,k,free\nkey,k,free\n", message: "quotas.csv:3: duplicate API key"},
+		{name: "Missing key plan", content: "key,alice-key\n", message: "quotas.csv:1: expected key"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseQuotas(strings.NewReader(tc.content), "quotas.csv")
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Errorf("ParseQuotas() error = %v, want it to contain %q", err, tc.message)
+			}
+		})
+	}
+}
+
+func newTestQuotaLimiter(t *testing.T, store UsageStore, clock *fakeClock) *QuotaLimiter {
+	quotas, err := ParseQuotas(strings.NewReader(testQuotaFile), "quotas.csv")
+	if err != nil {
+		t.Fatalf("ParseQuotas() failed: %v", err)
+	}
+	return NewQuotaLimiterWithClock(quotas, store, clock.Now)
+}
+
+func TestQuotaLimiter(t *testing.T) {
+	store, err := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.json"), 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	clock := newFakeClock() // midnight on January 1st
+	limiter := newTestQuotaLimiter(t, store, clock)
+
+	// The free plan allows 2 requests per second, 3 per day and 5 per month
+	steps := []struct {
+		advance  time.Duration
+		expected error
+	}{
+		{0, nil},
+		{0, nil},
+		{0, ErrRateLimitExceeded},
+		{time.Second, nil},
+		{time.Second, ErrQuotaExceeded}, // daily cap
+		{24 * time.Hour, nil},
+		{time.Second, nil},
+		{time.Second, ErrQuotaExceeded}, // monthly cap
+		{31 * 24 * time.Hour, nil},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if _, err := limiter.AllowKey("free-key"); err != step.expected {
+			t.Errorf("request %d: AllowKey() = %v, want %v", i, err, step.expected)
+		}
+	}
+
+	if _, err := limiter.AllowKey("stolen-key"); err != ErrUnknownAPIKey {
+		t.Errorf("AllowKey(stolen-key) = %v, want %v", err, ErrUnknownAPIKey)
+	}
+	// Plans without caps are only rate limited
+	for i := 0; i < 100; i++ {
+		if _, err := limiter.AllowKey("partner-key"); err != nil {
+			t.Fatalf("AllowKey(partner-key) request %d = %v, want nil", i, err)
+		}
+	}
+}
+
+func TestQuotaLimiterResult(t *testing.T) {
+	store, err := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.json"), 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	clock := newFakeClock()
+	clock.Advance(12 * time.Hour)
+	limiter := newTestQuotaLimiter(t, store, clock)
+
+	// The rate limit has the fewest requests remaining
+	result, err := limiter.AllowKey("free-key")
+	expected := Result{Limit: 2, Remaining: 1, Reset: 500 * time.Millisecond}
+	if err != nil || result != expected {
+		t.Errorf("first request = %+v, %v, want %+v, nil", result, err, expected)
+	}
+
+	// Then the daily cap
+	clock.Advance(time.Second)
+	limiter.AllowKey("free-key")
+	result, err = limiter.AllowKey("free-key")
+	expected = Result{Limit: 3, Remaining: 0, Reset: 12*time.Hour - time.Second}
+	if err != nil || result != expected {
+		t.Errorf("third request = %+v, %v, want %+v, nil", result, err, expected)
+	}
+
+	// Rejected requests wait until midnight
+	clock.Advance(time.Second)
+	result, err = limiter.AllowKey("free-key")
+	expected = Result{Limit: 3, Remaining: 0, Reset: 12*time.Hour - 2*time.Second, RetryAfter: 12*time.Hour - 2*time.Second}
+	if err != ErrQuotaExceeded || result != expected {
+		t.Errorf("fourth request = %+v, %v, want %+v, %v", result, err, expected, ErrQuotaExceeded)
+	}
+
+	usage, err := limiter.Usage("free-key")
+	if err != nil {
+		t.Fatalf("Usage() failed: %v", err)
+	}
+	midnight := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	if usage.Plan.Name != "free" || usage.Owner != "web" ||
+		usage.Daily != (PeriodUsage{Used: 3, Limit: 3, ResetsAt: midnight}) ||
+		usage.Monthly != (PeriodUsage{Used: 3, Limit: 5, ResetsAt: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)}) {
+		t.Errorf("Usage() = %+v", usage)
+	}
+}
+
+func TestQuotaLimiterCost(t *testing.T) {
+	store, err := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.json"), 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	clock := newFakeClock()
+	limiter := newTestQuotaLimiter(t, store, clock)
+
+	if _, err := limiter.AllowKeyN("free-key", 2); err != nil {
+		t.Fatalf("AllowKeyN(2) = %v, want nil", err)
+	}
+	// 2 more requests would go over the daily cap of 3
+	clock.Advance(time.Second)
+	if _, err := limiter.AllowKeyN("free-key", 2); err != ErrQuotaExceeded {
+		t.Errorf("AllowKeyN(2) over the daily cap = %v, want %v", err, ErrQuotaExceeded)
+	}
+	// The rejected request gave back the rate it took
+	result, err := limiter.AllowKey("free-key")
+	if err != nil || result.Remaining != 0 || result.Limit != 3 {
+		t.Errorf("AllowKey() after a rejected cost = %+v, %v, want the last request of the day", result, err)
+	}
+
+	// A request costing more than the daily cap is never allowed
+	clock.Advance(24 * time.Hour)
+	var costErr *CostError
+	if _, err := limiter.AllowKeyN("free-key", 4); !errors.As(err, &costErr) || costErr.Limit != 3 {
+		t.Errorf("AllowKeyN(4) = %v, want a cost over the daily cap of 3", err)
+	}
+	usage, err := limiter.Usage("free-key")
+	if err != nil || usage.Daily.Used != 0 || usage.Monthly.Used != 3 {
+		t.Errorf("Usage() = %+v, %v, want 0 requests used today and 3 this month", usage, err)
+	}
+}
+
+// failingUsageStore fails to count requests while err is set
+type failingUsageStore struct {
+	UsageStore
+	err error
+}
+
+func (s *failingUsageStore) Take(counters []UsageCounter, n int64) ([]int64, bool, error) {
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	return s.UsageStore.Take(counters, n)
+}
+
+func TestQuotaLimiterStoreError(t *testing.T) {
+	fileStore, err := NewFileUsageStore(filepath.Join(t.TempDir(), "usage.json"), 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	store := &failingUsageStore{UsageStore: fileStore, err: ErrLimiterUnavailable}
+	limiter := newTestQuotaLimiter(t, store, newFakeClock())
+	for range 3 {
+		if _, err := limiter.AllowKey("free-key"); err != ErrLimiterUnavailable {
+			t.Fatalf("AllowKey() with the store unavailable = %v, want %v", err, ErrLimiterUnavailable)
+		}
+	}
+
+	// The requests the store failed to count gave back the rate they took
+	store.err = nil
+	if result, err := limiter.AllowKeyN("free-key", 2); err != nil {
+		t.Errorf("AllowKeyN(2) once the store is back = %+v, %v, want the full burst", result, err)
+	}
+}
+
+func TestFileUsageStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	store, err := NewFileUsageStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed: %v", err)
+	}
+	now := time.Now()
+	counters := []UsageCounter{
+		{Key: "live", Limit: 10, Expires: now.Add(time.Hour)},
+		{Key: "ended", Limit: 10, Expires: now.Add(-time.Hour)},
+	}
+	for i := 0; i < 3; i++ {
+		if _, allowed, err := store.Take(counters, 1); err != nil || !allowed {
+			t.Fatalf("Take() = %v, %v, want allowed", allowed, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// A restarted store picks up the counts, without the ended period
+	store, err = NewFileUsageStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileUsageStore() failed on restart: %v", err)
+	}
+	counts, err := store.Counts(counters)
+	if err != nil || counts[0] != 3 || counts[1] != 0 {
+		t.Errorf("Counts() after restart = %v, %v, want [3 0]", counts, err)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileUsageStore(path, 0); err == nil {
+		t.Error("Expected error for a corrupt usage file, got nil")
+	}
+}
+
+func TestRedisUsageStore(t *testing.T) {
+	server := newFakeRedis(t)
+	client := NewRedisClient(server.addr(), time.Second)
+	defer client.Close()
+	clock := newFakeClock()
+
+	// Two replicas share the daily cap of 3
+	store := NewRedisUsageStore(client, "test:", false)
+	replicas := []*QuotaLimiter{newTestQuotaLimiter(t, store, clock), newTestQuotaLimiter(t, store, clock)}
+	allowed := 0
+	for i := 0; i < 6; i++ {
+		if _, err := replicas[i%2].AllowKey("free-key"); err == nil {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d requests across replicas, want the daily cap of 3", allowed)
+	}
+
+	usage, err := replicas[0].Usage("free-key")
+	if err != nil || usage.Daily.Used != 3 || usage.Monthly.Used != 3 {
+		t.Errorf("Usage() = %+v, %v, want 3 requests used", usage, err)
+	}
+}
+
+func TestRedisUsageStoreUnavailable(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client := NewRedisClient(addr, 50*time.Millisecond)
+	counters := []UsageCounter{{Key: "k", Limit: 1, Expires: time.Now().Add(time.Hour)}}
+	if _, allowed, err := NewRedisUsageStore(client, "", true).Take(counters, 1); err != nil || !allowed {
+		t.Errorf("fail open Take() = %v, %v, want allowed", allowed, err)
+	}
+	if _, _, err := NewRedisUsageStore(client, "", false).Take(counters, 1); err != ErrLimiterUnavailable {
+		t.Errorf("fail closed Take() = %v, want %v", err, ErrLimiterUnavailable)
+	}
+}
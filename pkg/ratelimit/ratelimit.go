@@ -8,28 +8,67 @@ import (
 
 var ErrRateLimitExceeded = errors.New("rate limit exceeded")
 
+// Result describes the state of a limit once a request was checked against
+// it, so clients can be told how to pace themselves
+type Result struct {
+	// Limit is the number of requests the limiter lets through at once, zero
+	// when the state of the limit is unknown
+	Limit int
+
+	// Remaining is the number of requests that would be allowed right now
+	Remaining int
+
+	// Reset is the time until the whole limit is available again
+	Reset time.Duration
+
+	// RetryAfter is the time until a rejected request would be allowed, zero
+	// for allowed requests
+	RetryAfter time.Duration
+}
+
+// Clock returns the current time. Limiters read the time through a Clock so
+// tests can control it instead of sleeping.
+type Clock func() time.Time
+
 // Limiter implements a simple rate limiter
 type Limiter struct {
 	requestsPerSecond int
 	window            time.Time
 	count             int
+	now               Clock
 	mu                sync.Mutex
 }
 
 // NewLimiter creates a new rate limiter with the specified requests per second
 func NewLimiter(requestsPerSecond int) *Limiter {
+	return NewLimiterWithClock(requestsPerSecond, time.Now)
+}
+
+// NewLimiterWithClock creates a new rate limiter that reads the time from clock
+func NewLimiterWithClock(requestsPerSecond int, clock Clock) *Limiter {
 	return &Limiter{
 		requestsPerSecond: requestsPerSecond,
-		window:            time.Now(),
+		window:            clock(),
+		now:               clock,
 	}
 }
 
 // Allow checks if a request is allowed under the rate limit
-func (l *Limiter) Allow() error {
+func (l *Limiter) Allow() (Result, error) {
+	return l.AllowN(1)
+}
+
+// AllowN checks if a request costing n requests is allowed under the rate
+// limit. A cost above the limit is rejected with a *CostError.
+func (l *Limiter) AllowN(n int) (Result, error) {
+	n, err := checkCost(n, l.requestsPerSecond)
+	if err != nil {
+		return Result{}, err
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	now := time.Now()
+	now := l.now()
 
 	// If more than a second has passed since the last window,
 	// reset the window and count
@@ -38,12 +77,27 @@ func (l *Limiter) Allow() error {
 		l.count = 0
 	}
 
+	// The count is reset when the window ends
+	result := Result{Limit: l.requestsPerSecond, Reset: l.window.Add(time.Second).Sub(now)}
+
 	// Check if the current request exceeds the limit
-	if l.count >= l.requestsPerSecond {
-		return ErrRateLimitExceeded
+	if l.count+n > l.requestsPerSecond {
+		result.Remaining = max(0, l.requestsPerSecond-l.count)
+		result.RetryAfter = result.Reset
+		return result, ErrRateLimitExceeded
 	}
 
 	// Increment the count and allow the request
-	l.count++
-	return nil
+	l.count += n
+	result.Remaining = l.requestsPerSecond - l.count
+	return result, nil
+}
+
+// RefundN uncounts a request costing n requests from the current window
+func (l *Limiter) RefundN(n int) {
+	n = max(n, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count = max(0, l.count-n)
 }
@@ -5,6 +5,34 @@ import (
 	"time"
 )
 
+// fakeClock is a manually advanced clock for deterministic tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// allowN calls Allow n times and returns how many requests were allowed
+func allowN(limiter Allower, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if _, err := limiter.Allow(); err == nil {
+			allowed++
+		}
+	}
+	return allowed
+}
+
 func TestNewLimiter(t *testing.T) {
 	// Test that NewLimiter initializes a limiter with the correct requestsPerSecond
 	requestsPerSecond := 100
@@ -39,14 +67,14 @@ func TestAllow(t *testing.T) {
 
 		// This should allow 'limit' requests
 		for i := 0; i < limit; i++ {
-			err := limiter.Allow()
+			_, err := limiter.Allow()
 			if err != nil {
 				t.Errorf("Allow() returned error on request %d of %d: %v", i+1, limit, err)
 			}
 		}
 
 		// The next request should be denied
-		err := limiter.Allow()
+		_, err := limiter.Allow()
 		if err == nil {
 			t.Error("Allow() did not return error after exceeding limit")
 		}
@@ -62,7 +90,7 @@ func TestAllow(t *testing.T) {
 
 		// Use up all allowed requests
 		for i := 0; i < limit; i++ {
-			err := limiter.Allow()
+			_, err := limiter.Allow()
 			if err != nil {
 				t.Errorf("Allow() returned error on request %d of %d: %v", i+1, limit, err)
 			}
@@ -73,7 +101,7 @@ func TestAllow(t *testing.T) {
 
 		// This should now allow another 'limit' requests
 		for i := 0; i < limit; i++ {
-			err := limiter.Allow()
+			_, err := limiter.Allow()
 			if err != nil {
 				t.Errorf("Allow() returned error on request %d of %d after reset: %v",
 					i+1, limit, err)
@@ -81,7 +109,7 @@ func TestAllow(t *testing.T) {
 		}
 
 		// The next request should be denied again
-		err := limiter.Allow()
+		_, err := limiter.Allow()
 		if err == nil {
 			t.Error("Allow() did not return error after exceeding limit after reset")
 		}
@@ -101,7 +129,7 @@ func TestAllowConcurrent(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		go func() {
 			for j := 0; j < 10; j++ {
-				err := limiter.Allow()
+				_, err := limiter.Allow()
 				if err == nil {
 					allowed <- true
 				}
@@ -137,3 +165,98 @@ outer:
 	}
 
 }
+
+func TestLimiterWindowBoundary(t *testing.T) {
+	// The fixed window lets twice the limit through around a window boundary
+	clock := newFakeClock()
+	limiter := NewLimiterWithClock(10, clock.Now)
+
+	clock.Advance(900 * time.Millisecond)
+	first := allowN(limiter, 10)
+	clock.Advance(200 * time.Millisecond)
+	second := allowN(limiter, 10)
+
+	if first != 10 || second != 10 {
+		t.Errorf("allowed %d then %d requests, expected 10 then 10", first, second)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		limiter     func(clock Clock) Allower
+		requests    int           // requests made up front
+		advance     time.Duration // time advanced before the checked request
+		expected    Result
+		expectedErr error
+	}{
+		{
+			name:     "Fixed window allowed",
+			limiter:  func(clock Clock) Allower { return NewLimiterWithClock(3, clock) },
+			requests: 1, advance: 400 * time.Millisecond,
+			expected: Result{Limit: 3, Remaining: 1, Reset: 600 * time.Millisecond},
+		},
+		{
+			name:     "Fixed window rejected",
+			limiter:  func(clock Clock) Allower { return NewLimiterWithClock(3, clock) },
+			requests: 3, advance: 400 * time.Millisecond,
+			expected:    Result{Limit: 3, Remaining: 0, Reset: 600 * time.Millisecond, RetryAfter: 600 * time.Millisecond},
+			expectedErr: ErrRateLimitExceeded,
+		},
+		{
+			name:     "Token bucket allowed",
+			limiter:  func(clock Clock) Allower { return NewTokenBucketWithClock(4, 5, clock) },
+			requests: 2,
+			expected: Result{Limit: 5, Remaining: 2, Reset: 750 * time.Millisecond},
+		},
+		{
+			name:     "Token bucket rejected",
+			limiter:  func(clock Clock) Allower { return NewTokenBucketWithClock(4, 5, clock) },
+			requests: 5, advance: 125 * time.Millisecond,
+			expected:    Result{Limit: 5, Remaining: 0, Reset: 1125 * time.Millisecond, RetryAfter: 125 * time.Millisecond},
+			expectedErr: ErrRateLimitExceeded,
+		},
+		{
+			name:     "Sliding log allowed",
+			limiter:  func(clock Clock) Allower { return NewSlidingWindowLogWithClock(2, time.Second, clock) },
+			requests: 1, advance: 300 * time.Millisecond,
+			expected: Result{Limit: 2, Remaining: 0, Reset: time.Second},
+		},
+		{
+			name:     "Sliding log rejected",
+			limiter:  func(clock Clock) Allower { return NewSlidingWindowLogWithClock(2, time.Second, clock) },
+			requests: 2, advance: 300 * time.Millisecond,
+			expected:    Result{Limit: 2, Remaining: 0, Reset: 700 * time.Millisecond, RetryAfter: 700 * time.Millisecond},
+			expectedErr: ErrRateLimitExceeded,
+		},
+		{
+			name:     "Sliding window allowed",
+			limiter:  func(clock Clock) Allower { return NewSlidingWindowCounterWithClock(4, time.Second, clock) },
+			requests: 1, advance: 1200 * time.Millisecond,
+			expected: Result{Limit: 4, Remaining: 2, Reset: 1800 * time.Millisecond},
+		},
+		{
+			name:     "Sliding window rejected",
+			limiter:  func(clock Clock) Allower { return NewSlidingWindowCounterWithClock(4, time.Second, clock) },
+			requests: 4, advance: 500 * time.Millisecond,
+			expected:    Result{Limit: 4, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond},
+			expectedErr: ErrRateLimitExceeded,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := tc.limiter(clock.Now)
+			allowN(limiter, tc.requests)
+			clock.Advance(tc.advance)
+			result, err := limiter.Allow()
+			if err != tc.expectedErr {
+				t.Errorf("Allow() error = %v, want %v", err, tc.expectedErr)
+			}
+			if result != tc.expected {
+				t.Errorf("Allow() = %+v, want %+v", result, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLimiterUnavailable is returned by a limiter that fails closed when its
+// shared state cannot be reached
+var ErrLimiterUnavailable = errors.New("rate limiter unavailable")
+
+// gcraScript implements the generic cell rate algorithm atomically in Redis.
+// A key stores the theoretical arrival time (TAT) of the next request in
+// microseconds: every allowed request moves it one emission interval later,
+// and a request is rejected when that would put it more than the burst
+// tolerance ahead of now. It reads the time from Redis so replicas with
+// skewed clocks share one timeline, and expires the key once the bucket is
+// full again. A request costing several requests moves the TAT by as many
+// intervals. It returns whether the request is allowed, the requests
+// remaining, the microseconds until a rejected request would be allowed and
+// the microseconds until the bucket is full.
+//
+// Writing after TIME relies on scripts being replicated by their effects,
+// the default since Redis 5 and the only mode since Redis 7, rather than by
+// running them again on replicas.
+//
+// KEYS[1] the key, ARGV[1] the emission interval in microseconds, ARGV[2] the
+// burst tolerance in microseconds, ARGV[3] the cost of the request
+const gcraScript = `
+local now = redis.call('TIME')
+local now_us = tonumber(now[1]) * 1000000 + tonumber(now[2])
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now_us)
+if tat < now_us then
+  tat = now_us
+end
+local new_tat = tat + interval * cost
+local allow_at = new_tat - tolerance
+if allow_at > now_us then
+  return {0, 0, allow_at - now_us, tat - now_us}
+end
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now_us) / 1000))
+return {1, math.floor((now_us + tolerance - new_tat) / interval), 0, new_tat - now_us}
+`
+
+// gcraRefundScript gives back what gcraScript charged a request by moving the
+// TAT as many intervals earlier, but not before now, and deletes the key once
+// the bucket is full again. Like gcraScript, it relies on effects
+// replication.
+//
+// KEYS[1] the key, ARGV[1] the emission interval in microseconds, ARGV[2] the
+// cost of the request
+const gcraRefundScript = `
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat then
+  return 0
+end
+local now = redis.call('TIME')
+local now_us = tonumber(now[1]) * 1000000 + tonumber(now[2])
+local new_tat = tat - tonumber(ARGV[1]) * tonumber(ARGV[2])
+if new_tat <= now_us then
+  redis.call('DEL', KEYS[1])
+else
+  redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now_us) / 1000))
+end
+return 1
+`
+
+// redisScript is a Lua script run by its SHA-1, so it is only sent to the
+// server when the server does not have it cached yet
+type redisScript struct {
+	source string
+	sha    string
+}
+
+func newRedisScript(source string) redisScript {
+	sum := sha1.Sum([]byte(source))
+	return redisScript{source: source, sha: hex.EncodeToString(sum[:])}
+}
+
+// run executes the script with keys and args, loading it with EVAL when the
+// server does not have it cached
+func (s redisScript) run(client *RedisClient, keys []string, args ...string) (any, error) {
+	command := append([]string{s.sha, strconv.Itoa(len(keys))}, keys...)
+	command = append(command, args...)
+	reply, err := client.Do(append([]string{"EVALSHA"}, command...)...)
+	var redisErr RedisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		command[0] = s.source
+		reply, err = client.Do(append([]string{"EVAL"}, command...)...)
+	}
+	return reply, err
+}
+
+var (
+	gcra       = newRedisScript(gcraScript)
+	gcraRefund = newRedisScript(gcraRefundScript)
+)
+
+// RedisLimiterOptions holds the settings of a RedisLimiter
+type RedisLimiterOptions struct {
+	// Prefix is prepended to every key stored in Redis
+	Prefix string
+
+	// Rate is the number of requests allowed per second on average, and
+	// Burst the number allowed at once
+	Rate  int
+	Burst int
+
+	// FailOpen allows requests when Redis cannot be reached. Otherwise they
+	// are rejected with ErrLimiterUnavailable.
+	FailOpen bool
+}
+
+// RedisLimiter shares a rate limit between every replica connected to the
+// same Redis server. It implements the generic cell rate algorithm, which
+// behaves like a token bucket with the given rate and burst, in a Lua script
+// so concurrent requests from all replicas are counted atomically.
+type RedisLimiter struct {
+	client  *RedisClient
+	options RedisLimiterOptions
+
+	// interval and tolerance are the GCRA parameters in microseconds
+	interval  string
+	tolerance string
+
+	// failing is set while Redis is unreachable, so the failure and the
+	// recovery are logged once instead of for every request
+	failing atomic.Bool
+}
+
+// NewRedisLimiter creates a limiter whose state lives in Redis
+func NewRedisLimiter(client *RedisClient, options RedisLimiterOptions) *RedisLimiter {
+	// A zero rate never refills, like a token bucket with a zero rate
+	interval := int64(time.Hour / time.Microsecond * 24 * 365)
+	if options.Rate > 0 {
+		interval = int64(time.Second/time.Microsecond) / int64(options.Rate)
+	}
+	return &RedisLimiter{
+		client:    client,
+		options:   options,
+		interval:  strconv.FormatInt(interval, 10),
+		tolerance: strconv.FormatInt(interval*int64(options.Burst), 10),
+	}
+}
+
+// Allow checks the request against the limit shared by all replicas
+func (l *RedisLimiter) Allow() (Result, error) {
+	return l.AllowKeyN("global", 1)
+}
+
+// AllowN checks a request costing n requests against the limit shared by all
+// replicas
+func (l *RedisLimiter) AllowN(n int) (Result, error) {
+	return l.AllowKeyN("global", n)
+}
+
+// AllowKey checks the request against the shared limit of key. While Redis
+// is unavailable the state of the limit is unknown and the Result is empty.
+func (l *RedisLimiter) AllowKey(key string) (Result, error) {
+	return l.AllowKeyN(key, 1)
+}
+
+// AllowKeyN checks a request costing n requests against the shared limit of
+// key. A cost above the burst is rejected with a *CostError without asking
+// Redis.
+func (l *RedisLimiter) AllowKeyN(key string, n int) (Result, error) {
+	n, err := checkCost(n, l.options.Burst)
+	if err != nil {
+		return Result{}, err
+	}
+	result, allowed, err := l.run(l.options.Prefix+key, strconv.Itoa(n))
+	if err != nil {
+		if !l.failing.Swap(true) {
+			log.Printf("ratelimit: redis unavailable, failing %s: %v", failPolicy(l.options.FailOpen), err)
+		}
+		if l.options.FailOpen {
+			return Result{}, nil
+		}
+		return Result{}, ErrLimiterUnavailable
+	}
+	if l.failing.Swap(false) {
+		log.Printf("ratelimit: redis available again")
+	}
+	if !allowed {
+		return result, ErrRateLimitExceeded
+	}
+	return result, nil
+}
+
+// RefundN gives back what the limit shared by all replicas charged a request
+// costing n
+func (l *RedisLimiter) RefundN(n int) {
+	l.RefundKeyN("global", n)
+}
+
+// RefundKeyN gives back what the shared limit of key charged a request
+// costing n. A refund failing while Redis is unavailable is dropped and the
+// request stays charged.
+func (l *RedisLimiter) RefundKeyN(key string, n int) {
+	cost := strconv.Itoa(max(n, 1))
+	gcraRefund.run(l.client, []string{l.options.Prefix + key}, l.interval, cost)
+}
+
+// failPolicy names the policy applied when Redis is unavailable for logging
+func failPolicy(failOpen bool) string {
+	if failOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// run executes the GCRA script for a request of key costing cost
+func (l *RedisLimiter) run(key, cost string) (Result, bool, error) {
+	reply, err := gcra.run(l.client, []string{key}, l.interval, l.tolerance, cost)
+	if err != nil {
+		return Result{}, false, err
+	}
+
+	values, err := redisIntegers(reply, 4)
+	if err != nil {
+		return Result{}, false, err
+	}
+	return Result{
+		Limit:      l.options.Burst,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		Reset:      time.Duration(values[3]) * time.Microsecond,
+	}, values[0] == 1, nil
+}
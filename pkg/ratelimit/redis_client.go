@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRedisTimeout bounds a single Redis command, including dialing
+const DefaultRedisTimeout = 100 * time.Millisecond
+
+// redisPoolSize is the number of idle connections kept for reuse
+const redisPoolSize = 16
+
+// RedisError is an error reply sent by the Redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// RedisClient is a minimal client of the Redis protocol (RESP), enough to run
+// the rate limiting scripts. It keeps a small pool of idle connections.
+type RedisClient struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient creates a client of the Redis server at addr. No connection
+// is made until the first command. A zero timeout takes DefaultRedisTimeout.
+func NewRedisClient(addr string, timeout time.Duration) *RedisClient {
+	if timeout <= 0 {
+		timeout = DefaultRedisTimeout
+	}
+	return &RedisClient{addr: addr, timeout: timeout, idle: make(chan *redisConn, redisPoolSize)}
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil, a
+// []any, or a RedisError returned as the error
+func (c *RedisClient) Do(args ...string) (any, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	conn.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	reply, err := conn.do(args)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be out of sync with the protocol
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// Close closes the idle connections
+func (c *RedisClient) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection or dials a new one
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// put returns a connection to the pool, or closes it when the pool is full
+func (c *RedisClient) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// do writes a command as an array of bulk strings and reads the reply
+func (c *redisConn) do(args []string) (any, error) {
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads one RESP reply
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", body)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", body)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			item, err := readRedisReply(r)
+			var redisErr RedisError
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = redisErr
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply type %q", kind)
+	}
+}
@@ -0,0 +1,457 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking enough RESP to run the rate
+// limiting scripts. It cannot run Lua, so it recognizes the scripts by their
+// SHA-1 and applies the same algorithms in Go, reading the time from clock the
+// way the script reads it from Redis.
+type fakeRedis struct {
+	listener net.Listener
+	clock    *fakeClock
+
+	mu       sync.Mutex
+	tats     map[string]int64 // theoretical arrival times in microseconds
+	counts   map[string]int64 // usage counts
+	scripts  map[string]bool  // SHA-1s loaded with EVAL
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &fakeRedis{
+		listener: listener,
+		clock:    newFakeClock(),
+		tats:     map[string]int64{},
+		counts:   map[string]int64{},
+		scripts:  map[string]bool{},
+	}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(reader)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, f.execute(args))
+	}
+}
+
+// readFakeCommand reads a command sent as an array of bulk strings
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readRedisReply(r)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected an array, got %v", reply)
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		args[i], _ = item.(string)
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) execute(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, strings.ToUpper(args[0]))
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "EVAL", "EVALSHA":
+		sha := args[1]
+		if strings.EqualFold(args[0], "EVAL") {
+			sha = newRedisScript(args[1]).sha
+			f.scripts[sha] = true
+		} else if !f.scripts[sha] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		numKeys, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+numKeys], args[3+numKeys:]
+		switch sha {
+		case gcra.sha:
+			return f.gcra(keys[0], argv[0], argv[1], argv[2])
+		case gcraRefund.sha:
+			return f.gcraRefund(keys[0], argv[0], argv[1])
+		case quota.sha:
+			return f.quota(keys, argv)
+		default:
+			return "-ERR unknown script\r\n"
+		}
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if count, ok := f.counts[key]; ok {
+				value := strconv.FormatInt(count, 10)
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// gcra mirrors gcraScript
+func (f *fakeRedis) gcra(key, intervalArg, toleranceArg, costArg string) string {
+	now := f.clock.Now().UnixMicro()
+	interval, _ := strconv.ParseInt(intervalArg, 10, 64)
+	tolerance, _ := strconv.ParseInt(toleranceArg, 10, 64)
+	cost, _ := strconv.ParseInt(costArg, 10, 64)
+
+	tat, ok := f.tats[key]
+	if !ok || tat < now {
+		tat = now
+	}
+	newTAT := tat + interval*cost
+	if allowAt := newTAT - tolerance; allowAt > now {
+		return fmt.Sprintf("*4\r\n:0\r\n:0\r\n:%d\r\n:%d\r\n", allowAt-now, tat-now)
+	}
+	f.tats[key] = newTAT
+	return fmt.Sprintf("*4\r\n:1\r\n:%d\r\n:0\r\n:%d\r\n", (now+tolerance-newTAT)/interval, newTAT-now)
+}
+
+// gcraRefund mirrors gcraRefundScript
+func (f *fakeRedis) gcraRefund(key, intervalArg, costArg string) string {
+	tat, ok := f.tats[key]
+	if !ok {
+		return ":0\r\n"
+	}
+	interval, _ := strconv.ParseInt(intervalArg, 10, 64)
+	cost, _ := strconv.ParseInt(costArg, 10, 64)
+	if newTAT := tat - interval*cost; newTAT <= f.clock.Now().UnixMicro() {
+		delete(f.tats, key)
+	} else {
+		f.tats[key] = newTAT
+	}
+	return ":1\r\n"
+}
+
+// quota mirrors quotaScript, without expiring keys
+func (f *fakeRedis) quota(keys, argv []string) string {
+	cost, _ := strconv.ParseInt(argv[2*len(keys)], 10, 64)
+	allowed := 1
+	for i, key := range keys {
+		limit, _ := strconv.ParseInt(argv[i], 10, 64)
+		if limit > 0 && f.counts[key]+cost > limit {
+			allowed = 0
+		}
+	}
+	reply := fmt.Sprintf("*%d\r\n:%d\r\n", len(keys)+1, allowed)
+	for _, key := range keys {
+		if allowed == 1 {
+			f.counts[key] += cost
+		}
+		reply += fmt.Sprintf(":%d\r\n", f.counts[key])
+	}
+	return reply
+}
+
+func TestRedisClientReplies(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	replies := "+OK\r\n-ERR broken\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*3\r\n:1\r\n$1\r\nx\r\n-ERR item\r\n"
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for range 6 {
+			if _, err := readFakeCommand(reader); err != nil {
+				return
+			}
+		}
+		io.WriteString(conn, replies)
+		// Keep the connection open until the client is done
+		reader.ReadByte()
+	}()
+
+	client := NewRedisClient(listener.Addr().String(), time.Second)
+	defer client.Close()
+
+	// Pipeline the commands on one connection so the replies arrive in order
+	conn, err := client.get()
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for range 6 {
+		fmt.Fprintf(conn.conn, "*1\r\n$4\r\nPING\r\n")
+	}
+	expected := []string{"OK", "error: ERR broken", "42", "hello", "<nil>", "[1 x ERR item]"}
+	for i, want := range expected {
+		reply, err := readRedisReply(conn.reader)
+		got := fmt.Sprint(reply)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != want {
+			t.Errorf("reply %d = %q, want %q", i, got, want)
+		}
+	}
+	conn.conn.Close()
+}
+
+func TestRedisLimiter(t *testing.T) {
+	server := newFakeRedis(t)
+	client := NewRedisClient(server.addr(), time.Second)
+	defer client.Close()
+
+	// Two replicas sharing the same Redis share the limit
+	options := RedisLimiterOptions{Prefix: "test:", Rate: 10, Burst: 5}
+	replicas := []*RedisLimiter{NewRedisLimiter(client, options), NewRedisLimiter(client, options)}
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if _, err := replicas[i%2].Allow(); err == nil {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("allowed %d requests across replicas, want the burst of 5", allowed)
+	}
+	expected := Result{Limit: 5, Remaining: 0, Reset: 500 * time.Millisecond, RetryAfter: 100 * time.Millisecond}
+	if result, err := replicas[0].Allow(); err != ErrRateLimitExceeded || result != expected {
+		t.Errorf("Allow() = %+v, %v, want %+v, %v", result, err, expected, ErrRateLimitExceeded)
+	}
+
+	// The bucket refills at the rate
+	server.clock.Advance(250 * time.Millisecond)
+	if got := allowN(replicas[0], 10); got != 2 {
+		t.Errorf("allowed %d requests after 250ms, want 2", got)
+	}
+
+	// Keys are limited separately
+	expected = Result{Limit: 5, Remaining: 4, Reset: 100 * time.Millisecond}
+	if result, err := replicas[0].AllowKey("client-a"); err != nil || result != expected {
+		t.Errorf("AllowKey(client-a) = %+v, %v, want %+v, nil", result, err, expected)
+	}
+
+	// A request can cost several
+	if result, err := replicas[0].AllowKeyN("batch", 3); err != nil || result.Remaining != 2 {
+		t.Errorf("AllowKeyN(batch, 3) = %+v, %v, want 2 remaining", result, err)
+	}
+	if result, err := replicas[1].AllowKeyN("batch", 3); err != ErrRateLimitExceeded || result.RetryAfter != 100*time.Millisecond {
+		t.Errorf("second AllowKeyN(batch, 3) = %+v, %v, want a 100ms retry and %v", result, err, ErrRateLimitExceeded)
+	}
+
+	// The script is loaded once, then run from the server's cache
+	server.mu.Lock()
+	commands := strings.Join(server.commands, " ")
+	server.mu.Unlock()
+	if !strings.HasPrefix(commands, "EVALSHA EVAL EVALSHA EVALSHA") || strings.Count(commands, "EVAL ") != 1 {
+		t.Errorf("commands = %s, want one EVAL after the first NOSCRIPT", commands)
+	}
+}
+
+func TestRedisLimiterRefund(t *testing.T) {
+	server := newFakeRedis(t)
+	client := NewRedisClient(server.addr(), time.Second)
+	defer client.Close()
+	limiter := NewRedisLimiter(client, RedisLimiterOptions{Prefix: "test:", Rate: 10, Burst: 5})
+
+	limiter.AllowKeyN("client", 4)
+	limiter.RefundKeyN("client", 3)
+	if result, err := limiter.AllowKeyN("client", 4); err != nil || result.Remaining != 0 {
+		t.Errorf("AllowKeyN(4) after a refund of 3 = %+v, %v, want 0 remaining", result, err)
+	}
+
+	// A full refund removes the key, and refunding an unknown key does nothing
+	limiter.RefundKeyN("client", 5)
+	limiter.RefundKeyN("unknown", 1)
+	server.mu.Lock()
+	_, exists := server.tats["test:client"]
+	server.mu.Unlock()
+	if exists {
+		t.Error("Expected the key of a full bucket to be deleted")
+	}
+	if got := allowN(limiter, 10); got != 5 {
+		t.Errorf("allowed %d requests after a full refund, want 5", got)
+	}
+}
+
+func TestRedisLimiterUnavailable(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	// Nothing listens on a closed listener's address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		expected error
+	}{
+		{name: "Fail open", failOpen: true, expected: nil},
+		{name: "Fail closed", failOpen: false, expected: ErrLimiterUnavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewRedisClient(addr, 50*time.Millisecond)
+			limiter := NewRedisLimiter(client, RedisLimiterOptions{Rate: 1, Burst: 1, FailOpen: tc.failOpen})
+			for i := 0; i < 3; i++ {
+				if _, err := limiter.Allow(); err != tc.expected {
+					t.Errorf("Allow() = %v, want %v", err, tc.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisLimiterTimeout(t *testing.T) {
+	// Temporarily disable logging to avoid polluting test output
+	oldLogger := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(oldLogger)
+
+	// A server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewRedisClient(listener.Addr().String(), 50*time.Millisecond)
+	limiter := NewRedisLimiter(client, RedisLimiterOptions{Rate: 1, Burst: 1})
+	start := time.Now()
+	if _, err := limiter.Allow(); err != ErrLimiterUnavailable {
+		t.Errorf("Allow() = %v, want %v", err, ErrLimiterUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Allow() took %v, want the command timeout", elapsed)
+	}
+}
+
+// newRealRedis connects to the Redis server at REDIS_ADDR, so the scripts
+// themselves run rather than their fakeRedis mirrors, and returns a key prefix
+// unique to the test. Every key written expires on its own. The test is
+// skipped when REDIS_ADDR is not set.
+func newRealRedis(t *testing.T) (*RedisClient, string) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	client := NewRedisClient(addr, time.Second)
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Do("PING"); err != nil {
+		t.Fatalf("Failed to reach Redis at %s: %v", addr, err)
+	}
+	return client, fmt.Sprintf("ip2country-test:%s:%d:", t.Name(), time.Now().UnixNano())
+}
+
+func TestRedisScriptsOnRedis(t *testing.T) {
+	client, prefix := newRealRedis(t)
+
+	// One request per second, so the bucket does not refill during the test
+	limiter := NewRedisLimiter(client, RedisLimiterOptions{Prefix: prefix, Rate: 1, Burst: 5})
+	if result, err := limiter.AllowKeyN("client", 3); err != nil || result.Remaining != 2 {
+		t.Errorf("AllowKeyN(3) = %+v, %v, want 2 remaining", result, err)
+	}
+	result, err := limiter.AllowKeyN("client", 3)
+	if err != ErrRateLimitExceeded || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("second AllowKeyN(3) = %+v, %v, want a retry within a second and %v", result, err, ErrRateLimitExceeded)
+	}
+
+	// A refund gives the tokens back, and a full refund removes the key
+	limiter.RefundKeyN("client", 3)
+	if result, err := limiter.AllowKeyN("client", 5); err != nil || result.Remaining != 0 {
+		t.Errorf("AllowKeyN(5) after a refund = %+v, %v, want 0 remaining", result, err)
+	}
+	limiter.RefundKeyN("client", 5)
+	if exists, err := client.Do("EXISTS", prefix+"client"); err != nil || exists != int64(0) {
+		t.Errorf("EXISTS after a full refund = %v, %v, want 0", exists, err)
+	}
+	limiter.RefundKeyN("unknown", 1)
+	if exists, err := client.Do("EXISTS", prefix+"unknown"); err != nil || exists != int64(0) {
+		t.Errorf("EXISTS after refunding an unknown key = %v, %v, want 0", exists, err)
+	}
+
+	// Quota counters count the cost against every limit and expire at the
+	// end of their period
+	store := NewRedisUsageStore(client, prefix, false)
+	expires := time.Now().Add(time.Minute)
+	counters := []UsageCounter{
+		{Key: "daily", Limit: 5, Expires: expires},
+		{Key: "monthly", Limit: 0, Expires: expires},
+	}
+	steps := []struct {
+		cost     int64
+		allowed  bool
+		expected []int64
+	}{
+		{cost: 3, allowed: true, expected: []int64{3, 3}},
+		{cost: 3, allowed: false, expected: []int64{3, 3}},
+		{cost: 2, allowed: true, expected: []int64{5, 5}},
+	}
+	for i, step := range steps {
+		counts, allowed, err := store.Take(counters, step.cost)
+		if err != nil || allowed != step.allowed || fmt.Sprint(counts) != fmt.Sprint(step.expected) {
+			t.Errorf("Take(%d) %d = %v, %v, %v, want %v, %v", step.cost, i, counts, allowed, err, step.expected, step.allowed)
+		}
+	}
+	ttl, err := client.Do("PTTL", prefix+"daily")
+	if err != nil || ttl.(int64) <= 0 || ttl.(int64) > time.Minute.Milliseconds() {
+		t.Errorf("PTTL of a counter = %v, %v, want the time until it expires", ttl, err)
+	}
+}
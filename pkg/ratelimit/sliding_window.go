@@ -0,0 +1,219 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// SlidingWindowLog implements an exact sliding window rate limiter. It keeps
+// the time of every request allowed within the last window, so no window of
+// that length, wherever it starts, ever holds more than limit requests. It
+// uses memory proportional to the limit.
+type SlidingWindowLog struct {
+	limit  int
+	window time.Duration
+	now    Clock
+
+	// times is a ring buffer of the allowed requests, oldest at head
+	times []time.Time
+	head  int
+	count int
+	mu    sync.Mutex
+}
+
+// NewSlidingWindowLog creates a sliding window log that allows limit
+// requests in any window of the given length
+func NewSlidingWindowLog(limit int, window time.Duration) *SlidingWindowLog {
+	return NewSlidingWindowLogWithClock(limit, window, time.Now)
+}
+
+// NewSlidingWindowLogWithClock creates a sliding window log that reads the
+// time from clock
+func NewSlidingWindowLogWithClock(limit int, window time.Duration, clock Clock) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		limit:  limit,
+		window: window,
+		now:    clock,
+		times:  make([]time.Time, max(limit, 0)),
+	}
+}
+
+// Allow records the request if fewer than limit requests were allowed within
+// the last window, or returns ErrRateLimitExceeded
+func (l *SlidingWindowLog) Allow() (Result, error) {
+	return l.AllowN(1)
+}
+
+// AllowN records a request costing n requests if they fit within the limit
+// of the last window, or returns ErrRateLimitExceeded. A cost above the limit
+// is rejected with a *CostError.
+func (l *SlidingWindowLog) AllowN(n int) (Result, error) {
+	n, err := checkCost(n, l.limit)
+	if err != nil {
+		return Result{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	// Forget requests that left the window
+	for l.count > 0 && !l.times[l.head].After(now.Add(-l.window)) {
+		l.head = (l.head + 1) % len(l.times)
+		l.count--
+	}
+
+	if l.count+n > l.limit {
+		result := l.result(now)
+		// A request is allowed again once enough of the oldest ones left
+		// the window to make room for it
+		result.RetryAfter = l.window
+		if l.count > 0 {
+			last := l.times[(l.head+l.count+n-l.limit-1)%len(l.times)]
+			result.RetryAfter = last.Add(l.window).Sub(now)
+		}
+		return result, ErrRateLimitExceeded
+	}
+	for range n {
+		l.times[(l.head+l.count)%len(l.times)] = now
+		l.count++
+	}
+	return l.result(now), nil
+}
+
+// RefundN forgets the n newest requests, those recorded for a request costing n
+func (l *SlidingWindowLog) RefundN(n int) {
+	n = max(n, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count = max(0, l.count-n)
+}
+
+// result reports the requests left and the time until the newest one leaves
+// the window. The caller must hold l.mu.
+func (l *SlidingWindowLog) result(now time.Time) Result {
+	result := Result{Limit: l.limit, Remaining: l.limit - l.count}
+	if l.count > 0 {
+		newest := l.times[(l.head+l.count-1)%len(l.times)]
+		result.Reset = newest.Add(l.window).Sub(now)
+	}
+	return result
+}
+
+// SlidingWindowCounter approximates a sliding window with two counters: the
+// requests of the current fixed window and of the previous one, weighted by
+// how much of the previous window still overlaps the sliding one. It smooths
+// the boundary bursts of a fixed window in constant memory, assuming the
+// previous window's requests were evenly spread.
+type SlidingWindowCounter struct {
+	limit  int
+	window time.Duration
+	now    Clock
+
+	start    time.Time // start of the current window
+	current  int
+	previous int
+	mu       sync.Mutex
+}
+
+// NewSlidingWindowCounter creates a sliding window counter that allows about
+// limit requests in any window of the given length
+func NewSlidingWindowCounter(limit int, window time.Duration) *SlidingWindowCounter {
+	return NewSlidingWindowCounterWithClock(limit, window, time.Now)
+}
+
+// NewSlidingWindowCounterWithClock creates a sliding window counter that
+// reads the time from clock
+func NewSlidingWindowCounterWithClock(limit int, window time.Duration, clock Clock) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		limit:  limit,
+		window: window,
+		now:    clock,
+		start:  clock(),
+	}
+}
+
+// Allow counts the request if the weighted count of the sliding window is
+// below the limit, or returns ErrRateLimitExceeded
+func (c *SlidingWindowCounter) Allow() (Result, error) {
+	return c.AllowN(1)
+}
+
+// AllowN counts a request costing n requests if it fits under the limit
+// along with the weighted count of the sliding window, or returns
+// ErrRateLimitExceeded. A cost above the limit is rejected with a *CostError.
+func (c *SlidingWindowCounter) AllowN(n int) (Result, error) {
+	n, err := checkCost(n, c.limit)
+	if err != nil {
+		return Result{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if elapsed := now.Sub(c.start); elapsed >= c.window {
+		// Move to the window containing now. The previous count only carries
+		// over when that window directly follows the current one.
+		windows := elapsed / c.window
+		if windows == 1 {
+			c.previous = c.current
+		} else {
+			c.previous = 0
+		}
+		c.current = 0
+		c.start = c.start.Add(windows * c.window)
+	}
+
+	overlap := 1 - float64(now.Sub(c.start))/float64(c.window)
+	if overlap < 0 || overlap > 1 {
+		// The clock went backwards past the window start
+		overlap = 1
+	}
+	if float64(c.previous)*overlap+float64(c.current+n-1) >= float64(c.limit) {
+		result := c.result(now, overlap)
+		result.RetryAfter = c.retryAfter(now, n)
+		return result, ErrRateLimitExceeded
+	}
+	c.current += n
+	return c.result(now, overlap), nil
+}
+
+// RefundN uncounts a request costing n requests from the current window
+func (c *SlidingWindowCounter) RefundN(n int) {
+	n = max(n, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = max(0, c.current-n)
+}
+
+// result reports the requests left under the weighted count and the time
+// until both counted windows have slid out. The caller must hold c.mu.
+func (c *SlidingWindowCounter) result(now time.Time, overlap float64) Result {
+	weighted := float64(c.previous)*overlap + float64(c.current)
+	result := Result{Limit: c.limit, Remaining: max(0, int(float64(c.limit)-weighted))}
+	switch {
+	case c.current > 0:
+		result.Reset = c.start.Add(2 * c.window).Sub(now)
+	case c.previous > 0:
+		result.Reset = c.start.Add(c.window).Sub(now)
+	}
+	return result
+}
+
+// retryAfter returns the time until the weighted count drops enough for a
+// request costing n as the previous window slides out, assuming no other
+// request is allowed meanwhile. The caller must hold c.mu.
+func (c *SlidingWindowCounter) retryAfter(now time.Time, n int) time.Duration {
+	if c.limit <= 0 {
+		return c.window
+	}
+	// The request fits once previous*overlap < limit-current-(n-1) within the
+	// current window, or current*overlap < limit-(n-1) in the next one
+	start, previous, room := c.start, float64(c.previous), float64(c.limit-c.current-n+1)
+	if c.current+n-1 >= c.limit {
+		start, previous, room = c.start.Add(c.window), float64(c.current), float64(c.limit-n+1)
+	}
+	elapsed := time.Duration((1 - room/previous) * float64(c.window))
+	return max(0, start.Add(elapsed).Sub(now))
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		steps    []time.Duration // time advanced before each batch
+		requests []int           // requests per batch
+		expected []int           // requests allowed per batch
+	}{
+		{
+			name: "Up to the limit", limit: 5,
+			steps: []time.Duration{0}, requests: []int{10}, expected: []int{5},
+		},
+		{
+			name: "Window boundary", limit: 10,
+			steps:    []time.Duration{900 * time.Millisecond, 200 * time.Millisecond, 800 * time.Millisecond},
+			requests: []int{10, 10, 10}, expected: []int{10, 0, 10},
+		},
+		{
+			name: "Requests leave one by one", limit: 3,
+			steps:    []time.Duration{0, 400 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond, 400 * time.Millisecond},
+			requests: []int{1, 1, 5, 5, 5}, expected: []int{1, 1, 1, 1, 1},
+		},
+		{
+			name: "Zero limit", limit: 0,
+			steps: []time.Duration{0, time.Hour}, requests: []int{3, 3}, expected: []int{0, 0},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewSlidingWindowLogWithClock(tc.limit, time.Second, clock.Now)
+			for i, step := range tc.steps {
+				clock.Advance(step)
+				if allowed := allowN(limiter, tc.requests[i]); allowed != tc.expected[i] {
+					t.Errorf("batch %d: allowed %d requests, expected %d", i, allowed, tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		steps    []time.Duration
+		requests []int
+		expected []int
+	}{
+		{
+			name: "Up to the limit", limit: 5,
+			steps: []time.Duration{0}, requests: []int{10}, expected: []int{5},
+		},
+		{
+			// 10 requests at the end of the first window still weigh 7.5
+			// a quarter into the second one
+			name: "Previous window weighted", limit: 10,
+			steps:    []time.Duration{900 * time.Millisecond, 350 * time.Millisecond},
+			requests: []int{10, 10}, expected: []int{10, 3},
+		},
+		{
+			name: "Previous window gone after two windows", limit: 10,
+			steps:    []time.Duration{0, 2 * time.Second},
+			requests: []int{10, 20}, expected: []int{10, 10},
+		},
+		{
+			name: "Clock going backwards", limit: 2,
+			steps:    []time.Duration{0, -time.Minute},
+			requests: []int{1, 5}, expected: []int{1, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewSlidingWindowCounterWithClock(tc.limit, time.Second, clock.Now)
+			for i, step := range tc.steps {
+				clock.Advance(step)
+				if allowed := allowN(limiter, tc.requests[i]); allowed != tc.expected[i] {
+					t.Errorf("batch %d: allowed %d requests, expected %d", i, allowed, tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowConcurrent(t *testing.T) {
+	limiters := map[string]Allower{
+		"log":     NewSlidingWindowLog(50, time.Hour),
+		"counter": NewSlidingWindowCounter(50, time.Hour),
+	}
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			allowed := make(chan int)
+			for i := 0; i < 10; i++ {
+				go func() {
+					allowed <- allowN(limiter, 10)
+				}()
+			}
+			total := 0
+			for i := 0; i < 10; i++ {
+				total += <-allowed
+			}
+			if total != 50 {
+				t.Errorf("allowed %d requests, expected 50", total)
+			}
+		})
+	}
+}
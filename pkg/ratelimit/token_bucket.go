@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket implements a token bucket rate limiter. The bucket holds up to
+// burst tokens and refills continuously at the configured rate, so short
+// bursts are absorbed while the sustained rate never exceeds the limit, even
+// across second boundaries.
+type TokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    Clock
+	mu     sync.Mutex
+}
+
+// NewTokenBucket creates a token bucket that allows requestsPerSecond on
+// average and up to burst requests at once. The bucket starts full.
+func NewTokenBucket(requestsPerSecond, burst int) *TokenBucket {
+	return NewTokenBucketWithClock(requestsPerSecond, burst, time.Now)
+}
+
+// NewTokenBucketWithClock creates a token bucket that reads the time from clock
+func NewTokenBucketWithClock(requestsPerSecond, burst int, clock Clock) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(requestsPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock(),
+		now:    clock,
+	}
+}
+
+// Allow takes a token from the bucket, or returns ErrRateLimitExceeded when
+// it is empty
+func (b *TokenBucket) Allow() (Result, error) {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens from the bucket, or returns ErrRateLimitExceeded
+// when it holds fewer. A cost above the burst is rejected with a *CostError.
+func (b *TokenBucket) AllowN(n int) (Result, error) {
+	n, err := checkCost(n, int(b.burst))
+	if err != nil {
+		return Result{}, err
+	}
+	cost := float64(n)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < cost {
+		result := b.result()
+		result.RetryAfter = b.timeToEarn(cost - b.tokens)
+		return result, ErrRateLimitExceeded
+	}
+	b.tokens -= cost
+	return b.result(), nil
+}
+
+// Wait takes a token, waiting until one is earned if the bucket is empty.
+// Waiting requests reserve their token on arrival, so they are served in
+// order and a request arriving later is told the full wait. When the token
+// would not be earned before the deadline of ctx it returns
+// ErrRateLimitExceeded at once.
+func (b *TokenBucket) Wait(ctx context.Context) (Result, error) {
+	return b.WaitN(ctx, 1)
+}
+
+// WaitN takes n tokens like Wait. A cost above the burst is rejected with a
+// *CostError, since the bucket never holds that many.
+func (b *TokenBucket) WaitN(ctx context.Context, n int) (Result, error) {
+	n, err := checkCost(n, int(b.burst))
+	if err != nil {
+		return Result{}, err
+	}
+	cost := float64(n)
+	b.mu.Lock()
+	b.refill()
+	var delay time.Duration
+	if b.tokens < cost {
+		delay = b.timeToEarn(cost - b.tokens)
+		// A bucket that never refills never earns the token
+		if b.rate <= 0 || !canWait(ctx, delay) {
+			result := b.result()
+			result.RetryAfter = delay
+			b.mu.Unlock()
+			return result, ErrRateLimitExceeded
+		}
+	}
+	// The bucket goes below zero while tokens are reserved
+	b.tokens -= cost
+	result := b.result()
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return result, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return result, nil
+	case <-ctx.Done():
+		// Hand the reserved tokens back to the requests queued behind
+		b.mu.Lock()
+		b.tokens += cost
+		b.mu.Unlock()
+		return result, ctx.Err()
+	}
+}
+
+// RefundN puts back the n tokens taken for a request, up to a full bucket
+func (b *TokenBucket) RefundN(n int) {
+	cost := float64(max(n, 1))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+cost)
+}
+
+// result reports the tokens left and the time to fill the bucket. The caller
+// must hold b.mu.
+func (b *TokenBucket) result() Result {
+	return Result{
+		Limit:     int(b.burst),
+		Remaining: max(0, int(b.tokens)),
+		Reset:     b.timeToEarn(b.burst - b.tokens),
+	}
+}
+
+// timeToEarn returns the time the bucket takes to earn tokens, zero when it
+// never refills
+func (b *TokenBucket) timeToEarn(tokens float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call. The caller must hold b.mu.
+func (b *TokenBucket) refill() {
+	now := b.now()
+	// A clock that went backwards earns nothing
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int
+		burst    int
+		steps    []time.Duration // time advanced before each batch
+		requests int             // requests per batch
+		expected []int           // requests allowed per batch
+	}{
+		{
+			name: "Burst up front", rate: 10, burst: 5,
+			steps: []time.Duration{0}, requests: 20, expected: []int{5},
+		},
+		{
+			name: "Refills at the rate", rate: 10, burst: 5,
+			steps: []time.Duration{0, 100 * time.Millisecond, 250 * time.Millisecond}, requests: 10, expected: []int{5, 1, 2},
+		},
+		{
+			name: "Never holds more than burst", rate: 10, burst: 5,
+			steps: []time.Duration{0, time.Hour}, requests: 10, expected: []int{5, 5},
+		},
+		{
+			name: "Burst larger than rate", rate: 2, burst: 10,
+			steps: []time.Duration{0, time.Second}, requests: 20, expected: []int{10, 2},
+		},
+		{
+			name: "Clock going backwards", rate: 10, burst: 1,
+			steps: []time.Duration{0, -time.Second, time.Second, 100 * time.Millisecond}, requests: 5, expected: []int{1, 0, 0, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			bucket := NewTokenBucketWithClock(tc.rate, tc.burst, clock.Now)
+			for i, step := range tc.steps {
+				clock.Advance(step)
+				if allowed := allowN(bucket, tc.requests); allowed != tc.expected[i] {
+					t.Errorf("batch %d: allowed %d requests, expected %d", i, allowed, tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketWindowBoundary(t *testing.T) {
+	// The fixed window allows twice the limit around a window boundary, a
+	// token bucket with burst equal to the rate allows it once plus the
+	// tokens earned in between
+	clock := newFakeClock()
+	bucket := NewTokenBucketWithClock(10, 10, clock.Now)
+
+	clock.Advance(900 * time.Millisecond)
+	first := allowN(bucket, 10)
+	clock.Advance(200 * time.Millisecond)
+	second := allowN(bucket, 10)
+
+	if first != 10 || second != 2 {
+		t.Errorf("allowed %d then %d requests, expected 10 then 2", first, second)
+	}
+}
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	bucket := NewTokenBucket(1, 50)
+
+	allowed := make(chan int)
+	for i := 0; i < 10; i++ {
+		go func() {
+			allowed <- allowN(bucket, 10)
+		}()
+	}
+	total := 0
+	for i := 0; i < 10; i++ {
+		total += <-allowed
+	}
+
+	// One token may be earned while the goroutines run
+	if total < 50 || total > 51 {
+		t.Errorf("Token bucket allowed %d requests, expected 50", total)
+	}
+}
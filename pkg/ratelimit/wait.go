@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Waiter is implemented by limiters that can hold a request costing n
+// requests until it is allowed instead of rejecting it
+type Waiter interface {
+	WaitN(ctx context.Context, n int) (Result, error)
+}
+
+// KeyAllower is implemented by limiters keeping a separate limit per key
+type KeyAllower interface {
+	AllowKey(key string) (Result, error)
+}
+
+// KeyWaiter is implemented by keyed limiters that can hold a request costing
+// n requests until it is allowed
+type KeyWaiter interface {
+	WaitKeyN(ctx context.Context, key string, n int) (Result, error)
+}
+
+// minWaitPoll keeps a limiter reporting no delay from being retried in a busy
+// loop
+const minWaitPoll = time.Millisecond
+
+// WaitN holds a request costing n requests until limiter allows it. It uses
+// the limiter's own WaitN when it has one, and otherwise retries after the
+// delay each rejection reports. When the request would not be allowed before
+// the deadline of ctx it returns ErrRateLimitExceeded at once instead of
+// waiting in vain.
+func WaitN(ctx context.Context, limiter Allower, n int) (Result, error) {
+	if waiter, ok := limiter.(Waiter); ok {
+		return waiter.WaitN(ctx, n)
+	}
+	return waitFor(ctx, func() (Result, error) { return AllowN(limiter, n) })
+}
+
+// WaitKeyN holds a request costing n requests until limiter allows it for
+// key, like WaitN
+func WaitKeyN(ctx context.Context, limiter KeyAllower, key string, n int) (Result, error) {
+	if waiter, ok := limiter.(KeyWaiter); ok {
+		return waiter.WaitKeyN(ctx, key, n)
+	}
+	return waitFor(ctx, func() (Result, error) { return AllowKeyN(limiter, key, n) })
+}
+
+// waitFor calls allow until it no longer returns ErrRateLimitExceeded,
+// sleeping for the reported delay in between. Other requests may take the
+// capacity freed meanwhile, so the wait can take longer than first reported.
+func waitFor(ctx context.Context, allow func() (Result, error)) (Result, error) {
+	for {
+		result, err := allow()
+		if !errors.Is(err, ErrRateLimitExceeded) {
+			return result, err
+		}
+		delay := max(result.RetryAfter, minWaitPoll)
+		if !canWait(ctx, delay) {
+			return result, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// canWait reports whether ctx leaves enough time to wait for delay
+func canWait(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) >= delay
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	// The fake clock never moves, so every token has to be reserved ahead
+	clock := newFakeClock()
+	bucket := NewTokenBucketWithClock(100, 1, clock.Now)
+	deadline := func(d time.Duration) context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	if _, err := bucket.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() with a full bucket = %v, want nil", err)
+	}
+
+	// A token is earned every 10ms, too late for a 5ms deadline, so the
+	// request is rejected at once rather than when the deadline passes
+	result, err := bucket.Wait(deadline(5 * time.Millisecond))
+	if err != ErrRateLimitExceeded || result.RetryAfter != 10*time.Millisecond {
+		t.Errorf("Wait() within 5ms = %+v, %v, want a 10ms retry and %v", result, err, ErrRateLimitExceeded)
+	}
+
+	start := time.Now()
+	if _, err := bucket.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Wait() returned after %v, want at least 10ms", elapsed)
+	}
+
+	// The next request queues behind the reserved token
+	result, err = bucket.Wait(deadline(15 * time.Millisecond))
+	if err != ErrRateLimitExceeded || result.RetryAfter != 20*time.Millisecond {
+		t.Errorf("Wait() behind a reservation = %+v, %v, want a 20ms retry and %v", result, err, ErrRateLimitExceeded)
+	}
+
+	// A request giving up hands its reservation back
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond, cancel)
+	if _, err := bucket.Wait(ctx); err != context.Canceled {
+		t.Errorf("canceled Wait() = %v, want %v", err, context.Canceled)
+	}
+	if result, _ := bucket.Wait(deadline(15 * time.Millisecond)); result.RetryAfter != 20*time.Millisecond {
+		t.Errorf("Wait() after a cancellation reports a %v retry, want 20ms", result.RetryAfter)
+	}
+
+	// A bucket that never refills rejects at once
+	empty := NewTokenBucketWithClock(0, 1, clock.Now)
+	empty.Allow()
+	if _, err := empty.Wait(context.Background()); err != ErrRateLimitExceeded {
+		t.Errorf("Wait() on a bucket that never refills = %v, want %v", err, ErrRateLimitExceeded)
+	}
+}
+
+// rejectingLimiter rejects its first calls, asking for a retry after delay
+type rejectingLimiter struct {
+	rejections int
+	delay      time.Duration
+	calls      int
+}
+
+func (l *rejectingLimiter) Allow() (Result, error) {
+	l.calls++
+	if l.calls <= l.rejections {
+		return Result{RetryAfter: l.delay}, ErrRateLimitExceeded
+	}
+	return Result{}, nil
+}
+
+func (l *rejectingLimiter) AllowKey(key string) (Result, error) {
+	return l.Allow()
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name          string
+		limiter       *rejectingLimiter
+		timeout       time.Duration
+		expected      error
+		expectedCalls int
+	}{
+		{
+			name:          "Allowed at once",
+			limiter:       &rejectingLimiter{},
+			timeout:       time.Second,
+			expected:      nil,
+			expectedCalls: 1,
+		},
+		{
+			name:          "Retried after the reported delay",
+			limiter:       &rejectingLimiter{rejections: 2, delay: 5 * time.Millisecond},
+			timeout:       time.Second,
+			expected:      nil,
+			expectedCalls: 3,
+		},
+		{
+			name:          "No delay reported",
+			limiter:       &rejectingLimiter{rejections: 3},
+			timeout:       time.Second,
+			expected:      nil,
+			expectedCalls: 4,
+		},
+		{
+			name:          "Delay past the deadline",
+			limiter:       &rejectingLimiter{rejections: 1, delay: time.Hour},
+			timeout:       time.Second,
+			expected:      ErrRateLimitExceeded,
+			expectedCalls: 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			if _, err := WaitN(ctx, tc.limiter, 1); !errors.Is(err, tc.expected) {
+				t.Errorf("WaitN() = %v, want %v", err, tc.expected)
+			}
+			if tc.limiter.calls != tc.expectedCalls {
+				t.Errorf("Allow() called %d times, want %d", tc.limiter.calls, tc.expectedCalls)
+			}
+
+			tc.limiter.calls = 0
+			if _, err := WaitKeyN(ctx, tc.limiter, "client", 1); !errors.Is(err, tc.expected) {
+				t.Errorf("WaitKeyN() = %v, want %v", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterWaitKey(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewKeyedLimiter(KeyedOptions{
+		NewLimiter: func() Allower { return NewTokenBucketWithClock(100, 1, clock.Now) },
+		Clock:      clock.Now,
+	})
+
+	// Waiting uses the reservations of the token bucket of each key
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.WaitKey(ctx, "a"); err != nil {
+		t.Errorf("WaitKey(a) = %v, want nil", err)
+	}
+	if result, err := limiter.WaitKey(ctx, "a"); err != ErrRateLimitExceeded || result.RetryAfter != 10*time.Millisecond {
+		t.Errorf("WaitKey(a) = %+v, %v, want a 10ms retry and %v", result, err, ErrRateLimitExceeded)
+	}
+	if _, err := limiter.WaitKey(ctx, "b"); err != nil {
+		t.Errorf("WaitKey(b) = %v, want nil", err)
+	}
+}